@@ -0,0 +1,92 @@
+package DHT
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+const ChallengeProtocol = "/Challenge/1.0.0"
+
+// ChallengeRequest 是文件所有者发给存储节点的存储证明挑战
+type ChallengeRequest struct {
+	RootHash  []byte `json:"rootHash"`
+	LeafIndex uint64 `json:"leafIndex"`
+	Nonce     []byte `json:"nonce"`
+}
+
+// ChallengeResponse 是存储节点对挑战的应答
+type ChallengeResponse struct {
+	LeafHash  []byte `json:"leafHash"`  // 数据块的哈希，即叶子节点哈希
+	NonceHash []byte `json:"nonceHash"` // sha256(nonce || 数据块)
+	Proof     []byte `json:"proof"`     // 二进制编码的叶子下标默克尔证明
+	Error     string `json:"error,omitempty"`
+}
+
+// ChallengeProver 根据挑战读取本地数据块并生成应答
+type ChallengeProver func(req *ChallengeRequest) (*ChallengeResponse, error)
+
+// Challenge 向目标节点发起一次存储证明挑战
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - target: 被挑战的节点
+//   - req: 挑战内容
+//
+// 返回值:
+//   - *ChallengeResponse: 目标节点的应答
+//   - error: 错误信息
+func (d *DHTService) Challenge(ctx context.Context, target peer.ID, req *ChallengeRequest) (*ChallengeResponse, error) {
+	s, err := d.Host.NewStream(ctx, target, ChallengeProtocol)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open challenge stream: %w", err)
+	}
+	defer s.Close()
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to send challenge: %w", err)
+	}
+
+	var resp ChallengeResponse
+	if err := json.NewDecoder(bufio.NewReader(s)).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to read challenge response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// ChallengeHandler 处理存储证明挑战
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - prover: 生成挑战应答的函数
+func (d *DHTService) ChallengeHandler(ctx context.Context, prover ChallengeProver) {
+	d.Host.SetStreamHandler(ChallengeProtocol, func(s network.Stream) {
+		var req ChallengeRequest
+		if err := json.NewDecoder(bufio.NewReader(s)).Decode(&req); err != nil {
+			logrus.WithError(err).Error("Can not read challenge")
+			s.Reset()
+			return
+		}
+		logrus.Infof("Received challenge for leaf %d from %s", req.LeafIndex, s.Conn().RemotePeer())
+
+		resp, err := prover(&req)
+		if err != nil {
+			logrus.WithError(err).Error("Can not answer challenge")
+			resp = &ChallengeResponse{Error: err.Error()}
+		}
+		if err := json.NewEncoder(s).Encode(resp); err != nil {
+			logrus.WithError(err).Error("Can not send challenge response")
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+}
@@ -0,0 +1,167 @@
+package DHT
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// 数据块压缩: 每个数据块可以单独压缩，默克尔树的叶子哈希始终是未压缩内容的哈希，
+// 因此验证与压缩算法无关。存储节点按收到的编码保存数据块，压缩的数据块文件名带有算法的扩展名，
+// 读取时按请求方接受的算法协商，请求方不接受时先解压再发送。
+
+const (
+	// CodecNone 表示数据块不压缩
+	CodecNone = ""
+	// CodecGzip 使用标准库的 gzip 压缩
+	CodecGzip = "gzip"
+	// CodecZstd 使用 zstd 压缩
+	CodecZstd = "zstd"
+)
+
+// maxChunkSize 是数据块的大小上限，压缩的数据块在接收时和解压后都不能超过，避免耗尽内存。
+// 变量而不是常量，测试中可以调小
+var maxChunkSize = 256 * 1024 * 1024
+
+var (
+	// ErrUnknownCodec 表示不支持的压缩算法
+	ErrUnknownCodec = errors.New("unknown chunk codec")
+	// ErrChunkTooLarge 表示数据块超过了 maxChunkSize
+	ErrChunkTooLarge = errors.New("chunk too large")
+)
+
+// Codecs 是支持的压缩算法，按优先级排列
+var Codecs = []string{CodecZstd, CodecGzip}
+
+// codecExt 是压缩的数据块文件的扩展名
+var codecExt = map[string]string{
+	CodecNone: "",
+	CodecGzip: ".gz",
+	CodecZstd: ".zst",
+}
+
+// zstd 的编码器和解码器可以并发使用
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxChunkSize)))
+)
+
+// CheckCodec 检查压缩算法是否受支持
+func CheckCodec(codec string) error {
+	if _, exists := codecExt[codec]; !exists {
+		return xerrors.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+	return nil
+}
+
+// Compress 使用 codec 压缩数据块
+// 参数:
+//   - codec: 压缩算法，CodecNone 时原样返回
+//   - data: 未压缩的数据块
+//
+// 返回值:
+//   - []byte: 压缩后的数据
+//   - error: 算法不支持时返回 ErrUnknownCodec
+func Compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, xerrors.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+}
+
+// Decompress 解压 codec 压缩的数据块，解压后超过 maxChunkSize 时返回错误
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		res, err := io.ReadAll(io.LimitReader(r, int64(maxChunkSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(res) > maxChunkSize {
+			return nil, xerrors.Errorf("%w: decompressed chunk exceeds %d bytes", ErrChunkTooLarge, maxChunkSize)
+		}
+		return res, nil
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, xerrors.Errorf("%w: %q", ErrUnknownCodec, codec)
+	}
+}
+
+// ChooseCodec 用 codec 压缩数据块，压缩后没有变小时不压缩
+// 返回值:
+//   - string: 实际使用的压缩算法
+//   - []byte: 编码后的数据
+//   - error: 算法不支持时返回 ErrUnknownCodec
+func ChooseCodec(codec string, data []byte) (string, []byte, error) {
+	compressed, err := Compress(codec, data)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(compressed) >= len(data) {
+		return CodecNone, data, nil
+	}
+	return codec, compressed, nil
+}
+
+// chunkPath 返回数据块以 codec 编码保存时的路径
+func chunkPath(path, name, codec string) string {
+	return filepath.Join(path, name+codecExt[codec])
+}
+
+// openChunk 按 accept 的顺序查找本地保存的数据块，找不到接受的编码时返回其他编码
+// 返回值:
+//   - []byte: 保存的数据
+//   - string: 数据的编码
+//   - error: 没有保存这个数据块时返回错误信息
+func openChunk(path, name string, accept []string) ([]byte, string, error) {
+	for _, codec := range append(append([]string{}, accept...), CodecNone, CodecZstd, CodecGzip) {
+		data, err := os.ReadFile(chunkPath(path, name, codec))
+		if err == nil {
+			return data, codec, nil
+		}
+	}
+	return nil, "", xerrors.Errorf("chunk %s not stored", name)
+}
+
+// ReadChunk 读取本地保存的数据块并解压
+// 参数:
+//   - path: 数据块的存储目录
+//   - name: 数据块的名字，即叶子哈希的16进制字符串
+//
+// 返回值:
+//   - []byte: 未压缩的数据块
+//   - error: 没有保存或解压失败时返回错误信息
+func ReadChunk(path, name string) ([]byte, error) {
+	data, codec, err := openChunk(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Decompress(codec, data)
+}
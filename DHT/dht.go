@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"github.com/libp2p/go-libp2p-kad-dht"
 	record "github.com/libp2p/go-libp2p-record"
@@ -16,6 +18,7 @@ import (
 	"golang.org/x/xerrors"
 	"io"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -35,13 +38,83 @@ type DHTService struct {
 	Host   host.Host
 	DHT    *dht.IpfsDHT
 	Config *DHTConfig
+
+	limiter      *limiter     // 文件传输的限速
+	scores       *peerScores  // 文件传输的节点评分
+	reachability atomic.Int32 // AutoNAT 检测到的可达性
 }
 
 type MetaData struct {
-	RootHash  []byte   `json:"rootHash"`
-	RandomNum []byte   `json:"randomNum"`
-	PublicKey []byte   `json:"publicKey"`
-	Leaves    [][]byte `json:"leaves"`
+	RootHash  []byte        `json:"rootHash"`
+	RandomNum []byte        `json:"randomNum"`
+	PublicKey []byte        `json:"publicKey"`
+	Leaves    [][]byte      `json:"leaves"`
+	Chunker   ChunkerParams `json:"chunker"`
+	Scheme    string        `json:"scheme,omitempty"` // 变色龙哈希方案，为空表示 p256
+	// SubtreeHeight 不为0时，每 2^SubtreeHeight 个叶子组成一个以变色龙哈希为根的子树，
+	// Subtrees 按叶子顺序记录每个子树根的哈希和随机数，修改一个子树中的数据块只需要在这个子树根上生成碰撞
+	SubtreeHeight int       `json:"subtreeHeight,omitempty"`
+	Subtrees      []Subtree `json:"subtrees,omitempty"`
+	// Codecs 与 Leaves 一一对应，记录每个数据块保存和传输时使用的压缩算法，没有压缩任何数据块时为空
+	Codecs    []string `json:"codecs,omitempty"`
+	Signature []byte   `json:"signature,omitempty"` // 上传者用变色龙私钥对 Digest 的签名，签名算法由 Scheme 决定，或分片持有者协作生成的 Schnorr 签名
+}
+
+// Digest 返回 metadata 中除签名以外所有字段的摘要，用于签名和验证
+func (m *MetaData) Digest() []byte {
+	h := sha256.New()
+	h.Write([]byte("FlexiSN metadata v1"))
+	writeField := func(data []byte) {
+		binary.Write(h, binary.BigEndian, uint64(len(data)))
+		h.Write(data)
+	}
+	writeField(m.RootHash)
+	writeField(m.RandomNum)
+	writeField(m.PublicKey)
+	binary.Write(h, binary.BigEndian, uint64(len(m.Leaves)))
+	for _, leaf := range m.Leaves {
+		writeField(leaf)
+	}
+	writeField([]byte(m.Chunker.Type))
+	for _, size := range []int{m.Chunker.BlockSize, m.Chunker.MinSize, m.Chunker.AvgSize, m.Chunker.MaxSize} {
+		binary.Write(h, binary.BigEndian, int64(size))
+	}
+	// 旧的 metadata 没有方案字段，为空时不写入摘要，旧的签名仍然有效
+	if m.Scheme != "" {
+		writeField([]byte(m.Scheme))
+	}
+	if m.SubtreeHeight != 0 {
+		binary.Write(h, binary.BigEndian, int64(m.SubtreeHeight))
+		binary.Write(h, binary.BigEndian, uint64(len(m.Subtrees)))
+		for _, subtree := range m.Subtrees {
+			writeField(subtree.Hash)
+			writeField(subtree.RandomNum)
+		}
+	}
+	if m.Chunker.Codec != "" || len(m.Codecs) != 0 {
+		writeField([]byte(m.Chunker.Codec))
+		binary.Write(h, binary.BigEndian, uint64(len(m.Codecs)))
+		for _, codec := range m.Codecs {
+			writeField([]byte(codec))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// Subtree 是一个变色龙子树根节点的哈希和随机数
+type Subtree struct {
+	Hash      []byte `json:"hash"`
+	RandomNum []byte `json:"randomNum"`
+}
+
+// ChunkerParams 记录生成 Leaves 时使用的分块算法及其参数，更新文件时需要使用相同的参数重新分块
+type ChunkerParams struct {
+	Type      string `json:"type"`
+	BlockSize int    `json:"blockSize,omitempty"`
+	MinSize   int    `json:"minSize,omitempty"`
+	AvgSize   int    `json:"avgSize,omitempty"`
+	MaxSize   int    `json:"maxSize,omitempty"`
+	Codec     string `json:"codec,omitempty"` // 压缩数据块使用的算法，为空表示不压缩
 }
 
 type DHTConfig struct {
@@ -53,6 +126,7 @@ type DHTConfig struct {
 	EnableAutoRefresh bool
 	NameSpace         string
 	Validator         record.Validator
+	NAT               *NATConfig // 为 nil 时不使用 NAT 穿透
 }
 
 // NewDHTConfig 返回一个包含默认配置的 DHTConfig 实例
@@ -79,21 +153,55 @@ func NewDHTConfig() DHTConfig {
 //   - *DHTService: DHT 服务实例
 //   - error: 错误信息
 func NewDHTService(ctx context.Context, config DHTConfig) (*DHTService, error) {
-	host, err := newBasicHost(config.Port, config.Insecure, config.Seed)
+	relays := &relayPeers{}
+	host, err := newBasicHost(config.Port, config.Insecure, config.Seed, config.NAT, relays)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to create host: %w", err)
 	}
+	service, err := NewDHTServiceWithHost(ctx, host, config)
+	if err != nil {
+		return nil, err
+	}
+	relays.dht.Store(service.DHT)
+	return service, nil
+}
 
+// NewDHTServiceWithHost 在已经创建好的主机上启动 DHT 服务，例如 mocknet 生成的主机。
+// config 中的 Port、Insecure、Seed 和 NAT 不会被使用。
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - host: 主机实例
+//   - config: DHT 配置
+//
+// 返回值:
+//   - *DHTService: DHT 服务实例
+//   - error: 错误信息
+func NewDHTServiceWithHost(ctx context.Context, host host.Host, config DHTConfig) (*DHTService, error) {
 	kdht, err := newDHT(ctx, host, config)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to create DHT instance: %w", err)
 	}
 
-	return &DHTService{
-		Host:   host,
-		DHT:    kdht,
-		Config: &config,
-	}, nil
+	service := &DHTService{
+		Host:    host,
+		DHT:     kdht,
+		Config:  &config,
+		limiter: newLimiter(),
+		scores:  newPeerScores(),
+	}
+	if err := service.watchReachability(ctx); err != nil {
+		service.Close()
+		return nil, xerrors.Errorf("failed to watch reachability: %w", err)
+	}
+	return service, nil
+}
+
+// Close 关闭 DHT 实例和主机
+func (d *DHTService) Close() error {
+	if err := d.DHT.Close(); err != nil {
+		return err
+	}
+	return d.Host.Close()
 }
 
 // newDHT 创建一个 DHT 实例
@@ -193,7 +301,9 @@ func (d *DHTService) GetValue(ctx context.Context, key string) (string, error) {
 	return string(value), nil
 }
 
-// Announce 向网络中的节点宣布一个 fileInfo
+// Announce 向网络中的节点宣布本节点持有一个 fileInfo，记录中的地址按可达性排列，见 ReachableAddrs。
+// 接收方只接受节点为自己发出的宣布，不能替其他节点登记副本。
+// 最近的节点中不包含本节点，记录同时保存在本地，Lookup 先问到本节点时也能查到这个副本
 // 参数:
 //   - ctx: 上下文，用于控制生命周期
 //   - fileInfo: 要宣布的 fileInfo
@@ -201,30 +311,38 @@ func (d *DHTService) GetValue(ctx context.Context, key string) (string, error) {
 // 返回值:
 //   - error: 错误信息
 func (d *DHTService) Announce(ctx context.Context, fileInfo string) error {
+	provider := peer.AddrInfo{
+		ID:    d.Host.ID(),
+		Addrs: d.ReachableAddrs(),
+	}
 	peers, err := d.DHT.GetClosestPeers(ctx, fileInfo)
 	if err != nil {
 		return err
 	}
+	buf, err := provider.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := d.DHT.ProviderStore().AddProvider(ctx, []byte(fileInfo), provider); err != nil {
+		return err
+	}
 	count := 0
 	for _, p := range peers {
 		s, err := d.Host.NewStream(ctx, p, AnnounceProtocol)
 		if err != nil {
-			logrus.Infof("Can not establish a stream with %d", p)
+			logrus.Infof("Can not establish a stream with %s", p)
 			continue
 		}
 		_, err = io.Copy(s, strings.NewReader(fileInfo+"\n"))
 		if err != nil {
-			logrus.Infof("Can not send chameHash with %d", p)
+			logrus.Infof("Can not send chameHash with %s", p)
+			s.Reset()
 			continue
 		}
-		ai := peer.AddrInfo{
-			ID:    d.Host.ID(),
-			Addrs: d.Host.Addrs(),
-		}
-		buf, err := ai.MarshalJSON()
 		_, err = io.Copy(s, bytes.NewReader(append(buf, []byte("\n")...)))
 		if err != nil {
-			logrus.Infof("Can not send host.ID with %d", p)
+			logrus.Infof("Can not send host.ID with %s", p)
+			s.Reset()
 			continue
 		}
 		s.Close()
@@ -236,7 +354,9 @@ func (d *DHTService) Announce(ctx context.Context, fileInfo string) error {
 	return nil
 }
 
-// AnnounceHandler 处理 Announce 请求
+// AnnounceHandler 处理 Announce 请求。
+// 只记录宣布者自己作为持有者的记录，记录中的节点与发起连接的节点不同时拒绝，
+// 否则任何节点都可以替别人宣布副本，让发送方误以为数据块已经有足够的副本而跳过发送
 // 参数:
 //   - ctx: 上下文，用于控制生命周期
 func (d *DHTService) AnnounceHandler(ctx context.Context) {
@@ -248,29 +368,42 @@ func (d *DHTService) AnnounceHandler(ctx context.Context) {
 
 		str, err := buf.ReadString('\n')
 		if err != nil {
-			logrus.Fatalf("Can not read Announce fileInfo")
+			logrus.Infof("Can not read Announce fileInfo: %v", err)
+			s.Reset()
+			return
 		}
 		fileInfo := str
 		fileInfo = strings.TrimRight(fileInfo, "\n")
 		logrus.Infof("get fileInfo %s", fileInfo)
 
 		str, err = buf.ReadString('\n')
+		if err != nil {
+			logrus.Infof("Can not read Announce addrInfo: %v", err)
+			s.Reset()
+			return
+		}
 		ai := peer.AddrInfo{}
-		addrJson := []byte(str)[:len(str)-1]
-		ai.UnmarshalJSON(addrJson)
+		if err := ai.UnmarshalJSON([]byte(strings.TrimRight(str, "\n"))); err != nil {
+			logrus.Infof("Can not parse Announce addrInfo: %v", err)
+			s.Reset()
+			return
+		}
 		logrus.Infof("get addrInfo %s, %s", ai.ID, ai.Addrs)
+		if remote := s.Conn().RemotePeer(); ai.ID != remote {
+			logrus.Warnf("Reject provider %s announced by %s", ai.ID, remote)
+			s.Reset()
+			return
+		}
 		ps := dht.ProviderStore()
 		err = ps.AddProvider(ctx, []byte(fileInfo), ai)
 		if err != nil {
 			// 使用WithError记录错误和堆栈跟踪
 			logrus.WithError(err).Error("Can not Add Provider")
-		}
-		logrus.Infof("Add Provider success!")
-		if err != nil {
 			s.Reset()
-		} else {
-			s.Close()
+			return
 		}
+		logrus.Infof("Add Provider success!")
+		s.Close()
 	})
 }
 
@@ -291,13 +424,14 @@ func (d *DHTService) Lookup(ctx context.Context, fileInfo string) ([]peer.AddrIn
 	for _, p := range peers {
 		s, err := d.Host.NewStream(ctx, p, LookupProtocol)
 		if err != nil {
-			logrus.Infof("Can not establish a stream with %d", p)
+			logrus.Infof("Can not establish a stream with %s", p)
 			continue
 		}
 		// 1, send a fileInfo
 		_, err = io.Copy(s, strings.NewReader(fileInfo+"\n"))
 		if err != nil {
-			logrus.Infof("Can not send chameHash with %d", p)
+			logrus.Infof("Can not send chameHash with %s", p)
+			s.Reset()
 			continue
 		}
 		logrus.Infof("send fileInfo success %s", fileInfo)
@@ -307,10 +441,13 @@ func (d *DHTService) Lookup(ctx context.Context, fileInfo string) ([]peer.AddrIn
 		// 2, read a bool
 		str, err := buf.ReadString('\n')
 		if err != nil {
-			logrus.Fatalf("Can not read bool")
+			logrus.Infof("Can not read bool from %s", p)
+			s.Reset()
+			continue
 		}
 		str = strings.TrimRight(str, "\n")
 		if str != "true" {
+			s.Close()
 			continue
 		}
 		logrus.Infof("read bool success %s", str)
@@ -331,7 +468,7 @@ func (d *DHTService) Lookup(ctx context.Context, fileInfo string) ([]peer.AddrIn
 
 			ai := peer.AddrInfo{}
 			err = ai.UnmarshalJSON(addrInfoJson)
-			logrus.Infof("get addrInfo %s, %s, %s", ai.ID, ai.Addrs[0], ai.String())
+			logrus.Infof("get addrInfo %s", ai.String())
 			if err != nil {
 				logrus.WithError(err).Error("Can not parse addrInfo")
 			}
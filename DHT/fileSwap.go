@@ -2,23 +2,30 @@ package DHT
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"errors"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	pro "github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
 const (
 	sendFileProtocol = "/SendFile/1.0.0"
 	getFileProtocol  = "/GetFile/1.0.0"
+	// 1.1.0 版本的请求在文件名后附带压缩算法: 发送时是数据的编码，读取时是接受的编码列表，
+	// 读取的应答在 true 后附带实际使用的编码。不支持 1.1.0 的节点之间仍使用未压缩的 1.0.0
+	sendFileCodecProtocol = "/SendFile/1.1.0"
+	getFileCodecProtocol  = "/GetFile/1.1.0"
 )
 
 // SendFile 将文件发送到目标节点。
@@ -29,20 +36,36 @@ const (
 // 返回值:
 // - error: 如果发送过程中出现错误，则返回错误信息。
 func (d *DHTService) SendFile(ctx context.Context, target multiaddr.Multiaddr, fileName string, file io.ReadWriter) error {
-	host := d.Host
+	return d.SendFileWithCodec(ctx, target, fileName, CodecNone, file)
+}
 
+// SendFileWithCodec 与 SendFile 相同，但 file 中是用 codec 压缩的数据块，
+// 目标节点按压缩的形式保存；目标节点不支持压缩时先解压再发送。
+func (d *DHTService) SendFileWithCodec(ctx context.Context, target multiaddr.Multiaddr, fileName, codec string, file io.ReadWriter) error {
+	if err := CheckCodec(codec); err != nil {
+		return err
+	}
 	// Extract peer ID and add to peerstore
 	info, err := peer.AddrInfoFromP2pAddr(target)
 	if err != nil {
 		return err
 	}
-	host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	return d.SendFileTo(ctx, *info, fileName, codec, file)
+}
+
+// SendFileTo 与 SendFileWithCodec 相同，但目标节点由 peer.AddrInfo 指定，
+// 节点的所有地址都加入 peerstore，建立连接时会尝试每个地址，而不只是第一个。
+func (d *DHTService) SendFileTo(ctx context.Context, info peer.AddrInfo, fileName, codec string, file io.ReadWriter) error {
+	if err := CheckCodec(codec); err != nil {
+		return err
+	}
+	d.Host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
 
 	// Use the common file transfer handler
-	return d.handleFileTransfer(ctx, info.ID, sendFileProtocol, fileName, file)
+	return d.handleFileTransfer(ctx, info.ID, sendFileProtocol, fileName, codec, file)
 }
 
-// GetFile 从目标节点检索文件。
+// GetFile 从目标节点检索文件，双方都支持时数据块以压缩的形式传输，写入 file 的总是解压后的内容。
 // 参数:
 // - ctx: 上下文，用于控制取消操作。
 // - target: 目标节点的多地址。
@@ -51,75 +74,142 @@ func (d *DHTService) SendFile(ctx context.Context, target multiaddr.Multiaddr, f
 // 返回值:
 // - error: 如果检索过程中出现错误，则返回错误信息。
 func (d *DHTService) GetFile(ctx context.Context, target multiaddr.Multiaddr, fileInfo, path string, file io.ReadWriter) error {
-	host := d.Host
-
 	// Extract peer ID and add to peerstore
 	info, err := peer.AddrInfoFromP2pAddr(target)
 	if err != nil {
 		return err
 	}
-	host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	return d.GetFileFrom(ctx, *info, fileInfo, file)
+}
+
+// GetFileFrom 与 GetFile 相同，但目标节点由 peer.AddrInfo 指定，建立连接时会尝试节点的每个地址。
+// 对方没有这个文件时返回 ErrFileNotFound。
+func (d *DHTService) GetFileFrom(ctx context.Context, info peer.AddrInfo, fileInfo string, file io.ReadWriter) error {
+	d.Host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
 
 	// Use the common file transfer handler
-	return d.handleFileTransfer(ctx, info.ID, getFileProtocol, fileInfo, file)
+	return d.handleFileTransfer(ctx, info.ID, getFileProtocol, fileInfo, CodecNone, file)
 }
 
-// handleFileTransfer 处理通过流发送和接收文件。
+// handleFileTransfer 处理通过流发送和接收文件，发送受上传速率、接收受下载速率的限制。
+// 每次传输的延迟、吞吐量和成败都记入对方节点的评分。
 // 参数:
 // - ctx: 上下文，用于控制取消操作。
 // - target: 目标节点的ID。
 // - protocol: 使用的协议。
 // - fileName: 文件名。
+// - codec: 发送文件时 file 中数据的编码。
 // - file: 文件读取器，如果是发送文件则传入文件读取器，否则传入nil。
 // 返回值:
 // - error: 如果传输过程中出现错误，则返回错误信息。
-func (d *DHTService) handleFileTransfer(ctx context.Context, target peer.ID, protocol, fileName string, file io.ReadWriter) error {
+func (d *DHTService) handleFileTransfer(ctx context.Context, target peer.ID, protocol, fileName, codec string, file io.ReadWriter) (err error) {
 	host := d.Host
+	start := time.Now()
+	var latency time.Duration
+	var n int64
+	defer func() {
+		elapsed := time.Since(start) - latency
+		d.scores.record(ctx, target, latency, n, elapsed, err)
+	}()
 
-	// Open a stream to the target peer
-	s, err := host.NewStream(ctx, target, pro.ID(protocol))
+	// Open a stream to the target peer, preferring the protocol version with compression
+	codecProtocol := sendFileCodecProtocol
+	if protocol == getFileProtocol {
+		codecProtocol = getFileCodecProtocol
+	}
+	s, err := host.NewStream(ctx, target, pro.ID(codecProtocol), pro.ID(protocol))
 	if err != nil {
 		return err
 	}
+	latency = time.Since(start)
 	defer s.Close()
-
-	// Send the file name
-	if _, err := s.Write([]byte(fileName + "\n")); err != nil {
-		return err
-	}
+	// 取消 ctx 时中断流，正在进行的读写立即返回
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+	withCodec := s.Protocol() == pro.ID(codecProtocol)
 
 	// Send or receive the file content
 	if protocol == sendFileProtocol {
 		// Sending file
-		buf := bufio.NewReader(file)
-		if _, err := io.Copy(s, buf); err != nil {
+		var content io.Reader = bufio.NewReader(file)
+		request := fileName
+		if withCodec {
+			request += " " + codec
+		} else if codec != CodecNone {
+			// 对方不支持压缩，发送解压后的内容
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return err
+			}
+			if data, err = Decompress(codec, data); err != nil {
+				return err
+			}
+			content = bytes.NewReader(data)
+		}
+		if _, err := s.Write([]byte(request + "\n")); err != nil {
+			return err
+		}
+		if n, err = io.Copy(d.uploadTo(ctx, target, s), content); err != nil {
 			return err
 		}
 		logrus.Println("File sent successfully")
 	} else {
+		// Send the file name and the accepted codecs
+		request := fileName
+		if withCodec {
+			request += " " + strings.Join(Codecs, ",")
+		}
+		if _, err := s.Write([]byte(request + "\n")); err != nil {
+			return err
+		}
+
 		// Receiving file
 
 		// Read the response about file availability
-		responseBuf := bufio.NewReader(s)
+		responseBuf := bufio.NewReader(d.downloadFrom(ctx, target, s))
 		str, err := responseBuf.ReadString('\n')
 		if err != nil {
 			return err
 		}
-		str = strings.TrimSpace(str)
-		if str != "true" {
+		fields := strings.Fields(str)
+		if len(fields) == 0 || fields[0] != "true" {
 			logrus.Printf("Peer does not have the file %s", fileName)
-			return errors.New("peer does not have the file")
+			return ErrFileNotFound
 		}
 		logrus.Printf("Peer has the file %s", fileName)
+		if len(fields) > 1 && fields[1] != CodecNone {
+			// 压缩的数据块先完整读取，解压后再写入
+			data, err := io.ReadAll(io.LimitReader(responseBuf, int64(maxChunkSize)+1))
+			if err != nil {
+				return err
+			}
+			n = int64(len(data))
+			if len(data) > maxChunkSize {
+				s.Reset()
+				return xerrors.Errorf("%w: compressed chunk %s exceeds %d bytes", ErrChunkTooLarge, fileName, maxChunkSize)
+			}
+			if data, err = Decompress(fields[1], data); err != nil {
+				return err
+			}
+			if _, err := file.Write(data); err != nil {
+				return err
+			}
+			logrus.Printf("File received successfully with %s", fields[1])
+			return nil
+		}
 
 		buf := bufio.NewWriter(file)
 
 		// Copy the incoming stream to the output file
 		// Ensure all data is copied before closing the stream
-		if _, err := io.Copy(buf, s); err != nil {
+		// 文件内容可能已经和应答一起被读入 responseBuf，必须从 responseBuf 继续读取
+		if n, err = io.Copy(buf, responseBuf); err != nil {
 			logrus.Printf("Cannot receive the file %s", fileName)
 			return err
 		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
 
 		// Data copy is complete, now we can close the stream.
 		logrus.Println("File received successfully")
@@ -128,101 +218,141 @@ func (d *DHTService) handleFileTransfer(ctx context.Context, target peer.ID, pro
 	return nil
 }
 
-// SendFileHandler 监听传入的文件请求。
+// SendFileHandler 监听传入的文件请求，接收受服务流数和下载速率的限制。
 // 参数:
 // - ctx: 上下文，用于控制取消操作。
 func (d *DHTService) SendFileHandler(ctx context.Context, path string) {
 	host := d.Host
-	host.SetStreamHandler(sendFileProtocol, func(s network.Stream) {
+	handler := func(s network.Stream) {
 		logrus.Println("Received new stream")
-		if err := receiveFile(s, path); err != nil {
+		remote := s.Conn().RemotePeer()
+		if err := d.limiter.acquire(ctx, remote); err != nil {
+			s.Reset()
+			return
+		}
+		defer d.limiter.release()
+		fileName, err := receiveFile(d.downloadFrom(ctx, remote, s), path)
+		if err != nil {
 			logrus.Println(err)
 			s.Reset()
-		} else {
-			s.Close()
+			return
 		}
-	})
+		s.Close()
+		// 收到数据块后由本节点宣布自己是持有者，发送方不能替接收方宣布
+		go func() {
+			if err := d.Announce(ctx, fileName); err != nil {
+				logrus.Infof("Announce received split %s failed: %v", fileName, err)
+			}
+		}()
+	}
+	host.SetStreamHandler(sendFileProtocol, handler)
+	host.SetStreamHandler(sendFileCodecProtocol, handler)
 	logrus.Println("Listening for connections")
 }
 
 // GetFileHandler 监听传入的文件请求以发送文件。
+// 请求方接受数据块保存的压缩形式时直接发送，否则先解压再发送。发送受服务流数和上传速率的限制。
 // 参数:
 // - ctx: 上下文，用于控制取消操作。
 // - path: 文件存储路径。
 func (d *DHTService) GetFileHandler(ctx context.Context, path string) {
 	host := d.Host
-	host.SetStreamHandler(getFileProtocol, func(s network.Stream) {
+	handler := func(s network.Stream) {
 		defer s.Close()
+		// 服务的流数达到上限时排队，轮到之后再读取请求
+		remote := s.Conn().RemotePeer()
+		if err := d.limiter.acquire(ctx, remote); err != nil {
+			s.Reset()
+			return
+		}
+		defer d.limiter.release()
 		buf := bufio.NewReader(s)
+		withCodec := s.Protocol() == getFileCodecProtocol
 
 		// Get fileInfo from the incoming request
 		str, err := buf.ReadString('\n')
 		if err != nil {
-			logrus.Fatalf("Cannot read fileInfo: %v", err)
+			// 请求方可能在排队时已经放弃
+			logrus.Printf("Cannot read fileInfo: %v", err)
+			s.Reset()
+			return
+		}
+		fileInfo, accepted, _ := strings.Cut(strings.TrimSpace(str), " ")
+		var accept []string
+		if withCodec && accepted != "" {
+			accept = strings.Split(accepted, ",")
 		}
-		fileInfo := strings.TrimSpace(str)
 		logrus.Printf("Requested file: %s", fileInfo)
 
 		// Attempt to find the file
-		file, err := os.Open(filepath.Join(path, fileInfo))
+		data, codec, err := openChunk(path, fileInfo, accept)
+		if err == nil && codec != CodecNone && !slices.Contains(accept, codec) {
+			data, err = Decompress(codec, data)
+			codec = CodecNone
+		}
 		if err != nil {
 			s.Write([]byte("false\n"))
 			logrus.Printf("Cannot find the file %s", fileInfo)
 			return
 		}
-		defer file.Close()
 
 		// Confirm file availability
-		s.Write([]byte("true\n"))
+		response := "true"
+		if withCodec {
+			response += " " + codec
+		}
+		s.Write([]byte(response + "\n"))
 		logrus.Printf("File found: %s", fileInfo)
 
 		// Send the file
-		fbuf := bufio.NewReader(file)
-		if _, err := io.Copy(s, fbuf); err != nil {
-			logrus.Fatal(err)
+		if _, err := d.uploadTo(ctx, remote, s).Write(data); err != nil {
+			logrus.Println(err)
+			s.Reset()
 			return
 		}
 		logrus.Printf("File send success: %s", fileInfo)
-	})
+	}
+	host.SetStreamHandler(getFileProtocol, handler)
+	host.SetStreamHandler(getFileCodecProtocol, handler)
 }
 
-// receiveFile 从流中接收文件并写入磁盘。
+// receiveFile 从流中接收文件并写入磁盘，压缩的数据块按压缩的形式保存。
 // 参数:
-// - s: 网络流。
+// - s: 网络流，已经按下载速率限速。
 // - path: 文件保存路径。
 // 返回值:
+// - string: 收到的数据块名称。
 // - error: 如果接收过程中出现错误，则返回错误信息。
-func receiveFile(s network.Stream, path string) error {
+func receiveFile(s io.Reader, path string) (string, error) {
 	buf := bufio.NewReader(s)
 
-	// Read the file name
-	fileName, err := buf.ReadString('\n')
+	// Read the file name and the codec of the content
+	request, err := buf.ReadString('\n')
 	if err != nil {
-		return err
+		return "", err
+	}
+	fileName, codec, _ := strings.Cut(strings.TrimSpace(request), " ")
+	if err := CheckCodec(codec); err != nil {
+		return "", err
 	}
-	fileName = strings.TrimSpace(fileName)
 
 	logrus.Printf("Receiving file: %s", fileName)
 
-	// Prepare the output file path
-	if path != "" {
-		fileName = filepath.Join(path, fileName)
-	}
-
 	// Create the output file
-	outFile, err := os.Create(fileName)
+	outFile, err := os.Create(chunkPath(path, fileName, codec))
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer outFile.Close()
 
 	// Copy the incoming stream to the output file
-	if _, err := io.Copy(outFile, s); err != nil {
-		return err
+	// 文件名之后的内容可能已经被读入 buf，必须从 buf 继续读取
+	if _, err := io.Copy(outFile, buf); err != nil {
+		return "", err
 	}
 
 	logrus.Println("File received successfully")
-	return nil
+	return fileName, nil
 }
 
 // getFileName extracts the file name from the full file path.
@@ -0,0 +1,236 @@
+package DHT
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pro "github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNode 是 mocknet 上的一个 DHTService，Path 是它保存数据块的目录
+type testNode struct {
+	*DHTService
+	Path string
+}
+
+// newTestNodes 在 mocknet 上创建 count 个两两相连的节点，并注册文件相关的协议处理函数。
+// dhtsim 依赖本包，包内的测试不能使用它
+func newTestNodes(t *testing.T, count int) []*testNode {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+
+	var nodes []*testNode
+	for i := 0; i < count; i++ {
+		host, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		service, err := NewDHTServiceWithHost(ctx, host, NewDHTConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { service.Close() })
+		node := &testNode{DHTService: service, Path: t.TempDir()}
+		service.SendFileHandler(ctx, node.Path)
+		service.GetFileHandler(ctx, node.Path)
+		nodes = append(nodes, node)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+// info 返回节点的地址信息
+func (node *testNode) info() peer.AddrInfo {
+	return peer.AddrInfo{ID: node.Host.ID(), Addrs: node.Host.Addrs()}
+}
+
+// randomChunk 返回 size 字节的随机内容，随机内容几乎不能压缩
+func randomChunk(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// compressibleChunk 返回 size 字节的可以压缩的内容
+func compressibleChunk(size int) []byte {
+	return bytes.Repeat([]byte("FlexiSN chunk "), size/14+1)[:size]
+}
+
+// storeChunk 把 data 用 codec 压缩后保存到节点的目录中
+func storeChunk(t *testing.T, node *testNode, name, codec string, data []byte) []byte {
+	t.Helper()
+	encoded, err := Compress(codec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(chunkPath(node.Path, name, codec), encoded, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// request 在 protocol 上发送原始的读取请求，返回应答行和之后的内容
+func request(t *testing.T, from, to *testNode, protocol, line string) (string, []byte) {
+	t.Helper()
+	s, err := from.Host.NewStream(context.Background(), to.Host.ID(), pro.ID(protocol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := bufio.NewReader(s)
+	response, err := buf.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimRight(response, "\n"), body
+}
+
+// stored 等待 path 的内容变为 want
+func stored(t *testing.T, path string, want []byte) bool {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err := os.ReadFile(path); err == nil && bytes.Equal(data, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetFileCodecNegotiation(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	client, server := nodes[0], nodes[1]
+	data := compressibleChunk(64 * 1024)
+	compressed := storeChunk(t, server, "chunk", CodecZstd, data)
+
+	// 双方都支持 zstd 时按压缩的形式传输，写入的是解压后的内容
+	var buffer bytes.Buffer
+	if err := client.GetFileFrom(context.Background(), server.info(), "chunk", &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), data) {
+		t.Fatal("received content differs")
+	}
+	response, body := request(t, client, server, getFileCodecProtocol, "chunk zstd,gzip")
+	if response != "true zstd" || !bytes.Equal(body, compressed) {
+		t.Fatalf("zstd requester got %q and %d bytes, want the stored zstd chunk", response, len(body))
+	}
+
+	// 只接受 gzip 或不接受压缩的请求方收到解压后的内容
+	for _, line := range []string{"chunk gzip", "chunk"} {
+		response, body := request(t, client, server, getFileCodecProtocol, line)
+		if strings.TrimSpace(response) != "true" || !bytes.Equal(body, data) {
+			t.Fatalf("request %q got %q and %d bytes, want the decompressed chunk", line, response, len(body))
+		}
+	}
+	// 不支持 1.1.0 的旧节点
+	response, body = request(t, client, server, getFileProtocol, "chunk")
+	if response != "true" || !bytes.Equal(body, data) {
+		t.Fatalf("old requester got %q and %d bytes, want the decompressed chunk", response, len(body))
+	}
+
+	response, _ = request(t, client, server, getFileCodecProtocol, "missing zstd")
+	if response != "false" {
+		t.Fatalf("missing chunk answered %q", response)
+	}
+	if err := client.GetFileFrom(context.Background(), server.info(), "missing", &buffer); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("got %v, want ErrFileNotFound", err)
+	}
+}
+
+func TestSendFileCodecNegotiation(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	sender, receiver, old := nodes[0], nodes[1], nodes[2]
+	// old 只支持不压缩的 1.0.0
+	old.Host.RemoveStreamHandler(sendFileCodecProtocol)
+	data := compressibleChunk(64 * 1024)
+	compressed, err := Compress(CodecZstd, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range []*testNode{receiver, old} {
+		if err := sender.SendFileTo(context.Background(), node.info(), "chunk", CodecZstd, bytes.NewBuffer(compressed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 发送方不等待对方写完文件
+	if !stored(t, chunkPath(receiver.Path, "chunk", CodecZstd), compressed) {
+		t.Fatal("receiver did not keep the zstd chunk")
+	}
+	if !stored(t, chunkPath(old.Path, "chunk", CodecNone), data) {
+		t.Fatal("old receiver did not get the decompressed chunk")
+	}
+	if _, err := os.Stat(chunkPath(old.Path, "chunk", CodecZstd)); err == nil {
+		t.Fatal("old receiver stored a zstd chunk")
+	}
+	for _, node := range []*testNode{receiver, old} {
+		chunk, err := ReadChunk(node.Path, "chunk")
+		if err != nil || !bytes.Equal(chunk, data) {
+			t.Fatalf("read back %d bytes: %v", len(chunk), err)
+		}
+	}
+}
+
+func TestGetFileRejectsOversizeChunk(t *testing.T) {
+	prev := maxChunkSize
+	maxChunkSize = 4 * 1024
+	t.Cleanup(func() { maxChunkSize = prev })
+
+	nodes := newTestNodes(t, 2)
+	client, server := nodes[0], nodes[1]
+	// 随机内容压缩后仍然超过上限
+	storeChunk(t, server, "large", CodecZstd, randomChunk(t, 2*maxChunkSize))
+	// 不超过上限的压缩数据块正常接收
+	small := compressibleChunk(maxChunkSize)
+	storeChunk(t, server, "small", CodecZstd, small)
+
+	var buffer bytes.Buffer
+	if err := client.GetFileFrom(context.Background(), server.info(), "large", &buffer); !errors.Is(err, ErrChunkTooLarge) {
+		t.Fatalf("got %v, want ErrChunkTooLarge", err)
+	}
+	if buffer.Len() != 0 {
+		t.Fatalf("wrote %d bytes of an oversize chunk", buffer.Len())
+	}
+	if err := client.GetFileFrom(context.Background(), server.info(), "small", &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), small) {
+		t.Fatal("received content differs")
+	}
+
+	// 压缩的数据块解压后超过上限同样被拒绝
+	bomb, err := Compress(CodecGzip, compressibleChunk(2*maxChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress(CodecGzip, bomb); !errors.Is(err, ErrChunkTooLarge) {
+		t.Fatalf("got %v, want ErrChunkTooLarge", err)
+	}
+}
@@ -0,0 +1,333 @@
+package DHT
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+	"io"
+	"sync"
+	"time"
+)
+
+// 传输限速: 文件传输的上传和下载分别受全局和每个节点的令牌桶限制，速率为 0 表示不限制。
+// 本节点同时服务的流数达到上限后，新的请求按节点排队，空出的名额在有请求的节点之间轮流分配，
+// 一个节点的大量请求不会让其他节点一直等待。
+
+const (
+	// limitPiece 是每次读写的最大字节数，限速的粒度
+	limitPiece = 32 * 1024
+	// peerIdleTime 是节点的令牌桶在没有传输后保留的时间
+	peerIdleTime = time.Minute
+)
+
+// timeNow 返回当前时间，测试中替换为假的时钟
+var timeNow = time.Now
+
+// Limits 是文件传输的限制，速率的单位是字节每秒，0 表示不限制
+type Limits struct {
+	UploadRate       int64 `yaml:"UploadRate"`       // 所有节点的上传总速率
+	DownloadRate     int64 `yaml:"DownloadRate"`     // 所有节点的下载总速率
+	PeerUploadRate   int64 `yaml:"PeerUploadRate"`   // 向每个节点上传的速率
+	PeerDownloadRate int64 `yaml:"PeerDownloadRate"` // 从每个节点下载的速率
+	MaxStreams       int   `yaml:"MaxStreams"`       // 同时服务的流数上限
+}
+
+// Validate 检查限制的取值
+func (limits Limits) Validate() error {
+	if limits.UploadRate < 0 || limits.DownloadRate < 0 || limits.PeerUploadRate < 0 ||
+		limits.PeerDownloadRate < 0 || limits.MaxStreams < 0 {
+		return xerrors.Errorf("limits must not be negative: %+v", limits)
+	}
+	return nil
+}
+
+// tokenBucket 是令牌桶，容量等于每秒的速率。
+// 令牌可以预支为负数，预支的部分按速率折算成需要等待的时间。
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: timeNow()}
+}
+
+// setRate 修改速率，已经预支的令牌保持不变
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(timeNow())
+	b.rate = rate
+	b.tokens = min(b.tokens, float64(rate))
+}
+
+// refill 按经过的时间补充令牌，调用时需要持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(b.rate), float64(b.rate))
+	}
+	b.last = now
+}
+
+// reserve 取出 n 个令牌，返回取出前需要等待的时间
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(timeNow())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// peerLimit 是一个节点的令牌桶和排队的流
+type peerLimit struct {
+	upload, download *tokenBucket
+	waiters          []chan struct{}
+	last             time.Time
+}
+
+// limiter 执行 Limits
+type limiter struct {
+	mu               sync.Mutex
+	limits           Limits
+	upload, download *tokenBucket
+	peers            map[peer.ID]*peerLimit
+	active           int       // 正在服务的流数
+	waiting          []peer.ID // 有流在排队的节点，按轮到的顺序排列
+	pruned           time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		upload:   newTokenBucket(0),
+		download: newTokenBucket(0),
+		peers:    make(map[peer.ID]*peerLimit),
+		pruned:   timeNow(),
+	}
+}
+
+// setLimits 修改限制，正在进行的传输立即按新的速率限速
+func (l *limiter) setLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.upload.setRate(limits.UploadRate)
+	l.download.setRate(limits.DownloadRate)
+	for _, p := range l.peers {
+		p.upload.setRate(limits.PeerUploadRate)
+		p.download.setRate(limits.PeerDownloadRate)
+	}
+	l.dispatch()
+}
+
+func (l *limiter) getLimits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// peer 返回节点的限制，不存在时创建，并删除长时间没有传输的节点，调用时需要持有锁
+func (l *limiter) peer(id peer.ID) *peerLimit {
+	now := timeNow()
+	if now.Sub(l.pruned) > peerIdleTime {
+		for pid, p := range l.peers {
+			if len(p.waiters) == 0 && now.Sub(p.last) > peerIdleTime {
+				delete(l.peers, pid)
+			}
+		}
+		l.pruned = now
+	}
+	p, exists := l.peers[id]
+	if !exists {
+		p = &peerLimit{
+			upload:   newTokenBucket(l.limits.PeerUploadRate),
+			download: newTokenBucket(l.limits.PeerDownloadRate),
+		}
+		l.peers[id] = p
+	}
+	p.last = now
+	return p
+}
+
+// acquire 获取一个服务流的名额，名额用完时排队等待
+// 参数:
+//   - ctx: 上下文，取消时放弃等待
+//   - id: 请求的节点
+//
+// 返回值:
+//   - error: 放弃等待时返回 ctx 的错误，获取成功后需要调用 release
+func (l *limiter) acquire(ctx context.Context, id peer.ID) error {
+	l.mu.Lock()
+	if l.limits.MaxStreams <= 0 || l.active < l.limits.MaxStreams {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	p := l.peer(id)
+	ready := make(chan struct{})
+	if len(p.waiters) == 0 {
+		l.waiting = append(l.waiting, id)
+	}
+	p.waiters = append(p.waiters, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// 放弃的同时已经分到了名额，交给下一个排队的流
+		l.active--
+		l.dispatch()
+	default:
+		for i, waiter := range p.waiters {
+			if waiter == ready {
+				p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+				break
+			}
+		}
+		if len(p.waiters) == 0 {
+			for i, pid := range l.waiting {
+				if pid == id {
+					l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// release 归还服务流的名额
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.dispatch()
+}
+
+// dispatch 把空出的名额轮流分给排队的节点，每个节点每轮一个，调用时需要持有锁
+func (l *limiter) dispatch() {
+	for len(l.waiting) > 0 && (l.limits.MaxStreams <= 0 || l.active < l.limits.MaxStreams) {
+		id := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		p := l.peers[id]
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+		if len(p.waiters) > 0 {
+			l.waiting = append(l.waiting, id)
+		}
+		l.active++
+	}
+}
+
+// wait 为与节点 id 之间传输的 n 个字节取出全局和节点的令牌，并等待到令牌足够
+func (l *limiter) wait(ctx context.Context, id peer.ID, upload bool, n int) error {
+	l.mu.Lock()
+	p := l.peer(id)
+	global, local := l.download, p.download
+	if upload {
+		global, local = l.upload, p.upload
+	}
+	l.mu.Unlock()
+
+	delay := max(global.reserve(n), local.reserve(n))
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader 是按下载速率限速的 io.Reader
+type limitedReader struct {
+	ctx     context.Context
+	limiter *limiter
+	peer    peer.ID
+	r       io.Reader
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitPiece {
+		p = p[:limitPiece]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, r.peer, false, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// limitedWriter 是按上传速率限速的 io.Writer
+type limitedWriter struct {
+	ctx     context.Context
+	limiter *limiter
+	peer    peer.ID
+	w       io.Writer
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), limitPiece)]
+		if err := w.limiter.wait(w.ctx, w.peer, true, len(piece)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(piece):]
+	}
+	return written, nil
+}
+
+// SetLimits 修改文件传输的限制，可以在运行时调用
+// 参数:
+//   - limits: 新的限制
+//
+// 返回值:
+//   - error: 限制为负数时返回错误信息
+func (d *DHTService) SetLimits(limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	d.limiter.setLimits(limits)
+	return nil
+}
+
+// Limits 返回当前文件传输的限制
+func (d *DHTService) Limits() Limits {
+	return d.limiter.getLimits()
+}
+
+// uploadTo 返回向节点 id 上传的限速 io.Writer
+func (d *DHTService) uploadTo(ctx context.Context, id peer.ID, w io.Writer) io.Writer {
+	return &limitedWriter{ctx: ctx, limiter: d.limiter, peer: id, w: w}
+}
+
+// downloadFrom 返回从节点 id 下载的限速 io.Reader
+func (d *DHTService) downloadFrom(ctx context.Context, id peer.ID, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, limiter: d.limiter, peer: id, r: r}
+}
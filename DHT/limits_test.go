@@ -0,0 +1,285 @@
+package DHT
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 是测试使用的时钟，只在调用 advance 时前进
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock 用假的时钟替换 timeNow，测试结束时恢复
+func useFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	prev := timeNow
+	timeNow = clock.Now
+	t.Cleanup(func() { timeNow = prev })
+	return clock
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	clock := useFakeClock(t)
+	const rate = 100 * 1024
+	b := newTokenBucket(rate)
+
+	// 满的桶可以立即取出一秒的令牌，之后按速率等待
+	start := clock.Now()
+	if delay := b.reserve(rate); delay != 0 {
+		t.Fatalf("full bucket delayed %v", delay)
+	}
+	delay := b.reserve(rate / 2)
+	if !near(delay, 500*time.Millisecond) {
+		t.Fatalf("delayed %v, want 500ms", delay)
+	}
+	clock.advance(delay)
+
+	// 调用者每次等待 reserve 返回的时间后再传输，任意时刻传输的字节数不超过一秒的突发加上速率乘以经过的时间
+	transferred := int64(rate + rate/2)
+	for i := 0; i < 1000; i++ {
+		n := limitPiece - i
+		clock.advance(b.reserve(n))
+		transferred += int64(n)
+		elapsed := clock.Now().Sub(start).Seconds()
+		if limit := float64(rate) + elapsed*rate + 1; float64(transferred) > limit {
+			t.Fatalf("transferred %d bytes in %.3fs, limit %.0f", transferred, elapsed, limit)
+		}
+	}
+	// 长时间的平均速率等于设定的速率
+	elapsed := clock.Now().Sub(start).Seconds()
+	if average := float64(transferred-rate) / elapsed; average < rate*0.99 || average > rate*1.01 {
+		t.Fatalf("average rate %.0f, want %d", average, rate)
+	}
+
+	// 空闲之后最多积累一秒的令牌
+	clock.advance(time.Hour)
+	if delay := b.reserve(rate); delay != 0 {
+		t.Fatalf("delayed %v after idle", delay)
+	}
+	if delay := b.reserve(rate / 10); !near(delay, 100*time.Millisecond) {
+		t.Fatalf("delayed %v, want 100ms: bucket holds more than one second", delay)
+	}
+
+	// 降低速率后预支的令牌按新的速率折算，速率为0时不限制
+	b.setRate(rate / 10)
+	if delay := b.reserve(0); !near(delay, time.Second) {
+		t.Fatalf("delayed %v after lowering the rate, want 1s", delay)
+	}
+	b.setRate(0)
+	if delay := b.reserve(1 << 30); delay != 0 {
+		t.Fatalf("unlimited bucket delayed %v", delay)
+	}
+}
+
+// near 判断令牌折算的等待时间与 want 相差不超过1微秒，折算时有浮点误差
+func near(delay, want time.Duration) bool {
+	return delay > want-time.Microsecond && delay < want+time.Microsecond
+}
+
+func TestLimiterWaitUsesGlobalAndPeerRates(t *testing.T) {
+	clock := useFakeClock(t)
+	l := newLimiter()
+	l.setLimits(Limits{UploadRate: 1000, PeerUploadRate: 100})
+	// 从不限制改为限制时全局的桶是空的，一秒后装满
+	clock.advance(time.Second)
+
+	// 节点的速率更低，节点的令牌用完后等待
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, "a", true, 100); err != nil {
+		t.Fatalf("first piece waited: %v", err)
+	}
+	if err := l.wait(ctx, "a", true, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want to wait for the peer rate", err)
+	}
+	// 其他节点有自己的令牌，但共享全局的速率: a 已经取出101个令牌，再有8个节点各取100个之后全局的令牌用完
+	for _, id := range []peer.ID{"b", "c", "d", "e", "f", "g", "h", "i"} {
+		if err := l.wait(ctx, id, true, 100); err != nil {
+			t.Fatalf("peer %s waited: %v", id, err)
+		}
+	}
+	if err := l.wait(ctx, "j", true, 100); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want to wait for the global rate", err)
+	}
+	// 下载不受上传限制
+	if err := l.wait(ctx, "a", false, 1<<20); err != nil {
+		t.Fatalf("download waited: %v", err)
+	}
+}
+
+// queue 在 l 中为节点 id 排队一个流，返回等待结束的结果，等到流确实进入队列后才返回
+func queue(t *testing.T, l *limiter, ctx context.Context, id peer.ID, granted chan<- peer.ID) <-chan error {
+	t.Helper()
+	l.mu.Lock()
+	before := 0
+	if p, exists := l.peers[id]; exists {
+		before = len(p.waiters)
+	}
+	l.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := l.acquire(ctx, id)
+		if err == nil {
+			granted <- id
+		}
+		done <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		p, exists := l.peers[id]
+		queued := exists && len(p.waiters) > before
+		l.mu.Unlock()
+		if queued {
+			return done
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream of %s not queued", id)
+		}
+	}
+}
+
+func TestLimiterFairQueue(t *testing.T) {
+	l := newLimiter()
+	l.setLimits(Limits{MaxStreams: 2})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(ctx, "busy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a 先排队4个流，b 和 c 之后各排队1个，空出的名额在节点之间轮流分配
+	granted := make(chan peer.ID, 10)
+	for _, id := range []peer.ID{"a", "a", "a", "a", "b", "c"} {
+		queue(t, l, ctx, id, granted)
+	}
+	var order []peer.ID
+	for i := 0; i < 6; i++ {
+		l.release()
+		select {
+		case id := <-granted:
+			order = append(order, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no stream admitted after release %d, order %v", i, order)
+		}
+	}
+	want := []peer.ID{"a", "b", "c", "a", "a", "a"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("admitted %v, want %v", order, want)
+		}
+	}
+
+	// 同时服务的流数不超过上限
+	l.mu.Lock()
+	active, waiting := l.active, len(l.waiting)
+	l.mu.Unlock()
+	if active != 2 || waiting != 0 {
+		t.Fatalf("%d active and %d waiting, want 2 and 0", active, waiting)
+	}
+}
+
+func TestLimiterCancelQueued(t *testing.T) {
+	l := newLimiter()
+	l.setLimits(Limits{MaxStreams: 1})
+	if err := l.acquire(context.Background(), "busy"); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan peer.ID, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := queue(t, l, ctx, "a", granted)
+	queue(t, l, context.Background(), "b", granted)
+
+	// 放弃等待的流离开队列，名额交给下一个节点
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	l.release()
+	select {
+	case id := <-granted:
+		if id != "b" {
+			t.Fatalf("admitted %s, want b", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream admitted")
+	}
+
+	// 提高上限时排队的流立即得到名额
+	queue(t, l, context.Background(), "c", granted)
+	l.setLimits(Limits{MaxStreams: 2})
+	select {
+	case id := <-granted:
+		if id != "c" {
+			t.Fatalf("admitted %s, want c", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("raising MaxStreams admitted no stream")
+	}
+}
+
+func TestLimiterEvictsIdlePeers(t *testing.T) {
+	clock := useFakeClock(t)
+	l := newLimiter()
+	l.setLimits(Limits{MaxStreams: 1, PeerUploadRate: 100})
+	ctx := context.Background()
+	if err := l.wait(ctx, "idle", true, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(ctx, "busy"); err != nil {
+		t.Fatal(err)
+	}
+	// queued 有排队的流，空闲再久也不能删除
+	granted := make(chan peer.ID, 1)
+	queue(t, l, ctx, "queued", granted)
+
+	clock.advance(peerIdleTime / 2)
+	if err := l.wait(ctx, "active", true, 10); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	count := len(l.peers)
+	l.mu.Unlock()
+	if count != 3 {
+		t.Fatalf("%d peers before the idle time, want 3", count)
+	}
+
+	clock.advance(peerIdleTime/2 + time.Second)
+	if err := l.wait(ctx, "new", true, 10); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	_, idle := l.peers["idle"]
+	_, queued := l.peers["queued"]
+	_, active := l.peers["active"]
+	l.mu.Unlock()
+	if idle || !queued || !active {
+		t.Fatalf("idle kept %v, queued kept %v, active kept %v", idle, queued, active)
+	}
+
+	// 删除后重新出现的节点从满的令牌桶开始
+	if err := l.wait(ctx, "idle", true, 100); err != nil {
+		t.Fatal(err)
+	}
+	l.release()
+	<-granted
+}
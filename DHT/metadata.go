@@ -0,0 +1,95 @@
+package DHT
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+	"io"
+	"strings"
+)
+
+const MetaDataProtocol = "/MetaData/1.0.0"
+
+// maxMetaDataSize 是 metadata 应答的大小上限
+const maxMetaDataSize = 64 * 1024 * 1024
+
+// MetaDataLoader 读取本地保存的 metadata，rootHash 是根哈希的16进制字符串
+type MetaDataLoader func(rootHash string) (*MetaData, error)
+
+// metaDataResponse 是对 metadata 请求的应答
+type metaDataResponse struct {
+	MetaData *MetaData `json:"metaData,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// GetMetaData 向目标节点请求根哈希对应的 metadata。
+// 对方节点不可信，调用者需要验证返回的 metadata 的根哈希、签名和默克尔树
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - target: 请求的节点
+//   - rootHash: 根哈希的16进制字符串
+//
+// 返回值:
+//   - *MetaData: 对方节点保存的 metadata
+//   - error: 对方没有这个 metadata 或请求失败时返回错误信息
+func (d *DHTService) GetMetaData(ctx context.Context, target peer.ID, rootHash string) (*MetaData, error) {
+	s, err := d.Host.NewStream(ctx, target, MetaDataProtocol)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open metadata stream: %w", err)
+	}
+	defer s.Close()
+
+	if _, err := io.WriteString(s, rootHash+"\n"); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to send metadata request: %w", err)
+	}
+
+	var resp metaDataResponse
+	if err := json.NewDecoder(io.LimitReader(s, maxMetaDataSize)).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to read metadata response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if resp.MetaData == nil {
+		return nil, xerrors.Errorf("peer %s returned no metadata", target)
+	}
+	return resp.MetaData, nil
+}
+
+// MetaDataHandler 处理 metadata 请求，只应答本地保存的 metadata
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - load: 读取本地 metadata 的函数
+func (d *DHTService) MetaDataHandler(ctx context.Context, load MetaDataLoader) {
+	d.Host.SetStreamHandler(MetaDataProtocol, func(s network.Stream) {
+		str, err := bufio.NewReader(s).ReadString('\n')
+		if err != nil {
+			logrus.WithError(err).Error("Can not read metadata request")
+			s.Reset()
+			return
+		}
+		rootHash := strings.TrimRight(str, "\n")
+
+		var resp metaDataResponse
+		// 根哈希必须是16进制，否则请求可以读到数据库中其他前缀的键
+		if _, err := hex.DecodeString(rootHash); err != nil || rootHash == "" {
+			resp.Error = "invalid root hash " + rootHash
+		} else if resp.MetaData, err = load(rootHash); err != nil {
+			resp.Error = "metadata " + rootHash + " not found"
+		}
+		if err := json.NewEncoder(s).Encode(&resp); err != nil {
+			logrus.WithError(err).Error("Can not send metadata response")
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+}
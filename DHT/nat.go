@@ -0,0 +1,212 @@
+package DHT
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+	"sort"
+	"sync/atomic"
+)
+
+// NAT 穿透: 节点在 NAT 之后时，可以通过 UPnP 在路由器上映射端口，或者通过中继节点接受连接，
+// 再由 DCUtR 借助中继连接打洞建立直连。AutoNAT 检测本节点是否可以从公网连接，
+// Announce 时按可达性排列地址，公网地址在前，不可达时中继地址排在私有地址之前。
+
+// NATConfig 是 NAT 穿透的配置，缺省时全部关闭，与只监听 TCP 端口的行为相同
+type NATConfig struct {
+	Relay         bool     `yaml:"Relay"`         // 中继客户端，不可达时通过中继节点接受连接
+	RelayService  bool     `yaml:"RelayService"`  // 为其他节点提供中继，只应在公网节点上开启
+	StaticRelays  []string `yaml:"StaticRelays"`  // 固定使用的中继节点地址，为空时从路由表中寻找提供中继的节点
+	AutoNAT       bool     `yaml:"AutoNAT"`       // 为其他节点检测可达性
+	HolePunching  bool     `yaml:"HolePunching"`  // 使用 DCUtR 打洞，需要开启 Relay
+	UPnP          bool     `yaml:"UPnP"`          // 通过 UPnP 或 NAT-PMP 在路由器上映射端口
+	Reachability  string   `yaml:"Reachability"`  // public 或 private 时不再检测，直接使用这个可达性
+	AnnounceAddrs []string `yaml:"AnnounceAddrs"` // 手动配置的公网地址，例如路由器上转发的端口，设置后只宣布这些地址
+}
+
+// relayPeers 从 DHT 的路由表中为自动中继提供候选节点，主机创建时 DHT 还不存在，创建之后再设置
+type relayPeers struct {
+	dht atomic.Pointer[dht.IpfsDHT]
+}
+
+// source 实现 autorelay.PeerSource，返回路由表中最多 num 个节点，是否提供中继由自动中继检查
+func (r *relayPeers) source(ctx context.Context, num int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo, num)
+	defer close(ch)
+	kdht := r.dht.Load()
+	if kdht == nil {
+		return ch
+	}
+	for _, p := range kdht.RoutingTable().ListPeers() {
+		if len(ch) == num {
+			break
+		}
+		ch <- kdht.Host().Peerstore().PeerInfo(p)
+	}
+	return ch
+}
+
+// options 返回 NAT 穿透对应的 libp2p 选项
+// 参数:
+//   - listenPort: 监听的端口，开启打洞时同时监听这个 UDP 端口上的 QUIC
+//   - insecure: 不加密时 QUIC 不可用
+//   - relays: 没有固定中继时自动中继使用的候选节点
+//
+// 返回值:
+//   - []libp2p.Option: libp2p 选项
+//   - error: 地址无效或配置冲突时返回错误信息
+func (config *NATConfig) options(listenPort int, insecure bool, relays *relayPeers) ([]libp2p.Option, error) {
+	listen := []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", listenPort)}
+	var opts []libp2p.Option
+	if config == nil {
+		config = &NATConfig{}
+	}
+	if config.HolePunching && !config.Relay {
+		return nil, xerrors.New("hole punching needs the relay client")
+	}
+
+	if config.Relay {
+		opts = append(opts, libp2p.EnableRelay())
+		if len(config.StaticRelays) > 0 {
+			static, err := parseAddrInfos(config.StaticRelays)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(static))
+		} else {
+			opts = append(opts, libp2p.EnableAutoRelayWithPeerSource(relays.source))
+		}
+	} else {
+		opts = append(opts, libp2p.DisableRelay())
+	}
+	if config.RelayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+	if config.AutoNAT {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	if config.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+		// UDP 打洞的成功率比 TCP 高
+		if !insecure {
+			listen = append(listen, fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", listenPort))
+		}
+	}
+	if config.UPnP {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+
+	switch config.Reachability {
+	case "":
+	case "public":
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	case "private":
+		opts = append(opts, libp2p.ForceReachabilityPrivate())
+	default:
+		return nil, xerrors.Errorf("unknown reachability %q", config.Reachability)
+	}
+
+	if len(config.AnnounceAddrs) > 0 {
+		announce := make([]multiaddr.Multiaddr, 0, len(config.AnnounceAddrs))
+		for _, s := range config.AnnounceAddrs {
+			addr, err := multiaddr.NewMultiaddr(s)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid announce address %s: %w", s, err)
+			}
+			announce = append(announce, addr)
+		}
+		// libp2p 会修改返回的切片，每次返回一个副本
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return append([]multiaddr.Multiaddr{}, announce...)
+		}))
+	}
+	return append(opts, libp2p.ListenAddrStrings(listen...)), nil
+}
+
+// parseAddrInfos 解析带有 /p2p/ 的节点地址，同一节点的多个地址合并在一起
+func parseAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid relay address %s: %w", s, err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// watchReachability 记录 AutoNAT 检测到的可达性变化，配置了固定的可达性时直接使用
+func (d *DHTService) watchReachability(ctx context.Context) error {
+	if d.Config.NAT != nil {
+		switch d.Config.NAT.Reachability {
+		case "public":
+			d.reachability.Store(int32(network.ReachabilityPublic))
+		case "private":
+			d.reachability.Store(int32(network.ReachabilityPrivate))
+		}
+	}
+	sub, err := d.Host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				reachability := e.(event.EvtLocalReachabilityChanged).Reachability
+				d.reachability.Store(int32(reachability))
+				logrus.Infof("Reachability changed to %s, addresses %v", reachability, d.ReachableAddrs())
+			}
+		}
+	}()
+	return nil
+}
+
+// Reachability 返回 AutoNAT 检测到的本节点的可达性，检测完成之前为 network.ReachabilityUnknown
+func (d *DHTService) Reachability() network.Reachability {
+	return network.Reachability(d.reachability.Load())
+}
+
+// ReachableAddrs 返回 Announce 时宣布的本节点地址。
+// 地址按其他节点连接成功的可能性排列: 公网地址在前；本节点不可达时中继地址排在私有地址之前，
+// 可达时中继地址排在最后；回环地址只对同一台机器上的节点有用，总是排在私有地址之后。
+func (d *DHTService) ReachableAddrs() []multiaddr.Multiaddr {
+	return rankAddrs(d.Host.Addrs(), d.Reachability())
+}
+
+// rankAddrs 按可达性排列地址，返回新的切片
+func rankAddrs(addrs []multiaddr.Multiaddr, reachability network.Reachability) []multiaddr.Multiaddr {
+	addrs = append([]multiaddr.Multiaddr{}, addrs...)
+	rank := func(addr multiaddr.Multiaddr) int {
+		_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+		switch {
+		case err == nil && reachability == network.ReachabilityPrivate:
+			return 1
+		case err == nil:
+			return 4
+		case manet.IsIPLoopback(addr):
+			return 3
+		case manet.IsPrivateAddr(addr):
+			return 2
+		default:
+			return 0
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool { return rank(addrs[i]) < rank(addrs[j]) })
+	return addrs
+}
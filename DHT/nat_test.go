@@ -0,0 +1,205 @@
+package DHT
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+const testRelay = "/ip4/203.0.113.7/tcp/4001/p2p/12D3KooWJWoaqZhDaoEFshF7Rh1bpY9ohihFhzcW6d69Lr2NASuq"
+
+// applyNAT 把 config 对应的选项应用到空的 libp2p 配置上
+func applyNAT(t *testing.T, config *NATConfig, insecure bool) *libp2p.Config {
+	t.Helper()
+	opts, err := config.options(4001, insecure, &relayPeers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &libp2p.Config{}
+	if err := cfg.Apply(opts...); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// listenAddrs 返回配置监听的地址
+func listenAddrs(cfg *libp2p.Config) []string {
+	addrs := make([]string, 0, len(cfg.ListenAddrs))
+	for _, addr := range cfg.ListenAddrs {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+func TestNATConfigParse(t *testing.T) {
+	data := `
+Relay: true
+RelayService: true
+StaticRelays:
+  - ` + testRelay + `
+AutoNAT: true
+HolePunching: true
+UPnP: true
+Reachability: private
+AnnounceAddrs:
+  - /ip4/198.51.100.1/tcp/4001
+`
+	var config NATConfig
+	if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+	want := NATConfig{
+		Relay:         true,
+		RelayService:  true,
+		StaticRelays:  []string{testRelay},
+		AutoNAT:       true,
+		HolePunching:  true,
+		UPnP:          true,
+		Reachability:  "private",
+		AnnounceAddrs: []string{"/ip4/198.51.100.1/tcp/4001"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Fatalf("parsed %+v, want %+v", config, want)
+	}
+
+	// 解析出的配置可以直接使用
+	cfg := applyNAT(t, &config, false)
+	if cfg.AutoNATConfig.ForceReachability == nil || *cfg.AutoNATConfig.ForceReachability != network.ReachabilityPrivate {
+		t.Fatalf("reachability %v, want private", cfg.AutoNATConfig.ForceReachability)
+	}
+	if cfg.AddrsFactory == nil {
+		t.Fatal("announce addresses ignored")
+	}
+	// 每次返回配置的地址的副本，忽略监听的地址
+	listen := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.168.1.2/tcp/4001")}
+	first := cfg.AddrsFactory(listen)
+	if len(first) != 1 || first[0].String() != "/ip4/198.51.100.1/tcp/4001" {
+		t.Fatalf("announced %v", first)
+	}
+	first[0] = listen[0]
+	if again := cfg.AddrsFactory(listen); again[0].String() != "/ip4/198.51.100.1/tcp/4001" {
+		t.Fatalf("announced %v after the caller modified the result", again)
+	}
+}
+
+func TestNATOptionsDefault(t *testing.T) {
+	// 缺省时只监听 TCP 端口，不使用中继和打洞
+	for _, config := range []*NATConfig{nil, {}} {
+		cfg := applyNAT(t, config, false)
+		if cfg.Relay || cfg.EnableAutoRelay || cfg.EnableRelayService || cfg.EnableHolePunching ||
+			cfg.NATManager != nil || cfg.AutoNATConfig.EnableService || cfg.AutoNATConfig.ForceReachability != nil ||
+			cfg.AddrsFactory != nil {
+			t.Fatalf("config %+v enabled NAT traversal", config)
+		}
+		if addrs := listenAddrs(cfg); !slices.Equal(addrs, []string{"/ip4/0.0.0.0/tcp/4001"}) {
+			t.Fatalf("listening on %v", addrs)
+		}
+	}
+}
+
+func TestNATOptionsRelayAndHolePunching(t *testing.T) {
+	// 没有固定中继时从路由表中寻找中继
+	cfg := applyNAT(t, &NATConfig{Relay: true}, false)
+	if !cfg.Relay || !cfg.EnableAutoRelay || cfg.EnableRelayService || cfg.EnableHolePunching {
+		t.Fatalf("relay client: relay %v, auto relay %v, service %v, hole punching %v",
+			cfg.Relay, cfg.EnableAutoRelay, cfg.EnableRelayService, cfg.EnableHolePunching)
+	}
+	cfg = applyNAT(t, &NATConfig{Relay: true, StaticRelays: []string{testRelay}}, false)
+	if !cfg.EnableAutoRelay || len(cfg.AutoRelayOpts) == 0 {
+		t.Fatal("static relays not used")
+	}
+
+	// 打洞同时监听 QUIC，不加密时 QUIC 不可用
+	cfg = applyNAT(t, &NATConfig{Relay: true, HolePunching: true, UPnP: true}, false)
+	if !cfg.EnableHolePunching || cfg.NATManager == nil {
+		t.Fatalf("hole punching %v, port mapping %v", cfg.EnableHolePunching, cfg.NATManager != nil)
+	}
+	want := []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}
+	if addrs := listenAddrs(cfg); !slices.Equal(addrs, want) {
+		t.Fatalf("listening on %v, want %v", addrs, want)
+	}
+	cfg = applyNAT(t, &NATConfig{Relay: true, HolePunching: true}, true)
+	if addrs := listenAddrs(cfg); !slices.Equal(addrs, want[:1]) {
+		t.Fatalf("insecure host listening on %v, want %v", addrs, want[:1])
+	}
+
+	// 公网节点为其他节点提供中继和可达性检测，不需要自己使用中继
+	cfg = applyNAT(t, &NATConfig{RelayService: true, AutoNAT: true, Reachability: "public"}, false)
+	if cfg.Relay || cfg.EnableAutoRelay || !cfg.EnableRelayService || !cfg.AutoNATConfig.EnableService {
+		t.Fatalf("public node: relay %v, auto relay %v, service %v, AutoNAT %v",
+			cfg.Relay, cfg.EnableAutoRelay, cfg.EnableRelayService, cfg.AutoNATConfig.EnableService)
+	}
+	if r := cfg.AutoNATConfig.ForceReachability; r == nil || *r != network.ReachabilityPublic {
+		t.Fatalf("reachability %v, want public", r)
+	}
+}
+
+func TestNATOptionsInvalid(t *testing.T) {
+	for name, config := range map[string]*NATConfig{
+		"hole punching without relay": {HolePunching: true},
+		"unknown reachability":        {Reachability: "sometimes"},
+		"invalid relay address":       {Relay: true, StaticRelays: []string{"not an address"}},
+		"relay without peer id":       {Relay: true, StaticRelays: []string{"/ip4/203.0.113.7/tcp/4001"}},
+		"invalid announce address":    {AnnounceAddrs: []string{"/ip4/300.0.0.1/tcp/4001"}},
+	} {
+		if _, err := config.options(4001, false, &relayPeers{}); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	// 没有开启中继客户端时不检查固定中继
+	if _, err := (&NATConfig{StaticRelays: []string{"not an address"}}).options(4001, false, &relayPeers{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// DHT 创建之前没有候选的中继
+	count := 0
+	for range (&relayPeers{}).source(context.Background(), 5) {
+		count++
+	}
+	if count != 0 {
+		t.Fatalf("%d relay candidates before the DHT exists", count)
+	}
+}
+
+func TestRankAddrs(t *testing.T) {
+	parse := func(addrs ...string) []multiaddr.Multiaddr {
+		maddrs := make([]multiaddr.Multiaddr, 0, len(addrs))
+		for _, s := range addrs {
+			maddrs = append(maddrs, multiaddr.StringCast(s))
+		}
+		return maddrs
+	}
+	const (
+		loopback = "/ip4/127.0.0.1/tcp/4001"
+		private  = "/ip4/192.168.1.2/tcp/4001"
+		public   = "/ip4/198.51.100.1/tcp/4001"
+		relayed  = testRelay + "/p2p-circuit"
+	)
+	addrs := parse(loopback, relayed, private, public)
+	for _, tc := range []struct {
+		reachability network.Reachability
+		want         []string
+	}{
+		{network.ReachabilityPrivate, []string{public, relayed, private, loopback}},
+		{network.ReachabilityPublic, []string{public, private, loopback, relayed}},
+		{network.ReachabilityUnknown, []string{public, private, loopback, relayed}},
+	} {
+		got := rankAddrs(addrs, tc.reachability)
+		ranked := make([]string, 0, len(got))
+		for _, addr := range got {
+			ranked = append(ranked, addr.String())
+		}
+		if !slices.Equal(ranked, tc.want) {
+			t.Errorf("%s: ranked %v, want %v", tc.reachability, ranked, tc.want)
+		}
+	}
+	// 排序不修改参数
+	if addrs[0].String() != loopback {
+		t.Fatal("rankAddrs sorted its argument")
+	}
+}
@@ -0,0 +1,166 @@
+package DHT
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 节点评分: 每次文件传输记录对方节点的延迟、吞吐量和成败，下载的数据块与叶子哈希不一致时记录一次不一致。
+// 评分是可靠性除以传输一个参考大小的数据块的预计时间，没有记录的节点取中等的评分，
+// 因此新节点仍有机会被选中，而经常失败、返回错误数据或很慢的节点排在后面。
+
+const (
+	// scoreAlpha 是延迟和吞吐量的指数移动平均的权重
+	scoreAlpha = 0.3
+	// scoreWindow 是成败次数的上限，超过后减半，使较早的记录逐渐失去作用
+	scoreWindow = 100
+	// scoreChunkSize 是估计传输时间时使用的数据块大小
+	scoreChunkSize = 1024 * 1024
+)
+
+// ErrFileNotFound 表示对方节点没有请求的文件，这不算作对方的失败
+var ErrFileNotFound = errors.New("peer does not have the file")
+
+// PeerScore 是一个节点的传输记录
+type PeerScore struct {
+	Successes  int
+	Failures   int
+	Mismatches int           // 下载的内容与哈希不一致的次数
+	Latency    time.Duration // 建立流的时间
+	Throughput float64       // 字节每秒，为0时没有记录
+	LastUsed   time.Time
+	LastError  string
+}
+
+// Value 返回节点的评分，越大越好
+func (s PeerScore) Value() float64 {
+	reliability := float64(s.Successes+1) / float64(s.Successes+s.Failures+2) / float64(1+s.Mismatches)
+	expected := s.Latency.Seconds()
+	if s.Throughput > 0 {
+		expected += scoreChunkSize / s.Throughput
+	}
+	return reliability / (1 + expected)
+}
+
+// peerScores 保存所有节点的传输记录
+type peerScores struct {
+	mu     sync.Mutex
+	scores map[peer.ID]*PeerScore
+}
+
+func newPeerScores() *peerScores {
+	return &peerScores{scores: make(map[peer.ID]*PeerScore)}
+}
+
+// get 返回节点的记录，不存在时创建，调用时需要持有锁
+func (p *peerScores) get(id peer.ID) *PeerScore {
+	s, exists := p.scores[id]
+	if !exists {
+		s = &PeerScore{}
+		p.scores[id] = s
+	}
+	s.LastUsed = time.Now()
+	return s
+}
+
+// record 记录一次传输
+// 参数:
+//   - ctx: 传输的上下文，被取消的传输不记录
+//   - id: 对方节点
+//   - latency: 建立流的时间，流没有建立时为0
+//   - bytes: 传输的字节数
+//   - elapsed: 流建立之后传输数据的时间
+//   - err: 传输的错误，ErrFileNotFound 只记录延迟
+func (p *peerScores) record(ctx context.Context, id peer.ID, latency time.Duration, bytes int64, elapsed time.Duration, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.get(id)
+	if latency > 0 {
+		s.Latency = ewma(s.Latency, latency)
+	}
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		return
+	case err != nil:
+		s.Failures++
+		s.LastError = err.Error()
+	default:
+		s.Successes++
+		if bytes > 0 && elapsed > 0 {
+			throughput := float64(bytes) / elapsed.Seconds()
+			if s.Throughput == 0 {
+				s.Throughput = throughput
+			} else {
+				s.Throughput = scoreAlpha*throughput + (1-scoreAlpha)*s.Throughput
+			}
+		}
+	}
+	if s.Successes+s.Failures > scoreWindow {
+		s.Successes /= 2
+		s.Failures /= 2
+	}
+}
+
+// ewma 返回加入新样本后的延迟平均值
+func ewma(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(scoreAlpha*float64(sample) + (1-scoreAlpha)*float64(avg))
+}
+
+// RecordMismatch 记录从节点 id 下载的内容与哈希不一致
+func (d *DHTService) RecordMismatch(id peer.ID) {
+	d.scores.mu.Lock()
+	defer d.scores.mu.Unlock()
+	s := d.scores.get(id)
+	s.Mismatches++
+	s.LastError = "content does not match its hash"
+}
+
+// RecordResult 记录与节点 id 一次传输之外的交互的成败，例如存储证明挑战，
+// 挑战失败说明节点可能没有保存数据块，和传输失败一样降低它的评分
+func (d *DHTService) RecordResult(id peer.ID, err error) {
+	d.scores.record(context.Background(), id, 0, 0, 0, err)
+}
+
+// PeerScores 返回所有有传输记录的节点
+func (d *DHTService) PeerScores() map[peer.ID]PeerScore {
+	d.scores.mu.Lock()
+	defer d.scores.mu.Unlock()
+	res := make(map[peer.ID]PeerScore, len(d.scores.scores))
+	for id, s := range d.scores.scores {
+		res[id] = *s
+	}
+	return res
+}
+
+// RankPeers 按评分从高到低排列节点，评分相同的节点保持原来的顺序
+// 参数:
+//   - peers: 候选节点，例如 GetClosestPeers 的结果
+//
+// 返回值:
+//   - []peer.ID: 排序后的新切片
+func (d *DHTService) RankPeers(peers []peer.ID) []peer.ID {
+	d.scores.mu.Lock()
+	values := make(map[peer.ID]float64, len(peers))
+	for _, id := range peers {
+		s, exists := d.scores.scores[id]
+		if !exists {
+			s = &PeerScore{}
+		}
+		values[id] = s.Value()
+	}
+	d.scores.mu.Unlock()
+
+	res := append([]peer.ID{}, peers...)
+	sort.SliceStable(res, func(i, j int) bool { return values[res[i]] > values[res[j]] })
+	return res
+}
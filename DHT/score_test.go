@@ -0,0 +1,127 @@
+package DHT
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"slices"
+	"testing"
+	"time"
+)
+
+var errTransfer = errors.New("stream reset")
+
+// newScoredService 返回只有评分的 DHTService
+func newScoredService() *DHTService {
+	return &DHTService{scores: newPeerScores()}
+}
+
+// transfers 为节点记录 n 次传输，每次 1MB，延迟和传输时间分别为 latency 和 elapsed
+func (d *DHTService) transfers(id peer.ID, n int, latency, elapsed time.Duration, err error) {
+	for i := 0; i < n; i++ {
+		d.scores.record(context.Background(), id, latency, scoreChunkSize, elapsed, err)
+	}
+}
+
+func TestRankPeersOrder(t *testing.T) {
+	d := newScoredService()
+	d.transfers("fast", 10, 10*time.Millisecond, 100*time.Millisecond, nil)
+	d.transfers("slow", 10, 10*time.Millisecond, 5*time.Second, nil)
+	d.transfers("flaky", 5, 10*time.Millisecond, 100*time.Millisecond, nil)
+	d.transfers("flaky", 5, 10*time.Millisecond, 0, errTransfer)
+	d.transfers("failing", 10, 0, 0, errTransfer)
+	d.transfers("lying", 10, 10*time.Millisecond, 100*time.Millisecond, nil)
+	for i := 0; i < 3; i++ {
+		d.RecordMismatch("lying")
+	}
+
+	peers := []peer.ID{"failing", "lying", "slow", "unknown", "flaky", "fast"}
+	got := d.RankPeers(peers)
+	// 一半失败的节点排在未知的节点之后
+	want := []peer.ID{"fast", "unknown", "flaky", "lying", "slow", "failing"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ranked %v, want %v", got, want)
+	}
+	// 排序不修改参数
+	if peers[0] != "failing" {
+		t.Fatal("RankPeers sorted its argument")
+	}
+
+	scores := d.PeerScores()
+	if s := scores["flaky"]; s.Successes != 5 || s.Failures != 5 || s.LastError != errTransfer.Error() {
+		t.Fatalf("flaky %+v", s)
+	}
+	if s := scores["lying"]; s.Mismatches != 3 {
+		t.Fatalf("lying %+v", s)
+	}
+	if _, exists := scores["unknown"]; exists {
+		t.Fatal("ranking created a record")
+	}
+}
+
+func TestRankPeersUnknownNotStarved(t *testing.T) {
+	d := newScoredService()
+	// 一个一般的已知节点不会把新节点挤到最后，新节点排在出过错的节点前面
+	d.transfers("known", 3, 50*time.Millisecond, time.Second, nil)
+	d.transfers("known", 1, 50*time.Millisecond, 0, errTransfer)
+	got := d.RankPeers([]peer.ID{"known", "new"})
+	if got[0] != "new" {
+		t.Fatalf("ranked %v, want the unknown peer first", got)
+	}
+
+	// 评分相同的节点保持原来的顺序，全部未知时不改变候选的顺序
+	peers := []peer.ID{"c", "a", "b"}
+	if got := d.RankPeers(peers); !slices.Equal(got, peers) {
+		t.Fatalf("ranked %v, want %v", got, peers)
+	}
+
+	// 没有找到文件只记录延迟，不算作失败
+	d.scores.record(context.Background(), "missing", 10*time.Millisecond, 0, 0, ErrFileNotFound)
+	if s := d.PeerScores()["missing"]; s.Failures != 0 || s.Successes != 0 || s.Latency != 10*time.Millisecond {
+		t.Fatalf("missing %+v", s)
+	}
+	// 被取消的传输不记录
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.scores.record(ctx, "cancelled", 0, 0, 0, context.Canceled)
+	if _, exists := d.PeerScores()["cancelled"]; exists {
+		t.Fatal("cancelled transfer recorded")
+	}
+}
+
+func TestScoreDecay(t *testing.T) {
+	d := newScoredService()
+	d.transfers("recovering", scoreWindow, 10*time.Millisecond, 0, errTransfer)
+	if got := d.RankPeers([]peer.ID{"recovering", "unknown"}); got[0] != "unknown" {
+		t.Fatalf("ranked %v after failures", got)
+	}
+
+	// 成败次数超过窗口后减半，较早的失败逐渐失去作用，节点在一个窗口之内恢复
+	recovered := 0
+	for i := 1; i <= scoreWindow; i++ {
+		d.transfers("recovering", 1, 10*time.Millisecond, 100*time.Millisecond, nil)
+		s := d.PeerScores()["recovering"]
+		if s.Successes+s.Failures > scoreWindow {
+			t.Fatalf("%d records kept, window is %d", s.Successes+s.Failures, scoreWindow)
+		}
+		if d.RankPeers([]peer.ID{"unknown", "recovering"})[0] == "recovering" {
+			recovered = i
+			break
+		}
+	}
+	if recovered == 0 {
+		t.Fatalf("peer not recovered after %d successes", scoreWindow)
+	}
+
+	// 延迟和吞吐量是移动平均，新的样本逐渐取代旧的
+	d.transfers("moving", 1, 100*time.Millisecond, 10*time.Second, nil)
+	before := d.PeerScores()["moving"]
+	d.transfers("moving", 20, 10*time.Millisecond, 100*time.Millisecond, nil)
+	after := d.PeerScores()["moving"]
+	if after.Latency >= before.Latency || after.Latency > 11*time.Millisecond {
+		t.Fatalf("latency %v after %v", after.Latency, before.Latency)
+	}
+	if after.Throughput <= before.Throughput || after.Throughput < 0.99*scoreChunkSize/0.1 {
+		t.Fatalf("throughput %.0f after %.0f", after.Throughput, before.Throughput)
+	}
+}
@@ -0,0 +1,121 @@
+package DHT
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// TrapdoorProtocol 是门限协作的协议，2.0.0 起承诺为 FROST 的两个点 D_i || E_i
+const TrapdoorProtocol = "/Trapdoor/2.0.0"
+
+const (
+	// TrapdoorCommit 是门限协作的第一轮，参与者返回随机数承诺
+	TrapdoorCommit = "commit"
+	// TrapdoorSign 是门限协作的第二轮，参与者返回部分结果
+	TrapdoorSign = "sign"
+
+	// TrapdoorCollision 表示为更新后的文件生成变色龙哈希碰撞
+	TrapdoorCollision = "collision"
+	// TrapdoorSchnorr 表示对 metadata 生成 Schnorr 签名
+	TrapdoorSchnorr = "schnorr"
+)
+
+// TrapdoorRequest 是协调者发给变色龙私钥分片持有者的请求
+type TrapdoorRequest struct {
+	Round   string `json:"round"`   // TrapdoorCommit 或 TrapdoorSign
+	Kind    string `json:"kind"`    // TrapdoorCollision 或 TrapdoorSchnorr
+	Session string `json:"session"` // 同一次协作的两轮请求使用相同的会话
+	PubKey  []byte `json:"pubKey"`  // 变色龙公钥，用于选择分片
+
+	// 第二轮中所有参与者的分片编号和对应的承诺
+	Indices     []int    `json:"indices,omitempty"`
+	Commitments [][]byte `json:"commitments,omitempty"`
+
+	// TrapdoorCollision: 旧消息及其随机数、根哈希和新消息
+	Message    []byte `json:"message,omitempty"`
+	RandomNum  []byte `json:"randomNum,omitempty"`
+	RootHash   []byte `json:"rootHash,omitempty"`
+	NewMessage []byte `json:"newMessage,omitempty"`
+
+	// TrapdoorSchnorr: 要签名的 metadata
+	MetaData *MetaData `json:"metaData,omitempty"`
+}
+
+// TrapdoorResponse 是分片持有者的应答
+type TrapdoorResponse struct {
+	Index      int    `json:"index"`
+	Threshold  int    `json:"threshold"`
+	Commitment []byte `json:"commitment,omitempty"` // 第一轮的承诺 D_i || E_i
+	Partial    []byte `json:"partial,omitempty"`    // 第二轮的部分结果 s_i
+	Error      string `json:"error,omitempty"`
+}
+
+// TrapdoorSigner 使用本地的分片应答协调者的请求
+type TrapdoorSigner func(from peer.ID, req *TrapdoorRequest) (*TrapdoorResponse, error)
+
+// Trapdoor 向分片持有者发送一轮门限协作请求
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - target: 分片持有者
+//   - req: 请求内容
+//
+// 返回值:
+//   - *TrapdoorResponse: 分片持有者的应答
+//   - error: 错误信息
+func (d *DHTService) Trapdoor(ctx context.Context, target peer.ID, req *TrapdoorRequest) (*TrapdoorResponse, error) {
+	s, err := d.Host.NewStream(ctx, target, TrapdoorProtocol)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open trapdoor stream: %w", err)
+	}
+	defer s.Close()
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to send trapdoor request: %w", err)
+	}
+
+	var resp TrapdoorResponse
+	if err := json.NewDecoder(bufio.NewReader(s)).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, xerrors.Errorf("failed to read trapdoor response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// TrapdoorHandler 处理门限协作请求
+// 参数:
+//   - ctx: 上下文，用于控制生命周期
+//   - signer: 使用本地分片生成应答的函数
+func (d *DHTService) TrapdoorHandler(ctx context.Context, signer TrapdoorSigner) {
+	d.Host.SetStreamHandler(TrapdoorProtocol, func(s network.Stream) {
+		var req TrapdoorRequest
+		if err := json.NewDecoder(bufio.NewReader(s)).Decode(&req); err != nil {
+			logrus.WithError(err).Error("Can not read trapdoor request")
+			s.Reset()
+			return
+		}
+		from := s.Conn().RemotePeer()
+		logrus.Infof("Received trapdoor %s %s request from %s", req.Kind, req.Round, from)
+
+		resp, err := signer(from, &req)
+		if err != nil {
+			logrus.WithError(err).Error("Can not answer trapdoor request")
+			resp = &TrapdoorResponse{Error: err.Error()}
+		}
+		if err := json.NewEncoder(s).Encode(resp); err != nil {
+			logrus.WithError(err).Error("Can not send trapdoor response")
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+}
@@ -13,7 +13,9 @@ import (
 
 // makeBasicHost creates a LibP2P host with a random peer ID listening on the
 // given multiaddress. It won't encrypt the connection if insecure is true.
-func newBasicHost(listenPort int, insecure bool, randseed int64) (host.Host, error) {
+// The NAT traversal features are enabled by nat, relays supplies the candidate
+// relays when no static relay is configured.
+func newBasicHost(listenPort int, insecure bool, randseed int64, nat *NATConfig, relays *relayPeers) (host.Host, error) {
 	var r io.Reader
 	if randseed == 0 {
 		r = rand.Reader
@@ -28,11 +30,11 @@ func newBasicHost(listenPort int, insecure bool, randseed int64) (host.Host, err
 		return nil, err
 	}
 
-	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", listenPort)),
-		libp2p.Identity(priv),
-		libp2p.DisableRelay(),
+	opts, err := nat.options(listenPort, insecure, relays)
+	if err != nil {
+		return nil, err
 	}
+	opts = append(opts, libp2p.Identity(priv))
 
 	if insecure {
 		opts = append(opts, libp2p.NoSecurity)
@@ -0,0 +1,239 @@
+package challenge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"main/manager"
+	"main/registry"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 挑战结果通过 metadata 后端的 PutRecord 保存在文件根哈希的16进制字符串下，
+// norn 后端写入链上，本地后端写入 registry 目录。键的格式:
+//   - challenge/<peerID>        该节点针对此文件最新的挑战结果
+//   - challenge/<peerID>/<seq>  该节点针对此文件的第 seq 次挑战结果，seq 从1开始
+const anchorKeyPrefix = "challenge/"
+
+const (
+	// anchorSeqPrefix 是本地为每个文件和节点分配的最后一个序号: anchorSeq/<rootHash>/<peerID>
+	anchorSeqPrefix = "anchorSeq/"
+	// anchorQueuePrefix 是等待上链的挑战结果: anchorQueue/<rootHash>/<peerID>/<seq>
+	anchorQueuePrefix = "anchorQueue/"
+	// anchorRetryInterval 是提交失败后重试的间隔
+	anchorRetryInterval = time.Minute
+)
+
+var (
+	// anchorLock 保证同一个序号只分配一次
+	anchorLock sync.Mutex
+	// anchorWake 通知 RunAnchorer 有新的挑战结果排队
+	anchorWake = make(chan struct{}, 1)
+)
+
+// AnchorRecord 是保存到 metadata 后端的挑战结果
+type AnchorRecord struct {
+	Seq         uint64 `json:"seq"`
+	Challenger  string `json:"challenger"`
+	Peer        string `json:"peer"`
+	RootHash    string `json:"rootHash"`
+	LeafIndex   uint64 `json:"leafIndex"`
+	Passed      bool   `json:"passed"`
+	ProofDigest string `json:"proofDigest"`
+	Height      uint64 `json:"height"` // 提交挑战结果时的区块高度，本地后端为0
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// AnchorKey 返回节点最新挑战结果的键
+func AnchorKey(p peer.ID) string {
+	return anchorKeyPrefix + p.String()
+}
+
+// AnchorHistoryKey 返回节点第 seq 次挑战结果的键
+func AnchorHistoryKey(p peer.ID, seq uint64) string {
+	return fmt.Sprintf("%s%s/%d", anchorKeyPrefix, p, seq)
+}
+
+// proofDigest 计算挑战应答的摘要，链上只保存摘要而不保存完整的证明
+func proofDigest(resp *dht.ChallengeResponse) []byte {
+	h := sha256.New()
+	h.Write(resp.LeafHash)
+	h.Write(resp.NonceHash)
+	h.Write(resp.Proof)
+	return h.Sum(nil)
+}
+
+// nextSeq 分配节点针对此文件的下一个挑战序号。
+// 序号由本地数据库中的计数器递增，不依赖后端的最新记录：上一次挑战的交易还未上链时，链上读到的序号会被重复使用。
+// 本地没有计数器时（例如数据库是新建的）从后端最新的记录继续。调用者需要持有 anchorLock
+func nextSeq(ctx context.Context, rootHash []byte, p peer.ID) (uint64, error) {
+	dbManager := manager.GetDBManager()
+	key := fmt.Sprintf("%s%x/%s", anchorSeqPrefix, rootHash, p)
+	var seq uint64
+	if err := dbManager.LoadFromMemory(key, &seq); err != nil {
+		latest, err := ReadAnchor(ctx, rootHash, p, 0)
+		if err == nil {
+			seq = latest.Seq
+		} else if !errors.Is(err, registry.ErrNotFound) {
+			return 0, err
+		}
+	}
+	seq++
+	if err := dbManager.SaveToMemory(key, seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// QueueAnchor 为一次挑战结果分配序号并放入上链队列，由 RunAnchorer 在后台提交，挑战本身不等待链上交易
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - result: 挑战结果。
+// 返回值:
+// - *AnchorRecord: 排队的记录，Height 在提交时才确定。
+// - error: 如果分配序号或保存失败，返回错误信息。
+func QueueAnchor(ctx context.Context, result *Result) (*AnchorRecord, error) {
+	anchorLock.Lock()
+	defer anchorLock.Unlock()
+
+	seq, err := nextSeq(ctx, result.RootHash, result.Peer)
+	if err != nil {
+		return nil, err
+	}
+	record := &AnchorRecord{
+		Seq:         seq,
+		Challenger:  manager.GetDHTService().Host.ID().String(),
+		Peer:        result.Peer.String(),
+		RootHash:    hex.EncodeToString(result.RootHash),
+		LeafIndex:   result.LeafIndex,
+		Passed:      result.Passed,
+		ProofDigest: hex.EncodeToString(result.ProofDigest),
+		Timestamp:   time.Now().Unix(),
+	}
+	key := fmt.Sprintf("%s%s/%s/%d", anchorQueuePrefix, record.RootHash, record.Peer, seq)
+	if err := manager.GetDBManager().SaveToMemory(key, record); err != nil {
+		return nil, err
+	}
+	select {
+	case anchorWake <- struct{}{}:
+	default:
+	}
+	return record, nil
+}
+
+// Anchor 将一个挑战结果提交到 metadata 后端，同时写入历史记录和最新记录
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - record: 排队的记录，提交前填入后端当前的区块高度。
+// 返回值:
+// - error: 如果提交失败，返回错误信息。
+func Anchor(ctx context.Context, record *AnchorRecord) error {
+	backend := manager.GetRegistry()
+	if backend == nil {
+		return errors.New("metadata registry not initialized")
+	}
+	p, err := peer.Decode(record.Peer)
+	if err != nil {
+		return err
+	}
+
+	record.Height, err = backend.Height(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{AnchorHistoryKey(p, record.Seq), AnchorKey(p)} {
+		if err := backend.PutRecord(ctx, record.RootHash, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushAnchors 按序号依次提交队列中的挑战结果，提交成功后移出队列。
+// 遇到失败时停止，保证同一个节点的最新记录不会被较早的结果覆盖
+func flushAnchors(ctx context.Context) error {
+	dbManager := manager.GetDBManager()
+	keys, err := dbManager.ListKeys(anchorQueuePrefix)
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]*AnchorRecord, len(keys))
+	for _, key := range keys {
+		var record AnchorRecord
+		if err := dbManager.LoadFromMemory(key, &record); err != nil {
+			return err
+		}
+		queued[key] = &record
+	}
+	sort.Slice(keys, func(i, j int) bool { return queued[keys[i]].Seq < queued[keys[j]].Seq })
+
+	for _, key := range keys {
+		if err := Anchor(ctx, queued[key]); err != nil {
+			return fmt.Errorf("anchor record %d of %s: %w", queued[key].Seq, queued[key].Peer, err)
+		}
+		if err := dbManager.DeleteFromMemory(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunAnchorer 在后台提交排队的挑战结果，有新的结果时立即提交，失败时每隔 anchorRetryInterval 重试，直到 ctx 结束
+func RunAnchorer(ctx context.Context) {
+	ticker := time.NewTicker(anchorRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := flushAnchors(ctx); err != nil {
+			logrus.Errorf("Anchor challenge results failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-anchorWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReadAnchor 从 metadata 后端读取挑战结果
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - rootHash: 文件根哈希。
+// - p: 被挑战的节点。
+// - seq: 第几次挑战，为0时读取最新的结果。
+// 返回值:
+// - *AnchorRecord: 挑战结果。
+// - error: 后端没有记录时返回 registry.ErrNotFound。
+func ReadAnchor(ctx context.Context, rootHash []byte, p peer.ID, seq uint64) (*AnchorRecord, error) {
+	backend := manager.GetRegistry()
+	if backend == nil {
+		return nil, errors.New("metadata registry not initialized")
+	}
+	key := AnchorKey(p)
+	if seq != 0 {
+		key = AnchorHistoryKey(p, seq)
+	}
+	data, err := backend.GetRecord(ctx, hex.EncodeToString(rootHash), key)
+	if err != nil {
+		return nil, err
+	}
+	var record AnchorRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid challenge record %s: %v", key, err)
+	}
+	return &record, nil
+}
@@ -0,0 +1,381 @@
+package challenge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/manager"
+	"main/resolver"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pendingPrefix 是预先计算好的挑战在数据库中的键前缀: challenge/<rootHash>/<leafIndex>/<nonce>
+	pendingPrefix = "challenge/"
+	// statsPrefix 是每个节点挑战结果在数据库中的键前缀: challengeStats/<peerID>
+	statsPrefix = "challengeStats/"
+
+	nonceSize = 32
+)
+
+// Config 是配置文件中的 Challenge 部分
+type Config struct {
+	Dir      string        `yaml:"Dir"`      // 应答挑战时读取数据块的目录，应与保存收到的数据块的目录相同
+	Interval time.Duration `yaml:"Interval"` // 发起挑战的间隔
+}
+
+// DefaultConfig 返回默认的配置
+func DefaultConfig() *Config {
+	return &Config{
+		Dir:      "data",
+		Interval: 10 * time.Minute,
+	}
+}
+
+// WithDefaults 用默认值补全缺省的字段
+func (config *Config) WithDefaults() *Config {
+	res := DefaultConfig()
+	if config == nil {
+		return res
+	}
+	if config.Dir != "" {
+		res.Dir = config.Dir
+	}
+	if config.Interval > 0 {
+		res.Interval = config.Interval
+	}
+	return res
+}
+
+// PendingChallenge 是发送文件时预先计算好的挑战，每个挑战只使用一次
+type PendingChallenge struct {
+	RootHash  []byte `json:"rootHash"`
+	LeafIndex uint64 `json:"leafIndex"`
+	LeafHash  []byte `json:"leafHash"`
+	Nonce     []byte `json:"nonce"`
+	Expected  []byte `json:"expected"` // sha256(nonce || 数据块)
+}
+
+// PeerStats 记录对一个节点的挑战结果
+type PeerStats struct {
+	Passed        int       `json:"passed"`
+	Failed        int       `json:"failed"`
+	LastPassed    bool      `json:"lastPassed"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastChallenge time.Time `json:"lastChallenge"`
+}
+
+// Result 是一次挑战的结果
+type Result struct {
+	Peer        peer.ID
+	RootHash    []byte
+	LeafIndex   uint64
+	Passed      bool
+	Err         error
+	ProofDigest []byte        // 应答的摘要，节点没有应答时为空
+	Anchor      *AnchorRecord // 排队上链的记录，由 RunAnchorer 在后台提交，排队失败时为 nil
+}
+
+// nonceHash 计算 sha256(nonce || chunk)
+func nonceHash(nonce, chunk []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+// Prepare 在发送文件时为一个数据块预先计算 count 个挑战。
+// 文件所有者不保存数据块本身，因此必须在仍持有数据时算好期望的应答。
+// 参数:
+// - rootHash: 文件的根哈希。
+// - leafIndex: 数据块的下标。
+// - chunk: 数据块内容。
+// - count: 挑战个数。
+// 返回值:
+// - error: 如果保存失败，返回错误信息。
+func Prepare(rootHash []byte, leafIndex int, chunk []byte, count int) error {
+	leafHash := sha256.Sum256(chunk)
+	for i := 0; i < count; i++ {
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		pending := &PendingChallenge{
+			RootHash:  rootHash,
+			LeafIndex: uint64(leafIndex),
+			LeafHash:  leafHash[:],
+			Nonce:     nonce,
+			Expected:  nonceHash(nonce, chunk),
+		}
+		key := fmt.Sprintf("%s%x/%d/%x", pendingPrefix, rootHash, leafIndex, nonce)
+		if err := manager.GetDBManager().SaveToMemory(key, pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard 删除一个文件所有未使用的挑战，文件内容更新后旧数据块的挑战不再有效
+func Discard(rootHash []byte) error {
+	return DiscardFrom(rootHash, 0)
+}
+
+// DiscardFrom 删除一个文件从第 first 个数据块开始的未使用的挑战，
+// 追加或截断文件时前面的数据块没有改变，它们的挑战仍然有效
+func DiscardFrom(rootHash []byte, first int) error {
+	dbManager := manager.GetDBManager()
+	prefix := fmt.Sprintf("%s%x/", pendingPrefix, rootHash)
+	keys, err := dbManager.ListKeys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		index, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		if leafIndex, err := strconv.Atoi(index); err == nil && leafIndex < first {
+			continue
+		}
+		if err := dbManager.DeleteFromMemory(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTree 获取 rootHash 对应的 metadata 并重建默克尔树
+func loadTree(ctx context.Context, rootHash []byte) (*chamMerkleTree.MerkleNode, *chamMerkleTree.ChameleonRandomNum, *chamMerkleTree.ChameleomPubKey, error) {
+	metaData, err := resolver.Resolve(ctx, hex.EncodeToString(rootHash))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("metadata of %x not found: %v", rootHash, err)
+	}
+	return chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData)
+}
+
+// Prover 返回存储节点使用的挑战应答函数，数据块从 path 目录读取
+func Prover(ctx context.Context, path string) dht.ChallengeProver {
+	return func(req *dht.ChallengeRequest) (*dht.ChallengeResponse, error) {
+		root, _, _, err := loadTree(ctx, req.RootHash)
+		if err != nil {
+			return nil, err
+		}
+		proof, err := chamMerkleTree.GenerateMerkleProofByIndex(root, int(req.LeafIndex))
+		if err != nil {
+			return nil, err
+		}
+		leaves := chamMerkleTree.GetAllLeavesHashes(root)
+		chunk, err := dht.ReadChunk(path, hex.EncodeToString(leaves[req.LeafIndex]))
+		if err != nil {
+			return nil, fmt.Errorf("split %x not stored", leaves[req.LeafIndex])
+		}
+		proofBytes, err := proof.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		leafHash := sha256.Sum256(chunk)
+		return &dht.ChallengeResponse{
+			LeafHash:  leafHash[:],
+			NonceHash: nonceHash(req.Nonce, chunk),
+			Proof:     proofBytes,
+		}, nil
+	}
+}
+
+// RegisterHandler 注册挑战协议的处理函数
+func RegisterHandler(ctx context.Context, path string) {
+	manager.GetDHTService().ChallengeHandler(ctx, Prover(ctx, path))
+}
+
+// Verify 验证存储节点对预先计算的挑战的应答
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - pending: 预先计算的挑战。
+// - resp: 存储节点的应答。
+// 返回值:
+// - error: 应答无效时返回原因，有效时返回 nil。
+func Verify(ctx context.Context, pending *PendingChallenge, resp *dht.ChallengeResponse) error {
+	if !bytes.Equal(resp.LeafHash, pending.LeafHash) {
+		return errors.New("leaf hash mismatch")
+	}
+	if !bytes.Equal(resp.NonceHash, pending.Expected) {
+		return errors.New("nonce hash mismatch")
+	}
+	var proof chamMerkleTree.MerkleProof
+	if err := proof.UnmarshalBinary(resp.Proof); err != nil {
+		return err
+	}
+	if proof.LeafIndex != pending.LeafIndex {
+		return fmt.Errorf("proof for leaf %d, want %d", proof.LeafIndex, pending.LeafIndex)
+	}
+	root, randomNum, pubKey, err := loadTree(ctx, pending.RootHash)
+	if err != nil {
+		return err
+	}
+	if proof.TreeSize != uint64(len(chamMerkleTree.GetAllLeavesHashes(root))) {
+		return fmt.Errorf("proof for tree size %d", proof.TreeSize)
+	}
+	height := 0
+	if proof.Subtree != nil {
+		height = int(proof.Subtree.Height)
+	}
+	if height != root.SubtreeHeight {
+		return fmt.Errorf("proof for subtree height %d, want %d", height, root.SubtreeHeight)
+	}
+	if !chamMerkleTree.VerifyMerkleProofByIndex(root.Hash, resp.LeafHash, &proof, pubKey, randomNum) {
+		return errors.New("merkle proof verification failed")
+	}
+	return nil
+}
+
+// ChallengePeer 使用一个预先计算的挑战检查目标节点是否仍然持有数据块，记录结果、更新节点评分并放入上链队列
+func ChallengePeer(ctx context.Context, target peer.ID, pending *PendingChallenge) *Result {
+	result := &Result{
+		Peer:      target,
+		RootHash:  pending.RootHash,
+		LeafIndex: pending.LeafIndex,
+	}
+	resp, err := manager.GetDHTService().Challenge(ctx, target, &dht.ChallengeRequest{
+		RootHash:  pending.RootHash,
+		LeafIndex: pending.LeafIndex,
+		Nonce:     pending.Nonce,
+	})
+	if err == nil {
+		result.ProofDigest = proofDigest(resp)
+		err = Verify(ctx, pending, resp)
+	}
+	result.Passed = err == nil
+	result.Err = err
+	manager.GetDHTService().RecordResult(target, err)
+
+	if err := recordResult(result); err != nil {
+		logrus.Errorf("Save challenge result of %s failed: %v", target, err)
+	}
+	result.Anchor, err = QueueAnchor(ctx, result)
+	if err != nil {
+		logrus.Errorf("Queue challenge result of %s for anchoring failed: %v", target, err)
+	}
+	return result
+}
+
+// recordResult 将挑战结果累加到节点的统计中
+func recordResult(result *Result) error {
+	stats, err := GetPeerStats(result.Peer)
+	if err != nil {
+		stats = &PeerStats{}
+	}
+	if result.Passed {
+		stats.Passed++
+		stats.LastError = ""
+	} else {
+		stats.Failed++
+		stats.LastError = result.Err.Error()
+	}
+	stats.LastPassed = result.Passed
+	stats.LastChallenge = time.Now()
+	return manager.GetDBManager().SaveToMemory(statsPrefix+result.Peer.String(), stats)
+}
+
+// GetPeerStats 读取一个节点的挑战统计
+func GetPeerStats(p peer.ID) (*PeerStats, error) {
+	var stats PeerStats
+	err := manager.GetDBManager().LoadFromMemory(statsPrefix+p.String(), &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ListPeerStats 读取所有节点的挑战统计
+func ListPeerStats() (map[string]*PeerStats, error) {
+	keys, err := manager.GetDBManager().ListKeys(statsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*PeerStats, len(keys))
+	for _, key := range keys {
+		var stats PeerStats
+		if err := manager.GetDBManager().LoadFromMemory(key, &stats); err != nil {
+			return nil, err
+		}
+		res[strings.TrimPrefix(key, statsPrefix)] = &stats
+	}
+	return res, nil
+}
+
+// RunOnce 随机选择一个未使用的挑战，向持有对应数据块的一个节点发起挑战
+// 返回值:
+// - *Result: 挑战结果，没有可用的挑战或持有者时为 nil。
+// - error: 错误信息。
+func RunOnce(ctx context.Context) (*Result, error) {
+	dbManager := manager.GetDBManager()
+	keys, err := dbManager.ListKeys(pendingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	key := keys[mrand.Intn(len(keys))]
+	var pending PendingChallenge
+	if err := dbManager.LoadFromMemory(key, &pending); err != nil {
+		return nil, err
+	}
+
+	dhtService := manager.GetDHTService()
+	providers, err := dhtService.Lookup(ctx, hex.EncodeToString(pending.LeafHash))
+	if err != nil {
+		return nil, err
+	}
+	var holders []peer.ID
+	for _, ai := range providers {
+		if ai.ID != dhtService.Host.ID() {
+			dhtService.Host.Peerstore().AddAddrs(ai.ID, ai.Addrs, time.Hour)
+			holders = append(holders, ai.ID)
+		}
+	}
+	if len(holders) == 0 {
+		return nil, nil
+	}
+
+	// 挑战一旦发出 nonce 就公开了，无论结果如何都不能再次使用
+	if err := dbManager.DeleteFromMemory(key); err != nil {
+		return nil, err
+	}
+	return ChallengePeer(ctx, holders[mrand.Intn(len(holders))], &pending), nil
+}
+
+// RunScheduler 每隔 interval 发起一次挑战，直到 ctx 结束
+func RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := RunOnce(ctx)
+			if err != nil {
+				logrus.Errorf("Storage challenge failed: %v", err)
+				continue
+			}
+			if result == nil {
+				continue
+			}
+			if result.Passed {
+				logrus.Infof("Peer %s passed storage challenge for leaf %d of %x", result.Peer, result.LeafIndex, result.RootHash)
+			} else {
+				logrus.Warnf("Peer %s failed storage challenge for leaf %d of %x: %v", result.Peer, result.LeafIndex, result.RootHash, result.Err)
+			}
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package challenge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/db"
+	"main/dhtsim"
+	"main/manager"
+	"main/registry"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	// blockSize 和 leafCount 决定测试文件的分块
+	blockSize = 1024
+	leafCount = 4
+	// perLeaf 是每个数据块预先计算的挑战个数
+	perLeaf = 2
+	// waitTimeout 是等待宣布传播或后台任务完成的最长时间
+	waitTimeout = 10 * time.Second
+)
+
+// env 是挑战测试的环境: owner 是文件所有者，holder 保存了全部数据块，empty 没有保存任何数据块。
+// 三个节点共用 manager 中的数据库和本地 metadata 后端，manager 的 DHTService 是 owner
+type env struct {
+	ctx      context.Context
+	owner    *dhtsim.Node
+	holder   *dhtsim.Node
+	empty    *dhtsim.Node
+	rootHash []byte
+	chunks   [][]byte
+}
+
+// newEnv 在模拟网络中发布一个 leafCount 个数据块的文件，为每个数据块准备 perLeaf 个挑战，
+// 并把数据块发送给 holder
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	network := dhtsim.New(ctx, t.TempDir())
+	t.Cleanup(func() { network.Close() })
+	nodes, err := network.Start(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbManager, err := db.NewDBManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := registry.NewLocalRegistry(t.TempDir(), dbManager, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevDHT, prevRegistry := manager.DBManager, manager.DHTService, manager.Registry
+	manager.DBManager, manager.DHTService, manager.Registry = dbManager, nodes[0].DHTService, backend
+	t.Cleanup(func() {
+		manager.DBManager, manager.DHTService, manager.Registry = prevDB, prevDHT, prevRegistry
+	})
+	for _, node := range nodes[1:] {
+		node.ChallengeHandler(ctx, Prover(ctx, node.Path))
+	}
+
+	e := &env{ctx: ctx, owner: nodes[0], holder: nodes[1], empty: nodes[2]}
+	data := make([]byte, leafCount*blockSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < leafCount; i++ {
+		e.chunks = append(e.chunks, data[i*blockSize:(i+1)*blockSize])
+	}
+	e.rootHash = publish(t, ctx, data)
+
+	for i, chunk := range e.chunks {
+		if err := Prepare(e.rootHash, i, chunk, perLeaf); err != nil {
+			t.Fatal(err)
+		}
+		info := peer.AddrInfo{ID: e.holder.Host.ID(), Addrs: e.holder.Host.Addrs()}
+		if err := e.owner.SendFileTo(ctx, info, leafName(chunk), dht.CodecNone, bytes.NewBuffer(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+// publish 用新生成的密钥为 data 构建默克尔树，把签名的 metadata 发布到 manager 的后端
+func publish(t *testing.T, ctx context.Context, data []byte) []byte {
+	t.Helper()
+	secKey, pubKey, err := chamMerkleTree.GenerateKeyPair(chamMerkleTree.SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config := chamMerkleTree.NewMerkleConfig()
+	config.BlockSize = blockSize
+	root, _, _, err := chamMerkleTree.BuildMerkleTree(file, config, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaData := chamMerkleTree.NewMetaData(root, pubKey, config.ChunkerParams())
+	if err := chamMerkleTree.SignMetaData(metaData, secKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.GetRegistry().Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+	return root.Hash
+}
+
+// leafName 返回数据块的名称，即叶子哈希的16进制字符串
+func leafName(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// pendingKeys 返回文件所有未使用的挑战的键
+func (e *env) pendingKeys(t *testing.T) []string {
+	t.Helper()
+	keys, err := manager.GetDBManager().ListKeys(fmt.Sprintf("%s%x/", pendingPrefix, e.rootHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// pending 读取第 leafIndex 个数据块的一个未使用的挑战
+func (e *env) pending(t *testing.T, leafIndex int) *PendingChallenge {
+	t.Helper()
+	keys, err := manager.GetDBManager().ListKeys(fmt.Sprintf("%s%x/%d/", pendingPrefix, e.rootHash, leafIndex))
+	if err != nil || len(keys) == 0 {
+		t.Fatalf("no challenge for leaf %d: %v", leafIndex, err)
+	}
+	var pending PendingChallenge
+	if err := manager.GetDBManager().LoadFromMemory(keys[0], &pending); err != nil {
+		t.Fatal(err)
+	}
+	return &pending
+}
+
+// waitFor 在 waitTimeout 内反复检查 cond，直到它返回 true
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPrepareDiscard(t *testing.T) {
+	e := newEnv(t)
+	if n := len(e.pendingKeys(t)); n != leafCount*perLeaf {
+		t.Fatalf("prepared %d challenges, want %d", n, leafCount*perLeaf)
+	}
+	for i, chunk := range e.chunks {
+		pending := e.pending(t, i)
+		if pending.LeafIndex != uint64(i) || leafName(chunk) != hex.EncodeToString(pending.LeafHash) {
+			t.Fatalf("challenge of leaf %d is for leaf %d %x", i, pending.LeafIndex, pending.LeafHash)
+		}
+		if !bytes.Equal(pending.Expected, nonceHash(pending.Nonce, chunk)) {
+			t.Fatalf("challenge of leaf %d expects a wrong answer", i)
+		}
+	}
+
+	// 追加或截断时保留前面数据块的挑战
+	if err := DiscardFrom(e.rootHash, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.pendingKeys(t)); n != 2*perLeaf {
+		t.Fatalf("%d challenges left, want %d", n, 2*perLeaf)
+	}
+	e.pending(t, 1)
+	if err := Discard(e.rootHash); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.pendingKeys(t)); n != 0 {
+		t.Fatalf("%d challenges left after discard", n)
+	}
+	if result, err := RunOnce(e.ctx); result != nil || err != nil {
+		t.Fatalf("RunOnce without challenges: %v, %v", result, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	e := newEnv(t)
+	pending := e.pending(t, 1)
+	resp, err := e.owner.Challenge(e.ctx, e.holder.Host.ID(), &dht.ChallengeRequest{
+		RootHash:  pending.RootHash,
+		LeafIndex: pending.LeafIndex,
+		Nonce:     pending.Nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(e.ctx, pending, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// 另一个数据块的应答
+	other, err := e.owner.Challenge(e.ctx, e.holder.Host.ID(), &dht.ChallengeRequest{
+		RootHash:  pending.RootHash,
+		LeafIndex: 2,
+		Nonce:     pending.Nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(resp *dht.ChallengeResponse)
+	}{
+		{"nonce hash", func(resp *dht.ChallengeResponse) { resp.NonceHash = nonceHash([]byte("other nonce"), e.chunks[1]) }},
+		{"leaf hash", func(resp *dht.ChallengeResponse) { resp.LeafHash = other.LeafHash }},
+		{"proof of another leaf", func(resp *dht.ChallengeResponse) { resp.Proof = other.Proof }},
+		{"truncated proof", func(resp *dht.ChallengeResponse) { resp.Proof = resp.Proof[:len(resp.Proof)/2] }},
+		{"tampered proof", func(resp *dht.ChallengeResponse) {
+			resp.Proof = append([]byte{}, resp.Proof...)
+			resp.Proof[len(resp.Proof)-1] ^= 1
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tampered := *resp
+			test.modify(&tampered)
+			if err := Verify(e.ctx, pending, &tampered); err == nil {
+				t.Fatal("tampered response accepted")
+			}
+		})
+	}
+}
+
+func TestChallengePeer(t *testing.T) {
+	e := newEnv(t)
+	holder, empty := e.holder.Host.ID(), e.empty.Host.ID()
+	// 发送数据块时已经记录了 holder 的传输
+	before := e.owner.PeerScores()[holder]
+
+	for i := 0; i < 2; i++ {
+		if result := ChallengePeer(e.ctx, holder, e.pending(t, i)); !result.Passed || result.Err != nil || len(result.ProofDigest) == 0 {
+			t.Fatalf("holder failed challenge %d: %v", i, result.Err)
+		}
+		if result := ChallengePeer(e.ctx, empty, e.pending(t, i)); result.Passed || result.Err == nil || result.ProofDigest != nil {
+			t.Fatalf("peer without the split passed challenge %d", i)
+		}
+	}
+
+	stats, err := ListPeerStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats[holder.String()]; s == nil || s.Passed != 2 || s.Failed != 0 || !s.LastPassed {
+		t.Fatalf("holder stats %+v", s)
+	}
+	if s := stats[empty.String()]; s == nil || s.Passed != 0 || s.Failed != 2 || s.LastPassed || s.LastError == "" {
+		t.Fatalf("failing peer stats %+v", s)
+	}
+
+	// 挑战失败的节点评分降低，排在通过挑战的节点后面
+	scores := e.owner.PeerScores()
+	if scores[empty].Failures != 2 || scores[holder].Successes != before.Successes+2 {
+		t.Fatalf("scores of holder %+v, failing peer %+v", scores[holder], scores[empty])
+	}
+	if scores[empty].Value() >= (dht.PeerScore{}).Value() {
+		t.Fatalf("failing peer scored %v, not below an unknown peer", scores[empty].Value())
+	}
+	if ranked := e.owner.RankPeers([]peer.ID{empty, holder}); ranked[0] != holder {
+		t.Fatalf("ranked %v, want holder first", ranked)
+	}
+}
+
+func TestRunOnceAndScheduler(t *testing.T) {
+	e := newEnv(t)
+	for _, chunk := range e.chunks {
+		name := leafName(chunk)
+		waitFor(t, "providers of "+name, func() bool {
+			providers, err := e.owner.Lookup(e.ctx, name)
+			return err == nil && len(providers) > 0
+		})
+	}
+
+	result, err := RunOnce(e.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Peer != e.holder.Host.ID() || !result.Passed {
+		t.Fatalf("RunOnce result %+v", result)
+	}
+	// 发出的挑战不再使用
+	if n := len(e.pendingKeys(t)); n != leafCount*perLeaf-1 {
+		t.Fatalf("%d challenges left, want %d", n, leafCount*perLeaf-1)
+	}
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	done := make(chan struct{})
+	go func() {
+		RunScheduler(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	// 恢复 manager 之前等待调度结束
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, "scheduled challenges", func() bool {
+		stats, err := GetPeerStats(e.holder.Host.ID())
+		return err == nil && stats.Passed >= 3
+	})
+}
+
+func TestAnchor(t *testing.T) {
+	e := newEnv(t)
+	holder, empty := e.holder.Host.ID(), e.empty.Host.ID()
+
+	first := ChallengePeer(e.ctx, holder, e.pending(t, 0))
+	second := ChallengePeer(e.ctx, holder, e.pending(t, 1))
+	if first.Anchor == nil || second.Anchor == nil || first.Anchor.Seq != 1 || second.Anchor.Seq != 2 {
+		t.Fatalf("queued anchors %+v, %+v", first.Anchor, second.Anchor)
+	}
+	if _, err := ReadAnchor(e.ctx, e.rootHash, holder, 0); !errors.Is(err, registry.ErrNotFound) {
+		t.Fatalf("anchor before flush: %v", err)
+	}
+	if err := flushAnchors(e.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := manager.GetDBManager().ListKeys(anchorQueuePrefix); err != nil || len(keys) != 0 {
+		t.Fatalf("anchor queue after flush: %v, %v", keys, err)
+	}
+
+	latest, err := ReadAnchor(e.ctx, e.rootHash, holder, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Seq != 2 || latest.LeafIndex != 1 || !latest.Passed || latest.Peer != holder.String() ||
+		latest.Challenger != e.owner.Host.ID().String() || latest.ProofDigest != hex.EncodeToString(second.ProofDigest) {
+		t.Fatalf("latest anchor %+v", latest)
+	}
+	history, err := ReadAnchor(e.ctx, e.rootHash, holder, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Seq != 1 || history.LeafIndex != 0 {
+		t.Fatalf("first anchor %+v", history)
+	}
+
+	// 本地计数器丢失时从后端最新的记录继续编号
+	if err := manager.GetDBManager().DeleteFromMemory(fmt.Sprintf("%s%x/%s", anchorSeqPrefix, e.rootHash, holder)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	done := make(chan struct{})
+	go func() {
+		RunAnchorer(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	third := ChallengePeer(ctx, holder, e.pending(t, 2))
+	failed := ChallengePeer(ctx, empty, e.pending(t, 2))
+	if third.Anchor == nil || third.Anchor.Seq != 3 || failed.Anchor == nil || failed.Anchor.Seq != 1 {
+		t.Fatalf("queued anchors %+v, %+v", third.Anchor, failed.Anchor)
+	}
+	waitFor(t, "background anchoring", func() bool {
+		latest, err := ReadAnchor(ctx, e.rootHash, holder, 0)
+		if err != nil || latest.Seq != 3 {
+			return false
+		}
+		record, err := ReadAnchor(ctx, e.rootHash, empty, 0)
+		return err == nil && !record.Passed && record.ProofDigest == ""
+	})
+}
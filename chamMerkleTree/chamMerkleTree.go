@@ -3,76 +3,104 @@ package chamMerkleTree
 import (
 	"bytes"
 	"container/list"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	dht "main/DHT"
-	"math/big"
 	"os"
 )
 
 // MerkleConfig 包含Merkle树的配置信息
 type MerkleConfig struct {
-	BlockSize int // 文件分块大小，默认为4MB
+	Chunker   string // 分块算法，fixed 或 fastcdc，默认为 fixed
+	BlockSize int    // fixed 分块大小，默认为4MB
+	MinSize   int    // fastcdc 最小块大小
+	AvgSize   int    // fastcdc 平均块大小
+	MaxSize   int    // fastcdc 最大块大小
+	Codec     string // 数据块的压缩算法，为空表示不压缩，压缩后没有变小的数据块不压缩
+	// SubtreeHeight 是变色龙子树的高度，不为0时每 2^SubtreeHeight 个叶子的子树根也使用变色龙哈希
+	SubtreeHeight int
 }
 
-// ChameleomPubKey 包含Chameleon哈希的公钥
+// ChameleomPubKey 包含Chameleon哈希的公钥及其所属的方案
 type ChameleomPubKey struct {
-	pubX *big.Int
-	pubY *big.Int
+	scheme ChameleonHash
+	data   []byte
 }
 
-func (pubKey *ChameleomPubKey) Serialize() []byte {
-	return append(pubKey.pubX.Bytes(), pubKey.pubY.Bytes()...)
-}
-
-func DeserializeChameleomPubKey(data []byte) *ChameleomPubKey {
-	pubXBytes := data[:32]
-	pubYBytes := data[32:]
-	return &ChameleomPubKey{
-		pubX: new(big.Int).SetBytes(pubXBytes),
-		pubY: new(big.Int).SetBytes(pubYBytes),
-	}
-}
-
-// ChameleonRandomNum 包含Chameleon哈希的随机数
+// ChameleonRandomNum 包含Chameleon哈希的随机数，编码由公钥的方案决定
 type ChameleonRandomNum struct {
-	rX *big.Int
-	rY *big.Int
-	s  *big.Int
+	data []byte
 }
 
-func (randomNum *ChameleonRandomNum) Serialize() []byte {
-	return append(append(randomNum.rX.Bytes(), randomNum.rY.Bytes()...), randomNum.s.Bytes()...)
+// GenerateChameleonKeyPair 生成 p256 方案的Chameleon哈希公私钥对
+func GenerateChameleonKeyPair() ([]byte, *ChameleomPubKey) {
+	secKey, pubKey, _ := GenerateKeyPair(SchemeP256)
+	return secKey, pubKey
 }
 
-func DeserializeChameleonRandomNum(data []byte) *ChameleonRandomNum {
-	rXBytes := data[:32]
-	rYBytes := data[32:64]
-	sBytes := data[64:]
-	return &ChameleonRandomNum{
-		rX: new(big.Int).SetBytes(rXBytes),
-		rY: new(big.Int).SetBytes(rYBytes),
-		s:  new(big.Int).SetBytes(sBytes),
+// GenerateKeyPair 生成指定方案的Chameleon哈希公私钥对
+// 参数:
+// - scheme: 方案 ID，为空表示 p256。
+// 返回值:
+// - []byte: 私钥。
+// - *ChameleomPubKey: 公钥。
+// - error: 方案未知或生成失败时返回错误信息。
+func GenerateKeyPair(scheme string) ([]byte, *ChameleomPubKey, error) {
+	s, err := GetScheme(scheme)
+	if err != nil {
+		return nil, nil, err
 	}
-}
-
-// GenerateChameleonKeyPair 生成Chameleon哈希的公私钥对
-func GenerateChameleonKeyPair() ([]byte, *ChameleomPubKey) {
-	priv, pubX, pubY, _ := elliptic.GenerateKey(GetCurve(), rand.Reader)
-	return priv, &ChameleomPubKey{
-		pubX: pubX,
-		pubY: pubY,
+	secKey, pubKey, err := s.KeyGen()
+	if err != nil {
+		return nil, nil, err
 	}
+	return secKey, &ChameleomPubKey{scheme: s, data: pubKey}, nil
 }
 
 // NewMerkleConfig 创建一个新的Merkle树配置
 func NewMerkleConfig() *MerkleConfig {
 	return &MerkleConfig{
+		Chunker:   FixedChunker,
 		BlockSize: 4 * 1024 * 1024, // 4MB
+		MinSize:   1 * 1024 * 1024, // 1MB
+		AvgSize:   4 * 1024 * 1024, // 4MB
+		MaxSize:   16 * 1024 * 1024,
+	}
+}
+
+// NewMerkleConfigFromParams 根据MetaData中记录的分块参数创建Merkle树配置
+func NewMerkleConfigFromParams(params dht.ChunkerParams) *MerkleConfig {
+	config := NewMerkleConfig()
+	// 旧的MetaData没有记录分块参数，使用默认的固定分块
+	if params.Type == "" {
+		return config
+	}
+	config.Chunker = params.Type
+	config.BlockSize = params.BlockSize
+	config.MinSize = params.MinSize
+	config.AvgSize = params.AvgSize
+	config.MaxSize = params.MaxSize
+	config.Codec = params.Codec
+	return config
+}
+
+// ChunkerParams 返回需要记录到MetaData中的分块参数
+func (config *MerkleConfig) ChunkerParams() dht.ChunkerParams {
+	if config.Chunker == FastCDCChunker {
+		return dht.ChunkerParams{
+			Type:    FastCDCChunker,
+			MinSize: config.MinSize,
+			AvgSize: config.AvgSize,
+			MaxSize: config.MaxSize,
+			Codec:   config.Codec,
+		}
+	}
+	return dht.ChunkerParams{
+		Type:      FixedChunker,
+		BlockSize: config.BlockSize,
+		Codec:     config.Codec,
 	}
 }
 
@@ -81,6 +109,40 @@ type MerkleNode struct {
 	Hash  []byte
 	Left  *MerkleNode
 	Right *MerkleNode
+	// RandomNum 是变色龙节点（根节点和子树根）的随机数，普通节点为 nil
+	RandomNum *ChameleonRandomNum
+	// SubtreeHeight 只在根节点上设置，为0时只有根节点使用变色龙哈希
+	SubtreeHeight int
+	// Codec 只在叶子上设置，是数据块保存和传输时使用的压缩算法
+	Codec string
+}
+
+// readLeaves 使用配置的分块算法读取文件，并为每个数据块创建叶子节点，
+// 配置了压缩算法时逐个数据块决定是否压缩
+func readLeaves(file io.Reader, config *MerkleConfig) ([]*MerkleNode, error) {
+	if err := dht.CheckCodec(config.Codec); err != nil {
+		return nil, err
+	}
+	chunker, err := NewChunker(file, config)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*MerkleNode
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		codec, _, err := dht.ChooseCodec(config.Codec, chunk)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, &MerkleNode{Hash: getHash(chunk), Codec: codec})
+	}
+	return nodes, nil
 }
 
 // getHash 计算给定数据的SHA-256哈希
@@ -91,14 +153,14 @@ func getHash(data []byte) []byte {
 
 // VerifyMerkleRoot 验证Merkle树的根节点是否正确
 func VerifyMerkleRoot(text, hX []byte, pubKey *ChameleomPubKey, randomNum *ChameleonRandomNum) bool {
-	return VerifyHash(text, randomNum.rX, randomNum.rY, randomNum.s, pubKey.pubX, pubKey.pubY, new(big.Int).SetBytes(hX))
+	return pubKey.scheme.Verify(pubKey.data, text, hX, randomNum.data)
 }
 
 // BuildMerkleTree 构建一个Merkle树，并返回根节点和一个Chameleon随机数。
 // 参数:
 // - filePath: 文件路径，表示要读取的文件。
 // - config: Merkle树的配置，包括块大小等信息。
-// - pubKey: Chameleon哈希的公钥。
+// - pubKey: Chameleon哈希的公钥，根哈希使用公钥所属的方案计算。
 // 返回值:
 // - *MerkleNode: Merkle树的根节点。
 // - *ChameleonRandomNum: Chameleon随机数。
@@ -110,66 +172,24 @@ func VerifyMerkleRoot(text, hX []byte, pubKey *ChameleomPubKey, randomNum *Chame
 // 最后，计算根节点的哈希值，并返回根节点和Chameleon随机数。
 func BuildMerkleTree(file *os.File, config *MerkleConfig, pubKey *ChameleomPubKey) (*MerkleNode, *ChameleonRandomNum, []byte, error) {
 	// 读取文件并创建叶子节点
-	var nodes []*MerkleNode
-	buffer := make([]byte, config.BlockSize)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, nil, nil, err
-		}
-		if n == 0 {
-			break
-		}
-		node := &MerkleNode{Hash: getHash(buffer[:n])}
-		nodes = append(nodes, node)
-		// 如果读取的数据量小于块大小，说明已到达文件末尾
-		if n < config.BlockSize {
-			break
-		}
+	nodes, err := readLeaves(file, config)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	// 构建Merkle树
-	for len(nodes) > 2 {
-		var newLevel []*MerkleNode
-		for i := 0; i < len(nodes); i += 2 {
-			var hash []byte
-			if i+1 < len(nodes) {
-				hash = getHash(append(nodes[i].Hash, nodes[i+1].Hash...))
-				newLevel = append(newLevel, &MerkleNode{
-					Hash:  hash,
-					Left:  nodes[i],
-					Right: nodes[i+1],
-				})
-			} else {
-				// 如果是最后一个节点，直接复制
-				newLevel = append(newLevel, nodes[i])
-			}
-		}
-		nodes = newLevel
-	}
-
-	var combined []byte
-	var root *MerkleNode
-	// 返回根节点
-	if len(nodes) == 1 {
-		combined = nodes[0].Hash
-		root = &MerkleNode{
-			Left: nodes[0],
-		}
-	} else {
-		combined = append(nodes[0].Hash, nodes[1].Hash...)
-		root = &MerkleNode{
-			Left:  nodes[0],
-			Right: nodes[1],
+	// 构建Merkle树，为根节点和每个子树根计算变色龙哈希
+	root, err := buildTree(nodes, config.SubtreeHeight, func(index int, node *MerkleNode, message []byte) error {
+		hash, randomness, err := pubKey.scheme.Hash(pubKey.data, message)
+		if err != nil {
+			return err
 		}
+		node.Hash, node.RandomNum = hash, &ChameleonRandomNum{data: randomness}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	rX, rY, s, hX := ComputeHash(combined, pubKey.pubX, pubKey.pubY)
-	root.Hash = hX.Bytes()
 
-	return root, &ChameleonRandomNum{
-		rX: rX,
-		rY: rY,
-		s:  s,
-	}, combined, nil
+	return root, root.RandomNum, ChameleonMessage(root), nil
 }
 
 // UpdateMerkleTree 更新Merkle树
@@ -191,68 +211,62 @@ func BuildMerkleTree(file *os.File, config *MerkleConfig, pubKey *ChameleomPubKe
 // - *ChameleonRandomNum: 新的Chameleon随机数
 // - error: 如果发生错误，返回错误信息
 func UpdateMerkleTree(file *os.File, config *MerkleConfig, pubKey *ChameleomPubKey, secKey, prevRootHash, chameleonHash []byte, randomNum *ChameleonRandomNum) (*MerkleNode, *ChameleonRandomNum, error) {
-	// 读取文件并创建叶子节点
-	var nodes []*MerkleNode
-	buffer := make([]byte, config.BlockSize)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, nil, err
-		}
-		if n == 0 {
-			break
-		}
-		node := &MerkleNode{Hash: getHash(buffer[:n])}
-		nodes = append(nodes, node)
-		// 如果读取的数据量小于块大小，说明已到达文件末尾
-		if n < config.BlockSize {
-			break
-		}
-	}
-	// 构建Merkle树
-	for len(nodes) > 2 {
-		var newLevel []*MerkleNode
-		for i := 0; i < len(nodes); i += 2 {
-			var hash []byte
-			if i+1 < len(nodes) {
-				hash = getHash(append(nodes[i].Hash, nodes[i+1].Hash...))
-				newLevel = append(newLevel, &MerkleNode{
-					Hash:  hash,
-					Left:  nodes[i],
-					Right: nodes[i+1],
-				})
-			} else {
-				// 如果是最后一个节点，直接复制
-				newLevel = append(newLevel, nodes[i])
-			}
+	return UpdateMerkleTreeWithCollider(file, config, prevRootHash, chameleonHash, randomNum, LocalCollider(pubKey, secKey))
+}
+
+// LocalCollider 返回使用本地私钥生成碰撞的 CollisionFunc
+func LocalCollider(pubKey *ChameleomPubKey, secKey []byte) CollisionFunc {
+	return func(message []byte, randomNum *ChameleonRandomNum, rootHash, newMessage []byte) (*ChameleonRandomNum, error) {
+		randomness, err := pubKey.scheme.Collide(secKey, message, rootHash, randomNum.data, newMessage)
+		if err != nil {
+			return nil, err
 		}
-		nodes = newLevel
+		return &ChameleonRandomNum{data: randomness}, nil
 	}
+}
 
-	var combined []byte
-	var root *MerkleNode
-	// 返回根节点
-	if len(nodes) == 1 {
-		combined = nodes[0].Hash
-		root = &MerkleNode{
-			Left: nodes[0],
-		}
-	} else {
-		combined = append(nodes[0].Hash, nodes[1].Hash...)
-		root = &MerkleNode{
-			Left:  nodes[0],
-			Right: nodes[1],
+// CollisionFunc 为新的变色龙哈希消息找到一个碰撞，使新消息与旧消息的变色龙哈希相同
+// 参数:
+// - message: 旧的变色龙哈希消息。
+// - randomNum: 旧的随机数。
+// - rootHash: 根哈希。
+// - newMessage: 新的变色龙哈希消息。
+// 返回值:
+// - *ChameleonRandomNum: 新的随机数。
+// - error: 错误信息。
+type CollisionFunc func(message []byte, randomNum *ChameleonRandomNum, rootHash, newMessage []byte) (*ChameleonRandomNum, error)
+
+// UpdateMerkleTreeWithCollider 与 UpdateMerkleTree 相同，但由 collide 生成碰撞，
+// 陷门可以由本地私钥提供，也可以由多个分片持有者协作提供。
+// 这两个函数只在根节点上生成碰撞，使用变色龙子树的文件需要用 UpdateMerkleTreeFromRoot 更新
+func UpdateMerkleTreeWithCollider(file *os.File, config *MerkleConfig, prevRootHash, chameleonHash []byte, randomNum *ChameleonRandomNum, collide CollisionFunc) (*MerkleNode, *ChameleonRandomNum, error) {
+	// 读取文件并创建叶子节点
+	nodes, err := readLeaves(file, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 构建Merkle树，只在根节点上生成碰撞
+	root, err := buildTree(nodes, 0, func(index int, node *MerkleNode, message []byte) error {
+		newRandomNum, err := collide(chameleonHash, randomNum, prevRootHash, message)
+		if err != nil {
+			return err
 		}
+		node.Hash, node.RandomNum = prevRootHash, newRandomNum
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	newRX, newRY, newS := FindCollision(chameleonHash, randomNum.rX, randomNum.rY, randomNum.s, new(big.Int).SetBytes(prevRootHash), combined, secKey)
-	root.Hash = prevRootHash
+	return root, root.RandomNum, nil
+}
 
-	return root, &ChameleonRandomNum{
-		rX: newRX,
-		rY: newRY,
-		s:  newS,
-	}, nil
+// ChameleonMessage 返回计算根节点变色龙哈希的消息，即根节点下一层节点哈希的拼接
+func ChameleonMessage(root *MerkleNode) []byte {
+	if root.Right == nil {
+		return root.Left.Hash
+	}
+	return append(append([]byte{}, root.Left.Hash...), root.Right.Hash...)
 }
 
 // LevelOrderTraversal 层序遍历Merkle树并打印结构
@@ -280,33 +294,42 @@ func LevelOrderTraversal(root *MerkleNode) {
 	}
 }
 
-// getAllLeaves 从Merkle树的根节点获取所有叶子节点的哈希值
+// GetAllLeavesHashes 从Merkle树的根节点按从左到右的顺序获取所有叶子节点的哈希值，
+// 顺序与文件中数据块的顺序一致
 func GetAllLeavesHashes(root *MerkleNode) [][]byte {
 	var leafHashes [][]byte
-	if root == nil {
-		return leafHashes
+	for _, leaf := range GetAllLeaves(root) {
+		leafHashes = append(leafHashes, leaf.Hash)
 	}
+	return leafHashes
+}
 
-	// 使用队列进行层序遍历
-	queue := list.New()
-	queue.PushBack(root)
+// GetAllLeaves 按从左到右的顺序获取所有叶子节点
+func GetAllLeaves(root *MerkleNode) []*MerkleNode {
+	var leaves []*MerkleNode
+	if root == nil {
+		return leaves
+	}
 
-	for queue.Len() > 0 {
-		node := queue.Remove(queue.Front()).(*MerkleNode)
-		// 如果是叶子节点，则添加到leafHashes列表中
+	// 使用栈进行先序遍历，先压入右子节点以保证左子树先被访问
+	stack := []*MerkleNode{root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		// 如果是叶子节点，则添加到leaves列表中
 		if node.Left == nil && node.Right == nil {
-			leafHashes = append(leafHashes, node.Hash)
-		}
-		// 将子节点加入队列
-		if node.Left != nil {
-			queue.PushBack(node.Left)
+			leaves = append(leaves, node)
+			continue
 		}
 		if node.Right != nil {
-			queue.PushBack(node.Right)
+			stack = append(stack, node.Right)
+		}
+		if node.Left != nil {
+			stack = append(stack, node.Left)
 		}
 	}
 
-	return leafHashes
+	return leaves
 }
 
 // GenerateMerkleProof 函数生成给定目标节点的默克尔证明路径。
@@ -377,6 +400,8 @@ func GenerateMerkleProof(root *MerkleNode, target []byte) [][]byte {
 }
 
 // VerifyMerkleProof 验证给定的 Merkle 证明是否有效。
+// 只适用于没有变色龙子树的树，使用子树时需要 VerifyMerkleProofByIndex。
+// 证明先转换为基于下标的证明，再由 VerifyMerkleProofByIndex 验证，不会修改 merkleProof。
 // 参数：
 // - rootHash: Merkle 树的根哈希值。
 // - targetHash: 目标哈希值，即需要验证的叶子节点哈希。
@@ -386,81 +411,120 @@ func GenerateMerkleProof(root *MerkleNode, target []byte) [][]byte {
 // 返回值：
 // - bool: 如果证明有效，返回 true；否则返回 false。
 func VerifyMerkleProof(rootHash, targetHash []byte, merkleProof [][]byte, pubKey *ChameleomPubKey, randomNum *ChameleonRandomNum) bool {
-	currentHash := targetHash
-	for i := len(merkleProof) - 2; i >= 2; i -= 2 {
-		var combined []byte
-		if len(merkleProof[i]) == 0 {
-			combined = append(currentHash, merkleProof[i+1]...)
+	proof, ok := indexProofFromPath(merkleProof)
+	return ok && VerifyMerkleProofByIndex(rootHash, targetHash, proof, pubKey, randomNum)
+}
+
+// indexProofFromPath 把 GenerateMerkleProof 生成的证明转换为基于下标的证明。
+// 路径证明从根节点开始每层保存左右两个兄弟节点，只有一个非空，根节点只有一个子节点时两个都为空。
+// 直接提升的节点不在路径上，因此路径只记录了叶子的左右方向，每层都有兄弟节点的满树与原来的树计算出相同的消息，
+// 下标由方向得到，叶子个数取这棵满树的叶子个数。
+func indexProofFromPath(merkleProof [][]byte) (*MerkleProof, bool) {
+	// 满树的叶子个数是 2 的层数次方，超过63层时溢出
+	if len(merkleProof) < 2 || len(merkleProof)%2 != 0 || len(merkleProof) > 2*63 {
+		return nil, false
+	}
+	var index, size uint64
+	var siblings [][]byte
+	left, right := merkleProof[0], merkleProof[1]
+	switch {
+	case len(left) == 0 && len(right) == 0:
+		// 只有一个叶子，叶子就是变色龙哈希的消息
+		if len(merkleProof) > 2 {
+			return nil, false
+		}
+		return &MerkleProof{LeafIndex: 0, TreeSize: 1}, true
+	case len(left) == 0:
+		index, size, siblings = 0, 2, [][]byte{right}
+	case len(right) == 0:
+		index, size, siblings = 1, 2, [][]byte{left}
+	default:
+		return nil, false
+	}
+	for i := 2; i < len(merkleProof); i += 2 {
+		left, right := merkleProof[i], merkleProof[i+1]
+		if (len(left) == 0) == (len(right) == 0) {
+			return nil, false
+		}
+		index, size = index*2, size*2
+		if len(left) != 0 {
+			index++
+			siblings = append(siblings, left)
 		} else {
-			combined = append(merkleProof[i], currentHash...)
+			siblings = append(siblings, right)
 		}
-		currentHash = getHash(combined)
-		fmt.Printf("currentHash: %x\n", currentHash)
 	}
-	var combined []byte
-	if len(merkleProof[0]) == 0 && len(merkleProof[1]) == 0 {
-		combined = currentHash
-	} else if len(merkleProof[0]) != 0 {
-		combined = append(merkleProof[0], currentHash...)
-	} else {
-		combined = append(currentHash, merkleProof[1]...)
+	// 路径从根节点开始，基于下标的证明从叶子开始
+	for i, j := 0, len(siblings)-1; i < j; i, j = i+1, j-1 {
+		siblings[i], siblings[j] = siblings[j], siblings[i]
 	}
-
-	toBe := VerifyMerkleRoot(combined, rootHash, pubKey, randomNum)
-
-	return toBe
+	return &MerkleProof{LeafIndex: index, TreeSize: size, Siblings: siblings}, true
 }
 
+// RebuildMerkleTreeFromMetaData 由 metadata 中的叶子重建默克尔树，并验证根节点和每个子树根的变色龙哈希
+// 返回值:
+// - *MerkleNode: 重建的根节点，变色龙节点的随机数已经设置。
+// - *ChameleonRandomNum: 根节点的随机数。
+// - *ChameleomPubKey: metadata 中的公钥。
+// - error: 编码无效或验证失败时返回错误信息。
 func RebuildMerkleTreeFromMetaData(metaData *dht.MetaData) (*MerkleNode, *ChameleonRandomNum, *ChameleomPubKey, error) {
+	// 方案由 metadata 记录，旧的 metadata 没有记录方案，使用 p256
+	pubKey, err := ParseChameleomPubKey(metaData.Scheme, metaData.PublicKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	randomNum, err := ParseChameleonRandomNum(metaData.Scheme, metaData.RandomNum)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// 读取metaData并创建叶子节点
+	if len(metaData.Codecs) != 0 && len(metaData.Codecs) != len(metaData.Leaves) {
+		return nil, nil, nil, fmt.Errorf("%d codecs for %d leaves", len(metaData.Codecs), len(metaData.Leaves))
+	}
 	var nodes []*MerkleNode
-	for _, leaf := range metaData.Leaves {
+	for i, leaf := range metaData.Leaves {
 		node := &MerkleNode{Hash: leaf}
-		nodes = append(nodes, node)
-	}
-	// 构建Merkle树
-	for len(nodes) > 2 {
-		var newLevel []*MerkleNode
-		for i := 0; i < len(nodes); i += 2 {
-			var hash []byte
-			if i+1 < len(nodes) {
-				hash = getHash(append(nodes[i].Hash, nodes[i+1].Hash...))
-				newLevel = append(newLevel, &MerkleNode{
-					Hash:  hash,
-					Left:  nodes[i],
-					Right: nodes[i+1],
-				})
-			} else {
-				// 如果是最后一个节点，直接复制
-				newLevel = append(newLevel, nodes[i])
+		if len(metaData.Codecs) != 0 {
+			if err := dht.CheckCodec(metaData.Codecs[i]); err != nil {
+				return nil, nil, nil, err
 			}
+			node.Codec = metaData.Codecs[i]
 		}
-		nodes = newLevel
+		nodes = append(nodes, node)
 	}
-
-	var combined []byte
-	var root *MerkleNode
-	// 返回根节点
-	if len(nodes) == 1 {
-		combined = nodes[0].Hash
-		root = &MerkleNode{
-			Left: nodes[0],
+	if metaData.SubtreeHeight == 0 && len(metaData.Subtrees) != 0 {
+		return nil, nil, nil, fmt.Errorf("%d subtrees without subtree height", len(metaData.Subtrees))
+	}
+	// 构建Merkle树，逐个验证变色龙节点
+	root, err := buildTree(nodes, metaData.SubtreeHeight, func(index int, node *MerkleNode, message []byte) error {
+		hash, nodeRandomNum := metaData.RootHash, randomNum
+		if index >= 0 {
+			if index >= len(metaData.Subtrees) {
+				return fmt.Errorf("subtree %d missing", index)
+			}
+			subtree := metaData.Subtrees[index]
+			parsed, err := ParseChameleonRandomNum(metaData.Scheme, subtree.RandomNum)
+			if err != nil {
+				return err
+			}
+			hash, nodeRandomNum = subtree.Hash, parsed
 		}
-	} else {
-		combined = append(nodes[0].Hash, nodes[1].Hash...)
-		root = &MerkleNode{
-			Left:  nodes[0],
-			Right: nodes[1],
+		if !VerifyMerkleRoot(message, hash, pubKey, nodeRandomNum) {
+			if index >= 0 {
+				return fmt.Errorf("Merkle subtree %d verification failed", index)
+			}
+			return fmt.Errorf("Merkle root verification failed")
 		}
+		node.Hash, node.RandomNum = hash, nodeRandomNum
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
 	}
-
-	randomNum := DeserializeChameleonRandomNum(metaData.RandomNum)
-	pubKey := DeserializeChameleomPubKey(metaData.PublicKey)
-	toBe := VerifyMerkleRoot(combined, metaData.RootHash, pubKey, randomNum)
-	if !toBe {
-		return nil, nil, nil, fmt.Errorf("Merkle root verification failed")
+	if subtrees := SubtreeRoots(root); len(subtrees) != len(metaData.Subtrees) {
+		return nil, nil, nil, fmt.Errorf("%d subtrees, want %d", len(metaData.Subtrees), len(subtrees))
 	}
-	root.Hash = metaData.RootHash
 
 	return root, randomNum, pubKey, nil
 }
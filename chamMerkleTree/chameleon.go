@@ -1,108 +1,285 @@
 package chamMerkleTree
 
 import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"fmt"
-	"io"
+	"errors"
+	"filippo.io/nistec"
 	"math/big"
 )
 
-//todo : use ecdsa instead of elliptic
+// p256 方案: h = R - H(m || R)·Y - s·G，哈希值是 h 的 X 坐标。
+// 持有私钥 x 时选择随机数 k，令 R' = h + k·G，s' = k - H(m' || R')·x 即得到新消息的碰撞。
+//
+// 涉及私钥和随机数 k 的运算都是常数时间的: 密钥生成和公钥检查使用 crypto/ecdh，
+// 模 N 的标量运算和 k·G 使用 p256Scalar。点运算都使用 filippo.io/nistec，
+// crypto/elliptic 只提供曲线参数，math/big 只用于公开的值，例如编码中的坐标和哈希挑战。
 
 var curve = elliptic.P256()
 var one = new(big.Int).SetInt64(1)
 
-func neg(y *big.Int) (modNegY *big.Int) {
-	y.Neg(y)
-	modNegY = y.Mod(y, curve.Params().P)
-	return modNegY
+type p256Scheme struct{}
+
+func (p256Scheme) ID() string {
+	return SchemeP256
 }
 
-func scalarRand() (x *big.Int, err error) {
-	params := curve.Params()
-	b := make([]byte, params.BitSize/8+8)
-	_, err = io.ReadFull(rand.Reader, b)
+func (p256Scheme) KeyGen() ([]byte, []byte, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	x = new(big.Int).SetBytes(b)
-	n := new(big.Int).Sub(params.N, one)
-	x.Mod(x, n)
-	x.Add(x, one)
-	return
+	return key.Bytes(), key.PublicKey().Bytes(), nil
 }
 
-func pointRand() (x *big.Int, y *big.Int, err error) {
+func (p256Scheme) PublicKey(secKey []byte) ([]byte, error) {
+	key, err := p256SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+func (p256Scheme) ParsePublicKey(data []byte) ([]byte, error) {
+	x, y, err := decodeP256PubKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeP256PubKey(x, y), nil
+}
+
+func (p256Scheme) ParseRandomness(data []byte) ([]byte, error) {
+	rX, rY, s, err := decodeP256RandomNum(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeP256RandomNum(rX, rY, s), nil
+}
+
+func (p256Scheme) Hash(pubKey, message []byte) ([]byte, []byte, error) {
+	pubX, pubY, err := decodeP256PubKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	rX, rY, err := pointRand()
+	if err != nil {
+		return nil, nil, err
+	}
 	s, err := scalarRand()
-	x, y = curve.ScalarBaseMult(s.Bytes())
-	return
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := computeHash(message, rX, rY, s, pubX, pubY)
+	if err != nil {
+		return nil, nil, err
+	}
+	hX, _ := p256Coords(h)
+	return hX.Bytes(), encodeP256RandomNum(rX, rY, s), nil
 }
 
-func computeHash(message []byte, rX *big.Int, rY *big.Int, s *big.Int, pubX *big.Int, pubY *big.Int) (hX, hY *big.Int) {
-	sha256Hash := sha256.New()
-	sha256Hash.Write(message)
-	sha256Hash.Write(rX.Bytes())
-	sha256Hash.Write(rY.Bytes())
-	sha256HashBytes := sha256Hash.Sum(nil)
+func (p256Scheme) Verify(pubKey, message, hash, randomness []byte) bool {
+	pubX, pubY, err := decodeP256PubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	rX, rY, s, err := decodeP256RandomNum(randomness)
+	if err != nil {
+		return false
+	}
+	h, err := computeHash(message, rX, rY, s, pubX, pubY)
+	if err != nil {
+		return false
+	}
+	hX, _ := p256Coords(h)
+	return hX.Cmp(new(big.Int).SetBytes(hash)) == 0
+}
+
+func (p256Scheme) Collide(secKey, message, hash, randomness, newMessage []byte) ([]byte, error) {
+	key, err := p256SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	pubX, pubY, err := decodeP256PubKey(key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	rX, rY, s, err := decodeP256RandomNum(randomness)
+	if err != nil {
+		return nil, err
+	}
+	h, err := computeHash(message, rX, rY, s, pubX, pubY)
+	if err != nil {
+		return nil, err
+	}
+	if hX, _ := p256Coords(h); hX.Cmp(new(big.Int).SetBytes(hash)) != 0 {
+		return nil, errors.New("random number does not open root hash")
+	}
+
+	x, err := new(p256Scalar).setBytes(key.Bytes())
+	if err != nil {
+		return nil, ErrInvalidSecKey
+	}
+
+	// new_r = h + k·G
+	k, err := p256ScalarRand()
+	if err != nil {
+		return nil, err
+	}
+	kG, err := p256BaseMult(k)
+	if err != nil {
+		return nil, err
+	}
+	newRX, newRY := p256Coords(nistec.NewP256Point().Add(h, kG))
 
-	t1X, t1Y := curve.ScalarMult(pubX, pubY, sha256HashBytes)
-	negT1X, negT1Y := t1X, neg(t1Y)
+	// new_s = k - H(m' || new_r)·x mod N
+	e := p256ScalarFromInt(p256Challenge(newMessage, newRX, newRY))
+	newS := new(p256Scalar).Sub(k, new(p256Scalar).Mul(e, x))
+	return encodeP256RandomNum(newRX, newRY, new(big.Int).SetBytes(newS.Bytes())), nil
+}
 
-	// r2 = s * basepoint
-	t2X, t2Y := curve.ScalarBaseMult(s.Bytes())
-	negT2X, negT2Y := t2X, neg(t2Y)
+// Sign 生成 Schnorr 签名 tag || R || s，s = k + H(R || Y || digest)·x，与门限陷门生成的签名格式相同。
+// 私钥不再用于 ECDSA: Schnorr 的挑战带有域分隔标签，与变色龙哈希的挑战 H(m || R) 不会相同，
+// 签名和碰撞共用一个私钥时也不会互相泄露私钥。
+func (p256Scheme) Sign(secKey, digest []byte) ([]byte, error) {
+	key, err := p256SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	pubX, pubY, err := decodeP256PubKey(key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	x, err := new(p256Scalar).setBytes(key.Bytes())
+	if err != nil {
+		return nil, ErrInvalidSecKey
+	}
+	k, err := p256ScalarRand()
+	if err != nil {
+		return nil, err
+	}
+	r, err := p256BaseMult(k)
+	if err != nil {
+		return nil, err
+	}
+	rX, rY := p256Coords(r)
+	e := p256ScalarFromInt(schnorrHash(rX, rY, pubX, pubY, digest))
+	s := new(p256Scalar).Mul(e, x)
+	s.Add(s, k)
+	return encodeSchnorr(rX, rY, new(big.Int).SetBytes(s.Bytes())), nil
+}
 
-	// h = r + r1 + r2
-	t3X, t3Y := curve.Add(rX, rY, negT1X, negT1Y)
-	hX, hY = curve.Add(t3X, t3Y, negT2X, negT2Y)
+// VerifySignature 验证 Schnorr 签名，旧版本发布的 metadata 使用 ECDSA 签名，仍然可以验证
+func (p256Scheme) VerifySignature(pubKey, digest, signature []byte) bool {
+	pubX, pubY, err := decodeP256PubKey(pubKey)
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	if signature[0] == schnorrTag {
+		return verifySchnorr(pubX, pubY, digest, signature)
+	}
+	return ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: curve, X: pubX, Y: pubY}, digest, signature)
+}
 
-	return
+// p256SecKey 检查私钥在 [1, N-1] 中，旧的私钥可能有前导零被去掉，先补齐到32字节
+func p256SecKey(secKey []byte) (*ecdh.PrivateKey, error) {
+	if len(secKey) == 0 || len(secKey) > scalarSize {
+		return nil, ErrInvalidSecKey
+	}
+	padded := make([]byte, scalarSize)
+	copy(padded[scalarSize-len(secKey):], secKey)
+	key, err := ecdh.P256().NewPrivateKey(padded)
+	if err != nil {
+		return nil, ErrInvalidSecKey
+	}
+	return key, nil
 }
 
-func ComputeHash(message []byte, pubX *big.Int, pubY *big.Int) (rX, rY, s, hashX *big.Int) {
-	rX, rY, _ = pointRand()
-	s, _ = scalarRand()
-	hashX, _ = computeHash(message, rX, rY, s, pubX, pubY)
-	return
+// newP256Point 返回坐标为 (x, y) 的点，点不在曲线上时返回错误
+func newP256Point(x, y *big.Int) (*nistec.P256Point, error) {
+	if x.Sign() < 0 || y.Sign() < 0 || x.BitLen() > 256 || y.BitLen() > 256 {
+		return nil, errors.New("point is not on curve")
+	}
+	data := make([]byte, 1+pointSize)
+	data[0] = 4
+	x.FillBytes(data[1 : 1+scalarSize])
+	y.FillBytes(data[1+scalarSize:])
+	return nistec.NewP256Point().SetBytes(data)
 }
 
-func VerifyHash(message []byte, rX *big.Int, rY *big.Int, s *big.Int, pubX *big.Int, pubY *big.Int, hashX *big.Int) (toBe bool) {
-	hX, _ := computeHash(message, rX, rY, s, pubX, pubY)
-	toBe = hX.Cmp(hashX) == 0
-	return
+// p256Coords 返回点的坐标，与 crypto/elliptic 相同，无穷远点的坐标是 (0, 0)
+func p256Coords(p *nistec.P256Point) (x, y *big.Int) {
+	data := p.Bytes()
+	if len(data) == 1 {
+		return new(big.Int), new(big.Int)
+	}
+	return new(big.Int).SetBytes(data[1 : 1+scalarSize]), new(big.Int).SetBytes(data[1+scalarSize:])
 }
 
-func GetCurve() elliptic.Curve {
-	return curve
+// scalarRand 生成 [1, N-1] 中的随机数，只用于会公开的值，例如随机数中的 s
+func scalarRand() (*big.Int, error) {
+	s, err := p256ScalarRand()
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(s.Bytes()), nil
 }
 
-func FindCollision(message []byte, rX *big.Int, rY *big.Int, s *big.Int, hashX *big.Int, newMessage []byte, priv []byte) (newRX, newRY, newS *big.Int) {
-	params := curve.Params()
-	pubX, pubY := curve.ScalarBaseMult(priv)
-	hX, hY := computeHash(message, rX, rY, s, pubX, pubY)
-	if hashX.Cmp(hX) != 0 {
-		fmt.Println("check hash of orginal message failed, exit")
+// pointRand 生成离散对数未知的随机点
+func pointRand() (x *big.Int, y *big.Int, err error) {
+	k, err := p256ScalarRand()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := p256BaseMult(k)
+	if err != nil {
+		return nil, nil, err
 	}
+	x, y = p256Coords(r)
+	return x, y, nil
+}
 
-	// new random K
-	k, _ := scalarRand()
-	//t1 = k * basepoint
-	t1X, t1Y := curve.ScalarBaseMult(k.Bytes())
-	// new_r = h + t1
-	newRX, newRY = curve.Add(hX, hY, t1X, t1Y)
-	// s' = k - H'*priv
+// p256Challenge 计算 H(m || R)，坐标使用不补零的编码以兼容已发布的根哈希
+func p256Challenge(message []byte, rX, rY *big.Int) *big.Int {
 	sha256Hash := sha256.New()
-	sha256Hash.Write([]byte(newMessage))
-	sha256Hash.Write(newRX.Bytes())
-	sha256Hash.Write(newRY.Bytes())
-	sha256HashBytes := sha256Hash.Sum(nil)
-	sha256HashInt := new(big.Int).SetBytes(sha256HashBytes)
-
-	// t2 = H' * priv % N
-	// new_s = k - t2 % N
-	t2 := new(big.Int).Mod(new(big.Int).Mul(sha256HashInt, new(big.Int).SetBytes(priv)), params.N)
-	newS = new(big.Int).Mod(new(big.Int).Sub(k, t2), params.N)
-	return
+	sha256Hash.Write(message)
+	sha256Hash.Write(rX.Bytes())
+	sha256Hash.Write(rY.Bytes())
+	return new(big.Int).SetBytes(sha256Hash.Sum(nil))
+}
+
+// computeHash 计算 h = R - H(m || R)·Y - s·G，R 和 Y 必须在曲线上。
+// 减法通过把公开的标量取负实现: h = R + (-e)·Y + (-s)·G
+func computeHash(message []byte, rX *big.Int, rY *big.Int, s *big.Int, pubX *big.Int, pubY *big.Int) (*nistec.P256Point, error) {
+	r, err := newP256Point(rX, rY)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := newP256Point(pubX, pubY)
+	if err != nil {
+		return nil, err
+	}
+	e := p256Challenge(message, rX, rY)
+
+	// t1 = -e·Y
+	t1, err := nistec.NewP256Point().ScalarMult(pub, negScalar(e))
+	if err != nil {
+		return nil, err
+	}
+	// t2 = -s·G
+	t2, err := nistec.NewP256Point().ScalarBaseMult(negScalar(s))
+	if err != nil {
+		return nil, err
+	}
+	h := nistec.NewP256Point().Add(r, t1)
+	return h.Add(h, t2), nil
+}
+
+// negScalar 返回公开的整数 -x mod N 的32字节编码
+func negScalar(x *big.Int) []byte {
+	n := curve.Params().N
+	neg := new(big.Int).Mod(x, n)
+	return neg.Sub(n, neg).Mod(neg, n).FillBytes(make([]byte, scalarSize))
 }
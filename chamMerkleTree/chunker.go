@@ -0,0 +1,178 @@
+package chamMerkleTree
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// FixedChunker 按固定大小切分文件
+	FixedChunker = "fixed"
+	// FastCDCChunker 基于内容定义的切分（FastCDC）
+	FastCDCChunker = "fastcdc"
+)
+
+// Chunker 将文件内容切分成数据块
+type Chunker interface {
+	// Next 返回下一个数据块，没有更多数据时返回 io.EOF
+	Next() ([]byte, error)
+}
+
+// NewChunker 根据Merkle树配置创建对应的分块器
+// 参数:
+// - r: 文件读取器
+// - config: Merkle树的配置，包括分块算法及其参数
+// 返回值:
+// - Chunker: 分块器
+// - error: 如果配置无效，返回错误信息
+func NewChunker(r io.Reader, config *MerkleConfig) (Chunker, error) {
+	switch config.Chunker {
+	case "", FixedChunker:
+		if config.BlockSize <= 0 {
+			return nil, fmt.Errorf("invalid block size %d", config.BlockSize)
+		}
+		return &fixedChunker{r: r, size: config.BlockSize}, nil
+	case FastCDCChunker:
+		if config.MinSize <= 0 || config.MinSize > config.AvgSize || config.AvgSize > config.MaxSize {
+			return nil, fmt.Errorf("invalid fastcdc sizes: min %d, avg %d, max %d", config.MinSize, config.AvgSize, config.MaxSize)
+		}
+		return newFastCDC(r, config.MinSize, config.AvgSize, config.MaxSize), nil
+	default:
+		return nil, fmt.Errorf("unknown chunker %q", config.Chunker)
+	}
+}
+
+// fixedChunker 按固定大小切分，最后一个数据块可能小于块大小
+type fixedChunker struct {
+	r    io.Reader
+	size int
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	buffer := make([]byte, c.size)
+	n, err := io.ReadFull(c.r, buffer)
+	if n == 0 {
+		if err == nil || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// gearTable 是FastCDC使用的随机表，由固定种子派生，保证所有节点切分结果一致
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// cdcReadSize 是FastCDC缓冲区每次增长的最小字节数，缓冲区按读到的数据增长到 maxSize 为止，
+// 小文件不会分配 maxSize 大小的缓冲区
+const cdcReadSize = 64 * 1024
+
+// fastCDC 实现了带归一化分块的FastCDC算法
+type fastCDC struct {
+	r       io.Reader
+	buf     []byte // 已读取但还没有切分的数据
+	err     error  // 读取遇到的错误，io.EOF 表示已读完
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64 // 未达到平均大小时使用的严格掩码
+	maskL   uint64 // 超过平均大小后使用的宽松掩码
+}
+
+func newFastCDC(r io.Reader, minSize, avgSize, maxSize int) *fastCDC {
+	b := bits.Len(uint(avgSize)) - 1
+	return &fastCDC{
+		r:       r,
+		minSize: minSize,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		maskS:   topBitsMask(b + 1),
+		maskL:   topBitsMask(b - 1),
+	}
+}
+
+// topBitsMask 返回高 n 位为1的掩码，gear hash 左移累积，高位包含最多的窗口信息
+func topBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// fill 读取数据直到缓冲区中有 maxSize 字节或者输入结束
+func (c *fastCDC) fill() {
+	for len(c.buf) < c.maxSize && c.err == nil {
+		if len(c.buf) == cap(c.buf) {
+			size := max(2*cap(c.buf), cdcReadSize)
+			buf := make([]byte, len(c.buf), min(size, c.maxSize))
+			copy(buf, c.buf)
+			c.buf = buf
+		}
+		n, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		c.err = err
+	}
+}
+
+func (c *fastCDC) Next() ([]byte, error) {
+	c.fill()
+	if len(c.buf) == 0 {
+		if c.err == nil {
+			return nil, io.EOF
+		}
+		return nil, c.err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+
+	cut := c.cutPoint(c.buf)
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+	return chunk, nil
+}
+
+// cutPoint 在 data 中查找下一个切分点
+func (c *fastCDC) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,181 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// cdcConfig 返回数据块较小的 FastCDC 配置，测试数据不需要很大
+func cdcConfig() *MerkleConfig {
+	config := NewMerkleConfig()
+	config.Chunker = FastCDCChunker
+	config.MinSize, config.AvgSize, config.MaxSize = 2*1024, 8*1024, 32*1024
+	return config
+}
+
+// fixedConfig 返回块大小为 size 的固定分块配置
+func fixedConfig(size int) *MerkleConfig {
+	config := NewMerkleConfig()
+	config.BlockSize = size
+	return config
+}
+
+// randomData 返回由 seed 决定的 n 字节数据
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	mrand.New(mrand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll 用 config 切分 r 的全部内容
+func chunkAll(t *testing.T, r io.Reader, config *MerkleConfig) [][]byte {
+	t.Helper()
+	chunker, err := NewChunker(r, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestNewChunkerRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*MerkleConfig)
+	}{
+		{"unknown chunker", func(c *MerkleConfig) { c.Chunker = "rabin" }},
+		{"zero block size", func(c *MerkleConfig) { c.BlockSize = 0 }},
+		{"zero min size", func(c *MerkleConfig) { c.Chunker, c.MinSize = FastCDCChunker, 0 }},
+		{"min above avg", func(c *MerkleConfig) { c.Chunker, c.MinSize, c.AvgSize = FastCDCChunker, 8, 4 }},
+		{"avg above max", func(c *MerkleConfig) { c.Chunker, c.AvgSize, c.MaxSize = FastCDCChunker, 8, 4 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewMerkleConfig()
+			tt.modify(config)
+			if _, err := NewChunker(bytes.NewReader(nil), config); err == nil {
+				t.Fatal("invalid config accepted")
+			}
+		})
+	}
+}
+
+func TestChunkers(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *MerkleConfig
+		size   int
+	}{
+		{"fixed empty", fixedConfig(4096), 0},
+		{"fixed short", fixedConfig(4096), 100},
+		{"fixed exact", fixedConfig(4096), 3 * 4096},
+		{"fixed tail", fixedConfig(4096), 3*4096 + 1},
+		{"fastcdc empty", cdcConfig(), 0},
+		{"fastcdc below min", cdcConfig(), 1024},
+		{"fastcdc large", cdcConfig(), 512 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomData(1, tt.size)
+			chunks := chunkAll(t, bytes.NewReader(data), tt.config)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+				t.Fatal("chunks do not concatenate to the input")
+			}
+			for i, chunk := range chunks {
+				last := i == len(chunks)-1
+				switch tt.config.Chunker {
+				case FixedChunker:
+					if len(chunk) > tt.config.BlockSize || !last && len(chunk) != tt.config.BlockSize {
+						t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+					}
+				case FastCDCChunker:
+					if len(chunk) > tt.config.MaxSize || !last && len(chunk) < tt.config.MinSize {
+						t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+					}
+				}
+			}
+
+			// 切分点只由内容决定，与每次读到多少字节无关
+			again := chunkAll(t, iotest.HalfReader(bytes.NewReader(data)), tt.config)
+			if len(again) != len(chunks) {
+				t.Fatalf("got %d chunks from short reads, want %d", len(again), len(chunks))
+			}
+			for i := range chunks {
+				if !bytes.Equal(again[i], chunks[i]) {
+					t.Fatalf("chunk %d differs with short reads", i)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkersReturnReadErrors(t *testing.T) {
+	errRead := errors.New("read failed")
+	for _, config := range []*MerkleConfig{fixedConfig(4096), cdcConfig()} {
+		t.Run(config.Chunker, func(t *testing.T) {
+			r := io.MultiReader(bytes.NewReader(randomData(2, 1000)), iotest.ErrReader(errRead))
+			chunker, err := NewChunker(r, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, err := chunker.Next()
+				if errors.Is(err, errRead) {
+					return
+				}
+				if err != nil {
+					t.Fatalf("got %v, want %v", err, errRead)
+				}
+			}
+		})
+	}
+}
+
+// sharedBytes 返回 b 中与 a 的某个数据块内容相同的数据块的总字节数
+func sharedBytes(a, b [][]byte) int {
+	seen := make(map[[sha256.Size]byte]bool, len(a))
+	for _, chunk := range a {
+		seen[sha256.Sum256(chunk)] = true
+	}
+	shared := 0
+	for _, chunk := range b {
+		if seen[sha256.Sum256(chunk)] {
+			shared += len(chunk)
+		}
+	}
+	return shared
+}
+
+// 在文件中间插入几个字节后，FastCDC 只有插入点附近的数据块改变，固定分块则之后的数据块全部改变
+func TestFastCDCDeduplicatesAcrossVersions(t *testing.T) {
+	v1 := randomData(3, 1024*1024)
+	v2 := append(append(append([]byte{}, v1[:300*1024]...), "inserted"...), v1[300*1024:]...)
+
+	cdc := sharedBytes(chunkAll(t, bytes.NewReader(v1), cdcConfig()), chunkAll(t, bytes.NewReader(v2), cdcConfig()))
+	if cdc < len(v2)*9/10 {
+		t.Fatalf("fastcdc shares %d of %d bytes", cdc, len(v2))
+	}
+	fixed := sharedBytes(chunkAll(t, bytes.NewReader(v1), fixedConfig(8*1024)), chunkAll(t, bytes.NewReader(v2), fixedConfig(8*1024)))
+	if fixed > 300*1024 {
+		t.Fatalf("fixed chunker shares %d bytes after the insertion point", fixed)
+	}
+
+	// 相同的版本切分结果完全相同
+	if same := sharedBytes(chunkAll(t, bytes.NewReader(v1), cdcConfig()), chunkAll(t, bytes.NewReader(v1), cdcConfig())); same != len(v1) {
+		t.Fatalf("identical files share %d of %d bytes", same, len(v1))
+	}
+}
@@ -0,0 +1,213 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 变色龙公钥和随机数的编码。
+//
+// 公钥和随机数只保存方案自己的规范编码，解码时由方案检查并转换为规范编码，
+// 因此同一个公钥总是得到相同的字节，可以直接比较。
+//
+// p256 的公钥使用 SEC1 非压缩格式: 0x04 || X || Y，共65字节。
+// 随机数使用带版本号的定长格式: 0x01 || rX || rY || s，共97字节。
+// 每个坐标和标量都补齐到32字节。旧版本直接拼接 big.Int.Bytes()，坐标有前导零时长度不足，
+// 解码时会尝试所有可能的切分，选择点在曲线上的那一种，因此旧的记录仍然可以读取。
+
+const (
+	// pubKeyPrefix 是 SEC1 非压缩公钥的首字节
+	pubKeyPrefix = 0x04
+	// pubKeySize 是编码后的公钥长度
+	pubKeySize = 1 + pointSize
+	// randomNumVersion 是随机数编码的版本号
+	randomNumVersion = 0x01
+	// randomNumSize 是编码后的随机数长度
+	randomNumSize = 1 + pointSize + scalarSize
+)
+
+var (
+	// ErrInvalidSecKey 表示私钥不是方案的有效私钥
+	ErrInvalidSecKey = errors.New("invalid chameleon secret key")
+	// ErrInvalidPubKey 表示公钥的编码无效或不在曲线上
+	ErrInvalidPubKey = errors.New("invalid chameleon public key")
+	// ErrInvalidRandomNum 表示随机数的编码无效或随机点不在曲线上
+	ErrInvalidRandomNum = errors.New("invalid chameleon random number")
+)
+
+// PubKeyFromSecKey 由变色龙私钥计算公钥
+// 参数:
+// - scheme: 方案 ID，为空表示 p256。
+// - secKey: 变色龙私钥。
+func PubKeyFromSecKey(scheme string, secKey []byte) (*ChameleomPubKey, error) {
+	s, err := GetScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.PublicKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ChameleomPubKey{scheme: s, data: data}, nil
+}
+
+// Scheme 返回公钥所属方案的 ID
+func (pubKey *ChameleomPubKey) Scheme() string {
+	return pubKey.scheme.ID()
+}
+
+// Serialize 返回公钥的规范编码
+func (pubKey *ChameleomPubKey) Serialize() []byte {
+	return append([]byte{}, pubKey.data...)
+}
+
+// Equal 判断两个公钥是否相同，与解码前的编码格式无关
+func (pubKey *ChameleomPubKey) Equal(other *ChameleomPubKey) bool {
+	return pubKey.scheme.ID() == other.scheme.ID() && bytes.Equal(pubKey.data, other.data)
+}
+
+// ParseChameleomPubKey 按方案解码公钥
+// 参数:
+// - scheme: 方案 ID，为空表示 p256。
+// - data: 公钥的编码。
+// 返回值:
+// - *ChameleomPubKey: 公钥。
+// - error: 方案未知时返回 ErrUnknownScheme，编码无效时返回 ErrInvalidPubKey。
+func ParseChameleomPubKey(scheme string, data []byte) (*ChameleomPubKey, error) {
+	s, err := GetScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := s.ParsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ChameleomPubKey{scheme: s, data: canonical}, nil
+}
+
+// DeserializeChameleomPubKey 解码 p256 公钥，同时接受旧版本的拼接格式
+// 返回值:
+// - *ChameleomPubKey: 公钥。
+// - error: 长度无效或点不在曲线上时返回 ErrInvalidPubKey。
+func DeserializeChameleomPubKey(data []byte) (*ChameleomPubKey, error) {
+	return ParseChameleomPubKey(SchemeP256, data)
+}
+
+// Serialize 返回随机数的规范编码
+func (randomNum *ChameleonRandomNum) Serialize() []byte {
+	return append([]byte{}, randomNum.data...)
+}
+
+// ParseChameleonRandomNum 按方案解码随机数
+// 返回值:
+// - *ChameleonRandomNum: 随机数。
+// - error: 方案未知时返回 ErrUnknownScheme，编码无效时返回 ErrInvalidRandomNum。
+func ParseChameleonRandomNum(scheme string, data []byte) (*ChameleonRandomNum, error) {
+	s, err := GetScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := s.ParseRandomness(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ChameleonRandomNum{data: canonical}, nil
+}
+
+// DeserializeChameleonRandomNum 解码 p256 随机数，同时接受旧版本的拼接格式
+// 返回值:
+// - *ChameleonRandomNum: 随机数。
+// - error: 长度无效、随机点不在曲线上或 s 超出范围时返回 ErrInvalidRandomNum。
+func DeserializeChameleonRandomNum(data []byte) (*ChameleonRandomNum, error) {
+	return ParseChameleonRandomNum(SchemeP256, data)
+}
+
+// p256Point 返回 p256 公钥的坐标，公钥属于其他方案时返回错误
+func (pubKey *ChameleomPubKey) p256Point() (x, y *big.Int, err error) {
+	if pubKey.scheme.ID() != SchemeP256 {
+		return nil, nil, fmt.Errorf("%w: %s key used as %s", ErrUnknownScheme, pubKey.scheme.ID(), SchemeP256)
+	}
+	return decodeP256PubKey(pubKey.data)
+}
+
+// p256Values 返回 p256 随机数的随机点和标量
+func (randomNum *ChameleonRandomNum) p256Values() (rX, rY, s *big.Int, err error) {
+	return decodeP256RandomNum(randomNum.data)
+}
+
+// encodeP256PubKey 将公钥编码为 SEC1 非压缩格式
+func encodeP256PubKey(x, y *big.Int) []byte {
+	return append([]byte{pubKeyPrefix}, marshalPoint(x, y)...)
+}
+
+// decodeP256PubKey 解码 SEC1 或旧格式的公钥
+func decodeP256PubKey(data []byte) (x, y *big.Int, err error) {
+	if len(data) == pubKeySize && data[0] == pubKeyPrefix {
+		// crypto/ecdh 检查点在曲线上且不是无穷远点
+		if _, err := ecdh.P256().NewPublicKey(data); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPubKey, err)
+		}
+		return new(big.Int).SetBytes(data[1 : 1+scalarSize]), new(big.Int).SetBytes(data[1+scalarSize:]), nil
+	}
+	x, y, _, ok := splitLegacyPoint(data, 0, 0)
+	if !ok {
+		return nil, nil, ErrInvalidPubKey
+	}
+	return x, y, nil
+}
+
+// encodeP256RandomNum 将随机数编码为带版本号的定长格式
+func encodeP256RandomNum(rX, rY, s *big.Int) []byte {
+	res := make([]byte, randomNumSize)
+	res[0] = randomNumVersion
+	copy(res[1:], marshalPoint(rX, rY))
+	s.FillBytes(res[1+pointSize:])
+	return res
+}
+
+// decodeP256RandomNum 解码带版本号或旧格式的随机数
+func decodeP256RandomNum(data []byte) (rX, rY, s *big.Int, err error) {
+	var sBytes []byte
+	if len(data) == randomNumSize && data[0] == randomNumVersion {
+		rX, rY, err = unmarshalPoint(data[1 : 1+pointSize])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidRandomNum, err)
+		}
+		sBytes = data[1+pointSize:]
+	} else {
+		var ok bool
+		// 旧格式中 s 也可能有前导零，但至少有1个字节
+		rX, rY, sBytes, ok = splitLegacyPoint(data, 1, scalarSize)
+		if !ok {
+			return nil, nil, nil, ErrInvalidRandomNum
+		}
+	}
+	s = new(big.Int).SetBytes(sBytes)
+	if s.Cmp(curve.Params().N) >= 0 {
+		return nil, nil, nil, ErrInvalidRandomNum
+	}
+	return rX, rY, s, nil
+}
+
+// splitLegacyPoint 从旧格式 X.Bytes() || Y.Bytes() || rest 的开头解析一个曲线点。
+// 坐标长度未知，依次尝试所有切分，优先尝试不需要补零的32字节，rest 的长度在 minRest 和 maxRest 之间。
+// 随机的切分恰好得到曲线上的点的概率可以忽略，因此结果是唯一的。
+func splitLegacyPoint(data []byte, minRest, maxRest int) (x, y *big.Int, rest []byte, ok bool) {
+	for xLen := scalarSize; xLen >= 1; xLen-- {
+		for yLen := scalarSize; yLen >= 1; yLen-- {
+			restLen := len(data) - xLen - yLen
+			if restLen < minRest || restLen > maxRest {
+				continue
+			}
+			x = new(big.Int).SetBytes(data[:xLen])
+			y = new(big.Int).SetBytes(data[xLen : xLen+yLen])
+			if _, err := newP256Point(x, y); err == nil {
+				return x, y, data[xLen+yLen:], true
+			}
+		}
+	}
+	return nil, nil, nil, false
+}
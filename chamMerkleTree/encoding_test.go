@@ -0,0 +1,257 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// 旧版本直接拼接 big.Int.Bytes() 生成的记录，公钥的 X 坐标、随机点的 X 坐标和 s 都有前导零，
+// 因此公钥只有63字节，随机数只有94字节
+const (
+	legacyMessage   = "legacy fixture"
+	legacyPubKey    = "bfc0c697abefa61179a8bffc5d2d37508b2cc8c4dc5bbeb55d111575e602f7970f47c769f922c5f248055ad690401e7845a047af2f4bdca806e513f215b2cf"
+	legacyRandomNum = "c364d6fa468df35d73b553c62202bc4038438cbf9d8099fb6e215172884b0bf2a59038502edd128fef3a4391891c8c4f0425348af207ca62df85dedc318315b90c446ec1f32e18ba8b0b1257017735121cf75c3d1ca43320d6cd7d258fe5"
+	legacyRootHash  = "bcb5c9e347740ef8853c02941469c25a987b8f63fe708cd902c13683bc6fb847"
+	// 同一个公钥和随机数的规范编码
+	canonicalPubKey    = "0400bfc0c697abefa61179a8bffc5d2d37508b2cc8c4dc5bbeb55d111575e602f7970f47c769f922c5f248055ad690401e7845a047af2f4bdca806e513f215b2cf"
+	canonicalRandomNum = "0100c364d6fa468df35d73b553c62202bc4038438cbf9d8099fb6e215172884b0bf2a59038502edd128fef3a4391891c8c4f0425348af207ca62df85dedc31831500b90c446ec1f32e18ba8b0b1257017735121cf75c3d1ca43320d6cd7d258fe5"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLegacyEncodingFixture(t *testing.T) {
+	pubKey, err := DeserializeChameleomPubKey(mustHex(t, legacyPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(pubKey.Serialize()); got != canonicalPubKey {
+		t.Fatalf("legacy public key decoded to %s", got)
+	}
+	canonical, err := DeserializeChameleomPubKey(mustHex(t, canonicalPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubKey.Equal(canonical) {
+		t.Fatal("legacy and canonical public keys differ")
+	}
+
+	// 完整长度的旧格式就是去掉版本号的规范编码
+	for _, legacy := range []string{legacyRandomNum, canonicalRandomNum[2:]} {
+		randomNum, err := DeserializeChameleonRandomNum(mustHex(t, legacy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(randomNum.Serialize()); got != canonicalRandomNum {
+			t.Fatalf("legacy random number decoded to %s", got)
+		}
+		rootHash := mustHex(t, legacyRootHash)
+		if !VerifyMerkleRoot([]byte(legacyMessage), rootHash, pubKey, randomNum) {
+			t.Fatal("legacy record does not open its root hash")
+		}
+		if VerifyMerkleRoot([]byte("other message"), rootHash, pubKey, randomNum) {
+			t.Fatal("legacy record opens the root hash for another message")
+		}
+	}
+}
+
+func TestPubKeyEncoding(t *testing.T) {
+	for _, scheme := range Schemes() {
+		t.Run(scheme, func(t *testing.T) {
+			secKey, pubKey, err := GenerateKeyPair(scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := pubKey.Serialize()
+			parsed, err := ParseChameleomPubKey(scheme, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Equal(pubKey) || !bytes.Equal(parsed.Serialize(), data) {
+				t.Fatal("public key changed in a round trip")
+			}
+			derived, err := PubKeyFromSecKey(scheme, secKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !derived.Equal(pubKey) {
+				t.Fatal("public key derived from the secret key differs")
+			}
+			// Serialize 返回副本，修改它不会改变公钥
+			data[len(data)-1] ^= 1
+			if parsed.Equal(&ChameleomPubKey{scheme: parsed.scheme, data: data}) || !parsed.Equal(pubKey) {
+				t.Fatal("serialized public key aliases the key")
+			}
+
+			for _, id := range Schemes() {
+				other, err := GetScheme(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id != scheme && pubKey.Equal(&ChameleomPubKey{scheme: other, data: pubKey.Serialize()}) {
+					t.Fatal("keys of different schemes are equal")
+				}
+			}
+		})
+	}
+}
+
+func TestPubKeyEncodingRejectsInvalid(t *testing.T) {
+	_, p256Key, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := GenerateKeyPair(SchemeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := p256Key.Serialize()
+	offCurve := append([]byte{}, valid...)
+	offCurve[len(offCurve)-1] ^= 1
+	badPrefix := append([]byte{0x05}, valid[1:]...)
+	infinity := append([]byte{pubKeyPrefix}, make([]byte, pointSize)...)
+	// y = 1 是 edwards25519 的单位元，属于小阶点
+	smallOrder := make([]byte, ed25519Size)
+	smallOrder[0] = 1
+
+	tests := []struct {
+		name   string
+		scheme string
+		data   []byte
+	}{
+		{"p256 empty", SchemeP256, nil},
+		{"p256 truncated", SchemeP256, valid[:pubKeySize-1]},
+		{"p256 too long", SchemeP256, append(append([]byte{}, valid...), 0)},
+		{"p256 off curve", SchemeP256, offCurve},
+		{"p256 bad prefix", SchemeP256, badPrefix},
+		{"p256 infinity", SchemeP256, infinity},
+		{"ed25519 empty", SchemeEd25519, nil},
+		{"ed25519 truncated", SchemeEd25519, edKey.Serialize()[:ed25519Size-1]},
+		{"ed25519 p256 key", SchemeEd25519, valid},
+		{"ed25519 identity", SchemeEd25519, smallOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseChameleomPubKey(tt.scheme, tt.data); !errors.Is(err, ErrInvalidPubKey) {
+				t.Fatalf("got %v, want ErrInvalidPubKey", err)
+			}
+		})
+	}
+	if _, err := ParseChameleomPubKey("rsa", valid); !errors.Is(err, ErrUnknownScheme) {
+		t.Fatalf("got %v, want ErrUnknownScheme", err)
+	}
+}
+
+func TestRandomNumEncoding(t *testing.T) {
+	for _, scheme := range Schemes() {
+		t.Run(scheme, func(t *testing.T) {
+			_, pubKey, err := GenerateKeyPair(scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := []byte("message")
+			hash, randomness, err := pubKey.scheme.Hash(pubKey.data, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			randomNum, err := ParseChameleonRandomNum(scheme, randomness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(randomNum.Serialize(), randomness) {
+				t.Fatal("random number changed in a round trip")
+			}
+			if !VerifyMerkleRoot(message, hash, pubKey, randomNum) {
+				t.Fatal("decoded random number does not open the hash")
+			}
+		})
+	}
+}
+
+func TestRandomNumEncodingRejectsInvalid(t *testing.T) {
+	_, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, randomness, err := pubKey.scheme.Hash(pubKey.data, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func([]byte)) []byte {
+		data := append([]byte{}, randomness...)
+		f(data)
+		return data
+	}
+	// s 必须小于曲线的阶
+	largeS := modify(func(data []byte) { curve.Params().N.FillBytes(data[1+pointSize:]) })
+	legacyLargeS := largeS[1:]
+
+	_, edKey, err := GenerateKeyPair(SchemeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edRandomness, err := edKey.scheme.Hash(edKey.data, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edNonCanonical := append([]byte{}, edRandomness...)
+	for i := ed25519Size; i < ed25519RandomSize; i++ {
+		edNonCanonical[i] = 0xff
+	}
+
+	tests := []struct {
+		name   string
+		scheme string
+		data   []byte
+	}{
+		{"p256 empty", SchemeP256, nil},
+		{"p256 truncated", SchemeP256, randomness[:randomNumSize-1]},
+		{"p256 too long", SchemeP256, append(append([]byte{}, randomness...), 0)},
+		{"p256 bad version", SchemeP256, modify(func(data []byte) { data[0] = 0x02 })},
+		{"p256 off curve", SchemeP256, modify(func(data []byte) { data[pointSize] ^= 1 })},
+		{"p256 s too large", SchemeP256, largeS},
+		{"p256 legacy s too large", SchemeP256, legacyLargeS},
+		{"ed25519 truncated", SchemeEd25519, edRandomness[:ed25519RandomSize-1]},
+		{"ed25519 p256 random number", SchemeEd25519, randomness},
+		{"ed25519 non-canonical s", SchemeEd25519, edNonCanonical},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseChameleonRandomNum(tt.scheme, tt.data); !errors.Is(err, ErrInvalidRandomNum) {
+				t.Fatalf("got %v, want ErrInvalidRandomNum", err)
+			}
+		})
+	}
+}
+
+func TestPubKeyFromSecKeyRejectsInvalid(t *testing.T) {
+	n := curve.Params().N.Bytes()
+	tests := []struct {
+		name   string
+		scheme string
+		secKey []byte
+	}{
+		{"p256 empty", SchemeP256, nil},
+		{"p256 zero", SchemeP256, make([]byte, scalarSize)},
+		{"p256 order", SchemeP256, n},
+		{"p256 too long", SchemeP256, make([]byte, scalarSize+1)},
+		{"ed25519 zero", SchemeEd25519, make([]byte, ed25519Size)},
+		{"ed25519 non-canonical", SchemeEd25519, bytes.Repeat([]byte{0xff}, ed25519Size)},
+		{"ed25519 short", SchemeEd25519, make([]byte, ed25519Size-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := PubKeyFromSecKey(tt.scheme, tt.secKey); !errors.Is(err, ErrInvalidSecKey) {
+				t.Fatalf("got %v, want ErrInvalidSecKey", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,822 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// 证明二进制编码的版本号，没有子树的证明仍然使用版本1
+const (
+	proofVersion        = 1
+	subtreeProofVersion = 2
+)
+
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+// MerkleProof 是基于叶子下标的默克尔证明。
+// Siblings 按从叶子到根的顺序只保存实际存在的兄弟节点，
+// 某一层是否有兄弟节点由 LeafIndex 和 TreeSize 唯一确定，因此不需要空占位。
+// 树使用变色龙子树时，Siblings 只到叶子所在的子树根为止，Subtree 证明子树根属于整棵树。
+type MerkleProof struct {
+	LeafIndex uint64
+	TreeSize  uint64
+	Siblings  [][]byte
+	Subtree   *SubtreeProof
+}
+
+// SubtreeProof 是叶子所在的变色龙子树根到根节点的证明
+type SubtreeProof struct {
+	Height    uint64   // 子树高度
+	Hash      []byte   // 子树根的变色龙哈希
+	RandomNum []byte   // 子树根的随机数
+	Siblings  [][]byte // 子树根到根节点的兄弟节点，规则与叶子的兄弟节点相同
+}
+
+// MerkleMultiProof 是多个叶子共享兄弟节点的默克尔证明。
+// Indices 升序排列且不重复，Siblings 按逐层、从左到右的顺序保存验证所需但无法由已知叶子推出的节点。
+// 树使用变色龙子树时，Siblings 依次保存每个涉及的子树内部的兄弟节点，Subtrees 证明这些子树根属于整棵树。
+type MerkleMultiProof struct {
+	Indices  []uint64
+	TreeSize uint64
+	Siblings [][]byte
+	Subtrees *SubtreeMultiProof
+}
+
+// SubtreeMultiProof 是多个变色龙子树根到根节点的证明，Hashes 和 RandomNums 按子树顺序排列
+type SubtreeMultiProof struct {
+	Height     uint64
+	Hashes     [][]byte
+	RandomNums [][]byte
+	Siblings   [][]byte
+}
+
+// buildLevels 从叶子开始逐层计算哈希，规则与 BuildMerkleTree 相同：
+// 两两合并，奇数个节点时最后一个直接提升，直到只剩下一个或两个节点。
+// 最后一层的节点即为计算 chameleon hash 的消息。
+func buildLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	nodes := leaves
+	for len(nodes) > 2 {
+		var newLevel [][]byte
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 < len(nodes) {
+				newLevel = append(newLevel, getHash(append(append([]byte{}, nodes[i]...), nodes[i+1]...)))
+			} else {
+				newLevel = append(newLevel, nodes[i])
+			}
+		}
+		levels = append(levels, newLevel)
+		nodes = newLevel
+	}
+	return levels
+}
+
+// subtreeSpan 返回第 index 个叶子所在的子树序号、在子树中的下标和这个子树的叶子数
+func subtreeSpan(index, treeSize, height uint64) (subtree, local, size uint64) {
+	subtree = index >> height
+	start := subtree << height
+	return subtree, index - start, min(uint64(1)<<height, treeSize-start)
+}
+
+// subtreeCount 返回 treeSize 个叶子分成的子树个数
+func subtreeCount(treeSize, height uint64) uint64 {
+	return (treeSize + uint64(1)<<height - 1) >> height
+}
+
+// validSubtreeHeight 检查证明中的子树高度
+func validSubtreeHeight(height uint64) bool {
+	return height > 0 && height <= maxSubtreeHeight
+}
+
+// subtreeHashes 返回子树根的哈希
+func subtreeHashes(subtrees []*MerkleNode) [][]byte {
+	hashes := make([][]byte, len(subtrees))
+	for i, subtree := range subtrees {
+		hashes[i] = subtree.Hash
+	}
+	return hashes
+}
+
+// siblingQueue 按顺序取出证明中的兄弟节点
+type siblingQueue [][]byte
+
+// next 取出下一个兄弟节点，证明中的兄弟节点不足时返回 nil
+func (queue *siblingQueue) next() []byte {
+	if len(*queue) == 0 {
+		return nil
+	}
+	sibling := (*queue)[0]
+	*queue = (*queue)[1:]
+	return sibling
+}
+
+// pathSiblings 返回 leaves 中第 index 个叶子到变色龙节点路径上的兄弟节点
+func pathSiblings(leaves [][]byte, index uint64) [][]byte {
+	var siblings [][]byte
+	idx := index
+	for _, level := range buildLevels(leaves) {
+		if sibling := idx ^ 1; sibling < uint64(len(level)) {
+			siblings = append(siblings, level[sibling])
+		}
+		idx /= 2
+	}
+	return siblings
+}
+
+// pathMessage 由叶子和兄弟节点计算变色龙节点的消息，兄弟节点不足时返回 nil
+func pathMessage(idx, size uint64, targetHash []byte, siblings *siblingQueue) []byte {
+	currentHash := targetHash
+	for size > 2 {
+		if sibling := idx ^ 1; sibling < size {
+			siblingHash := siblings.next()
+			if siblingHash == nil {
+				return nil
+			}
+			if idx%2 == 0 {
+				currentHash = getHash(append(append([]byte{}, currentHash...), siblingHash...))
+			} else {
+				currentHash = getHash(append(append([]byte{}, siblingHash...), currentHash...))
+			}
+		}
+		idx, size = idx/2, (size+1)/2
+	}
+
+	if size == 2 {
+		siblingHash := siblings.next()
+		if siblingHash == nil {
+			return nil
+		}
+		if idx == 0 {
+			return append(append([]byte{}, currentHash...), siblingHash...)
+		}
+		return append(append([]byte{}, siblingHash...), currentHash...)
+	}
+	return currentHash
+}
+
+// GenerateMerkleProofByIndex 为第 index 个叶子生成默克尔证明。
+// 与 GenerateMerkleProof 不同，它按下标定位叶子，能够区分内容相同的重复数据块。
+// 参数:
+// - root: 默克尔树的根节点。
+// - index: 叶子下标，从0开始，与文件中数据块的顺序一致。
+// 返回值:
+// - *MerkleProof: 默克尔证明。
+// - error: 如果下标越界，返回错误信息。
+func GenerateMerkleProofByIndex(root *MerkleNode, index int) (*MerkleProof, error) {
+	leaves := GetAllLeavesHashes(root)
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range [0, %d)", index, len(leaves))
+	}
+
+	proof := &MerkleProof{
+		LeafIndex: uint64(index),
+		TreeSize:  uint64(len(leaves)),
+	}
+	if root.SubtreeHeight == 0 {
+		proof.Siblings = pathSiblings(leaves, proof.LeafIndex)
+		return proof, nil
+	}
+
+	height := uint64(root.SubtreeHeight)
+	subtrees := SubtreeRoots(root)
+	subtree, local, _ := subtreeSpan(proof.LeafIndex, proof.TreeSize, height)
+	node := subtrees[subtree]
+	proof.Siblings = pathSiblings(GetAllLeavesHashes(node), local)
+	proof.Subtree = &SubtreeProof{
+		Height:    height,
+		Hash:      node.Hash,
+		RandomNum: node.RandomNum.Serialize(),
+		Siblings:  pathSiblings(subtreeHashes(subtrees), subtree),
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProofByIndex 验证 GenerateMerkleProofByIndex 生成的默克尔证明。
+// 使用变色龙子树时先用子树根的随机数验证叶子属于子树，再用根节点的随机数验证子树根属于整棵树。
+// 参数：
+// - rootHash: Merkle 树的根哈希值。
+// - targetHash: 目标叶子节点的哈希值。
+// - proof: 默克尔证明。
+// - pubKey: 公钥，用于验证 Chameleon 哈希。
+// - randomNum: 随机数，用于验证 Chameleon 哈希。
+// 返回值：
+// - bool: 如果证明有效，返回 true；否则返回 false。
+func VerifyMerkleProofByIndex(rootHash, targetHash []byte, proof *MerkleProof, pubKey *ChameleomPubKey, randomNum *ChameleonRandomNum) bool {
+	if proof == nil || proof.LeafIndex >= proof.TreeSize {
+		return false
+	}
+	siblings := siblingQueue(proof.Siblings)
+	if proof.Subtree == nil {
+		message := pathMessage(proof.LeafIndex, proof.TreeSize, targetHash, &siblings)
+		return message != nil && len(siblings) == 0 && VerifyMerkleRoot(message, rootHash, pubKey, randomNum)
+	}
+
+	sub := proof.Subtree
+	if !validSubtreeHeight(sub.Height) {
+		return false
+	}
+	subtree, local, size := subtreeSpan(proof.LeafIndex, proof.TreeSize, sub.Height)
+	message := pathMessage(local, size, targetHash, &siblings)
+	if message == nil || len(siblings) != 0 || !VerifyMerkleRoot(message, sub.Hash, pubKey, &ChameleonRandomNum{data: sub.RandomNum}) {
+		return false
+	}
+	upper := siblingQueue(sub.Siblings)
+	message = pathMessage(subtree, subtreeCount(proof.TreeSize, sub.Height), sub.Hash, &upper)
+	return message != nil && len(upper) == 0 && VerifyMerkleRoot(message, rootHash, pubKey, randomNum)
+}
+
+// multiSiblings 返回 leaves 中 known 这些叶子到变色龙节点所需的兄弟节点，known 升序且不重复
+func multiSiblings(leaves [][]byte, known []uint64) [][]byte {
+	var siblings [][]byte
+	for _, level := range buildLevels(leaves) {
+		set := make(map[uint64]bool, len(known))
+		for _, idx := range known {
+			set[idx] = true
+		}
+		for _, idx := range known {
+			if sibling := idx ^ 1; sibling < uint64(len(level)) && !set[sibling] {
+				siblings = append(siblings, level[sibling])
+			}
+		}
+		known = parentIndices(known)
+	}
+	return siblings
+}
+
+// multiMessage 由多个叶子和兄弟节点计算变色龙节点的消息，兄弟节点不足时返回 nil
+func multiMessage(known []uint64, size uint64, leafHashes [][]byte, siblings *siblingQueue) []byte {
+	current := make(map[uint64][]byte, len(leafHashes))
+	for i, idx := range known {
+		current[idx] = leafHashes[i]
+	}
+
+	for size > 2 {
+		for _, idx := range known {
+			if sibling := idx ^ 1; sibling < size {
+				if _, ok := current[sibling]; !ok {
+					if current[sibling] = siblings.next(); current[sibling] == nil {
+						return nil
+					}
+				}
+			}
+		}
+		parents := make(map[uint64][]byte, len(known))
+		for _, idx := range known {
+			parent := idx / 2
+			if _, ok := parents[parent]; ok {
+				continue
+			}
+			left, right := parent*2, parent*2+1
+			if right < size {
+				parents[parent] = getHash(append(append([]byte{}, current[left]...), current[right]...))
+			} else {
+				parents[parent] = current[left]
+			}
+		}
+		current = parents
+		known = parentIndices(known)
+		size = (size + 1) / 2
+	}
+
+	if size == 2 {
+		for _, idx := range []uint64{0, 1} {
+			if _, ok := current[idx]; !ok {
+				if current[idx] = siblings.next(); current[idx] == nil {
+					return nil
+				}
+			}
+		}
+		return append(append([]byte{}, current[0]...), current[1]...)
+	}
+	return current[0]
+}
+
+// subtreeGroup 是 Indices 中属于同一个子树的一段下标 [start, end)
+type subtreeGroup struct {
+	subtree    uint64
+	start, end int
+}
+
+// groupBySubtree 将升序的叶子下标按所在的子树分组
+func groupBySubtree(indices []uint64, height uint64) []subtreeGroup {
+	var groups []subtreeGroup
+	for i, idx := range indices {
+		subtree := idx >> height
+		if len(groups) == 0 || groups[len(groups)-1].subtree != subtree {
+			groups = append(groups, subtreeGroup{subtree: subtree, start: i})
+		}
+		groups[len(groups)-1].end = i + 1
+	}
+	return groups
+}
+
+// localIndices 返回子树中的下标
+func (group subtreeGroup) localIndices(indices []uint64, height uint64) []uint64 {
+	locals := make([]uint64, 0, group.end-group.start)
+	for _, idx := range indices[group.start:group.end] {
+		locals = append(locals, idx-group.subtree<<height)
+	}
+	return locals
+}
+
+// GenerateMerkleMultiProof 为多个叶子生成共享兄弟节点的默克尔证明。
+// 参数:
+// - root: 默克尔树的根节点。
+// - indices: 叶子下标，可以无序或重复。
+// 返回值:
+// - *MerkleMultiProof: 默克尔多叶子证明，Indices 为去重并排序后的下标。
+// - error: 如果下标越界或为空，返回错误信息。
+func GenerateMerkleMultiProof(root *MerkleNode, indices []int) (*MerkleMultiProof, error) {
+	leaves := GetAllLeavesHashes(root)
+	if len(indices) == 0 {
+		return nil, errors.New("no leaf index given")
+	}
+	known := make([]uint64, 0, len(indices))
+	for _, index := range indices {
+		if index < 0 || index >= len(leaves) {
+			return nil, fmt.Errorf("leaf index %d out of range [0, %d)", index, len(leaves))
+		}
+		known = append(known, uint64(index))
+	}
+	known = sortUnique(known)
+
+	proof := &MerkleMultiProof{
+		Indices:  known,
+		TreeSize: uint64(len(leaves)),
+	}
+	if root.SubtreeHeight == 0 {
+		proof.Siblings = multiSiblings(leaves, known)
+		return proof, nil
+	}
+
+	height := uint64(root.SubtreeHeight)
+	subtrees := SubtreeRoots(root)
+	proof.Subtrees = &SubtreeMultiProof{Height: height}
+	var covered []uint64
+	for _, group := range groupBySubtree(known, height) {
+		node := subtrees[group.subtree]
+		proof.Siblings = append(proof.Siblings, multiSiblings(GetAllLeavesHashes(node), group.localIndices(known, height))...)
+		proof.Subtrees.Hashes = append(proof.Subtrees.Hashes, node.Hash)
+		proof.Subtrees.RandomNums = append(proof.Subtrees.RandomNums, node.RandomNum.Serialize())
+		covered = append(covered, group.subtree)
+	}
+	proof.Subtrees.Siblings = multiSiblings(subtreeHashes(subtrees), covered)
+	return proof, nil
+}
+
+// VerifyMerkleMultiProof 验证 GenerateMerkleMultiProof 生成的默克尔多叶子证明。
+// 参数：
+// - rootHash: Merkle 树的根哈希值。
+// - leafHashes: 叶子哈希，与 proof.Indices 一一对应。
+// - proof: 默克尔多叶子证明。
+// - pubKey: 公钥，用于验证 Chameleon 哈希。
+// - randomNum: 随机数，用于验证 Chameleon 哈希。
+// 返回值：
+// - bool: 如果证明有效，返回 true；否则返回 false。
+func VerifyMerkleMultiProof(rootHash []byte, leafHashes [][]byte, proof *MerkleMultiProof, pubKey *ChameleomPubKey, randomNum *ChameleonRandomNum) bool {
+	if proof == nil || len(proof.Indices) == 0 || len(proof.Indices) != len(leafHashes) {
+		return false
+	}
+	for i, idx := range proof.Indices {
+		if idx >= proof.TreeSize || (i > 0 && idx <= proof.Indices[i-1]) {
+			return false
+		}
+	}
+	siblings := siblingQueue(proof.Siblings)
+	if proof.Subtrees == nil {
+		message := multiMessage(proof.Indices, proof.TreeSize, leafHashes, &siblings)
+		return message != nil && len(siblings) == 0 && VerifyMerkleRoot(message, rootHash, pubKey, randomNum)
+	}
+
+	sub := proof.Subtrees
+	if !validSubtreeHeight(sub.Height) {
+		return false
+	}
+	groups := groupBySubtree(proof.Indices, sub.Height)
+	if len(sub.Hashes) != len(groups) || len(sub.RandomNums) != len(groups) {
+		return false
+	}
+	var covered []uint64
+	for i, group := range groups {
+		_, _, size := subtreeSpan(proof.Indices[group.start], proof.TreeSize, sub.Height)
+		message := multiMessage(group.localIndices(proof.Indices, sub.Height), size, leafHashes[group.start:group.end], &siblings)
+		if message == nil || !VerifyMerkleRoot(message, sub.Hashes[i], pubKey, &ChameleonRandomNum{data: sub.RandomNums[i]}) {
+			return false
+		}
+		covered = append(covered, group.subtree)
+	}
+	if len(siblings) != 0 {
+		return false
+	}
+	upper := siblingQueue(sub.Siblings)
+	message := multiMessage(covered, subtreeCount(proof.TreeSize, sub.Height), sub.Hashes, &upper)
+	return message != nil && len(upper) == 0 && VerifyMerkleRoot(message, rootHash, pubKey, randomNum)
+}
+
+// sortUnique 对下标排序并去重
+func sortUnique(indices []uint64) []uint64 {
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	res := indices[:0]
+	for i, idx := range indices {
+		if i == 0 || idx != indices[i-1] {
+			res = append(res, idx)
+		}
+	}
+	return res
+}
+
+// parentIndices 返回已排序下标在上一层对应的父节点下标
+func parentIndices(indices []uint64) []uint64 {
+	var parents []uint64
+	for _, idx := range indices {
+		if len(parents) == 0 || parents[len(parents)-1] != idx/2 {
+			parents = append(parents, idx/2)
+		}
+	}
+	return parents
+}
+
+// MarshalBinary 将证明编码为紧凑的二进制格式：
+// version(1字节) | leafIndex(uvarint) | treeSize(uvarint) | count(uvarint) | siblings(每个32字节)
+// 使用变色龙子树时版本号为2，并在末尾追加 height(uvarint) | hash | randomNum | count(uvarint) | siblings，
+// 子树部分的每一项都以 uvarint 长度开头，因为变色龙哈希的长度由方案决定。
+func (proof *MerkleProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if proof.Subtree == nil {
+		buf.WriteByte(proofVersion)
+	} else {
+		buf.WriteByte(subtreeProofVersion)
+	}
+	writeUvarint(&buf, proof.LeafIndex)
+	writeUvarint(&buf, proof.TreeSize)
+	if err := writeHashes(&buf, proof.Siblings); err != nil {
+		return nil, err
+	}
+	if sub := proof.Subtree; sub != nil {
+		writeUvarint(&buf, sub.Height)
+		writeBytes(&buf, sub.Hash)
+		writeBytes(&buf, sub.RandomNum)
+		writeByteSlices(&buf, sub.Siblings)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary 解码 MarshalBinary 生成的二进制证明
+func (proof *MerkleProof) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	version, err := readVersion(r)
+	if err != nil {
+		return err
+	}
+	leafIndex, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: leaf index: %v", ErrInvalidProof, err)
+	}
+	treeSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: tree size: %v", ErrInvalidProof, err)
+	}
+	siblings, err := readHashes(r)
+	if err != nil {
+		return err
+	}
+	var sub *SubtreeProof
+	if version == subtreeProofVersion {
+		sub = &SubtreeProof{}
+		if sub.Height, err = binary.ReadUvarint(r); err != nil {
+			return fmt.Errorf("%w: subtree height: %v", ErrInvalidProof, err)
+		}
+		if sub.Hash, err = readBytes(r); err != nil {
+			return err
+		}
+		if sub.RandomNum, err = readBytes(r); err != nil {
+			return err
+		}
+		if sub.Siblings, err = readByteSlices(r); err != nil {
+			return err
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidProof, r.Len())
+	}
+	proof.LeafIndex, proof.TreeSize, proof.Siblings, proof.Subtree = leafIndex, treeSize, siblings, sub
+	return nil
+}
+
+// merkleProofJSON 是 MerkleProof 的 JSON 格式，哈希使用16进制字符串
+type merkleProofJSON struct {
+	LeafIndex uint64            `json:"leafIndex"`
+	TreeSize  uint64            `json:"treeSize"`
+	Siblings  []string          `json:"siblings"`
+	Subtree   *subtreeProofJSON `json:"subtree,omitempty"`
+}
+
+// subtreeProofJSON 是 SubtreeProof 的 JSON 格式
+type subtreeProofJSON struct {
+	Height    uint64   `json:"height"`
+	Hash      string   `json:"hash"`
+	RandomNum string   `json:"randomNum"`
+	Siblings  []string `json:"siblings"`
+}
+
+// MarshalJSON 将证明编码为 JSON
+func (proof *MerkleProof) MarshalJSON() ([]byte, error) {
+	res := merkleProofJSON{
+		LeafIndex: proof.LeafIndex,
+		TreeSize:  proof.TreeSize,
+		Siblings:  encodeHexHashes(proof.Siblings),
+	}
+	if sub := proof.Subtree; sub != nil {
+		res.Subtree = &subtreeProofJSON{
+			Height:    sub.Height,
+			Hash:      hex.EncodeToString(sub.Hash),
+			RandomNum: hex.EncodeToString(sub.RandomNum),
+			Siblings:  encodeHexHashes(sub.Siblings),
+		}
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON 解码 JSON 格式的证明
+func (proof *MerkleProof) UnmarshalJSON(data []byte) error {
+	var res merkleProofJSON
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	siblings, err := decodeHexHashes(res.Siblings, sha256.Size)
+	if err != nil {
+		return err
+	}
+	var sub *SubtreeProof
+	if res.Subtree != nil {
+		sub = &SubtreeProof{Height: res.Subtree.Height}
+		if sub.Hash, err = hex.DecodeString(res.Subtree.Hash); err != nil {
+			return fmt.Errorf("%w: subtree hash: %v", ErrInvalidProof, err)
+		}
+		if sub.RandomNum, err = hex.DecodeString(res.Subtree.RandomNum); err != nil {
+			return fmt.Errorf("%w: subtree random number: %v", ErrInvalidProof, err)
+		}
+		if sub.Siblings, err = decodeHexHashes(res.Subtree.Siblings, 0); err != nil {
+			return err
+		}
+	}
+	proof.LeafIndex, proof.TreeSize, proof.Siblings, proof.Subtree = res.LeafIndex, res.TreeSize, siblings, sub
+	return nil
+}
+
+// MarshalBinary 将多叶子证明编码为紧凑的二进制格式：
+// version(1字节) | treeSize(uvarint) | count(uvarint) | indices(uvarint) | count(uvarint) | siblings(每个32字节)
+// 使用变色龙子树时版本号为2，并在末尾追加 height(uvarint) | hashes | randomNums | siblings，
+// 每组都以 uvarint 个数开头，每一项都以 uvarint 长度开头。
+func (proof *MerkleMultiProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if proof.Subtrees == nil {
+		buf.WriteByte(proofVersion)
+	} else {
+		buf.WriteByte(subtreeProofVersion)
+	}
+	writeUvarint(&buf, proof.TreeSize)
+	writeUvarint(&buf, uint64(len(proof.Indices)))
+	for _, idx := range proof.Indices {
+		writeUvarint(&buf, idx)
+	}
+	if err := writeHashes(&buf, proof.Siblings); err != nil {
+		return nil, err
+	}
+	if sub := proof.Subtrees; sub != nil {
+		writeUvarint(&buf, sub.Height)
+		writeByteSlices(&buf, sub.Hashes)
+		writeByteSlices(&buf, sub.RandomNums)
+		writeByteSlices(&buf, sub.Siblings)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary 解码 MarshalBinary 生成的二进制多叶子证明
+func (proof *MerkleMultiProof) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	version, err := readVersion(r)
+	if err != nil {
+		return err
+	}
+	treeSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: tree size: %v", ErrInvalidProof, err)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: index count: %v", ErrInvalidProof, err)
+	}
+	if count > uint64(r.Len()) {
+		return fmt.Errorf("%w: index count %d too large", ErrInvalidProof, count)
+	}
+	indices := make([]uint64, count)
+	for i := range indices {
+		if indices[i], err = binary.ReadUvarint(r); err != nil {
+			return fmt.Errorf("%w: index: %v", ErrInvalidProof, err)
+		}
+	}
+	siblings, err := readHashes(r)
+	if err != nil {
+		return err
+	}
+	var sub *SubtreeMultiProof
+	if version == subtreeProofVersion {
+		sub = &SubtreeMultiProof{}
+		if sub.Height, err = binary.ReadUvarint(r); err != nil {
+			return fmt.Errorf("%w: subtree height: %v", ErrInvalidProof, err)
+		}
+		if sub.Hashes, err = readByteSlices(r); err != nil {
+			return err
+		}
+		if sub.RandomNums, err = readByteSlices(r); err != nil {
+			return err
+		}
+		if sub.Siblings, err = readByteSlices(r); err != nil {
+			return err
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidProof, r.Len())
+	}
+	proof.Indices, proof.TreeSize, proof.Siblings, proof.Subtrees = indices, treeSize, siblings, sub
+	return nil
+}
+
+// merkleMultiProofJSON 是 MerkleMultiProof 的 JSON 格式，哈希使用16进制字符串
+type merkleMultiProofJSON struct {
+	Indices  []uint64               `json:"indices"`
+	TreeSize uint64                 `json:"treeSize"`
+	Siblings []string               `json:"siblings"`
+	Subtrees *subtreeMultiProofJSON `json:"subtrees,omitempty"`
+}
+
+// subtreeMultiProofJSON 是 SubtreeMultiProof 的 JSON 格式
+type subtreeMultiProofJSON struct {
+	Height     uint64   `json:"height"`
+	Hashes     []string `json:"hashes"`
+	RandomNums []string `json:"randomNums"`
+	Siblings   []string `json:"siblings"`
+}
+
+// MarshalJSON 将多叶子证明编码为 JSON
+func (proof *MerkleMultiProof) MarshalJSON() ([]byte, error) {
+	res := merkleMultiProofJSON{
+		Indices:  proof.Indices,
+		TreeSize: proof.TreeSize,
+		Siblings: encodeHexHashes(proof.Siblings),
+	}
+	if sub := proof.Subtrees; sub != nil {
+		res.Subtrees = &subtreeMultiProofJSON{
+			Height:     sub.Height,
+			Hashes:     encodeHexHashes(sub.Hashes),
+			RandomNums: encodeHexHashes(sub.RandomNums),
+			Siblings:   encodeHexHashes(sub.Siblings),
+		}
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON 解码 JSON 格式的多叶子证明
+func (proof *MerkleMultiProof) UnmarshalJSON(data []byte) error {
+	var res merkleMultiProofJSON
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	siblings, err := decodeHexHashes(res.Siblings, sha256.Size)
+	if err != nil {
+		return err
+	}
+	var sub *SubtreeMultiProof
+	if res.Subtrees != nil {
+		sub = &SubtreeMultiProof{Height: res.Subtrees.Height}
+		if sub.Hashes, err = decodeHexHashes(res.Subtrees.Hashes, 0); err != nil {
+			return err
+		}
+		if sub.RandomNums, err = decodeHexHashes(res.Subtrees.RandomNums, 0); err != nil {
+			return err
+		}
+		if sub.Siblings, err = decodeHexHashes(res.Subtrees.Siblings, 0); err != nil {
+			return err
+		}
+	}
+	proof.Indices, proof.TreeSize, proof.Siblings, proof.Subtrees = res.Indices, res.TreeSize, siblings, sub
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	buf.Write(tmp[:n])
+}
+
+func writeHashes(buf *bytes.Buffer, hashes [][]byte) error {
+	writeUvarint(buf, uint64(len(hashes)))
+	for _, hash := range hashes {
+		if len(hash) != sha256.Size {
+			return fmt.Errorf("%w: hash length %d", ErrInvalidProof, len(hash))
+		}
+		buf.Write(hash)
+	}
+	return nil
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	writeUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func writeByteSlices(buf *bytes.Buffer, slices [][]byte) {
+	writeUvarint(buf, uint64(len(slices)))
+	for _, data := range slices {
+		writeBytes(buf, data)
+	}
+}
+
+func readVersion(r *bytes.Reader) (byte, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: empty data", ErrInvalidProof)
+	}
+	if version != proofVersion && version != subtreeProofVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidProof, version)
+	}
+	return version, nil
+}
+
+func readHashes(r *bytes.Reader) ([][]byte, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: sibling count: %v", ErrInvalidProof, err)
+	}
+	if count > uint64(r.Len()/sha256.Size) {
+		return nil, fmt.Errorf("%w: sibling count %d too large", ErrInvalidProof, count)
+	}
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		hashes[i] = make([]byte, sha256.Size)
+		r.Read(hashes[i])
+	}
+	return hashes, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: length: %v", ErrInvalidProof, err)
+	}
+	if length > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: length %d too large", ErrInvalidProof, length)
+	}
+	data := make([]byte, length)
+	r.Read(data)
+	return data, nil
+}
+
+func readByteSlices(r *bytes.Reader) ([][]byte, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: count: %v", ErrInvalidProof, err)
+	}
+	// 每一项至少有1个字节的长度
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: count %d too large", ErrInvalidProof, count)
+	}
+	slices := make([][]byte, count)
+	for i := range slices {
+		if slices[i], err = readBytes(r); err != nil {
+			return nil, err
+		}
+	}
+	return slices, nil
+}
+
+func encodeHexHashes(hashes [][]byte) []string {
+	res := make([]string, len(hashes))
+	for i, hash := range hashes {
+		res[i] = hex.EncodeToString(hash)
+	}
+	return res
+}
+
+// decodeHexHashes 解码16进制字符串，size 大于0时每一项必须恰好有 size 个字节，
+// 与二进制格式一样，叶子层的兄弟节点是 SHA-256 哈希，变色龙哈希的长度由方案决定
+func decodeHexHashes(hashes []string, size int) ([][]byte, error) {
+	res := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		var err error
+		if res[i], err = hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%w: sibling %d: %v", ErrInvalidProof, i, err)
+		}
+		if size > 0 && len(res[i]) != size {
+			return nil, fmt.Errorf("%w: sibling %d has %d bytes", ErrInvalidProof, i, len(res[i]))
+		}
+	}
+	return res, nil
+}
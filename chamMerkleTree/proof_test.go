@@ -0,0 +1,412 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// leafSize 是测试树使用的固定数据块大小，数据块越小，同样的数据生成的叶子越多
+const leafSize = 64
+
+// buildFile 把 data 写入临时文件，用 config 构建默克尔树
+func buildFile(t *testing.T, data []byte, config *MerkleConfig, pubKey *ChameleomPubKey) *MerkleNode {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	root, _, _, err := BuildMerkleTree(file, config, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// testTree 构建有 leaves 个叶子、子树高度为 height 的树
+func testTree(t *testing.T, leaves, height int) (*MerkleNode, *ChameleomPubKey) {
+	t.Helper()
+	_, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fixedConfig(leafSize)
+	config.SubtreeHeight = height
+	root := buildFile(t, randomData(int64(leaves), leaves*leafSize), config, pubKey)
+	return root, pubKey
+}
+
+// treeShapes 覆盖只有一两个叶子、叶子个数为奇数、子树不满以及子树高度大于树高的情况
+var treeShapes = []struct {
+	leaves, height int
+}{
+	{1, 0}, {2, 0}, {3, 0}, {7, 0}, {16, 0}, {33, 0},
+	{1, 2}, {5, 1}, {7, 2}, {16, 2}, {33, 3}, {6, 5},
+}
+
+func TestMerkleProofByIndex(t *testing.T) {
+	for _, shape := range treeShapes {
+		t.Run(fmt.Sprintf("%d leaves height %d", shape.leaves, shape.height), func(t *testing.T) {
+			root, pubKey := testTree(t, shape.leaves, shape.height)
+			leaves := GetAllLeavesHashes(root)
+			for i, leaf := range leaves {
+				proof, err := GenerateMerkleProofByIndex(root, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (proof.Subtree != nil) != (shape.height > 0) {
+					t.Fatalf("leaf %d: subtree proof present = %v", i, proof.Subtree != nil)
+				}
+				if !VerifyMerkleProofByIndex(root.Hash, leaf, proof, pubKey, root.RandomNum) {
+					t.Fatalf("leaf %d: valid proof rejected", i)
+				}
+				// 同一个证明不能用来证明其他叶子
+				other := leaves[(i+1)%len(leaves)]
+				if len(leaves) > 1 && VerifyMerkleProofByIndex(root.Hash, other, proof, pubKey, root.RandomNum) {
+					t.Fatalf("leaf %d: proof accepted for another leaf", i)
+				}
+			}
+			for _, index := range []int{-1, len(leaves)} {
+				if _, err := GenerateMerkleProofByIndex(root, index); err == nil {
+					t.Fatalf("generated a proof for index %d", index)
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleProofByIndexRejectsTampering(t *testing.T) {
+	for _, height := range []int{0, 2} {
+		root, pubKey := testTree(t, 13, height)
+		leaf := GetAllLeavesHashes(root)[5]
+		_, otherKey, err := GenerateKeyPair(SchemeP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name   string
+			modify func(*MerkleProof)
+			pubKey *ChameleomPubKey
+		}{
+			{name: "sibling", modify: func(p *MerkleProof) { p.Siblings[0][0] ^= 1 }},
+			{name: "extra sibling", modify: func(p *MerkleProof) { p.Siblings = append(p.Siblings, make([]byte, 32)) }},
+			{name: "missing sibling", modify: func(p *MerkleProof) { p.Siblings = p.Siblings[1:] }},
+			{name: "leaf index", modify: func(p *MerkleProof) { p.LeafIndex = 4 }},
+			{name: "index out of range", modify: func(p *MerkleProof) { p.LeafIndex = p.TreeSize }},
+			{name: "tree size", modify: func(p *MerkleProof) { p.TreeSize = 12 }},
+			{name: "public key", modify: func(*MerkleProof) {}, pubKey: otherKey},
+		}
+		if height > 0 {
+			tests = append(tests, []struct {
+				name   string
+				modify func(*MerkleProof)
+				pubKey *ChameleomPubKey
+			}{
+				{name: "subtree hash", modify: func(p *MerkleProof) { p.Subtree.Hash[0] ^= 1 }},
+				{name: "subtree randomness", modify: func(p *MerkleProof) { p.Subtree.RandomNum[len(p.Subtree.RandomNum)-1] ^= 1 }},
+				{name: "subtree sibling", modify: func(p *MerkleProof) { p.Subtree.Siblings[0][0] ^= 1 }},
+				{name: "subtree height", modify: func(p *MerkleProof) { p.Subtree.Height = 1 }},
+				{name: "subtree height out of range", modify: func(p *MerkleProof) { p.Subtree.Height = maxSubtreeHeight + 1 }},
+				{name: "subtree removed", modify: func(p *MerkleProof) { p.Subtree = nil }},
+			}...)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("height %d %s", height, tt.name), func(t *testing.T) {
+				proof, err := GenerateMerkleProofByIndex(root, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.modify(proof)
+				key := pubKey
+				if tt.pubKey != nil {
+					key = tt.pubKey
+				}
+				if VerifyMerkleProofByIndex(root.Hash, leaf, proof, key, root.RandomNum) {
+					t.Fatal("tampered proof accepted")
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleMultiProof(t *testing.T) {
+	for _, shape := range treeShapes {
+		t.Run(fmt.Sprintf("%d leaves height %d", shape.leaves, shape.height), func(t *testing.T) {
+			root, pubKey := testTree(t, shape.leaves, shape.height)
+			leaves := GetAllLeavesHashes(root)
+			n := len(leaves)
+			sets := [][]int{
+				{0},
+				{n - 1},
+				{n - 1, 0, n / 2, 0, n - 1}, // 无序且重复
+			}
+			all := make([]int, n)
+			for i := range all {
+				all[i] = n - 1 - i
+			}
+			sets = append(sets, all)
+			for _, indices := range sets {
+				proof, err := GenerateMerkleMultiProof(root, indices)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 1; i < len(proof.Indices); i++ {
+					if proof.Indices[i] <= proof.Indices[i-1] {
+						t.Fatalf("indices %v are not sorted and unique", proof.Indices)
+					}
+				}
+				hashes := make([][]byte, len(proof.Indices))
+				for i, idx := range proof.Indices {
+					hashes[i] = leaves[idx]
+				}
+				if !VerifyMerkleMultiProof(root.Hash, hashes, proof, pubKey, root.RandomNum) {
+					t.Fatalf("indices %v: valid proof rejected", indices)
+				}
+				// 交换叶子的顺序或换成其他叶子都不能通过验证
+				if len(hashes) > 1 {
+					swapped := append([][]byte{}, hashes...)
+					swapped[0], swapped[1] = swapped[1], swapped[0]
+					if VerifyMerkleMultiProof(root.Hash, swapped, proof, pubKey, root.RandomNum) {
+						t.Fatalf("indices %v: proof accepted with swapped leaves", indices)
+					}
+				}
+				wrong := append([][]byte{}, hashes...)
+				wrong[0] = getHash([]byte("not a leaf"))
+				if VerifyMerkleMultiProof(root.Hash, wrong, proof, pubKey, root.RandomNum) {
+					t.Fatalf("indices %v: proof accepted with a wrong leaf", indices)
+				}
+				if VerifyMerkleMultiProof(root.Hash, hashes[1:], proof, pubKey, root.RandomNum) {
+					t.Fatalf("indices %v: proof accepted with too few leaves", indices)
+				}
+			}
+			for _, indices := range [][]int{nil, {-1}, {0, n}} {
+				if _, err := GenerateMerkleMultiProof(root, indices); err == nil {
+					t.Fatalf("generated a proof for indices %v", indices)
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleMultiProofRejectsTampering(t *testing.T) {
+	for _, height := range []int{0, 2} {
+		root, pubKey := testTree(t, 21, height)
+		leaves := GetAllLeavesHashes(root)
+		tests := []struct {
+			name   string
+			modify func(*MerkleMultiProof)
+		}{
+			{"sibling", func(p *MerkleMultiProof) { p.Siblings[len(p.Siblings)-1][0] ^= 1 }},
+			{"extra sibling", func(p *MerkleMultiProof) { p.Siblings = append(p.Siblings, make([]byte, 32)) }},
+			{"unsorted indices", func(p *MerkleMultiProof) { p.Indices[0], p.Indices[1] = p.Indices[1], p.Indices[0] }},
+			{"duplicate index", func(p *MerkleMultiProof) { p.Indices[1] = p.Indices[0] }},
+			// 21 个叶子和 25 个叶子的树形状不同，高度为2时子树个数也不同
+			{"tree size", func(p *MerkleMultiProof) { p.TreeSize += 4 }},
+		}
+		if height > 0 {
+			tests = append(tests, []struct {
+				name   string
+				modify func(*MerkleMultiProof)
+			}{
+				{"subtree hash", func(p *MerkleMultiProof) { p.Subtrees.Hashes[0][0] ^= 1 }},
+				{"subtree randomness", func(p *MerkleMultiProof) { p.Subtrees.RandomNums[0] = p.Subtrees.RandomNums[1] }},
+				{"missing subtree", func(p *MerkleMultiProof) { p.Subtrees.Hashes = p.Subtrees.Hashes[1:] }},
+				{"subtree height", func(p *MerkleMultiProof) { p.Subtrees.Height = 3 }},
+			}...)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("height %d %s", height, tt.name), func(t *testing.T) {
+				proof, err := GenerateMerkleMultiProof(root, []int{2, 9, 17})
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.modify(proof)
+				hashes := [][]byte{leaves[2], leaves[9], leaves[17]}
+				if VerifyMerkleMultiProof(root.Hash, hashes, proof, pubKey, root.RandomNum) {
+					t.Fatal("tampered proof accepted")
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleProofEncoding(t *testing.T) {
+	for _, height := range []int{0, 2} {
+		root, pubKey := testTree(t, 11, height)
+		leaves := GetAllLeavesHashes(root)
+		wantVersion := byte(proofVersion)
+		if height > 0 {
+			wantVersion = subtreeProofVersion
+		}
+		t.Run(fmt.Sprintf("index height %d", height), func(t *testing.T) {
+			proof, err := GenerateMerkleProofByIndex(root, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := proof.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[0] != wantVersion {
+				t.Fatalf("got version %d, want %d", data[0], wantVersion)
+			}
+			var decoded MerkleProof
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := decoded.MarshalBinary(); !bytes.Equal(again, data) {
+				t.Fatal("binary round trip changed the proof")
+			}
+			if !VerifyMerkleProofByIndex(root.Hash, leaves[7], &decoded, pubKey, root.RandomNum) {
+				t.Fatal("decoded binary proof rejected")
+			}
+
+			text, err := json.Marshal(proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromJSON MerkleProof
+			if err := json.Unmarshal(text, &fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := fromJSON.MarshalBinary(); !bytes.Equal(again, data) {
+				t.Fatal("json round trip changed the proof")
+			}
+			testDecodeErrors(t, data, func(data []byte) error { return new(MerkleProof).UnmarshalBinary(data) })
+		})
+		t.Run(fmt.Sprintf("multi height %d", height), func(t *testing.T) {
+			proof, err := GenerateMerkleMultiProof(root, []int{10, 1, 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := proof.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[0] != wantVersion {
+				t.Fatalf("got version %d, want %d", data[0], wantVersion)
+			}
+			var decoded MerkleMultiProof
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := decoded.MarshalBinary(); !bytes.Equal(again, data) {
+				t.Fatal("binary round trip changed the proof")
+			}
+			hashes := [][]byte{leaves[1], leaves[4], leaves[10]}
+			if !VerifyMerkleMultiProof(root.Hash, hashes, &decoded, pubKey, root.RandomNum) {
+				t.Fatal("decoded binary proof rejected")
+			}
+
+			text, err := json.Marshal(proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromJSON MerkleMultiProof
+			if err := json.Unmarshal(text, &fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := fromJSON.MarshalBinary(); !bytes.Equal(again, data) {
+				t.Fatal("json round trip changed the proof")
+			}
+			testDecodeErrors(t, data, func(data []byte) error { return new(MerkleMultiProof).UnmarshalBinary(data) })
+		})
+	}
+}
+
+// testDecodeErrors 检查截断、末尾多余的字节和未知的版本号都被拒绝
+func testDecodeErrors(t *testing.T, data []byte, decode func([]byte) error) {
+	t.Helper()
+	for n := 0; n < len(data); n++ {
+		if err := decode(data[:n]); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("truncated to %d bytes: got %v, want ErrInvalidProof", n, err)
+		}
+	}
+	if err := decode(append(append([]byte{}, data...), 0)); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("trailing byte: got %v, want ErrInvalidProof", err)
+	}
+	for _, version := range []byte{0, subtreeProofVersion + 1} {
+		bad := append([]byte{version}, data[1:]...)
+		if err := decode(bad); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("version %d: got %v, want ErrInvalidProof", version, err)
+		}
+	}
+}
+
+func TestMerkleProofJSONRejectsBadHex(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		into json.Unmarshaler
+	}{
+		{"index not hex", `{"leafIndex":0,"treeSize":2,"siblings":["zz"]}`, new(MerkleProof)},
+		{"index short hash", `{"leafIndex":0,"treeSize":2,"siblings":["00"]}`, new(MerkleProof)},
+		{"multi not hex", `{"indices":[0],"treeSize":2,"siblings":["zz"]}`, new(MerkleMultiProof)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := json.Unmarshal([]byte(tt.text), tt.into); err == nil {
+				t.Fatal("malformed proof accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyMerkleProofByPath(t *testing.T) {
+	for _, leaves := range []int{1, 2, 3, 5, 7, 16, 33} {
+		t.Run(fmt.Sprintf("%d leaves", leaves), func(t *testing.T) {
+			root, pubKey := testTree(t, leaves, 0)
+			for i, leaf := range GetAllLeavesHashes(root) {
+				// 所有兄弟节点共享一块内存，验证时向其中追加数据会覆盖后面的兄弟节点
+				var packed []byte
+				for _, sibling := range GenerateMerkleProof(root, leaf) {
+					packed = append(packed, sibling...)
+				}
+				saved := append([]byte{}, packed...)
+				var proof [][]byte
+				offset := 0
+				for _, sibling := range GenerateMerkleProof(root, leaf) {
+					proof = append(proof, packed[offset:offset+len(sibling)])
+					offset += len(sibling)
+				}
+				if !VerifyMerkleProof(root.Hash, leaf, proof, pubKey, root.RandomNum) {
+					t.Fatalf("leaf %d: valid proof rejected", i)
+				}
+				if !bytes.Equal(packed, saved) {
+					t.Fatalf("leaf %d: proof modified by verification", i)
+				}
+				if VerifyMerkleProof(root.Hash, getHash([]byte("not a leaf")), proof, pubKey, root.RandomNum) {
+					t.Fatalf("leaf %d: proof accepted for another leaf", i)
+				}
+				if len(proof) > 2 {
+					// 交换一层的左右兄弟节点会改变叶子的位置
+					swapped := append([][]byte{}, proof...)
+					swapped[2], swapped[3] = swapped[3], swapped[2]
+					if VerifyMerkleProof(root.Hash, leaf, swapped, pubKey, root.RandomNum) {
+						t.Fatalf("leaf %d: proof accepted with swapped siblings", i)
+					}
+					both := append([][]byte{}, proof...)
+					sibling := append(append([]byte{}, proof[2]...), proof[3]...)
+					both[2], both[3] = sibling, sibling
+					if VerifyMerkleProof(root.Hash, leaf, both, pubKey, root.RandomNum) {
+						t.Fatalf("leaf %d: proof accepted with two siblings on one level", i)
+					}
+				}
+			}
+			for _, proof := range [][][]byte{nil, {{}}, {{}, {}, {}}} {
+				if VerifyMerkleProof(root.Hash, GetAllLeavesHashes(root)[0], proof, pubKey, root.RandomNum) {
+					t.Fatalf("malformed proof %v accepted", proof)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package chamMerkleTree
+
+import (
+	"crypto/rand"
+	"errors"
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+	"io"
+	"math/big"
+)
+
+// p256Scalar 是模 P-256 群阶 N 的标量，使用 filippo.io/bigmod 的常数时间运算。
+// 所有涉及私钥、私钥分片和随机数 k 的标量运算都使用这个类型，math/big 只用于公开的值，
+// 例如哈希挑战的验证和拉格朗日系数。零值表示0，每次运算都写入新的 bigmod.Nat，复制的标量之间互不影响。
+type p256Scalar struct {
+	n *bigmod.Nat
+}
+
+var (
+	// p256Order 是群阶 N
+	p256Order *bigmod.Modulus
+	// errInvalidScalar 表示标量的编码不是 [0, N-1] 中的32字节大端整数
+	errInvalidScalar = errors.New("invalid p256 scalar")
+)
+
+func init() {
+	var err error
+	p256Order, err = bigmod.NewModulusFromBig(curve.Params().N)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// nat 返回标量的值，零值返回0
+func (x *p256Scalar) nat() *bigmod.Nat {
+	if x.n == nil {
+		return bigmod.NewNat().ExpandFor(p256Order)
+	}
+	return x.n
+}
+
+// clone 返回标量值的副本，运算在副本上进行，不修改参数
+func (x *p256Scalar) clone() *bigmod.Nat {
+	return bigmod.NewNat().ExpandFor(p256Order).Add(x.nat(), p256Order)
+}
+
+// setBytes 解码32字节的大端整数，值不小于 N 时返回错误
+func (x *p256Scalar) setBytes(b []byte) (*p256Scalar, error) {
+	if len(b) != scalarSize {
+		return nil, errInvalidScalar
+	}
+	n, err := bigmod.NewNat().SetBytes(b, p256Order)
+	if err != nil {
+		return nil, errInvalidScalar
+	}
+	x.n = n
+	return x, nil
+}
+
+// setReducedBytes 把至多32字节的大端整数（例如哈希值）模 N 约简，2^256 < 2N，减一次 N 即可
+func (x *p256Scalar) setReducedBytes(b []byte) *p256Scalar {
+	n, err := bigmod.NewNat().SetOverflowingBytes(b, p256Order)
+	if err != nil {
+		// 调用者保证 b 不超过32字节
+		panic(err)
+	}
+	x.n = n
+	return x
+}
+
+// Bytes 返回32字节的大端编码
+func (x *p256Scalar) Bytes() []byte {
+	return x.nat().Bytes(p256Order)
+}
+
+// Add 计算 a + b mod N
+func (x *p256Scalar) Add(a, b *p256Scalar) *p256Scalar {
+	x.n = a.clone().Add(b.nat(), p256Order)
+	return x
+}
+
+// Sub 计算 a - b mod N
+func (x *p256Scalar) Sub(a, b *p256Scalar) *p256Scalar {
+	x.n = a.clone().Sub(b.nat(), p256Order)
+	return x
+}
+
+// Mul 计算 a·b mod N
+func (x *p256Scalar) Mul(a, b *p256Scalar) *p256Scalar {
+	x.n = a.clone().Mul(b.nat(), p256Order)
+	return x
+}
+
+// IsZero 在标量为0时返回1
+func (x *p256Scalar) IsZero() int {
+	return int(x.nat().IsZero())
+}
+
+// p256ScalarRand 生成 [1, N-1] 中的随机标量，超出范围的随机数直接丢弃，被丢弃的值与结果无关
+func p256ScalarRand() (*p256Scalar, error) {
+	b := make([]byte, scalarSize)
+	for {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+		x, err := new(p256Scalar).setBytes(b)
+		if err == nil && x.IsZero() == 0 {
+			return x, nil
+		}
+	}
+}
+
+// p256ScalarFromInt 返回公开的大整数对应的标量，例如挑战 e 和拉格朗日系数
+func p256ScalarFromInt(x *big.Int) *p256Scalar {
+	return new(p256Scalar).setReducedBytes(new(big.Int).Mod(x, curve.Params().N).FillBytes(make([]byte, scalarSize)))
+}
+
+// p256BaseMult 计算 k·G，k 是秘密的标量，使用 nistec 的常数时间实现，k 为0时返回错误
+func p256BaseMult(k *p256Scalar) (*nistec.P256Point, error) {
+	if k.IsZero() == 1 {
+		return nil, errInvalidScalar
+	}
+	return nistec.NewP256Point().ScalarBaseMult(k.Bytes())
+}
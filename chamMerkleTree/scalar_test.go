@@ -0,0 +1,107 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"math/big"
+	mrand "math/rand"
+	"testing"
+)
+
+// scalarValues 返回边界值和由 seed 决定的随机值，都在 [0, N-1] 中
+func scalarValues(seed int64) []*big.Int {
+	n := curve.Params().N
+	values := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(2),
+		new(big.Int).Sub(n, one),
+		new(big.Int).Sub(n, big.NewInt(2)),
+		new(big.Int).Rsh(n, 1),
+		new(big.Int).Sub(new(big.Int).Lsh(one, 255), one),
+	}
+	r := mrand.New(mrand.NewSource(seed))
+	for i := 0; i < 20; i++ {
+		values = append(values, new(big.Int).Rand(r, n))
+	}
+	return values
+}
+
+func TestP256ScalarArithmetic(t *testing.T) {
+	n := curve.Params().N
+	values := scalarValues(1)
+	for _, a := range values {
+		for _, b := range values {
+			sa, sb := p256ScalarFromInt(a), p256ScalarFromInt(b)
+			tests := []struct {
+				op   string
+				got  *p256Scalar
+				want *big.Int
+			}{
+				{"add", new(p256Scalar).Add(sa, sb), new(big.Int).Add(a, b)},
+				{"sub", new(p256Scalar).Sub(sa, sb), new(big.Int).Sub(a, b)},
+				{"mul", new(p256Scalar).Mul(sa, sb), new(big.Int).Mul(a, b)},
+			}
+			for _, tt := range tests {
+				want := tt.want.Mod(tt.want, n).FillBytes(make([]byte, scalarSize))
+				if !bytes.Equal(tt.got.Bytes(), want) {
+					t.Fatalf("%x %s %x = %x, want %x", a, tt.op, b, tt.got.Bytes(), want)
+				}
+			}
+		}
+	}
+}
+
+func TestP256ScalarEncoding(t *testing.T) {
+	n := curve.Params().N
+	for _, a := range scalarValues(2) {
+		b := a.FillBytes(make([]byte, scalarSize))
+		x, err := new(p256Scalar).setBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(x.Bytes(), b) {
+			t.Fatalf("%x decoded to %x", b, x.Bytes())
+		}
+		if (x.IsZero() == 1) != (a.Sign() == 0) {
+			t.Fatalf("IsZero(%x) = %d", b, x.IsZero())
+		}
+	}
+
+	// setBytes 只接受 [0, N-1] 中的32字节编码
+	for _, b := range [][]byte{
+		n.FillBytes(make([]byte, scalarSize)),
+		bytes.Repeat([]byte{0xff}, scalarSize),
+		make([]byte, scalarSize-1),
+		nil,
+	} {
+		if _, err := new(p256Scalar).setBytes(b); err == nil {
+			t.Fatalf("scalar %x accepted", b)
+		}
+	}
+
+	// 哈希值等不小于 N 的输入被约简
+	for _, v := range []*big.Int{n, new(big.Int).Add(n, one), new(big.Int).Sub(new(big.Int).Lsh(one, 256), one)} {
+		want := new(big.Int).Mod(v, n).FillBytes(make([]byte, scalarSize))
+		if got := new(p256Scalar).setReducedBytes(v.Bytes()).Bytes(); !bytes.Equal(got, want) {
+			t.Fatalf("%x reduced to %x, want %x", v, got, want)
+		}
+	}
+}
+
+func TestP256BaseMult(t *testing.T) {
+	for _, a := range scalarValues(3)[1:] {
+		p, err := p256BaseMult(p256ScalarFromInt(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y := p256Coords(p)
+		wantX, wantY := curve.ScalarBaseMult(a.FillBytes(make([]byte, scalarSize)))
+		if x.Cmp(wantX) != 0 || y.Cmp(wantY) != 0 {
+			t.Fatalf("%x·G differs from crypto/elliptic", a)
+		}
+	}
+	// 0·G 是无穷远点，不能作为随机点
+	if _, err := p256BaseMult(new(p256Scalar)); err == nil {
+		t.Fatal("0·G accepted")
+	}
+}
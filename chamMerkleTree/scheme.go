@@ -0,0 +1,91 @@
+package chamMerkleTree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 变色龙哈希方案的 ID，记录在 metadata 的 Scheme 字段中，验证者据此选择方案
+const (
+	// SchemeP256 是 P-256 上基于离散对数的方案，Scheme 字段为空的旧 metadata 使用这个方案
+	SchemeP256 = "p256"
+	// SchemeEd25519 是 edwards25519 上基于离散对数的方案
+	SchemeEd25519 = "ed25519"
+
+	// DefaultScheme 是生成新密钥时默认使用的方案
+	DefaultScheme = SchemeP256
+)
+
+// ErrUnknownScheme 表示没有注册这个 ID 的变色龙哈希方案
+var ErrUnknownScheme = errors.New("unknown chameleon hash scheme")
+
+// ChameleonHash 是一个变色龙哈希方案。
+// 持有私钥的一方可以为任意新消息找到与旧消息哈希相同的随机数，其他人无法做到。
+// 所有密钥、哈希值和随机数都使用方案自己的字节编码。
+type ChameleonHash interface {
+	// ID 返回方案的 ID
+	ID() string
+	// KeyGen 生成一对私钥和公钥
+	KeyGen() (secKey, pubKey []byte, err error)
+	// PublicKey 由私钥计算公钥
+	PublicKey(secKey []byte) ([]byte, error)
+	// ParsePublicKey 检查公钥的编码，返回规范编码
+	ParsePublicKey(data []byte) ([]byte, error)
+	// ParseRandomness 检查随机数的编码，返回规范编码
+	ParseRandomness(data []byte) ([]byte, error)
+	// Hash 为消息选择随机数并计算哈希值
+	Hash(pubKey, message []byte) (hash, randomness []byte, err error)
+	// Verify 检查随机数能否把消息打开为哈希值
+	Verify(pubKey, message, hash, randomness []byte) bool
+	// Collide 使用私钥为新消息计算随机数，使其哈希值与旧消息相同
+	Collide(secKey, message, hash, randomness, newMessage []byte) ([]byte, error)
+	// Sign 使用同一个私钥对摘要签名，用于 metadata 签名
+	Sign(secKey, digest []byte) ([]byte, error)
+	// VerifySignature 使用公钥验证签名
+	VerifySignature(pubKey, digest, signature []byte) bool
+}
+
+var (
+	schemesLock sync.RWMutex
+	schemes     = make(map[string]ChameleonHash)
+)
+
+func init() {
+	RegisterScheme(p256Scheme{})
+	RegisterScheme(ed25519Scheme{})
+}
+
+// RegisterScheme 注册一个变色龙哈希方案，ID 相同时覆盖之前的方案
+func RegisterScheme(scheme ChameleonHash) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	schemes[scheme.ID()] = scheme
+}
+
+// GetScheme 返回 ID 对应的方案，ID 为空时返回 SchemeP256
+func GetScheme(id string) (ChameleonHash, error) {
+	if id == "" {
+		id = SchemeP256
+	}
+	schemesLock.RLock()
+	defer schemesLock.RUnlock()
+	scheme, ok := schemes[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, id)
+	}
+	return scheme, nil
+}
+
+// Schemes 返回所有已注册方案的 ID
+func Schemes() []string {
+	schemesLock.RLock()
+	defer schemesLock.RUnlock()
+	var ids []string
+	for id := range schemes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
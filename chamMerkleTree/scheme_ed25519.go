@@ -0,0 +1,228 @@
+package chamMerkleTree
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"filippo.io/edwards25519"
+	"fmt"
+	"io"
+)
+
+// ed25519 方案: 与 p256 方案相同的构造 h = R - H(m || R)·Y - s·B，运算在 edwards25519 的素数阶子群上进行。
+// 哈希值是 h 的32字节编码，随机数是 R || s，共64字节，私钥是32字节的规范标量。
+// 所有涉及私钥的运算都由 filippo.io/edwards25519 以常数时间完成。
+// metadata 使用同一个私钥的 Schnorr 签名: R || s，s·B = R + H(R || Y || digest)·Y。
+
+const (
+	// ed25519Size 是 edwards25519 点和标量的编码长度
+	ed25519Size = 32
+	// ed25519RandomSize 是随机数 R || s 的编码长度
+	ed25519RandomSize = 2 * ed25519Size
+)
+
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) ID() string {
+	return SchemeEd25519
+}
+
+func (ed25519Scheme) KeyGen() ([]byte, []byte, error) {
+	x, err := ed25519ScalarRand()
+	if err != nil {
+		return nil, nil, err
+	}
+	return x.Bytes(), new(edwards25519.Point).ScalarBaseMult(x).Bytes(), nil
+}
+
+func (ed25519Scheme) PublicKey(secKey []byte) ([]byte, error) {
+	x, err := ed25519SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Point).ScalarBaseMult(x).Bytes(), nil
+}
+
+func (ed25519Scheme) ParsePublicKey(data []byte) ([]byte, error) {
+	y, err := ed25519PubKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return y.Bytes(), nil
+}
+
+func (ed25519Scheme) ParseRandomness(data []byte) ([]byte, error) {
+	r, s, err := ed25519RandomNum(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(r.Bytes(), s.Bytes()...), nil
+}
+
+func (ed25519Scheme) Hash(pubKey, message []byte) ([]byte, []byte, error) {
+	y, err := ed25519PubKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := ed25519ScalarRand()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := ed25519ScalarRand()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := new(edwards25519.Point).ScalarBaseMult(k)
+	h := ed25519ComputeHash(message, r, s, y)
+	return h.Bytes(), append(r.Bytes(), s.Bytes()...), nil
+}
+
+func (ed25519Scheme) Verify(pubKey, message, hash, randomness []byte) bool {
+	y, err := ed25519PubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	r, s, err := ed25519RandomNum(randomness)
+	if err != nil {
+		return false
+	}
+	h := ed25519ComputeHash(message, r, s, y)
+	return subtle.ConstantTimeCompare(h.Bytes(), hash) == 1
+}
+
+func (ed25519Scheme) Collide(secKey, message, hash, randomness, newMessage []byte) ([]byte, error) {
+	x, err := ed25519SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	y := new(edwards25519.Point).ScalarBaseMult(x)
+	r, s, err := ed25519RandomNum(randomness)
+	if err != nil {
+		return nil, err
+	}
+	h := ed25519ComputeHash(message, r, s, y)
+	if subtle.ConstantTimeCompare(h.Bytes(), hash) != 1 {
+		return nil, errors.New("random number does not open root hash")
+	}
+
+	// R' = h + k·B, s' = k - H(m' || R')·x
+	k, err := ed25519ScalarRand()
+	if err != nil {
+		return nil, err
+	}
+	newR := new(edwards25519.Point).Add(h, new(edwards25519.Point).ScalarBaseMult(k))
+	e := ed25519Challenge("FlexiSN chameleon ed25519 v1", newMessage, newR.Bytes())
+	newS := new(edwards25519.Scalar).Subtract(k, new(edwards25519.Scalar).Multiply(e, x))
+	return append(newR.Bytes(), newS.Bytes()...), nil
+}
+
+func (ed25519Scheme) Sign(secKey, digest []byte) ([]byte, error) {
+	x, err := ed25519SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ed25519ScalarRand()
+	if err != nil {
+		return nil, err
+	}
+	r := new(edwards25519.Point).ScalarBaseMult(k)
+	y := new(edwards25519.Point).ScalarBaseMult(x)
+	e := ed25519Challenge("FlexiSN schnorr ed25519 v1", r.Bytes(), y.Bytes(), digest)
+	s := new(edwards25519.Scalar).MultiplyAdd(e, x, k)
+	return append(r.Bytes(), s.Bytes()...), nil
+}
+
+func (ed25519Scheme) VerifySignature(pubKey, digest, signature []byte) bool {
+	y, err := ed25519PubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	r, s, err := ed25519RandomNum(signature)
+	if err != nil {
+		return false
+	}
+	e := ed25519Challenge("FlexiSN schnorr ed25519 v1", r.Bytes(), y.Bytes(), digest)
+	// R == s·B - e·Y
+	check := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(new(edwards25519.Scalar).Negate(e), y, s)
+	return check.Equal(r) == 1
+}
+
+// ed25519ComputeHash 计算 h = R - H(m || R)·Y - s·B
+func ed25519ComputeHash(message []byte, r *edwards25519.Point, s *edwards25519.Scalar, y *edwards25519.Point) *edwards25519.Point {
+	e := ed25519Challenge("FlexiSN chameleon ed25519 v1", message, r.Bytes())
+	// e·Y + s·B，所有输入都是公开的，可以使用变长时间的运算
+	t := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(e, y, s)
+	return new(edwards25519.Point).Subtract(r, t)
+}
+
+// ed25519Challenge 将带域分隔标签的输入哈希为标量，每个输入前写入长度，避免不同的切分得到相同的哈希
+func ed25519Challenge(tag string, parts ...[]byte) *edwards25519.Scalar {
+	h := sha512.New()
+	h.Write([]byte(tag))
+	for _, part := range parts {
+		binary.Write(h, binary.BigEndian, uint64(len(part)))
+		h.Write(part)
+	}
+	e, _ := new(edwards25519.Scalar).SetUniformBytes(h.Sum(nil))
+	return e
+}
+
+// ed25519ScalarRand 生成非零的随机标量
+func ed25519ScalarRand() (*edwards25519.Scalar, error) {
+	zero := edwards25519.NewScalar()
+	for {
+		b := make([]byte, 64)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+		x, err := new(edwards25519.Scalar).SetUniformBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if x.Equal(zero) == 0 {
+			return x, nil
+		}
+	}
+}
+
+// ed25519SecKey 解码私钥，私钥必须是非零的规范标量
+func ed25519SecKey(secKey []byte) (*edwards25519.Scalar, error) {
+	x, err := new(edwards25519.Scalar).SetCanonicalBytes(secKey)
+	if err != nil || x.Equal(edwards25519.NewScalar()) == 1 {
+		return nil, ErrInvalidSecKey
+	}
+	return x, nil
+}
+
+// ed25519PubKey 解码公钥，拒绝小阶点，否则碰撞可能不需要私钥
+func ed25519PubKey(data []byte) (*edwards25519.Point, error) {
+	if len(data) != ed25519Size {
+		return nil, fmt.Errorf("%w: invalid length %d", ErrInvalidPubKey, len(data))
+	}
+	y, err := new(edwards25519.Point).SetBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPubKey, err)
+	}
+	if new(edwards25519.Point).MultByCofactor(y).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("%w: small order point", ErrInvalidPubKey)
+	}
+	return y, nil
+}
+
+// ed25519RandomNum 解码随机数 R || s
+func ed25519RandomNum(data []byte) (*edwards25519.Point, *edwards25519.Scalar, error) {
+	if len(data) != ed25519RandomSize {
+		return nil, nil, fmt.Errorf("%w: invalid length %d", ErrInvalidRandomNum, len(data))
+	}
+	r, err := new(edwards25519.Point).SetBytes(data[:ed25519Size])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidRandomNum, err)
+	}
+	s, err := new(edwards25519.Scalar).SetCanonicalBytes(data[ed25519Size:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidRandomNum, err)
+	}
+	return r, s, nil
+}
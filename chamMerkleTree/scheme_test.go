@@ -0,0 +1,231 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// flip 返回把第 i 个字节翻转一位后的副本，i 为负数时从末尾数起
+func flip(data []byte, i int) []byte {
+	res := append([]byte{}, data...)
+	if i < 0 {
+		i += len(res)
+	}
+	res[i] ^= 1
+	return res
+}
+
+func TestSchemesRegistered(t *testing.T) {
+	for _, id := range []string{SchemeP256, SchemeEd25519} {
+		scheme, err := GetScheme(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scheme.ID() != id {
+			t.Fatalf("scheme %s has ID %s", id, scheme.ID())
+		}
+	}
+	// 旧的 metadata 没有 Scheme 字段
+	if scheme, err := GetScheme(""); err != nil || scheme.ID() != SchemeP256 {
+		t.Fatalf("empty scheme resolved to %v, %v", scheme, err)
+	}
+	if _, err := GetScheme("rsa"); !errors.Is(err, ErrUnknownScheme) {
+		t.Fatalf("got %v, want ErrUnknownScheme", err)
+	}
+}
+
+func TestSchemeCollision(t *testing.T) {
+	for _, id := range Schemes() {
+		t.Run(id, func(t *testing.T) {
+			scheme, err := GetScheme(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secKey, pubKey, err := scheme.KeyGen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if derived, err := scheme.PublicKey(secKey); err != nil || !bytes.Equal(derived, pubKey) {
+				t.Fatalf("PublicKey returned %x, %v", derived, err)
+			}
+			otherSecKey, otherPubKey, err := scheme.KeyGen()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			message := []byte("old message")
+			hash, randomness, err := scheme.Hash(pubKey, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !scheme.Verify(pubKey, message, hash, randomness) {
+				t.Fatal("hash does not verify")
+			}
+			// 同一个消息的两次哈希使用不同的随机数，哈希值也不同
+			again, _, err := scheme.Hash(pubKey, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(again, hash) {
+				t.Fatal("hash is deterministic")
+			}
+
+			newMessage := []byte("new message")
+			newRandomness, err := scheme.Collide(secKey, message, hash, randomness, newMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !scheme.Verify(pubKey, newMessage, hash, newRandomness) {
+				t.Fatal("collision does not open the hash")
+			}
+			// 碰撞可以继续进行，每次都从上一次的随机数开始
+			third, err := scheme.Collide(secKey, newMessage, hash, newRandomness, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !scheme.Verify(pubKey, message, hash, third) {
+				t.Fatal("second collision does not open the hash")
+			}
+
+			tests := []struct {
+				name              string
+				pubKey, msg, hash []byte
+				randomness        []byte
+			}{
+				{"other message", pubKey, []byte("other"), hash, newRandomness},
+				{"old message", pubKey, message, hash, newRandomness},
+				{"hash", pubKey, newMessage, flip(hash, -1), newRandomness},
+				{"randomness", pubKey, newMessage, hash, flip(newRandomness, -1)},
+				{"truncated randomness", pubKey, newMessage, hash, newRandomness[:len(newRandomness)-1]},
+				{"public key", otherPubKey, newMessage, hash, newRandomness},
+				{"invalid public key", flip(pubKey, -1), newMessage, hash, newRandomness},
+			}
+			for _, tt := range tests {
+				if scheme.Verify(tt.pubKey, tt.msg, tt.hash, tt.randomness) {
+					t.Fatalf("%s: tampered opening verified", tt.name)
+				}
+			}
+
+			// 其他私钥得到的随机数不能打开哈希值，随机数与哈希值不符时拒绝生成碰撞
+			if _, err := scheme.Collide(otherSecKey, message, hash, randomness, newMessage); err == nil {
+				t.Fatal("collision generated with another secret key")
+			}
+			if _, err := scheme.Collide(secKey, []byte("other"), hash, randomness, newMessage); err == nil {
+				t.Fatal("collision generated for a message the randomness does not open")
+			}
+			if _, err := scheme.Collide(nil, message, hash, randomness, newMessage); !errors.Is(err, ErrInvalidSecKey) {
+				t.Fatalf("got %v, want ErrInvalidSecKey", err)
+			}
+		})
+	}
+}
+
+func TestSchemeSignature(t *testing.T) {
+	for _, id := range Schemes() {
+		t.Run(id, func(t *testing.T) {
+			scheme, err := GetScheme(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secKey, pubKey, err := scheme.KeyGen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, otherPubKey, err := scheme.KeyGen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256([]byte("metadata"))
+			signature, err := scheme.Sign(secKey, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !scheme.VerifySignature(pubKey, digest[:], signature) {
+				t.Fatal("signature does not verify")
+			}
+			if _, err := scheme.Sign(nil, digest[:]); !errors.Is(err, ErrInvalidSecKey) {
+				t.Fatalf("got %v, want ErrInvalidSecKey", err)
+			}
+
+			other := sha256.Sum256([]byte("other metadata"))
+			tests := []struct {
+				name           string
+				pubKey, digest []byte
+				signature      []byte
+			}{
+				{"digest", pubKey, other[:], signature},
+				{"public key", otherPubKey, digest[:], signature},
+				{"first byte", pubKey, digest[:], flip(signature, 0)},
+				{"last byte", pubKey, digest[:], flip(signature, -1)},
+				{"truncated", pubKey, digest[:], signature[:len(signature)-1]},
+				{"empty", pubKey, digest[:], nil},
+			}
+			for _, tt := range tests {
+				if scheme.VerifySignature(tt.pubKey, tt.digest, tt.signature) {
+					t.Fatalf("%s: tampered signature verified", tt.name)
+				}
+			}
+		})
+	}
+}
+
+// 旧版本用 ECDSA 签名 metadata，新版本只生成 Schnorr 签名，但旧的签名仍然可以验证
+func TestP256LegacyECDSASignature(t *testing.T) {
+	scheme := p256Scheme{}
+	secKey, pubKey, err := scheme.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubX, pubY, err := decodeP256PubKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: pubX, Y: pubY},
+		D:         new(big.Int).SetBytes(secKey),
+	}
+	digest := sha256.Sum256([]byte("metadata"))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scheme.VerifySignature(pubKey, digest[:], signature) {
+		t.Fatal("legacy ECDSA signature does not verify")
+	}
+	other := sha256.Sum256([]byte("other metadata"))
+	if scheme.VerifySignature(pubKey, other[:], signature) {
+		t.Fatal("legacy ECDSA signature verified for another digest")
+	}
+
+	// 新生成的签名是 Schnorr 签名
+	schnorr, err := scheme.Sign(secKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schnorr[0] != schnorrTag || ecdsa.VerifyASN1(&key.PublicKey, digest[:], schnorr) {
+		t.Fatal("Sign produced an ECDSA signature")
+	}
+}
+
+// 旧的私钥可能去掉了前导零，补齐后得到相同的公钥
+func TestP256ShortSecKey(t *testing.T) {
+	secKey := make([]byte, scalarSize)
+	secKey[scalarSize-1] = 7
+	scheme := p256Scheme{}
+	full, err := scheme.PublicKey(secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := scheme.PublicKey([]byte{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(full, short) {
+		t.Fatal("short secret key gives a different public key")
+	}
+}
@@ -0,0 +1,52 @@
+package chamMerkleTree
+
+import (
+	"errors"
+	dht "main/DHT"
+)
+
+var (
+	// ErrUnsigned 表示 metadata 没有签名
+	ErrUnsigned = errors.New("metadata not signed")
+	// ErrInvalidSignature 表示 metadata 的签名与其中的 PublicKey 不匹配
+	ErrInvalidSignature = errors.New("invalid metadata signature")
+)
+
+// SignMetaData 使用变色龙私钥对 metadata 签名。
+// 签名算法由 metadata 的 Scheme 决定，都是挑战带有域分隔标签的 Schnorr 签名，与变色龙哈希使用同一条曲线和同一个私钥，
+// 因此签名可以直接用 metadata 中的 PublicKey 验证，只有变色龙私钥的持有者才能发布或更新这个文件的 metadata。
+// 参数:
+// - metaData: 要签名的 metadata，签名写入 Signature 字段。
+// - secKey: 变色龙私钥。
+// 返回值:
+// - error: 签名失败时返回错误信息。
+func SignMetaData(metaData *dht.MetaData, secKey []byte) error {
+	scheme, err := GetScheme(metaData.Scheme)
+	if err != nil {
+		return err
+	}
+	signature, err := scheme.Sign(secKey, metaData.Digest())
+	if err != nil {
+		return err
+	}
+	metaData.Signature = signature
+	return nil
+}
+
+// VerifyMetaDataSignature 用 metadata 中的 PublicKey 验证签名，
+// 单个私钥生成的签名和门限陷门生成的 Schnorr 签名都可以通过验证
+// 返回值:
+// - error: 没有签名时返回 ErrUnsigned，签名无效或方案未知时返回 ErrInvalidSignature。
+func VerifyMetaDataSignature(metaData *dht.MetaData) error {
+	if len(metaData.Signature) == 0 {
+		return ErrUnsigned
+	}
+	pubKey, err := ParseChameleomPubKey(metaData.Scheme, metaData.PublicKey)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !pubKey.scheme.VerifySignature(pubKey.data, metaData.Digest(), metaData.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	dht "main/DHT"
+)
+
+// 变色龙子树: SubtreeHeight 为 h 时，叶子按顺序每 2^h 个分为一组，每组按与整棵树相同的规则合并，
+// 组的根节点使用变色龙哈希，这些子树根再合并到使用变色龙哈希的根节点。
+// 修改一个数据块后只需要在它所在的子树根上生成碰撞，子树根的哈希不变，根节点和其他子树都不需要改变，
+// 其他子树中叶子的证明在更新前后保持有效。
+
+// maxSubtreeHeight 是子树高度的上限
+const maxSubtreeHeight = 32
+
+var (
+	// ErrInvalidSubtreeHeight 表示子树高度超出范围
+	ErrInvalidSubtreeHeight = errors.New("invalid chameleon subtree height")
+	// ErrEmptyTree 表示文件或 metadata 中没有数据块
+	ErrEmptyTree = errors.New("merkle tree has no leaves")
+)
+
+// checkSubtreeHeight 检查子树高度在 [0, maxSubtreeHeight] 中
+func checkSubtreeHeight(height int) error {
+	if height < 0 || height > maxSubtreeHeight {
+		return fmt.Errorf("%w: %d", ErrInvalidSubtreeHeight, height)
+	}
+	return nil
+}
+
+// hashFunc 为一个变色龙节点计算哈希和随机数
+// 参数:
+// - index: 子树的序号，根节点为 -1。
+// - node: 变色龙节点，子节点已经设置。
+// - message: 计算变色龙哈希的消息。
+type hashFunc func(index int, node *MerkleNode, message []byte) error
+
+// mergeNodes 两两合并节点，奇数个节点时最后一个直接提升，直到只剩下一个或两个节点，
+// 返回以它们为子节点的变色龙节点和计算变色龙哈希的消息，节点的哈希由调用者计算
+func mergeNodes(nodes []*MerkleNode) (*MerkleNode, []byte) {
+	for len(nodes) > 2 {
+		var newLevel []*MerkleNode
+		for i := 0; i < len(nodes); i += 2 {
+			if i+1 < len(nodes) {
+				newLevel = append(newLevel, &MerkleNode{
+					Hash:  getHash(append(append([]byte{}, nodes[i].Hash...), nodes[i+1].Hash...)),
+					Left:  nodes[i],
+					Right: nodes[i+1],
+				})
+			} else {
+				// 如果是最后一个节点，直接复制
+				newLevel = append(newLevel, nodes[i])
+			}
+		}
+		nodes = newLevel
+	}
+	if len(nodes) == 1 {
+		return &MerkleNode{Left: nodes[0]}, nodes[0].Hash
+	}
+	return &MerkleNode{Left: nodes[0], Right: nodes[1]}, append(append([]byte{}, nodes[0].Hash...), nodes[1].Hash...)
+}
+
+// buildTree 由叶子构建树，先按顺序计算每个子树根，再计算根节点
+func buildTree(leaves []*MerkleNode, height int, hash hashFunc) (*MerkleNode, error) {
+	if len(leaves) == 0 {
+		return nil, ErrEmptyTree
+	}
+	if err := checkSubtreeHeight(height); err != nil {
+		return nil, err
+	}
+	nodes := leaves
+	if height > 0 {
+		size := 1 << height
+		var subtrees []*MerkleNode
+		for start := 0; start < len(leaves); start += size {
+			node, message := mergeNodes(leaves[start:min(start+size, len(leaves))])
+			if err := hash(len(subtrees), node, message); err != nil {
+				return nil, err
+			}
+			subtrees = append(subtrees, node)
+		}
+		nodes = subtrees
+	}
+	root, message := mergeNodes(nodes)
+	root.SubtreeHeight = height
+	if err := hash(-1, root, message); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// SubtreeRoots 按叶子顺序返回根节点下的变色龙子树根，没有使用子树时返回 nil
+func SubtreeRoots(root *MerkleNode) []*MerkleNode {
+	if root == nil || root.SubtreeHeight == 0 {
+		return nil
+	}
+	var subtrees []*MerkleNode
+	var walk func(node *MerkleNode)
+	walk = func(node *MerkleNode) {
+		if node == nil {
+			return
+		}
+		if node.RandomNum != nil {
+			subtrees = append(subtrees, node)
+			return
+		}
+		walk(node.Left)
+		walk(node.Right)
+	}
+	walk(root.Left)
+	walk(root.Right)
+	return subtrees
+}
+
+// UpdateMerkleTreeFromRoot 用新的文件内容更新树，只在内容改变的变色龙节点上生成碰撞。
+// 子树高度沿用旧的树，子树的内容没有改变时沿用原来的随机数，超出旧的子树个数的子树重新计算变色龙哈希，
+// 子树根的排列改变时再在根节点上生成碰撞，因此根哈希总是保持不变。
+// 参数:
+// - file: 新的文件内容。
+// - config: Merkle树的配置，分块参数必须与旧的树相同。
+// - oldRoot: 由 RebuildMerkleTreeFromMetaData 重建的旧的树。
+// - pubKey: Chameleon哈希的公钥。
+// - collide: 生成碰撞的函数，由 LocalCollider 或门限陷门提供。
+// 返回值:
+// - *MerkleNode: 新的树的根节点，根哈希与旧的树相同。
+// - error: 错误信息。
+func UpdateMerkleTreeFromRoot(file io.Reader, config *MerkleConfig, oldRoot *MerkleNode, pubKey *ChameleomPubKey, collide CollisionFunc) (*MerkleNode, error) {
+	leaves, err := readLeaves(file, config)
+	if err != nil {
+		return nil, err
+	}
+	return updateLeaves(leaves, oldRoot, pubKey, collide)
+}
+
+// UpdateMerkleTreeTail 保留旧的树的前 keep 个叶子，用 tail 切分出的数据块替换其余的叶子，
+// 用于追加和截断文件：只需要读取新的尾部，保留的叶子直接沿用旧的哈希。
+// 分块算法从数据块的开头开始切分，与之前的边界无关，因此 tail 从第 keep 个数据块的开头开始时，
+// 结果与重新切分整个文件相同。
+// 参数:
+// - tail: 从第 keep 个数据块开头开始的新内容。
+// - keep: 保留的叶子个数。
+// - config: Merkle树的配置，分块参数必须与旧的树相同。
+// - oldRoot: 由 RebuildMerkleTreeFromMetaData 重建的旧的树。
+// - pubKey: Chameleon哈希的公钥。
+// - collide: 生成碰撞的函数。
+// 返回值:
+// - *MerkleNode: 新的树的根节点，根哈希与旧的树相同。
+// - error: keep 超出范围或新的树没有叶子时返回错误信息。
+func UpdateMerkleTreeTail(tail io.Reader, keep int, config *MerkleConfig, oldRoot *MerkleNode, pubKey *ChameleomPubKey, collide CollisionFunc) (*MerkleNode, error) {
+	oldLeaves := GetAllLeaves(oldRoot)
+	if keep < 0 || keep > len(oldLeaves) {
+		return nil, fmt.Errorf("keep %d leaves out of range [0, %d]", keep, len(oldLeaves))
+	}
+	tailLeaves, err := readLeaves(tail, config)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([]*MerkleNode, 0, keep+len(tailLeaves))
+	for _, leaf := range oldLeaves[:keep] {
+		leaves = append(leaves, &MerkleNode{Hash: leaf.Hash, Codec: leaf.Codec})
+	}
+	return updateLeaves(append(leaves, tailLeaves...), oldRoot, pubKey, collide)
+}
+
+// updateLeaves 由新的叶子构建树，只在消息改变的变色龙节点上生成碰撞
+func updateLeaves(leaves []*MerkleNode, oldRoot *MerkleNode, pubKey *ChameleomPubKey, collide CollisionFunc) (*MerkleNode, error) {
+	oldSubtrees := SubtreeRoots(oldRoot)
+	return buildTree(leaves, oldRoot.SubtreeHeight, func(index int, node *MerkleNode, message []byte) error {
+		old := oldRoot
+		if index >= 0 {
+			if index >= len(oldSubtrees) {
+				// 新增的子树还没有发布过，直接计算变色龙哈希
+				hash, randomness, err := pubKey.scheme.Hash(pubKey.data, message)
+				if err != nil {
+					return err
+				}
+				node.Hash, node.RandomNum = hash, &ChameleonRandomNum{data: randomness}
+				return nil
+			}
+			old = oldSubtrees[index]
+		}
+		node.Hash, node.RandomNum = old.Hash, old.RandomNum
+		oldMessage := ChameleonMessage(old)
+		if bytes.Equal(oldMessage, message) {
+			return nil
+		}
+		randomNum, err := collide(oldMessage, old.RandomNum, old.Hash, message)
+		if err != nil {
+			return err
+		}
+		node.RandomNum = randomNum
+		return nil
+	})
+}
+
+// NewMetaData 由树生成 metadata，包括根节点和所有子树根的哈希与随机数以及每个数据块的压缩算法，签名由调用者完成
+// 参数:
+// - root: 根节点，变色龙节点的随机数已经计算。
+// - pubKey: Chameleon哈希的公钥。
+// - chunker: 生成叶子时使用的分块参数。
+func NewMetaData(root *MerkleNode, pubKey *ChameleomPubKey, chunker dht.ChunkerParams) *dht.MetaData {
+	metaData := &dht.MetaData{
+		RootHash:      root.Hash,
+		RandomNum:     root.RandomNum.Serialize(),
+		PublicKey:     pubKey.Serialize(),
+		Leaves:        GetAllLeavesHashes(root),
+		Chunker:       chunker,
+		Scheme:        pubKey.Scheme(),
+		SubtreeHeight: root.SubtreeHeight,
+	}
+	for i, leaf := range GetAllLeaves(root) {
+		if leaf.Codec == dht.CodecNone {
+			continue
+		}
+		if metaData.Codecs == nil {
+			metaData.Codecs = make([]string, len(metaData.Leaves))
+		}
+		metaData.Codecs[i] = leaf.Codec
+	}
+	for _, subtree := range SubtreeRoots(root) {
+		metaData.Subtrees = append(metaData.Subtrees, dht.Subtree{
+			Hash:      subtree.Hash,
+			RandomNum: subtree.RandomNum.Serialize(),
+		})
+	}
+	return metaData
+}
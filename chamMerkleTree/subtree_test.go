@@ -0,0 +1,342 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	dht "main/DHT"
+	"testing"
+)
+
+// countingCollider 返回使用本地私钥生成碰撞的 CollisionFunc，并记录生成碰撞的次数
+func countingCollider(pubKey *ChameleomPubKey, secKey []byte) (CollisionFunc, *int) {
+	calls := 0
+	collide := LocalCollider(pubKey, secKey)
+	return func(message []byte, randomNum *ChameleonRandomNum, rootHash, newMessage []byte) (*ChameleonRandomNum, error) {
+		calls++
+		return collide(message, randomNum, rootHash, newMessage)
+	}, &calls
+}
+
+// publish 由树生成 metadata 再重建，与命令更新已发布的文件时一样从 metadata 开始
+func publish(t *testing.T, root *MerkleNode, pubKey *ChameleomPubKey, config *MerkleConfig) *MerkleNode {
+	t.Helper()
+	rebuilt, _, _, err := RebuildMerkleTreeFromMetaData(NewMetaData(root, pubKey, config.ChunkerParams()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Hash, root.Hash) {
+		t.Fatal("rebuilt tree has another root hash")
+	}
+	return rebuilt
+}
+
+// leafHashes 返回用 config 切分 data 得到的叶子哈希
+func leafHashes(t *testing.T, data []byte, config *MerkleConfig) [][]byte {
+	t.Helper()
+	var hashes [][]byte
+	for _, chunk := range chunkAll(t, bytes.NewReader(data), config) {
+		hashes = append(hashes, getHash(chunk))
+	}
+	return hashes
+}
+
+// checkProofs 检查新的树中每个叶子的证明都能通过验证
+func checkProofs(t *testing.T, root *MerkleNode, pubKey *ChameleomPubKey) {
+	t.Helper()
+	for i, leaf := range GetAllLeavesHashes(root) {
+		proof, err := GenerateMerkleProofByIndex(root, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyMerkleProofByIndex(root.Hash, leaf, proof, pubKey, root.RandomNum) {
+			t.Fatalf("leaf %d does not verify", i)
+		}
+	}
+}
+
+func TestSubtreeUpdateIsLocal(t *testing.T) {
+	const leaves, edited = 20, 9
+	tests := []struct {
+		height int
+		// oldProofsValid 表示更新后其他叶子的旧证明是否仍然有效
+		oldProofsValid bool
+	}{
+		// 只有根节点是变色龙节点时，碰撞改变了根节点的随机数，所有旧的证明都失效
+		{0, false},
+		// 子树证明带有子树根的随机数，只有被修改的子树生成碰撞，根节点的随机数不变
+		{1, true},
+		{2, true},
+		{3, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("height %d", tt.height), func(t *testing.T) {
+			secKey, pubKey, err := GenerateKeyPair(SchemeP256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := fixedConfig(leafSize)
+			config.SubtreeHeight = tt.height
+			data := randomData(4, leaves*leafSize)
+			oldRoot := publish(t, buildFile(t, data, config, pubKey), pubKey, config)
+			oldSubtrees := SubtreeRoots(oldRoot)
+			var oldProofs []*MerkleProof
+			for i := 0; i < leaves; i++ {
+				proof, err := GenerateMerkleProofByIndex(oldRoot, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				oldProofs = append(oldProofs, proof)
+			}
+
+			newData := append([]byte{}, data...)
+			newData[edited*leafSize+10] ^= 1
+			collide, calls := countingCollider(pubKey, secKey)
+			root, err := UpdateMerkleTreeFromRoot(bytes.NewReader(newData), config, oldRoot, pubKey, collide)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(root.Hash, oldRoot.Hash) {
+				t.Fatal("root hash changed")
+			}
+			if *calls != 1 {
+				t.Fatalf("generated %d collisions, want 1", *calls)
+			}
+			if got, want := GetAllLeavesHashes(root), leafHashes(t, newData, config); len(got) != len(want) || !bytes.Equal(got[edited], want[edited]) {
+				t.Fatal("edited leaf was not updated")
+			}
+
+			// 只有被修改的子树的随机数改变
+			if tt.height > 0 {
+				if !bytes.Equal(root.RandomNum.Serialize(), oldRoot.RandomNum.Serialize()) {
+					t.Fatal("root random number changed")
+				}
+				subtrees := SubtreeRoots(root)
+				if len(subtrees) != len(oldSubtrees) {
+					t.Fatalf("got %d subtrees, want %d", len(subtrees), len(oldSubtrees))
+				}
+				for i, subtree := range subtrees {
+					if !bytes.Equal(subtree.Hash, oldSubtrees[i].Hash) {
+						t.Fatalf("subtree %d hash changed", i)
+					}
+					changed := !bytes.Equal(subtree.RandomNum.Serialize(), oldSubtrees[i].RandomNum.Serialize())
+					if changed != (i == edited>>tt.height) {
+						t.Fatalf("subtree %d random number changed = %v", i, changed)
+					}
+				}
+			}
+
+			// 其他叶子的旧证明在更新之后仍然有效，被修改的叶子需要新的证明
+			leafHashes := GetAllLeavesHashes(root)
+			for i, proof := range oldProofs {
+				valid := VerifyMerkleProofByIndex(root.Hash, leafHashes[i], proof, pubKey, root.RandomNum)
+				if i != edited && valid != tt.oldProofsValid {
+					t.Fatalf("old proof of leaf %d valid = %v", i, valid)
+				}
+				if i == edited && tt.height > 0 && valid {
+					t.Fatal("old proof of the edited leaf verifies the new content")
+				}
+			}
+			checkProofs(t, root, pubKey)
+			publish(t, root, pubKey, config)
+
+			// 内容没有改变时不需要生成碰撞
+			*calls = 0
+			if _, err := UpdateMerkleTreeFromRoot(bytes.NewReader(newData), config, root, pubKey, collide); err != nil {
+				t.Fatal(err)
+			}
+			if *calls != 0 {
+				t.Fatalf("generated %d collisions for unchanged content", *calls)
+			}
+		})
+	}
+}
+
+func TestSubtreeUpdateRequiresTrapdoor(t *testing.T) {
+	_, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSecKey, _, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fixedConfig(leafSize)
+	config.SubtreeHeight = 2
+	data := randomData(5, 10*leafSize)
+	oldRoot := buildFile(t, data, config, pubKey)
+	data[0] ^= 1
+	if _, err := UpdateMerkleTreeFromRoot(bytes.NewReader(data), config, oldRoot, pubKey, LocalCollider(pubKey, otherSecKey)); err == nil {
+		t.Fatal("updated a tree with another secret key")
+	}
+}
+
+func TestRebuildRejectsTamperedSubtrees(t *testing.T) {
+	_, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fixedConfig(leafSize)
+	config.SubtreeHeight = 2
+	root := buildFile(t, randomData(6, 10*leafSize), config, pubKey)
+	if got := len(SubtreeRoots(root)); got != 3 {
+		t.Fatalf("got %d subtrees, want 3", got)
+	}
+
+	tests := []struct {
+		name string
+		edit func(*dht.MetaData)
+	}{
+		{"leaf", func(m *dht.MetaData) { m.Leaves[5] = getHash([]byte("other")) }},
+		{"subtree hash", func(m *dht.MetaData) { m.Subtrees[1].Hash = flip(m.Subtrees[1].Hash, 0) }},
+		{"subtree random number", func(m *dht.MetaData) { m.Subtrees[1].RandomNum = m.Subtrees[0].RandomNum }},
+		{"missing subtree", func(m *dht.MetaData) { m.Subtrees = m.Subtrees[:2] }},
+		{"extra subtree", func(m *dht.MetaData) { m.Subtrees = append(m.Subtrees, m.Subtrees[0]) }},
+		{"subtree height", func(m *dht.MetaData) { m.SubtreeHeight = 1 }},
+		{"subtree height out of range", func(m *dht.MetaData) { m.SubtreeHeight = maxSubtreeHeight + 1 }},
+		{"subtrees without height", func(m *dht.MetaData) { m.SubtreeHeight = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metaData := NewMetaData(root, pubKey, config.ChunkerParams())
+			tt.edit(metaData)
+			if _, _, _, err := RebuildMerkleTreeFromMetaData(metaData); err == nil {
+				t.Fatal("tampered metadata rebuilt")
+			}
+		})
+	}
+}
+
+func TestBuildTreeRejectsInvalidInput(t *testing.T) {
+	hash := func(int, *MerkleNode, []byte) error { return nil }
+	leaves := []*MerkleNode{{Hash: getHash([]byte("leaf"))}}
+	if _, err := buildTree(nil, 0, hash); !errors.Is(err, ErrEmptyTree) {
+		t.Fatalf("got %v, want ErrEmptyTree", err)
+	}
+	for _, height := range []int{-1, maxSubtreeHeight + 1} {
+		if _, err := buildTree(leaves, height, hash); !errors.Is(err, ErrInvalidSubtreeHeight) {
+			t.Fatalf("height %d: got %v, want ErrInvalidSubtreeHeight", height, err)
+		}
+	}
+}
+
+// tailOf 与 append 和 truncate 命令一样找到需要重新切分的位置：
+// 追加时最后一个数据块可能不满，与追加的内容一起重新切分；截断时保留截断位置之前的完整数据块。
+// 返回保留的叶子个数和从第 keep 个数据块开头开始的新内容。
+func tailOf(t *testing.T, oldData, newData []byte, config *MerkleConfig) (int, []byte) {
+	t.Helper()
+	chunks := chunkAll(t, bytes.NewReader(oldData), config)
+	keep, offset := len(chunks)-1, len(oldData)-len(chunks[len(chunks)-1])
+	if len(newData) < len(oldData) {
+		keep, offset = 0, 0
+		for _, chunk := range chunks {
+			if offset+len(chunk) > len(newData) {
+				break
+			}
+			keep, offset = keep+1, offset+len(chunk)
+		}
+	}
+	return keep, newData[offset:]
+}
+
+func TestTailUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func() *MerkleConfig
+		height int
+		size   int // 原文件的大小
+		change func([]byte) []byte
+	}{
+		{"fixed append", func() *MerkleConfig { return fixedConfig(leafSize) }, 0, 10*leafSize + 20, appendBytes(300)},
+		{"fixed append new subtrees", func() *MerkleConfig { return fixedConfig(leafSize) }, 2, 10*leafSize + 20, appendBytes(20 * leafSize)},
+		{"fixed append to full chunk", func() *MerkleConfig { return fixedConfig(leafSize) }, 2, 8 * leafSize, appendBytes(leafSize + 1)},
+		{"fixed truncate", func() *MerkleConfig { return fixedConfig(leafSize) }, 0, 20 * leafSize, truncateTo(7*leafSize + 5)},
+		{"fixed truncate removes subtrees", func() *MerkleConfig { return fixedConfig(leafSize) }, 2, 20 * leafSize, truncateTo(5*leafSize + 5)},
+		{"fixed truncate at boundary", func() *MerkleConfig { return fixedConfig(leafSize) }, 2, 20 * leafSize, truncateTo(6 * leafSize)},
+		{"fixed truncate inside first chunk", func() *MerkleConfig { return fixedConfig(leafSize) }, 1, 9 * leafSize, truncateTo(3)},
+		{"fastcdc append", cdcConfig, 0, 100 * 1024, appendBytes(50 * 1024)},
+		{"fastcdc append with subtrees", cdcConfig, 2, 100 * 1024, appendBytes(50 * 1024)},
+		{"fastcdc truncate with subtrees", cdcConfig, 2, 100 * 1024, truncateTo(41 * 1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secKey, pubKey, err := GenerateKeyPair(SchemeP256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := tt.config()
+			config.SubtreeHeight = tt.height
+			data := randomData(7, tt.size)
+			oldRoot := publish(t, buildFile(t, data, config, pubKey), pubKey, config)
+			newData := tt.change(data)
+
+			keep, tail := tailOf(t, data, newData, config)
+			collide, calls := countingCollider(pubKey, secKey)
+			root, err := UpdateMerkleTreeTail(bytes.NewReader(tail), keep, config, oldRoot, pubKey, collide)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(root.Hash, oldRoot.Hash) {
+				t.Fatal("root hash changed")
+			}
+			// 结果与重新切分整个新文件相同
+			got, want := GetAllLeavesHashes(root), leafHashes(t, newData, config)
+			if len(got) != len(want) {
+				t.Fatalf("got %d leaves, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Fatalf("leaf %d differs from rechunking the new file", i)
+				}
+			}
+			checkProofs(t, root, pubKey)
+			publish(t, root, pubKey, config)
+
+			// 只包含保留的叶子的子树不需要碰撞，随机数不变
+			if tt.height > 0 {
+				oldSubtrees, subtrees := SubtreeRoots(oldRoot), SubtreeRoots(root)
+				unchanged := keep >> tt.height
+				for i := 0; i < unchanged; i++ {
+					if !bytes.Equal(subtrees[i].RandomNum.Serialize(), oldSubtrees[i].RandomNum.Serialize()) {
+						t.Fatalf("subtree %d before the tail changed", i)
+					}
+				}
+				if *calls > 1+len(oldSubtrees)-unchanged {
+					t.Fatalf("generated %d collisions for %d changed subtrees", *calls, len(oldSubtrees)-unchanged)
+				}
+			}
+		})
+	}
+}
+
+// appendBytes 返回在文件末尾追加 n 个字节的修改
+func appendBytes(n int) func([]byte) []byte {
+	return func(data []byte) []byte {
+		return append(append([]byte{}, data...), randomData(8, n)...)
+	}
+}
+
+// truncateTo 返回把文件截断为 size 个字节的修改
+func truncateTo(size int) func([]byte) []byte {
+	return func(data []byte) []byte {
+		return append([]byte{}, data[:size]...)
+	}
+}
+
+func TestTailUpdateRejectsInvalidKeep(t *testing.T) {
+	secKey, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fixedConfig(leafSize)
+	oldRoot := buildFile(t, randomData(9, 4*leafSize), config, pubKey)
+	for _, keep := range []int{-1, 5} {
+		if _, err := UpdateMerkleTreeTail(bytes.NewReader([]byte("tail")), keep, config, oldRoot, pubKey, LocalCollider(pubKey, secKey)); err == nil {
+			t.Fatalf("kept %d of 4 leaves", keep)
+		}
+	}
+	// 不保留任何叶子且没有新内容时树为空
+	if _, err := UpdateMerkleTreeTail(bytes.NewReader(nil), 0, config, oldRoot, pubKey, LocalCollider(pubKey, secKey)); !errors.Is(err, ErrEmptyTree) {
+		t.Fatalf("got %v, want ErrEmptyTree", err)
+	}
+}
@@ -0,0 +1,540 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"filippo.io/nistec"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// 门限陷门：变色龙私钥 x 按 Shamir 方案拆分为 n 个分片 x_i = f(i)，f(0) = x，任意 t 个分片可以协作
+// 生成碰撞或签名，整个过程中完整的私钥不会出现在任何一个节点上。
+//
+// 协作按 FROST 的方式进行: 每个参与者选择一对随机数 (d_i, e_i) 并公开 D_i = d_i·G、E_i = e_i·G，
+// 绑定系数 ρ_i 由请求内容和全部承诺哈希得到，随机点 R = h + Σ(D_i + ρ_i·E_i)（碰撞）或 R = Σ(D_i + ρ_i·E_i)（签名），
+// 参与者返回部分结果 s_i = d_i + ρ_i·e_i ∓ e·λ_i·x_i，其中 λ_i 是拉格朗日系数，
+// 协调者把部分结果相加即得到 s' = k - e·x（碰撞）或 s = k + e·x（Schnorr 签名）。
+
+const (
+	// pointSize 是定长编码的曲线点长度，X 与 Y 各32字节
+	pointSize = 64
+	// scalarSize 是定长编码的标量长度
+	scalarSize = 32
+	// schnorrTag 是门限 Schnorr 签名的首字节，ECDSA 的 ASN.1 签名总是以 0x30 开头
+	schnorrTag = 0x01
+	// schnorrSize 是 Schnorr 签名的长度: tag || R || s
+	schnorrSize = 1 + pointSize + scalarSize
+	// commitmentSize 是一个参与者的承诺 D_i || E_i 的长度
+	commitmentSize = 2 * pointSize
+
+	sessionCollision = "collision"
+	sessionSchnorr   = "schnorr"
+)
+
+var (
+	// ErrInvalidShare 表示分片与其公开的分片公钥不匹配
+	ErrInvalidShare = errors.New("invalid key share")
+	// ErrNotEnoughShares 表示参与的分片少于门限
+	ErrNotEnoughShares = errors.New("not enough key shares")
+)
+
+// KeyShare 是变色龙私钥的一个 Shamir 分片
+type KeyShare struct {
+	Index        int      `json:"index"`        // 分片编号，从1开始
+	Threshold    int      `json:"threshold"`    // 生成碰撞或签名至少需要的分片数
+	PubKey       []byte   `json:"pubKey"`       // 完整的变色龙公钥，编码与 ChameleomPubKey.Serialize 相同
+	Share        []byte   `json:"share"`        // 分片私钥 f(Index)
+	PublicShares [][]byte `json:"publicShares"` // 每个分片对应的公钥 f(i)·G，下标为 i-1
+}
+
+// marshalPoint 将曲线点编码为定长的64字节
+func marshalPoint(x, y *big.Int) []byte {
+	res := make([]byte, pointSize)
+	x.FillBytes(res[:32])
+	y.FillBytes(res[32:])
+	return res
+}
+
+// unmarshalPoint 解码定长的曲线点，并检查点在曲线上
+func unmarshalPoint(data []byte) (*big.Int, *big.Int, error) {
+	if len(data) != pointSize {
+		return nil, nil, fmt.Errorf("invalid point length %d", len(data))
+	}
+	x := new(big.Int).SetBytes(data[:32])
+	y := new(big.Int).SetBytes(data[32:])
+	if _, err := newP256Point(x, y); err != nil {
+		return nil, nil, err
+	}
+	return x, y, nil
+}
+
+// SplitKey 将变色龙私钥拆分为 total 个分片，任意 threshold 个分片可以协作使用陷门
+// 参数:
+// - secKey: 变色龙私钥。
+// - threshold: 门限 t，1 <= t <= total。
+// - total: 分片数 n。
+// 返回值:
+// - []*KeyShare: 编号为 1..n 的分片。
+// - error: 参数无效时返回错误信息。
+func SplitKey(secKey []byte, threshold, total int) ([]*KeyShare, error) {
+	if threshold < 1 || threshold > total {
+		return nil, fmt.Errorf("invalid threshold %d of %d", threshold, total)
+	}
+	key, err := p256SecKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := new(p256Scalar).setBytes(key.Bytes())
+	if err != nil {
+		return nil, ErrInvalidSecKey
+	}
+
+	// f(z) = x + a_1·z + ... + a_{t-1}·z^{t-1}
+	coefficients := []*p256Scalar{secret}
+	for i := 1; i < threshold; i++ {
+		a, err := p256ScalarRand()
+		if err != nil {
+			return nil, err
+		}
+		coefficients = append(coefficients, a)
+	}
+
+	pubKey := key.PublicKey().Bytes()
+	values := make([]*p256Scalar, total)
+	publicShares := make([][]byte, total)
+	for i := 1; i <= total; i++ {
+		z := p256ScalarFromInt(big.NewInt(int64(i)))
+		value := new(p256Scalar)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			value.Mul(value, z)
+			value.Add(value, coefficients[j])
+		}
+		values[i-1] = value
+		p, err := p256BaseMult(value)
+		if err != nil {
+			return nil, err
+		}
+		publicShares[i-1] = marshalPoint(p256Coords(p))
+	}
+
+	shares := make([]*KeyShare, total)
+	for i, value := range values {
+		shares[i] = &KeyShare{
+			Index:        i + 1,
+			Threshold:    threshold,
+			PubKey:       pubKey,
+			Share:        value.Bytes(),
+			PublicShares: publicShares,
+		}
+	}
+	return shares, nil
+}
+
+// Verify 检查分片私钥与分片公钥一致，并且前 t 个分片公钥插值得到完整的公钥
+func (share *KeyShare) Verify() error {
+	if share.Threshold < 1 || share.Index < 1 || share.Index > len(share.PublicShares) || share.Threshold > len(share.PublicShares) {
+		return ErrInvalidShare
+	}
+	secret, err := new(p256Scalar).setBytes(share.Share)
+	if err != nil {
+		return ErrInvalidShare
+	}
+	p, err := p256BaseMult(secret)
+	if err != nil || !bytes.Equal(marshalPoint(p256Coords(p)), share.PublicShares[share.Index-1]) {
+		return ErrInvalidShare
+	}
+
+	indices := make([]int, share.Threshold)
+	for i := range indices {
+		indices[i] = i + 1
+	}
+	sum := nistec.NewP256Point()
+	for _, index := range indices {
+		point, err := unmarshalP256Point(share.PublicShares[index-1])
+		if err != nil {
+			return ErrInvalidShare
+		}
+		lambda, err := LagrangeCoefficient(index, indices)
+		if err != nil {
+			return err
+		}
+		if _, err := point.ScalarMult(point, lambda.FillBytes(make([]byte, scalarSize))); err != nil {
+			return err
+		}
+		sum.Add(sum, point)
+	}
+	pubKey, err := DeserializeChameleomPubKey(share.PubKey)
+	if err != nil || !bytes.Equal(pubKey.Serialize(), encodeP256PubKey(p256Coords(sum))) {
+		return ErrInvalidShare
+	}
+	return nil
+}
+
+// unmarshalP256Point 解码定长的曲线点
+func unmarshalP256Point(data []byte) (*nistec.P256Point, error) {
+	x, y, err := unmarshalPoint(data)
+	if err != nil {
+		return nil, err
+	}
+	return newP256Point(x, y)
+}
+
+// LagrangeCoefficient 计算分片 index 在 indices 这组分片中插值 f(0) 的拉格朗日系数
+// λ_i = Π j/(j-i) mod N
+func LagrangeCoefficient(index int, indices []int) (*big.Int, error) {
+	params := curve.Params()
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	found := false
+	seen := make(map[int]bool, len(indices))
+	for _, j := range indices {
+		if j < 1 || seen[j] {
+			return nil, fmt.Errorf("invalid share index %d", j)
+		}
+		seen[j] = true
+		if j == index {
+			found = true
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(j)))
+		num.Mod(num, params.N)
+		den.Mul(den, big.NewInt(int64(j-index)))
+		den.Mod(den, params.N)
+	}
+	if !found {
+		return nil, fmt.Errorf("share %d is not a participant", index)
+	}
+	den.ModInverse(den, params.N)
+	return num.Mul(num, den).Mod(num, params.N), nil
+}
+
+// Nonce 是一个参与者在一次协作中使用的一对随机数 (d_i, e_i)，只能使用一次
+type Nonce struct {
+	hiding     p256Scalar
+	binding    p256Scalar
+	commitment []byte
+	used       bool
+}
+
+// NewNonce 生成一次协作使用的随机数和承诺 D_i || E_i = d_i·G || e_i·G
+func NewNonce() (*Nonce, error) {
+	nonce := &Nonce{}
+	commitment := make([]byte, 0, commitmentSize)
+	for _, k := range []*p256Scalar{&nonce.hiding, &nonce.binding} {
+		r, err := p256ScalarRand()
+		if err != nil {
+			return nil, err
+		}
+		*k = *r
+		p, err := p256BaseMult(k)
+		if err != nil {
+			return nil, err
+		}
+		commitment = append(commitment, marshalPoint(p256Coords(p))...)
+	}
+	nonce.commitment = commitment
+	return nonce, nil
+}
+
+// Commitment 返回第一轮公开的承诺
+func (nonce *Nonce) Commitment() []byte {
+	return nonce.commitment
+}
+
+// Session 是一次门限协作的公开内容。参与者和协调者用相同的输入创建 Session，
+// 得到相同的绑定系数 ρ_i、随机点 R 和挑战 e。
+type Session struct {
+	kind        string
+	indices     []int
+	commitments [][]byte
+	rhos        []*big.Int
+	rX, rY      *big.Int
+	e           *big.Int
+}
+
+// hashParts 计算带域分隔标签的哈希，每个输入前写入长度，避免不同的切分得到相同的哈希
+func hashParts(tag string, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(tag))
+	for _, part := range parts {
+		binary.Write(h, binary.BigEndian, uint64(len(part)))
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// newSession 按分片编号排序参与者，计算绑定系数 ρ_i = H(Y, 请求内容, 所有承诺, i)
+// 和随机点 R = base + Σ(D_i + ρ_i·E_i)，base 为 nil 时从无穷远点开始。
+// 绑定系数依赖于请求内容和全部承诺，协调者无法在看到承诺之后选择请求内容或参与者组合，
+// 这阻止了两轮 Schnorr 在并发会话中受到的 ROS 攻击。
+func newSession(kind string, pubKey *ChameleomPubKey, context []byte, base *nistec.P256Point, indices []int, commitments [][]byte) (*Session, error) {
+	if len(indices) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+	if len(indices) != len(commitments) {
+		return nil, errors.New("indices and commitments mismatch")
+	}
+	session := &Session{
+		kind:        kind,
+		indices:     append([]int{}, indices...),
+		commitments: append([][]byte{}, commitments...),
+	}
+	sort.Sort(byIndex{session})
+	list := sha256.New()
+	for i, index := range session.indices {
+		if index < 1 || (i > 0 && session.indices[i-1] == index) {
+			return nil, fmt.Errorf("invalid share index %d", index)
+		}
+		if len(session.commitments[i]) != commitmentSize {
+			return nil, fmt.Errorf("invalid commitment length %d", len(session.commitments[i]))
+		}
+		binary.Write(list, binary.BigEndian, uint64(index))
+		list.Write(session.commitments[i])
+	}
+	listHash := list.Sum(nil)
+
+	r := nistec.NewP256Point()
+	if base != nil {
+		r.Set(base)
+	}
+	for i, index := range session.indices {
+		d, err := unmarshalP256Point(session.commitments[i][:pointSize])
+		if err != nil {
+			return nil, err
+		}
+		e, err := unmarshalP256Point(session.commitments[i][pointSize:])
+		if err != nil {
+			return nil, err
+		}
+		indexBytes := binary.BigEndian.AppendUint64(nil, uint64(index))
+		rho := new(big.Int).SetBytes(hashParts("FlexiSN frost rho v1", pubKey.Serialize(), context, listHash, indexBytes))
+		rho.Mod(rho, curve.Params().N)
+		session.rhos = append(session.rhos, rho)
+
+		// 承诺和绑定系数都是公开的
+		if _, err := e.ScalarMult(e, rho.FillBytes(make([]byte, scalarSize))); err != nil {
+			return nil, err
+		}
+		r.Add(r, d)
+		r.Add(r, e)
+	}
+	if len(r.Bytes()) == 1 {
+		return nil, errors.New("group commitment is the point at infinity")
+	}
+	session.rX, session.rY = p256Coords(r)
+	return session, nil
+}
+
+// byIndex 按分片编号排列会话中的参与者
+type byIndex struct{ *Session }
+
+func (b byIndex) Len() int           { return len(b.indices) }
+func (b byIndex) Less(i, j int) bool { return b.indices[i] < b.indices[j] }
+func (b byIndex) Swap(i, j int) {
+	b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+	b.commitments[i], b.commitments[j] = b.commitments[j], b.commitments[i]
+}
+
+// CollisionSession 创建门限碰撞的会话，R' = h + Σ(D_i + ρ_i·E_i)，e = H(m' || R')。
+// 参与者和协调者分别调用这个函数，参与者会先验证旧的随机数确实是 rootHash 的一个打开方式。
+// 参数:
+// - message: 旧的变色龙哈希消息。
+// - randomNum: 旧的随机数。
+// - pubKey: 变色龙公钥。
+// - rootHash: 根哈希，即变色龙哈希值的 X 坐标。
+// - newMessage: 新的变色龙哈希消息。
+// - indices: 参与者的分片编号。
+// - commitments: 参与者的承诺，与 indices 一一对应。
+// 返回值:
+// - *Session: 会话。
+// - error: 旧的随机数无法打开根哈希或承诺无效时返回错误信息。
+func CollisionSession(message []byte, randomNum *ChameleonRandomNum, pubKey *ChameleomPubKey, rootHash, newMessage []byte, indices []int, commitments [][]byte) (*Session, error) {
+	// 门限陷门只支持 p256 方案
+	pubX, pubY, err := pubKey.p256Point()
+	if err != nil {
+		return nil, err
+	}
+	oldRX, oldRY, oldS, err := randomNum.p256Values()
+	if err != nil {
+		return nil, err
+	}
+	h, err := computeHash(message, oldRX, oldRY, oldS, pubX, pubY)
+	if err != nil {
+		return nil, err
+	}
+	if hX, _ := p256Coords(h); hX.Cmp(new(big.Int).SetBytes(rootHash)) != 0 {
+		return nil, errors.New("random number does not open root hash")
+	}
+	context := hashParts("FlexiSN frost collision v1", message, randomNum.Serialize(), rootHash, newMessage)
+	session, err := newSession(sessionCollision, pubKey, context, h, indices, commitments)
+	if err != nil {
+		return nil, err
+	}
+	// 与 p256 方案的 Collide 使用相同的挑战，结果可以直接用 VerifyMerkleRoot 验证
+	session.e = p256Challenge(newMessage, session.rX, session.rY)
+	return session, nil
+}
+
+// SchnorrSession 创建门限 Schnorr 签名的会话，R = Σ(D_i + ρ_i·E_i)，e = H(R || Y || digest)
+func SchnorrSession(pubKey *ChameleomPubKey, digest []byte, indices []int, commitments [][]byte) (*Session, error) {
+	pubX, pubY, err := pubKey.p256Point()
+	if err != nil {
+		return nil, err
+	}
+	context := hashParts("FlexiSN frost schnorr v1", digest)
+	session, err := newSession(sessionSchnorr, pubKey, context, nil, indices, commitments)
+	if err != nil {
+		return nil, err
+	}
+	session.e = schnorrHash(session.rX, session.rY, pubX, pubY, digest)
+	return session, nil
+}
+
+func schnorrHash(rX, rY, pubX, pubY *big.Int, digest []byte) *big.Int {
+	sha256Hash := sha256.New()
+	sha256Hash.Write([]byte("FlexiSN schnorr v1"))
+	sha256Hash.Write(marshalPoint(rX, rY))
+	sha256Hash.Write(marshalPoint(pubX, pubY))
+	sha256Hash.Write(digest)
+	e := new(big.Int).SetBytes(sha256Hash.Sum(nil))
+	return e.Mod(e, curve.Params().N)
+}
+
+// partial 计算 d_i + ρ_i·e_i ∓ e·λ_i·x_i，减号用于碰撞，加号用于签名
+func (share *KeyShare) partial(nonce *Nonce, session *Session, kind string) ([]byte, error) {
+	if session.kind != kind {
+		return nil, fmt.Errorf("session is not for %s", kind)
+	}
+	if nonce.used {
+		return nil, errors.New("nonce already used")
+	}
+	if len(session.indices) < share.Threshold {
+		return nil, ErrNotEnoughShares
+	}
+	// 协调者必须使用本节点第一轮给出的承诺，否则随机点与部分结果不对应
+	position := -1
+	for i, index := range session.indices {
+		if index == share.Index && bytes.Equal(session.commitments[i], nonce.commitment) {
+			position = i
+		}
+	}
+	if position < 0 {
+		return nil, errors.New("own commitment missing")
+	}
+	lambda, err := LagrangeCoefficient(share.Index, session.indices)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := new(p256Scalar).setBytes(share.Share)
+	if err != nil {
+		return nil, ErrInvalidShare
+	}
+	// 无论成功与否随机数都只使用一次，否则两个部分结果可以解出分片私钥
+	nonce.used = true
+
+	// ρ_i、e 和 λ_i 是公开的，分片私钥和随机数只参与常数时间的运算
+	k := new(p256Scalar).Mul(p256ScalarFromInt(session.rhos[position]), &nonce.binding)
+	k.Add(k, &nonce.hiding)
+	nonce.hiding, nonce.binding = p256Scalar{}, p256Scalar{}
+	t := new(p256Scalar).Mul(p256ScalarFromInt(session.e), p256ScalarFromInt(lambda))
+	t.Mul(t, secret)
+	if kind == sessionCollision {
+		return k.Sub(k, t).Bytes(), nil
+	}
+	return k.Add(k, t).Bytes(), nil
+}
+
+// PartialCollision 计算这个分片对碰撞的部分结果 s_i = d_i + ρ_i·e_i - e·λ_i·x_i
+// 参数:
+// - nonce: 这个分片在本次协作第一轮生成的随机数，调用之后不能再使用。
+// - session: CollisionSession 创建的会话。
+func (share *KeyShare) PartialCollision(nonce *Nonce, session *Session) ([]byte, error) {
+	return share.partial(nonce, session, sessionCollision)
+}
+
+// PartialSchnorr 计算这个分片对签名的部分结果 s_i = d_i + ρ_i·e_i + e·λ_i·x_i
+func (share *KeyShare) PartialSchnorr(nonce *Nonce, session *Session) ([]byte, error) {
+	return share.partial(nonce, session, sessionSchnorr)
+}
+
+// sumPartials 计算部分结果的和
+func sumPartials(partials [][]byte) (*big.Int, error) {
+	s := new(big.Int)
+	for _, partial := range partials {
+		if len(partial) != scalarSize {
+			return nil, fmt.Errorf("invalid partial length %d", len(partial))
+		}
+		s.Add(s, new(big.Int).SetBytes(partial))
+	}
+	return s.Mod(s, curve.Params().N), nil
+}
+
+// CombineCollision 汇总部分结果得到新的随机数
+func CombineCollision(session *Session, partials [][]byte) (*ChameleonRandomNum, error) {
+	if session.kind != sessionCollision {
+		return nil, fmt.Errorf("session is not for %s", sessionCollision)
+	}
+	s, err := sumPartials(partials)
+	if err != nil {
+		return nil, err
+	}
+	return &ChameleonRandomNum{data: encodeP256RandomNum(session.rX, session.rY, s)}, nil
+}
+
+// CombineSchnorr 汇总部分结果得到 Schnorr 签名 tag || R || s
+func CombineSchnorr(session *Session, partials [][]byte) ([]byte, error) {
+	if session.kind != sessionSchnorr {
+		return nil, fmt.Errorf("session is not for %s", sessionSchnorr)
+	}
+	s, err := sumPartials(partials)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSchnorr(session.rX, session.rY, s), nil
+}
+
+// encodeSchnorr 编码 Schnorr 签名 tag || R || s
+func encodeSchnorr(rX, rY, s *big.Int) []byte {
+	signature := make([]byte, 0, schnorrSize)
+	signature = append(signature, schnorrTag)
+	signature = append(signature, marshalPoint(rX, rY)...)
+	return append(signature, s.FillBytes(make([]byte, scalarSize))...)
+}
+
+// verifySchnorr 验证 s·G == R + e·Y
+func verifySchnorr(pubX, pubY *big.Int, digest, signature []byte) bool {
+	if len(signature) != schnorrSize || signature[0] != schnorrTag {
+		return false
+	}
+	rX, rY, err := unmarshalPoint(signature[1 : 1+pointSize])
+	if err != nil {
+		return false
+	}
+	s := new(big.Int).SetBytes(signature[1+pointSize:])
+	if s.Cmp(curve.Params().N) >= 0 {
+		return false
+	}
+	r, err := newP256Point(rX, rY)
+	if err != nil {
+		return false
+	}
+	pub, err := newP256Point(pubX, pubY)
+	if err != nil {
+		return false
+	}
+	e := schnorrHash(rX, rY, pubX, pubY, digest)
+	left, err := nistec.NewP256Point().ScalarBaseMult(s.FillBytes(make([]byte, scalarSize)))
+	if err != nil {
+		return false
+	}
+	right, err := nistec.NewP256Point().ScalarMult(pub, e.FillBytes(make([]byte, scalarSize)))
+	if err != nil {
+		return false
+	}
+	right.Add(r, right)
+	return bytes.Equal(left.Bytes(), right.Bytes())
+}
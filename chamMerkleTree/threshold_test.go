@@ -0,0 +1,363 @@
+package chamMerkleTree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// thresholdFixture 生成一对 p256 密钥和一个用公钥计算的变色龙哈希
+func thresholdFixture(t *testing.T) (secKey []byte, pubKey *ChameleomPubKey, hash []byte, randomNum *ChameleonRandomNum) {
+	t.Helper()
+	secKey, pubKey, err := GenerateKeyPair(SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, randomness, err := pubKey.scheme.Hash(pubKey.data, []byte("old message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secKey, pubKey, hash, &ChameleonRandomNum{data: randomness}
+}
+
+// thresholdCollide 让 indices 中的分片协作为 newMessage 生成碰撞
+func thresholdCollide(t *testing.T, shares []*KeyShare, indices []int, pubKey *ChameleomPubKey, hash []byte, randomNum *ChameleonRandomNum, newMessage []byte) (*ChameleonRandomNum, error) {
+	t.Helper()
+	nonces := make([]*Nonce, len(indices))
+	commitments := make([][]byte, len(indices))
+	for i := range indices {
+		nonce, err := NewNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonces[i], commitments[i] = nonce, nonce.Commitment()
+	}
+	var partials [][]byte
+	for i, index := range indices {
+		// 每个参与者独立创建会话
+		session, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, newMessage, indices, commitments)
+		if err != nil {
+			return nil, err
+		}
+		partial, err := shares[index-1].PartialCollision(nonces[i], session)
+		if err != nil {
+			return nil, err
+		}
+		partials = append(partials, partial)
+	}
+	session, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, newMessage, indices, commitments)
+	if err != nil {
+		return nil, err
+	}
+	return CombineCollision(session, partials)
+}
+
+func TestSplitKey(t *testing.T) {
+	secKey, pubKey, _, _ := thresholdFixture(t)
+	tests := []struct {
+		name      string
+		threshold int
+		total     int
+		wantErr   bool
+	}{
+		{"1 of 1", 1, 1, false},
+		{"2 of 3", 2, 3, false},
+		{"3 of 5", 3, 5, false},
+		{"5 of 5", 5, 5, false},
+		{"zero threshold", 0, 3, true},
+		{"threshold above total", 4, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := SplitKey(secKey, tt.threshold, tt.total)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shares) != tt.total {
+				t.Fatalf("got %d shares, want %d", len(shares), tt.total)
+			}
+			for i, share := range shares {
+				if share.Index != i+1 || share.Threshold != tt.threshold {
+					t.Fatalf("share %d has index %d threshold %d", i, share.Index, share.Threshold)
+				}
+				if !bytes.Equal(share.PubKey, pubKey.Serialize()) {
+					t.Fatal("share has another public key")
+				}
+				if err := share.Verify(); err != nil {
+					t.Fatalf("share %d: %v", share.Index, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitKeyRejectsTamperedShare(t *testing.T) {
+	secKey, _, _, _ := thresholdFixture(t)
+	shares, err := SplitKey(secKey, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := *shares[0]
+	share.Share = append([]byte{}, share.Share...)
+	share.Share[scalarSize-1] ^= 1
+	if !errors.Is(share.Verify(), ErrInvalidShare) {
+		t.Fatal("tampered share accepted")
+	}
+
+	// 分片公钥被替换为另一个密钥的分片公钥时，插值得不到原来的公钥
+	otherKey, _, _, _ := thresholdFixture(t)
+	others, err := SplitKey(otherKey, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share = *shares[0]
+	share.PublicShares = append([][]byte{shares[0].PublicShares[0]}, others[0].PublicShares[1:]...)
+	if !errors.Is(share.Verify(), ErrInvalidShare) {
+		t.Fatal("foreign public shares accepted")
+	}
+}
+
+func TestThresholdCollision(t *testing.T) {
+	secKey, pubKey, hash, randomNum := thresholdFixture(t)
+	shares, err := SplitKey(secKey, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		indices []int
+		wantErr bool
+	}{
+		{"first three", []int{1, 2, 3}, false},
+		{"last three", []int{3, 4, 5}, false},
+		{"unordered", []int{5, 1, 3}, false},
+		{"all five", []int{1, 2, 3, 4, 5}, false},
+		{"below threshold", []int{2, 4}, true},
+		{"duplicate index", []int{1, 1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newMessage := []byte("new message " + tt.name)
+			newRandomNum, err := thresholdCollide(t, shares, tt.indices, pubKey, hash, randomNum, newMessage)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleRoot(newMessage, hash, pubKey, newRandomNum) {
+				t.Fatal("threshold collision does not open the hash")
+			}
+			if VerifyMerkleRoot([]byte("another message"), hash, pubKey, newRandomNum) {
+				t.Fatal("collision opens the hash for another message")
+			}
+		})
+	}
+}
+
+func TestPartialCollisionRejectsMisuse(t *testing.T) {
+	secKey, pubKey, hash, randomNum := thresholdFixture(t)
+	shares, err := SplitKey(secKey, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := []int{1, 2}
+	newNonces := func() ([]*Nonce, [][]byte) {
+		var nonces []*Nonce
+		var commitments [][]byte
+		for range indices {
+			nonce, err := NewNonce()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonces = append(nonces, nonce)
+			commitments = append(commitments, nonce.Commitment())
+		}
+		return nonces, commitments
+	}
+	newMessage := []byte("new message")
+
+	t.Run("nonce reuse", func(t *testing.T) {
+		nonces, commitments := newNonces()
+		session, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, newMessage, indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := shares[0].PartialCollision(nonces[0], session); err != nil {
+			t.Fatal(err)
+		}
+		// 第二次使用同一个随机数，即使换了消息也必须拒绝，否则两个部分结果可以解出分片私钥
+		other, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, []byte("other"), indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := shares[0].PartialCollision(nonces[0], other); err == nil {
+			t.Fatal("nonce used twice")
+		}
+	})
+
+	t.Run("replaced commitment", func(t *testing.T) {
+		nonces, commitments := newNonces()
+		_, replaced := newNonces()
+		commitments[0] = replaced[0]
+		session, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, newMessage, indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := shares[0].PartialCollision(nonces[0], session); err == nil {
+			t.Fatal("partial computed for a commitment the share did not give")
+		}
+	})
+
+	t.Run("schnorr session", func(t *testing.T) {
+		nonces, commitments := newNonces()
+		session, err := SchnorrSession(pubKey, []byte("digest"), indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := shares[0].PartialCollision(nonces[0], session); err == nil {
+			t.Fatal("collision partial computed for a signature session")
+		}
+	})
+
+	t.Run("wrong opening", func(t *testing.T) {
+		_, commitments := newNonces()
+		wrongHash := sha256.Sum256([]byte("not the hash"))
+		if _, err := CollisionSession([]byte("old message"), randomNum, pubKey, wrongHash[:], newMessage, indices, commitments); err == nil {
+			t.Fatal("session created for a random number that does not open the hash")
+		}
+	})
+
+	t.Run("binding factor depends on message", func(t *testing.T) {
+		_, commitments := newNonces()
+		a, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, []byte("a"), indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, []byte("b"), indices, commitments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 相同的承诺用于不同的消息时得到不同的随机点，协调者不能挑选消息来组合部分结果
+		if a.rX.Cmp(b.rX) == 0 && a.rY.Cmp(b.rY) == 0 {
+			t.Fatal("group commitment does not depend on the message")
+		}
+	})
+}
+
+func TestCombineCollisionRejectsBadPartials(t *testing.T) {
+	secKey, pubKey, hash, randomNum := thresholdFixture(t)
+	shares, err := SplitKey(secKey, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := []int{1, 3}
+	var nonces []*Nonce
+	var commitments [][]byte
+	for range indices {
+		nonce, err := NewNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, nonce)
+		commitments = append(commitments, nonce.Commitment())
+	}
+	newMessage := []byte("new message")
+	session, err := CollisionSession([]byte("old message"), randomNum, pubKey, hash, newMessage, indices, commitments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partials [][]byte
+	for i, index := range indices {
+		partial, err := shares[index-1].PartialCollision(nonces[i], session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partials = append(partials, partial)
+	}
+
+	if _, err := CombineCollision(session, [][]byte{partials[0], partials[1][1:]}); err == nil {
+		t.Fatal("short partial accepted")
+	}
+	tampered := append([]byte{}, partials[1]...)
+	tampered[0] ^= 1
+	randomNum2, err := CombineCollision(session, [][]byte{partials[0], tampered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyMerkleRoot(newMessage, hash, pubKey, randomNum2) {
+		t.Fatal("tampered partial produced a valid collision")
+	}
+	if VerifyMerkleRoot(newMessage, hash, pubKey, mustCombine(t, session, partials[:1])) {
+		t.Fatal("a single partial produced a valid collision")
+	}
+	if !VerifyMerkleRoot(newMessage, hash, pubKey, mustCombine(t, session, partials)) {
+		t.Fatal("valid partials do not combine")
+	}
+}
+
+func mustCombine(t *testing.T, session *Session, partials [][]byte) *ChameleonRandomNum {
+	t.Helper()
+	randomNum, err := CombineCollision(session, partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return randomNum
+}
+
+func TestThresholdSchnorr(t *testing.T) {
+	secKey, pubKey, _, _ := thresholdFixture(t)
+	shares, err := SplitKey(secKey, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("metadata"))
+	indices := []int{2, 3}
+	var nonces []*Nonce
+	var commitments [][]byte
+	for range indices {
+		nonce, err := NewNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, nonce)
+		commitments = append(commitments, nonce.Commitment())
+	}
+	session, err := SchnorrSession(pubKey, digest[:], indices, commitments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partials [][]byte
+	for i, index := range indices {
+		partial, err := shares[index-1].PartialSchnorr(nonces[i], session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partials = append(partials, partial)
+	}
+	if _, err := CombineCollision(session, partials); err == nil {
+		t.Fatal("signature session combined into a collision")
+	}
+	signature, err := CombineSchnorr(session, partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubKey.scheme.VerifySignature(pubKey.data, digest[:], signature) {
+		t.Fatal("threshold signature rejected")
+	}
+	other := sha256.Sum256([]byte("other metadata"))
+	if pubKey.scheme.VerifySignature(pubKey.data, other[:], signature) {
+		t.Fatal("threshold signature accepted for another digest")
+	}
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"main/challenge"
+	"main/run"
+	"strconv"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "challenge",
+		Description: "Challenges a peer holding our chunks, or shows results with -stats",
+		Action:      challengeAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "challenge-record",
+		Description: "Reads an anchored challenge result from the metadata registry with -root and -peer",
+		Action:      challengeRecordAction,
+	})
+}
+
+func challengeAction(ctx context.Context, params map[string]string) error {
+	if _, exists := params["-stats"]; exists {
+		stats, err := challenge.ListPeerStats()
+		if err != nil {
+			return err
+		}
+		for p, s := range stats {
+			fmt.Printf("%s passed: %d failed: %d last: %v at %s %s\n",
+				p, s.Passed, s.Failed, s.LastPassed, s.LastChallenge.Format("2006-01-02 15:04:05"), s.LastError)
+		}
+		return nil
+	}
+
+	result, err := challenge.RunOnce(ctx)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		fmt.Println("No pending challenge or no holder found")
+		return nil
+	}
+	if result.Passed {
+		fmt.Printf("Peer %s passed challenge for leaf %d of %x\n", result.Peer, result.LeafIndex, result.RootHash)
+	} else {
+		fmt.Printf("Peer %s failed challenge for leaf %d of %x: %v\n", result.Peer, result.LeafIndex, result.RootHash, result.Err)
+	}
+	if result.Anchor != nil {
+		fmt.Printf("Queued for anchoring as record %d\n", result.Anchor.Seq)
+	}
+	return nil
+}
+
+// challengeRecordAction 从 metadata 后端读取挑战结果，-seq 指定第几次挑战，缺省时读取最新结果
+func challengeRecordAction(ctx context.Context, params map[string]string) error {
+	rootString, exists := params["-root"]
+	if !exists {
+		fmt.Println("Please provide a root hash with -root")
+		return run.NoRequiredParamError
+	}
+	peerString, exists := params["-peer"]
+	if !exists {
+		fmt.Println("Please provide a peer ID with -peer")
+		return run.NoRequiredParamError
+	}
+	rootHash, err := hex.DecodeString(rootString)
+	if err != nil {
+		return err
+	}
+	p, err := peer.Decode(peerString)
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	if seqString, exists := params["-seq"]; exists {
+		seq, err = strconv.ParseUint(seqString, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	record, err := challenge.ReadAnchor(ctx, rootHash, p, seq)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("record %d: peer %s leaf %d of %s passed: %v height: %d challenger: %s proof digest: %s\n",
+		record.Seq, record.Peer, record.LeafIndex, record.RootHash, record.Passed, record.Height, record.Challenger, record.ProofDigest)
+	return nil
+}
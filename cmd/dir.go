@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"main/chamMerkleTree"
+	"main/manager"
+	"main/manifest"
+	"main/resolver"
+	"os"
+)
+
+// sendDirectory 逐个发送目录中的文件，再把目录清单作为一个文件发送，清单的根哈希就是目录的标识。
+// 指定 -root 时更新这个已发布的目录：清单中已有的文件在原来的根哈希上更新，内容没有改变的文件被跳过，
+// 清单本身也在原来的根哈希上更新，因此增加或删除文件后目录的根哈希保持不变。
+func sendDirectory(ctx context.Context, params map[string]string, dir string, parameter *manager.Parameters, config *chamMerkleTree.MerkleConfig, num, challenges int) error {
+	rootHex, update := params["-root"]
+	old := make(map[string]manifest.Entry)
+	if update {
+		oldManifest, err := fetchManifest(ctx, rootHex, false)
+		if err != nil {
+			return err
+		}
+		for _, entry := range oldManifest.Files {
+			old[entry.Path] = entry
+		}
+	}
+
+	// 1, Send every file of the directory
+	m := &manifest.Manifest{}
+	err := manifest.Walk(dir, func(path, rel string, info fs.FileInfo) error {
+		if info.IsDir() {
+			m.Dirs = append(m.Dirs, rel)
+			return nil
+		}
+		entry := manifest.Entry{Path: rel, Size: info.Size(), Mode: info.Mode().Perm()}
+		// 空文件没有数据块，只记录在清单中
+		if entry.Size > 0 {
+			var err error
+			entry.Root, err = sendEntry(ctx, params, path, old[rel].Root, parameter, config, num, challenges)
+			if err != nil {
+				return err
+			}
+		}
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2, Send the manifest
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp("", "manifest")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if update {
+		if err := updateFile(ctx, params, rootHex, tempFile.Name()); err != nil {
+			return err
+		}
+	} else {
+		root, err := sendFile(ctx, tempFile.Name(), parameter, config, num, challenges)
+		if err != nil {
+			return err
+		}
+		rootHex = hex.EncodeToString(root.Hash)
+	}
+	logrus.Infof("Send directory %s as %s with %d files", dir, rootHex, len(m.Files))
+	return nil
+}
+
+// sendEntry 发送目录中的一个文件，返回文件的根哈希。
+// oldRoot 不为空时文件已经在清单中，在原来的根哈希上更新，内容没有改变时直接跳过。
+func sendEntry(ctx context.Context, params map[string]string, path, oldRoot string, parameter *manager.Parameters, config *chamMerkleTree.MerkleConfig, num, challenges int) (string, error) {
+	if oldRoot != "" {
+		same, err := sameContent(ctx, oldRoot, path)
+		if err != nil {
+			return "", err
+		}
+		if !same {
+			err = updateFile(ctx, params, oldRoot, path)
+		}
+		return oldRoot, err
+	}
+	root, err := sendFile(ctx, path, parameter, config, num, challenges)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(root.Hash), nil
+}
+
+// getDirectory 下载目录清单，并按清单在 dirPath 下恢复每个文件及其权限
+func getDirectory(ctx context.Context, rootHex, dirPath string, requireConfirmed bool) error {
+	m, err := fetchManifest(ctx, rootHex, requireConfirmed)
+	if err != nil {
+		return err
+	}
+	if err := m.MakeDirs(dirPath); err != nil {
+		return err
+	}
+	for _, entry := range m.Files {
+		target, err := entry.Target(dirPath)
+		if err != nil {
+			return err
+		}
+		if entry.Root == "" {
+			err = os.WriteFile(target, nil, entry.Mode)
+		} else {
+			err = getFile(ctx, entry.Root, target, requireConfirmed)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, entry.Mode); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Get directory %s with %d files", rootHex, len(m.Files))
+	return nil
+}
+
+// fetchManifest 下载并解析根哈希为 rootHex 的目录清单
+func fetchManifest(ctx context.Context, rootHex string, requireConfirmed bool) (*manifest.Manifest, error) {
+	tempFile, err := os.CreateTemp("", "manifest")
+	if err != nil {
+		return nil, err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	if err := getFile(ctx, rootHex, tempFile.Name(), requireConfirmed); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Parse(data)
+}
+
+// sameContent 判断本地文件按已发布文件的分块参数切分后，数据块是否与已发布的 metadata 相同
+func sameContent(ctx context.Context, rootHex, filePath string) (bool, error) {
+	metaData, err := resolver.Resolve(ctx, rootHex)
+	if err != nil {
+		return false, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	chunker, err := chamMerkleTree.NewChunker(file, chamMerkleTree.NewMerkleConfigFromParams(metaData.Chunker))
+	if err != nil {
+		return false, err
+	}
+	for i := 0; ; i++ {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return i == len(metaData.Leaves), nil
+		}
+		if err != nil {
+			return false, err
+		}
+		hash := sha256.Sum256(chunk)
+		if i >= len(metaData.Leaves) || !bytes.Equal(hash[:], metaData.Leaves[i]) {
+			return false, nil
+		}
+	}
+}
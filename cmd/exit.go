@@ -20,7 +20,7 @@ func init() {
 func exitAction(ctx context.Context, params map[string]string) error {
 	fmt.Println("Exiting the CLI...")
 
-	manager.GetGRPCClient().Close()
+	manager.GetRegistry().Close()
 	manager.GetDBManager().CloseDB()
 	ctx.Done()
 
@@ -1,17 +1,20 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
 	"io"
-	dht "main/DHT"
 	"main/chamMerkleTree"
 	"main/manager"
+	"main/registry"
+	"main/resolver"
 	"main/run"
+	"main/transfer"
 	"os"
 	"path/filepath"
 )
@@ -19,110 +22,148 @@ import (
 func init() {
 	run.RegisterCommand(run.Command{
 		Name:        "get",
-		Description: "Gets a file from network",
+		Description: "Gets a file -f or a directory -dir from network, -bg runs in background",
 		Action:      getAction,
 	})
 }
 
 func getAction(ctx context.Context, params map[string]string) error {
 	fileName, exists := params["-f"]
-	if !exists {
-		logrus.Printf("Please provide a file name with -f")
+	dirName, isDir := params["-dir"]
+	if !exists && !isDir {
+		logrus.Printf("Please provide a file name with -f or a directory with -dir")
 		return run.NoRequiredParamError
 	}
 	filePath, exists := params["-path"]
 	if !exists {
 		filePath = "data"
 	}
+	// -confirmed 时拒绝还没有达到确认数的 metadata，避免使用可能被链重组撤销的版本
+	_, confirmed := params["-confirmed"]
+	if isDir {
+		return runTransfer(ctx, params, "get", dirName, func(ctx context.Context) error {
+			return getDirectory(ctx, dirName, filepath.Join(filePath, dirName), confirmed)
+		})
+	}
+	return runTransfer(ctx, params, "get", fileName, func(ctx context.Context) error {
+		return getFile(ctx, fileName, filepath.Join(filePath, fileName), confirmed)
+	})
+}
 
+// getFile 下载根哈希为 fileName 的文件并保存到 filePath
+func getFile(ctx context.Context, fileName, filePath string, requireConfirmed bool) error {
 	dhtService := manager.GetDHTService()
 
 	// 1, Get the file information from the blockchain
-	root, _, _, err := getChameleonMerkleTree(fileName)
+	root, _, _, err := getChameleonMerkleTree(ctx, fileName)
 	if err != nil {
-		return nil
+		return err
+	}
+	if requireConfirmed {
+		confirmed, err := manager.GetRegistry().IsConfirmed(ctx, fileName)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return fmt.Errorf("%w: %s", registry.ErrUnconfirmed, fileName)
+		}
 	}
 	logrus.Infof("Get the root hash %s", hex.EncodeToString(root.Hash))
 
 	// 2, get the file splits from the network
 	leaves := chamMerkleTree.GetAllLeavesHashes(root)
+	t := transfer.FromContext(ctx)
+	t.AddTotal(0, len(leaves))
 	files := []*os.File{}
+	// 传输被取消或失败时也要删除已经下载的临时文件
+	defer func() {
+		for _, file := range files {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
 	for _, leaf := range leaves {
 		// get the file split from the network
-		splitName := hex.EncodeToString(leaf)
-		peers, err := dhtService.DHT.GetClosestPeers(ctx, hex.EncodeToString(leaf))
+		chunk, err := fetchSplit(ctx, leaf)
 		if err != nil {
-			logrus.Errorf("Get closest peers failed")
 			return err
 		}
-		if len(peers) == 0 {
-			peers = dhtService.DHT.RoutingTable().ListPeers()
-			logrus.Infof("bootstrap peers", len(peers))
-		}
-		logrus.Infof("Get closest peers success")
 
 		// create a temp files
-		tempFile, err := os.CreateTemp("", splitName)
-		var find bool
+		tempFile, err := os.CreateTemp("", hex.EncodeToString(leaf))
 		if err != nil {
 			return err
 		}
-		for _, peer := range peers {
-
-			addrInfo, err := dhtService.DHT.FindPeer(ctx, peer)
-			if err != nil {
-				return err
-			}
-			maddrs := addrInfo.Addrs
-			maddr, err := multiaddr.NewMultiaddr(maddrs[0].String() + "/p2p/" + peer.String())
-			if err != nil {
-				return err
-			}
-			err = dhtService.GetFile(ctx, maddr, splitName, "", tempFile)
-			if err != nil {
-				logrus.Println("Get file failed", err)
-			} else {
-				find = true
-				files = append(files, tempFile)
-				break
-			}
-
-		}
-		if !find {
-			return errors.New(fmt.Sprintf("Can not find the file split %s", splitName))
+		files = append(files, tempFile)
+		if _, err := tempFile.Write(chunk); err != nil {
+			return err
 		}
+		t.AddChunk(int64(len(chunk)))
 	}
 
 	// 3, merge the file splits into the original file
-	filePath = filepath.Join(filePath, fileName)
 	err = mergeFiles(files, filePath)
 	if err != nil {
 		return err
 	}
 
-	// 4, remove the temp files
-	for _, file := range files {
-		file.Close()
-		os.Remove(file.Name())
-	}
-
-	// 5, Announce the file to the network
+	// 4, Announce the file to the network
 	dhtService.Announce(ctx, fileName)
 
 	return nil
 }
 
-func getChameleonMerkleTree(fileHash string) (*chamMerkleTree.MerkleNode, *chamMerkleTree.ChameleonRandomNum, *chamMerkleTree.ChameleomPubKey, error) {
-	// 1, get information from db
-	var metaData dht.MetaData
-	err := manager.GetDBManager().LoadFromMemory(fileHash, &metaData)
+// fetchSplit 从持有分片的节点下载一个数据块，并检查内容与叶子哈希一致。
+// 候选节点按评分从高到低尝试，内容与哈希不一致的节点记录一次不一致。
+func fetchSplit(ctx context.Context, leaf []byte) ([]byte, error) {
+	dhtService := manager.GetDHTService()
+	splitName := hex.EncodeToString(leaf)
+	peers, err := dhtService.DHT.GetClosestPeers(ctx, splitName)
+	if err != nil {
+		logrus.Errorf("Get closest peers failed")
+		return nil, err
+	}
+	if len(peers) == 0 {
+		peers = dhtService.DHT.RoutingTable().ListPeers()
+		logrus.Infof("bootstrap peers %d", len(peers))
+	}
+	logrus.Infof("Get closest peers success")
+
+	for _, peer := range dhtService.RankPeers(peers) {
+		addrInfo, err := dhtService.DHT.FindPeer(ctx, peer)
+		if err != nil {
+			logrus.Println("Find peer failed", err)
+			continue
+		}
+		var buffer bytes.Buffer
+		err = dhtService.GetFileFrom(ctx, addrInfo, splitName, &buffer)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			logrus.Println("Get file failed", err)
+			continue
+		}
+		if hash := sha256.Sum256(buffer.Bytes()); !bytes.Equal(hash[:], leaf) {
+			logrus.Printf("Split %s from %s does not match its hash", splitName, peer)
+			dhtService.RecordMismatch(peer)
+			continue
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Can not find the file split %s", splitName))
+}
+
+func getChameleonMerkleTree(ctx context.Context, fileHash string) (*chamMerkleTree.MerkleNode, *chamMerkleTree.ChameleonRandomNum, *chamMerkleTree.ChameleomPubKey, error) {
+	// 1, get information from db, fall back to the chain
+	metaData, err := resolver.Resolve(ctx, fileHash)
 	if err != nil {
-		logrus.Errorf("Load metadata from db failed: %v", err)
+		logrus.Errorf("Resolve metadata failed: %v", err)
 		return nil, nil, nil, err
 	}
 
 	// 2, rebuild the chameleon merkle tree
-	root, randomNum, pubKey, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(&metaData)
+	root, randomNum, pubKey, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData)
 	if err != nil {
 		return nil, nil, nil, err
 	}
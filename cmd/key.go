@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"main/keystore"
+	"main/manager"
+	"main/run"
+	"os"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "keys",
+		Description: "Lists the chameleon keys in the keystore",
+		Action:      keysAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "key-create",
+		Description: "Creates a chameleon key with -name and optional -scheme (p256, ed25519), encrypted with -pass",
+		Action:      keyCreateAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "key-import",
+		Description: "Imports a hex chameleon secret key with -name, -sec and optional -scheme, encrypted with -pass",
+		Action:      keyImportAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "key-export",
+		Description: "Prints the hex secret key of -name after checking -pass",
+		Action:      keyExportAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "key-select",
+		Description: "Unlocks -name with -pass and makes it the default key for send",
+		Action:      keySelectAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "key-rotate",
+		Description: "Creates -name with optional -scheme and makes it the default key, older keys stay usable with send -key",
+		Action:      keyRotateAction,
+	})
+}
+
+// passphrase 返回命令中指定的口令，没有指定时从环境变量读取
+func passphrase(params map[string]string) string {
+	if pass, exists := params["-pass"]; exists {
+		return pass
+	}
+	return os.Getenv(keystore.PassphraseEnv)
+}
+
+// keyName 返回 -name 参数
+func keyName(params map[string]string) (string, error) {
+	name, exists := params["-name"]
+	if !exists || name == "" {
+		return "", run.NoRequiredParamError
+	}
+	return name, nil
+}
+
+// signingKey 返回发送文件使用的密钥：指定了 -key 时从密钥库解锁，否则使用默认密钥
+func signingKey(params map[string]string) (*manager.Parameters, error) {
+	name, exists := params["-key"]
+	if !exists {
+		parameter := manager.GetParameters()
+		if parameter == nil {
+			return nil, errors.New("no default chameleon key, select one with key-select")
+		}
+		return parameter, nil
+	}
+	key, err := manager.GetKeystore().Unlock(name, passphrase(params))
+	if err != nil {
+		return nil, err
+	}
+	return &manager.Parameters{SecKey: key.SecKey, PubKey: key.PubKey}, nil
+}
+
+func keysAction(ctx context.Context, params map[string]string) error {
+	infos := manager.GetKeystore().List()
+	if len(infos) == 0 {
+		fmt.Println("No keys, create one with key-create")
+		return nil
+	}
+	for _, info := range infos {
+		mark := " "
+		if info.Default {
+			mark = "*"
+		}
+		state := "locked"
+		if info.Unlocked {
+			state = "unlocked"
+		}
+		fmt.Printf("%s %s %s %s %s created %s\n", mark, info.Name, info.Scheme, hex.EncodeToString(info.PubKey), state, info.Created.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func keyCreateAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	key, err := manager.GetKeystore().Create(name, params["-scheme"], passphrase(params))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s key %s: %s\n", key.PubKey.Scheme(), name, hex.EncodeToString(key.PubKey.Serialize()))
+	return nil
+}
+
+func keyImportAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	secString, exists := params["-sec"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	secKey, err := hex.DecodeString(secString)
+	if err != nil {
+		return err
+	}
+	key, err := manager.GetKeystore().Import(name, params["-scheme"], secKey, passphrase(params))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %s key %s: %s\n", key.PubKey.Scheme(), name, hex.EncodeToString(key.PubKey.Serialize()))
+	return nil
+}
+
+func keyExportAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	secKey, err := manager.GetKeystore().Export(name, passphrase(params))
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(secKey))
+	return nil
+}
+
+func keySelectAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	ks := manager.GetKeystore()
+	key, err := ks.Unlock(name, passphrase(params))
+	if err != nil {
+		return err
+	}
+	if err := ks.SetDefault(name); err != nil {
+		return err
+	}
+	manager.UseKey(key)
+	fmt.Printf("Default key is %s\n", name)
+	return nil
+}
+
+// keyRotateAction 创建新密钥并设为默认密钥。
+// 文件的根哈希由上传时的公钥决定，已经发布的文件仍然只能用原来的密钥更新，因此旧密钥会保留在密钥库中。
+func keyRotateAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	ks := manager.GetKeystore()
+	key, err := ks.Create(name, params["-scheme"], passphrase(params))
+	if err != nil {
+		return err
+	}
+	if err := ks.SetDefault(name); err != nil {
+		return err
+	}
+	manager.UseKey(key)
+	fmt.Printf("Rotated default key to %s: %s\n", name, hex.EncodeToString(key.PubKey.Serialize()))
+	return nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"main/manager"
+	"main/run"
+	"strconv"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "limits",
+		Description: "Shows or sets transfer limits in bytes per second with -up -down -peer-up -peer-down and -streams, 0 for unlimited",
+		Action:      limitsAction,
+	})
+}
+
+// limitsAction 修改文件传输的限制，没有指定的限制保持不变，修改后打印当前的限制
+func limitsAction(ctx context.Context, params map[string]string) error {
+	dhtService := manager.GetDHTService()
+	limits := dhtService.Limits()
+	rates := []struct {
+		param string
+		value *int64
+	}{
+		{"-up", &limits.UploadRate},
+		{"-down", &limits.DownloadRate},
+		{"-peer-up", &limits.PeerUploadRate},
+		{"-peer-down", &limits.PeerDownloadRate},
+	}
+	for _, rate := range rates {
+		if value, exists := params[rate.param]; exists {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", rate.param, err)
+			}
+			*rate.value = n
+		}
+	}
+	if value, exists := params["-streams"]; exists {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid -streams: %v", err)
+		}
+		limits.MaxStreams = n
+	}
+	if err := dhtService.SetLimits(limits); err != nil {
+		return err
+	}
+
+	fmt.Printf("upload: %s download: %s\n", formatRate(limits.UploadRate), formatRate(limits.DownloadRate))
+	fmt.Printf("per peer upload: %s download: %s\n", formatRate(limits.PeerUploadRate), formatRate(limits.PeerDownloadRate))
+	if limits.MaxStreams > 0 {
+		fmt.Printf("serving streams: %d\n", limits.MaxStreams)
+	} else {
+		fmt.Println("serving streams: unlimited")
+	}
+	return nil
+}
+
+// formatRate 格式化字节每秒的速率
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", rate)
+}
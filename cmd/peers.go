@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"main/manager"
+	"main/run"
+	"time"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "peers",
+		Description: "Lists the transfer scores of peers, best first",
+		Action:      peersAction,
+	})
+}
+
+func peersAction(ctx context.Context, params map[string]string) error {
+	dhtService := manager.GetDHTService()
+	scores := dhtService.PeerScores()
+	if len(scores) == 0 {
+		fmt.Println("No transfer with any peer")
+		return nil
+	}
+	ids := make([]peer.ID, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	for _, id := range dhtService.RankPeers(ids) {
+		s := scores[id]
+		fmt.Printf("%s score: %.3f ok: %d failed: %d mismatched: %d latency: %s throughput: %.0f B/s %s\n",
+			id, s.Value(), s.Successes, s.Failures, s.Mismatches, s.Latency.Round(time.Millisecond), s.Throughput, s.LastError)
+	}
+	return nil
+}
@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
-	"encoding/json"
-	"github.com/multiformats/go-multiaddr"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/sirupsen/logrus"
 	"io"
 	"main/DHT"
+	"main/challenge"
 	"main/chamMerkleTree"
 	"main/manager"
+	"main/registry"
 	"main/run"
+	"main/transfer"
 	"os"
 	"strconv"
 )
@@ -19,7 +22,7 @@ import (
 func init() {
 	run.RegisterCommand(run.Command{
 		Name:        "send",
-		Description: "Sends a file to network",
+		Description: "Sends a file -f or a directory -dir to network, -subtree h puts a chameleon hash on every subtree of 2^h chunks, -bg runs in background",
 		Action:      sendAction,
 	})
 }
@@ -27,170 +30,286 @@ func init() {
 // todo: use memoFile instead of tempFIle
 func sendAction(ctx context.Context, params map[string]string) error {
 	filePath, exists := params["-f"]
-	if !exists {
-		logrus.Printf("Please provide a file path with -f")
+	dirPath, isDir := params["-dir"]
+	if !exists && !isDir {
+		logrus.Printf("Please provide a file path with -f or a directory with -dir")
 		return run.NoRequiredParamError
 	}
-	numString, exists := params["-n"]
-	num := 5
-	var err error
-	if exists {
-		num, err = strconv.Atoi(numString)
-		if err != nil {
-			return err
-		}
+	num, challenges, err := replicaParams(params)
+	if err != nil {
+		return err
 	}
 
-	dhtService := manager.GetDHTService()
-	parameter := manager.GetParameters()
+	// -key 指定持有这个文件陷门的密钥，缺省时使用默认密钥
+	parameter, err := signingKey(params)
+	if err != nil {
+		return err
+	}
+	config, err := parseMerkleConfig(params)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return runTransfer(ctx, params, "send", dirPath, func(ctx context.Context) error {
+			return sendDirectory(ctx, params, dirPath, parameter, config, num, challenges)
+		})
+	}
+	return runTransfer(ctx, params, "send", filePath, func(ctx context.Context) error {
+		_, err := sendFile(ctx, filePath, parameter, config, num, challenges)
+		return err
+	})
+}
 
+// sendFile 为文件构建变色龙默克尔树，把数据块发送到网络后发布 metadata
+// 返回值:
+// - *chamMerkleTree.MerkleNode: 文件的默克尔树。
+// - error: 错误信息。
+func sendFile(ctx context.Context, filePath string, parameter *manager.Parameters, config *chamMerkleTree.MerkleConfig, num, challenges int) (*chamMerkleTree.MerkleNode, error) {
 	// 1, Generate Chameleon Merkle tree
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logrus.Infof("Send file %s", filePath)
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	transfer.FromContext(ctx).AddTotal(info.Size(), 0)
 
-	pubKey := parameter.PubKey
-	config := chamMerkleTree.NewMerkleConfig()
-	root, randomNum, _, err := chamMerkleTree.BuildMerkleTree(file, config, pubKey)
+	root, _, _, err := chamMerkleTree.BuildMerkleTree(file, config, parameter.PubKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_, err = file.Seek(0, 0)
-	fileBuf := bufio.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	chunker, err := chamMerkleTree.NewChunker(bufio.NewReader(file), config)
+	if err != nil {
+		return nil, err
+	}
 
-	// 2, Send metadata to the network
-	err = sendMetadata(ctx, root, randomNum, pubKey)
+	// 2, Sign the metadata, the root hash must not already belong to another key
+	metaData, err := signMetadata(root, parameter, config)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = registry.CheckOwner(manager.GetDBManager(), metaData)
+	if err != nil {
+		return nil, err
 	}
-	logrus.Infof("Send metadata %s", hex.EncodeToString(root.Hash))
 
 	// 3, Send the file splits to the network
+	err = sendSplits(ctx, root, chunker, 0, num, challenges)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Send file %s finished", filePath)
+
+	// 4, Publish the metadata after the splits are stored,
+	// 发送失败时不会在链上留下没有副本的所有者绑定
+	err = publishMetadata(ctx, metaData)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Send metadata %s", hex.EncodeToString(root.Hash))
+
+	// 5, Announce the file to the network
+	//dhtService.Announce(ctx, hex.EncodeToString(root.Hash))
+
+	return root, nil
+}
+
+// sendSplits 按 root 的叶子顺序从 chunker 读取从第 first 个开始的数据块，为每个数据块预先计算存储证明挑战，
+// 并发送到 num 个节点，已经有足够副本的数据块会被跳过。ctx 所属的传输记录每个数据块的进度
+func sendSplits(ctx context.Context, root *chamMerkleTree.MerkleNode, chunker chamMerkleTree.Chunker, first, num, challenges int) error {
+	dhtService := manager.GetDHTService()
 	// todo: use multiThreads
-	leaves := chamMerkleTree.GetAllLeavesHashes(root)
-	buffer := make([]byte, config.BlockSize)
-	for _, leaf := range leaves {
+	leaves := chamMerkleTree.GetAllLeaves(root)
+	t := transfer.FromContext(ctx)
+	t.AddTotal(0, len(leaves)-first)
+	var totalBytes, dedupBytes, storedBytes int64
+	var dedupSplits, toppedUpSplits int
+	for i := first; i < len(leaves); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		leaf := leaves[i].Hash
 
 		splitName := hex.EncodeToString(leaf)
 		logrus.Infof("Send split %s", splitName)
 
-		n, err := fileBuf.Read(buffer)
-		if err != nil && err != io.EOF {
-			logrus.Errorf("Read file failed")
-			return err
-		}
-		if n == 0 {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
 			logrus.Infof("Read file finished")
 			break
 		}
+		if err != nil {
+			logrus.Errorf("Read file failed")
+			return err
+		}
 		logrus.Infof("Read fileSplit success")
+		totalBytes += int64(len(chunk))
 
-		// create temp file and write buffer to it
-		tempFile, err := os.CreateTemp("", splitName)
+		err = challenge.Prepare(root.Hash, i, chunk, challenges)
 		if err != nil {
-			logrus.Errorf("Create temp file failed")
+			logrus.Errorf("Prepare storage challenges failed")
 			return err
 		}
-		_, err = tempFile.Write(buffer[:n])
+
+		// 已经有足够多节点持有相同的分片时直接跳过，否则只补齐缺少的副本
+		providers := lookupProviders(ctx, dhtService, splitName)
+		if len(providers) >= num {
+			logrus.Infof("Split %s already has %d replicas, skip", splitName, len(providers))
+			dedupBytes += int64(len(chunk))
+			dedupSplits++
+			t.AddChunk(int64(len(chunk)))
+			continue
+		}
+		if len(providers) > 0 {
+			logrus.Infof("Split %s has %d replicas, top up to %d", splitName, len(providers), num)
+			toppedUpSplits++
+		}
+
+		// 按叶子记录的压缩算法压缩，叶子哈希仍然是未压缩内容的哈希
+		codec := leaves[i].Codec
+		encoded, err := DHT.Compress(codec, chunk)
 		if err != nil {
-			logrus.Errorf("Write buffer to temp file failed")
 			return err
 		}
-		logrus.Infof("Write buffer to temp file success")
+		storedBytes += int64(len(encoded))
 
-		peers, err := dhtService.DHT.GetClosestPeers(ctx, splitName)
+		stored, err := storeSplit(ctx, dhtService, splitName, codec, encoded, providers, num-len(providers))
 		if err != nil {
-			logrus.Errorf("Get closest peers failed")
 			return err
 		}
-		if len(peers) == 0 {
-			peers = dhtService.DHT.RoutingTable().ListPeers()
-			logrus.Infof("bootstrap peers", len(peers))
-		}
-		logrus.Infof("Get closest peers success")
-
-		numTemp := num
-		for _, peer := range peers {
-			tempFile.Seek(0, 0)
-			logrus.Infof("Send split %s to %s", splitName, peer)
-			if numTemp == 0 {
-				break
-			}
-			numTemp--
-			addrInfo, err := dhtService.DHT.FindPeer(ctx, peer)
-			if err != nil {
-				return err
-			}
-			maddrs := addrInfo.Addrs
-			maddr, err := multiaddr.NewMultiaddr(maddrs[0].String() + "/p2p/" + peer.String())
-			if err != nil {
-				logrus.Errorf("Convert address to multiaddress failed")
-				return err
-			}
-			logrus.Infof("Send split %s to %s", splitName, maddr)
-
-			// send file
-			err = dhtService.SendFile(ctx, maddr, splitName, tempFile)
-			if err != nil {
-				logrus.Errorf("Send split %s to %s failed", splitName, peer)
-				return err
-			}
-			logrus.Infof("Send split %s to %s success", splitName, peer)
-			dhtService.Announce(ctx, splitName)
-
-			// remove temp file
-			tempFile.Close()
-			os.Remove(tempFile.Name())
-
-			// 如果读取的数据量小于块大小，说明已到达文件末尾
-			if n < config.BlockSize {
-				break
-			}
-
-		}
-
-	}
-	// 4, Announce the file to the network
-	//dhtService.Announce(ctx, hex.EncodeToString(root.Hash))
-
+		if stored < num-len(providers) {
+			logrus.Warnf("Split %s is stored on %d peers, %d short of %d", splitName, len(providers)+stored, num-len(providers)-stored, num)
+		}
+		t.AddChunk(int64(len(chunk)))
+	}
+	logrus.Infof("Sent %d bytes in %d splits, %d bytes deduplicated (%d splits skipped, %d splits topped up), %d bytes after compression",
+		totalBytes, len(leaves)-first, dedupBytes, dedupSplits, toppedUpSplits, storedBytes)
 	return nil
 }
 
-// send metadata to norn
-func sendMetadata(ctx context.Context, root *chamMerkleTree.MerkleNode, randomNum *chamMerkleTree.ChameleonRandomNum, pubKey *chamMerkleTree.ChameleomPubKey) error {
-	// 1, Serialize the metadata
-	metaData := &DHT.MetaData{
-		RootHash:  root.Hash,
-		RandomNum: randomNum.Serialize(),
-		PublicKey: pubKey.Serialize(),
-		Leaves:    chamMerkleTree.GetAllLeavesHashes(root),
+// storeSplit 把编码后的分片写入临时文件，按评分从高到低发送到不在 providers 中的节点，直到 want 个节点保存成功。
+// 发送失败时换下一个节点，临时文件在返回时删除
+// 返回值:
+// - int: 保存成功的节点数。
+// - error: 错误信息。
+func storeSplit(ctx context.Context, dhtService *DHT.DHTService, splitName, codec string, encoded []byte, providers map[peer.ID]bool, want int) (int, error) {
+	// create temp file and write buffer to it
+	tempFile, err := os.CreateTemp("", splitName)
+	if err != nil {
+		logrus.Errorf("Create temp file failed")
+		return 0, err
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+	_, err = tempFile.Write(encoded)
+	if err != nil {
+		logrus.Errorf("Write buffer to temp file failed")
+		return 0, err
 	}
-	// 2, Send the metadata to the network
-	// 将结构体转换为 JSON 字符串
-	jsonData, err := json.Marshal(metaData)
+	logrus.Infof("Write buffer to temp file success")
+
+	peers, err := dhtService.DHT.GetClosestPeers(ctx, splitName)
+	if err != nil {
+		logrus.Errorf("Get closest peers failed")
+		return 0, err
+	}
+	if len(peers) == 0 {
+		peers = dhtService.DHT.RoutingTable().ListPeers()
+		logrus.Infof("bootstrap peers %d", len(peers))
+	}
+	logrus.Infof("Get closest peers success")
+
+	stored := 0
+	for _, peer := range dhtService.RankPeers(peers) {
+		if stored == want {
+			break
+		}
+		if providers[peer] {
+			continue
+		}
+		tempFile.Seek(0, 0)
+		addrInfo, err := dhtService.DHT.FindPeer(ctx, peer)
+		if err != nil {
+			logrus.Errorf("Find peer %s failed: %v", peer, err)
+			continue
+		}
+		logrus.Infof("Send split %s to %s", splitName, peer)
+
+		// send file
+		err = dhtService.SendFileTo(ctx, addrInfo, splitName, codec, tempFile)
+		if ctx.Err() != nil {
+			return stored, ctx.Err()
+		}
+		if err != nil {
+			logrus.Errorf("Send split %s to %s failed: %v", splitName, peer, err)
+			continue
+		}
+		logrus.Infof("Send split %s to %s success", splitName, peer)
+		stored++
+	}
+	return stored, nil
+}
+
+// lookupProviders 查询网络中已经持有分片的节点，查询失败时视为没有副本。
+// 只有节点为自己宣布的副本会被记录，收到分片的节点自己宣布；宣布了却没有保存分片的节点会在存储证明挑战中失败
+func lookupProviders(ctx context.Context, dhtService *DHT.DHTService, splitName string) map[peer.ID]bool {
+	providers := make(map[peer.ID]bool)
+	addrInfos, err := dhtService.Lookup(ctx, splitName)
+	if err != nil {
+		logrus.Infof("Lookup split %s: %v", splitName, err)
+		return providers
+	}
+	for _, ai := range addrInfos {
+		if ai.ID == dhtService.Host.ID() {
+			continue
+		}
+		providers[ai.ID] = true
+	}
+	return providers
+}
+
+// signMetadata 由默克尔树生成 metadata 并用 parameter 的私钥签名，签名后才能绑定所有者
+func signMetadata(root *chamMerkleTree.MerkleNode, parameter *manager.Parameters, config *chamMerkleTree.MerkleConfig) (*DHT.MetaData, error) {
+	metaData := chamMerkleTree.NewMetaData(root, parameter.PubKey, config.ChunkerParams())
+	err := chamMerkleTree.SignMetaData(metaData, parameter.SecKey)
+	if err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+// publishMetadata 检查已签名的 metadata 的所有者，发布到 metadata 后端并保存到本地
+func publishMetadata(ctx context.Context, metaData *DHT.MetaData) error {
+	// 根哈希已经属于其他公钥时拒绝发布
+	err := registry.CheckOwner(manager.GetDBManager(), metaData)
 	if err != nil {
-		logrus.Errorf("Error marshalling struct:", err)
 		return err
 	}
 
-	// 3, Send the metadata to the network
-	_, err = manager.GetGRPCClient().SendTransactionWithData(ctx, "set", hex.EncodeToString(root.Hash), "metadata", string(jsonData))
+	err = manager.GetRegistry().Publish(ctx, metaData)
 	if err != nil {
 		logrus.Errorf("Send metadata to network failed")
 		return err
 	}
 
-	// 4, storage locally
-	err = manager.GetDBManager().SaveToMemory(hex.EncodeToString(root.Hash), metaData)
+	// storage locally
+	err = manager.GetDBManager().SaveToMemory(hex.EncodeToString(metaData.RootHash), metaData)
 	if err != nil {
 		logrus.Errorf("Save metadata to memory failed")
 		return err
 	}
 
-	//// 5, verify storage
+	//// 4, verify storage
 	//var metaDataVerify DHT.MetaData
 	//manager.GetDBManager().LoadFromMemory(hex.EncodeToString(root.Hash), &metaDataVerify)
 	//
@@ -198,3 +317,46 @@ func sendMetadata(ctx context.Context, root *chamMerkleTree.MerkleNode, randomNu
 
 	return nil
 }
+
+// parseMerkleConfig 根据命令行参数生成Merkle树配置
+// -chunker 选择分块算法（fixed 或 fastcdc），-bs 指定固定分块大小，
+// -min/-avg/-max 指定 fastcdc 的最小、平均和最大块大小，单位均为字节，
+// -subtree 指定变色龙子树的高度，0 表示只有根节点使用变色龙哈希，
+// -compress 指定数据块的压缩算法（zstd 或 gzip）
+func parseMerkleConfig(params map[string]string) (*chamMerkleTree.MerkleConfig, error) {
+	config := chamMerkleTree.NewMerkleConfig()
+	if chunker, exists := params["-chunker"]; exists {
+		config.Chunker = chunker
+	}
+	sizes := map[string]*int{
+		"-bs":  &config.BlockSize,
+		"-min": &config.MinSize,
+		"-avg": &config.AvgSize,
+		"-max": &config.MaxSize,
+	}
+	for name, size := range sizes {
+		value, exists := params[name]
+		if !exists {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*size = n
+	}
+	if codec, exists := params["-compress"]; exists {
+		if err := DHT.CheckCodec(codec); err != nil {
+			return nil, err
+		}
+		config.Codec = codec
+	}
+	if value, exists := params["-subtree"]; exists {
+		height, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -subtree: %v", err)
+		}
+		config.SubtreeHeight = height
+	}
+	return config, nil
+}
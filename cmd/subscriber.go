@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"main/run"
+	"main/websocket"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "subscriber",
+		Description: "Shows the state and message counters of the chain subscription",
+		Action:      subscriberAction,
+	})
+}
+
+func subscriberAction(ctx context.Context, params map[string]string) error {
+	stats := websocket.GetStats()
+	fmt.Printf("connected: %v connects: %d failures: %d backoff: %s\n", stats.Connected, stats.Connects, stats.Failures, stats.Backoff)
+	fmt.Printf("received: %d applied: %d skipped: %d malformed: %d rejected: %d apply errors: %d\n",
+		stats.Received, stats.Applied, stats.Skipped, stats.Malformed, stats.Rejected, stats.ApplyError)
+	return nil
+}
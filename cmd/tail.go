@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"main/DHT"
+	"main/challenge"
+	"main/chamMerkleTree"
+	"main/resolver"
+	"main/run"
+	"main/transfer"
+	"os"
+	"strconv"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "append",
+		Description: "Appends file -f to the content of -root, using key -key or the share holders -holders",
+		Action:      appendAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "truncate",
+		Description: "Truncates the content of -root to -size bytes, using key -key or the share holders -holders",
+		Action:      truncateAction,
+	})
+}
+
+// appendAction 在已发布文件的末尾追加 -f 的内容，根哈希保持不变。
+// 最后一个数据块从网络下载，与追加的内容一起重新切分，其余的叶子直接沿用。
+// 追加的内容从文件流式读取两遍，分别用于计算新的叶子和发送数据块，内存中只保留最后一个数据块。
+func appendAction(ctx context.Context, params map[string]string) error {
+	rootHex, exists := params["-root"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	filePath, exists := params["-f"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	metaData, oldRoot, pubKey, err := resolveTree(ctx, rootHex)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 最后一个数据块可能不满，需要与追加的内容合并后再切分
+	leaves := chamMerkleTree.GetAllLeavesHashes(oldRoot)
+	last, err := fetchSplit(ctx, leaves[len(leaves)-1])
+	if err != nil {
+		return err
+	}
+	openTail := func() (io.Reader, error) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return io.MultiReader(bytes.NewReader(last), bufio.NewReader(file)), nil
+	}
+	return updateTail(ctx, params, metaData, oldRoot, pubKey, len(leaves)-1, openTail, int64(len(last))+info.Size())
+}
+
+// truncateAction 将已发布文件截断为 -size 字节，根哈希保持不变。
+// 截断位置所在的数据块从网络下载并截短，之后的叶子被删除。
+func truncateAction(ctx context.Context, params map[string]string) error {
+	rootHex, exists := params["-root"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	sizeString, exists := params["-size"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	size, err := strconv.ParseInt(sizeString, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid -size: %v", err)
+	}
+	if size <= 0 {
+		return errors.New("file can not be truncated to empty")
+	}
+	metaData, oldRoot, pubKey, err := resolveTree(ctx, rootHex)
+	if err != nil {
+		return err
+	}
+
+	keep, tail, err := locateOffset(ctx, oldRoot, chamMerkleTree.NewMerkleConfigFromParams(metaData.Chunker), size)
+	if err != nil {
+		return err
+	}
+	if keep == len(metaData.Leaves) {
+		logrus.Infof("File %s already has %d bytes", rootHex, size)
+		return nil
+	}
+	openTail := func() (io.Reader, error) {
+		return bytes.NewReader(tail), nil
+	}
+	return updateTail(ctx, params, metaData, oldRoot, pubKey, keep, openTail, int64(len(tail)))
+}
+
+// resolveTree 获取 rootHex 对应的 metadata 并重建默克尔树
+func resolveTree(ctx context.Context, rootHex string) (*DHT.MetaData, *chamMerkleTree.MerkleNode, *chamMerkleTree.ChameleomPubKey, error) {
+	metaData, err := resolver.Resolve(ctx, rootHex)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	root, _, pubKey, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return metaData, root, pubKey, nil
+}
+
+// locateOffset 找到文件第 size 个字节所在的数据块，返回它之前的数据块个数和它在 size 之前的部分。
+// 固定分块时除最后一个数据块外都是满的，可以直接算出位置；fastcdc 的块大小不固定，需要从头下载数据块累计长度。
+// size 恰好落在数据块的边界上时 tail 为空，size 等于文件大小时返回全部叶子的个数。
+func locateOffset(ctx context.Context, root *chamMerkleTree.MerkleNode, config *chamMerkleTree.MerkleConfig, size int64) (int, []byte, error) {
+	leaves := chamMerkleTree.GetAllLeavesHashes(root)
+	first, offset := 0, int64(0)
+	if config.Chunker == "" || config.Chunker == chamMerkleTree.FixedChunker {
+		first = int(min(size/int64(config.BlockSize), int64(len(leaves)-1)))
+		offset = int64(first) * int64(config.BlockSize)
+	}
+	for i := first; i < len(leaves); i++ {
+		if offset == size {
+			return i, nil, nil
+		}
+		chunk, err := fetchSplit(ctx, leaves[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		if offset+int64(len(chunk)) > size {
+			return i, chunk[:size-offset], nil
+		}
+		offset += int64(len(chunk))
+	}
+	if offset == size {
+		return len(leaves), nil, nil
+	}
+	return 0, nil, fmt.Errorf("file has %d bytes, can not truncate to %d", offset, size)
+}
+
+// updateTail 保留前 keep 个数据块，用 openTail 读取的内容替换其余的数据块，发送新的数据块后发布新的 metadata。
+// openTail 每次调用都从头读取新的尾部，tailSize 是它的字节数。
+//
+// 发布的仍然是完整的 metadata 而不是只包含改变的叶子和子树根的增量：后端按根哈希保存一个完整的条目，
+// 更新时整体替换，签名覆盖全部叶子，没有看到之前版本的节点也必须能单独验证和使用这个条目，增量无法做到这一点。
+func updateTail(ctx context.Context, params map[string]string, metaData *DHT.MetaData, oldRoot *chamMerkleTree.MerkleNode, pubKey *chamMerkleTree.ChameleomPubKey, keep int, openTail func() (io.Reader, error), tailSize int64) error {
+	num, challenges, err := replicaParams(params)
+	if err != nil {
+		return err
+	}
+	config := chamMerkleTree.NewMerkleConfigFromParams(metaData.Chunker)
+	transfer.FromContext(ctx).AddTotal(tailSize, 0)
+
+	// 1, Find collisions for the changed subtrees
+	collide, sign, err := trapdoor(ctx, params, pubKey)
+	if err != nil {
+		return err
+	}
+	tail, err := openTail()
+	if err != nil {
+		return err
+	}
+	root, err := chamMerkleTree.UpdateMerkleTreeTail(tail, keep, config, oldRoot, pubKey, collide)
+	if err != nil {
+		return err
+	}
+
+	// 2, Sign the new metadata
+	newMetaData := chamMerkleTree.NewMetaData(root, pubKey, metaData.Chunker)
+	if err := sign(newMetaData); err != nil {
+		return err
+	}
+
+	// 3, Send the new tail splits to the network, challenges of the kept splits stay valid
+	if err := challenge.DiscardFrom(metaData.RootHash, keep); err != nil {
+		return err
+	}
+	if tail, err = openTail(); err != nil {
+		return err
+	}
+	chunker, err := chamMerkleTree.NewChunker(tail, config)
+	if err != nil {
+		return err
+	}
+	if err := sendSplits(ctx, root, chunker, keep, num, challenges); err != nil {
+		return err
+	}
+
+	// 4, Publish the new metadata after its splits are stored
+	if err := publishMetadata(ctx, newMetaData); err != nil {
+		return err
+	}
+	logrus.Infof("Update metadata %x, %d leaves kept, %d leaves replaced by %d", metaData.RootHash,
+		keep, len(metaData.Leaves)-keep, len(newMetaData.Leaves)-keep)
+	return nil
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"main/run"
+	"main/transfer"
+	"strconv"
+	"time"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "transfers",
+		Description: "Lists the send and get transfers with their progress",
+		Action:      transfersAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "transfer-status",
+		Description: "Shows the progress of transfer -id",
+		Action:      transferStatusAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "cancel",
+		Description: "Cancels transfer -id",
+		Action:      cancelAction,
+	})
+}
+
+// runTransfer 把一次传输登记到传输管理器并用传输的上下文执行 fn。
+// 指定 -bg 时在后台执行，打印传输编号后立即返回，结果可以用 transfer-status 查看。
+func runTransfer(ctx context.Context, params map[string]string, kind, name string, fn func(ctx context.Context) error) error {
+	t, transferCtx := transfer.Start(ctx, kind, name)
+	if _, background := params["-bg"]; !background {
+		err := fn(transferCtx)
+		t.Finish(err)
+		return err
+	}
+	go func() {
+		err := fn(transferCtx)
+		t.Finish(err)
+		if err != nil {
+			logrus.Errorf("Transfer %d %s %s: %v", t.ID, kind, name, err)
+		} else {
+			logrus.Infof("Transfer %d %s %s finished", t.ID, kind, name)
+		}
+	}()
+	fmt.Printf("Transfer %d started\n", t.ID)
+	return nil
+}
+
+func transfersAction(ctx context.Context, params map[string]string) error {
+	statuses := transfer.List()
+	if len(statuses) == 0 {
+		fmt.Println("No transfer")
+		return nil
+	}
+	for _, s := range statuses {
+		fmt.Printf("%d %s %s %s %s\n", s.ID, s.Kind, s.State, formatProgress(s), s.Name)
+	}
+	return nil
+}
+
+func transferStatusAction(ctx context.Context, params map[string]string) error {
+	t, err := transferParam(params)
+	if err != nil {
+		return err
+	}
+	s := t.Status()
+	fmt.Printf("transfer %d: %s %s\n", s.ID, s.Kind, s.Name)
+	fmt.Printf("state: %s, started at %s, elapsed %s\n", s.State, s.Started.Format("2006-01-02 15:04:05"), s.Elapsed.Round(time.Second))
+	fmt.Printf("progress: %s\n", formatProgress(s))
+	if s.Err != nil {
+		fmt.Printf("error: %v\n", s.Err)
+	}
+	return nil
+}
+
+func cancelAction(ctx context.Context, params map[string]string) error {
+	t, err := transferParam(params)
+	if err != nil {
+		return err
+	}
+	if state := t.Status().State; state != transfer.Running {
+		return fmt.Errorf("transfer %d is already %s", t.ID, state)
+	}
+	t.Cancel()
+	fmt.Printf("Transfer %d cancelled\n", t.ID)
+	return nil
+}
+
+// transferParam 读取 -id 指定的传输
+func transferParam(params map[string]string) (*transfer.Transfer, error) {
+	idString, exists := params["-id"]
+	if !exists {
+		return nil, run.NoRequiredParamError
+	}
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -id: %v", err)
+	}
+	return transfer.Get(id)
+}
+
+// formatProgress 格式化传输的字节数、数据块数、吞吐量和预计剩余时间
+func formatProgress(s transfer.Status) string {
+	res := fmt.Sprintf("%d", s.Bytes)
+	if s.TotalBytes > 0 {
+		res += fmt.Sprintf("/%d", s.TotalBytes)
+	}
+	res += fmt.Sprintf(" bytes, %d/%d chunks, %.0f B/s", s.Chunks, s.TotalChunks, s.Throughput)
+	if s.ETA > 0 {
+		res += fmt.Sprintf(", ETA %s", s.ETA.Round(time.Second))
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"main/transfer"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// find 返回编号为 id 的传输的状态
+func find(t *testing.T, id int) transfer.Status {
+	t.Helper()
+	for _, s := range transfer.List() {
+		if s.ID == id {
+			return s
+		}
+	}
+	t.Fatalf("transfer %d not listed", id)
+	return transfer.Status{}
+}
+
+// waitState 等待传输进入 state
+func waitState(t *testing.T, id int, state transfer.State) transfer.Status {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if s := find(t, id); s.State == state {
+			return s
+		}
+	}
+	t.Fatalf("transfer %d not %s", id, state)
+	return transfer.Status{}
+}
+
+func TestRunTransferBackground(t *testing.T) {
+	started := make(chan *transfer.Transfer, 1)
+	release := make(chan struct{})
+	err := runTransfer(context.Background(), map[string]string{"-bg": ""}, "get", "root", func(ctx context.Context) error {
+		tr := transfer.FromContext(ctx)
+		tr.AddTotal(200, 2)
+		tr.AddChunk(100)
+		started <- tr
+		<-release
+		tr.AddChunk(100)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := <-started
+
+	// 后台传输在列表中显示进度
+	s := find(t, tr.ID)
+	if s.Kind != "get" || s.Name != "root" || s.State != transfer.Running || s.Bytes != 100 || s.TotalChunks != 2 {
+		t.Fatalf("listed %+v", s)
+	}
+	if progress := formatProgress(s); !strings.HasPrefix(progress, "100/200 bytes, 1/2 chunks") {
+		t.Fatalf("progress %q", progress)
+	}
+	if err := transfersAction(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := transferStatusAction(context.Background(), map[string]string{"-id": strconv.Itoa(tr.ID)}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	s = waitState(t, tr.ID, transfer.Done)
+	if s.Bytes != 200 || s.Chunks != 2 {
+		t.Fatalf("finished %+v", s)
+	}
+	// 已经结束的传输不能取消
+	if err := cancelAction(context.Background(), map[string]string{"-id": strconv.Itoa(tr.ID)}); err == nil {
+		t.Fatal("cancelled a finished transfer")
+	}
+}
+
+func TestCancelBackgroundTransfer(t *testing.T) {
+	started := make(chan *transfer.Transfer, 1)
+	err := runTransfer(context.Background(), map[string]string{"-bg": ""}, "send", "file", func(ctx context.Context) error {
+		started <- transfer.FromContext(ctx)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := <-started
+	if err := cancelAction(context.Background(), map[string]string{"-id": strconv.Itoa(tr.ID)}); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitState(t, tr.ID, transfer.Cancelled); !errors.Is(s.Err, context.Canceled) {
+		t.Fatalf("cancelled with %v", s.Err)
+	}
+
+	for _, params := range []map[string]string{{}, {"-id": "x"}, {"-id": "-1"}} {
+		if err := cancelAction(context.Background(), params); err == nil {
+			t.Fatalf("cancelled %v", params)
+		}
+	}
+}
+
+func TestRunTransferForeground(t *testing.T) {
+	var id int
+	want := errors.New("no peers")
+	err := runTransfer(context.Background(), map[string]string{}, "get", "root", func(ctx context.Context) error {
+		id = transfer.FromContext(ctx).ID
+		return want
+	})
+	if !errors.Is(err, want) {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+	// 前台传输返回时已经结束
+	if s := find(t, id); s.State != transfer.Failed || !errors.Is(s.Err, want) {
+		t.Fatalf("listed %+v", s)
+	}
+}
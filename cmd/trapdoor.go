@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"main/chamMerkleTree"
+	"main/manager"
+	"main/run"
+	"main/threshold"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-split",
+		Description: "Splits key -name into -n shares written to -out, any -t of them can update files",
+		Action:      trapdoorSplitAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-load",
+		Description: "Loads share file -f, -allow lists the peers that may coordinate updates (* for any)",
+		Action:      trapdoorLoadAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-shares",
+		Description: "Lists the key shares held by this node",
+		Action:      trapdoorSharesAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-requests",
+		Description: "Lists the trapdoor requests from other peers waiting for approval",
+		Action:      trapdoorRequestsAction,
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-approve",
+		Description: "Approves trapdoor request -id, the share then answers with its partial result",
+		Action:      trapdoorDecideAction(true),
+	})
+	run.RegisterCommand(run.Command{
+		Name:        "trapdoor-deny",
+		Description: "Denies trapdoor request -id",
+		Action:      trapdoorDecideAction(false),
+	})
+}
+
+// trapdoorSplitAction 将密钥库中的一个密钥拆分为分片文件。
+// 分片文件需要分发给各个持有者，之后应从本节点删除完整的密钥和分片文件。
+func trapdoorSplitAction(ctx context.Context, params map[string]string) error {
+	name, err := keyName(params)
+	if err != nil {
+		return err
+	}
+	t, err := strconv.Atoi(params["-t"])
+	if err != nil {
+		return fmt.Errorf("invalid -t: %v", err)
+	}
+	n, err := strconv.Atoi(params["-n"])
+	if err != nil {
+		return fmt.Errorf("invalid -n: %v", err)
+	}
+	out, exists := params["-out"]
+	if !exists {
+		out = "shares-" + name
+	}
+
+	// 门限陷门只支持 p256 方案
+	for _, info := range manager.GetKeystore().List() {
+		if info.Name == name && info.Scheme != chamMerkleTree.SchemeP256 {
+			return fmt.Errorf("key %s uses %s, only %s keys can be split", name, info.Scheme, chamMerkleTree.SchemeP256)
+		}
+	}
+	secKey, err := manager.GetKeystore().Export(name, passphrase(params))
+	if err != nil {
+		return err
+	}
+	shares, err := chamMerkleTree.SplitKey(secKey, t, n)
+	if err != nil {
+		return err
+	}
+	paths, err := threshold.WriteShares(shares, out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Split key %s into %d shares, %d needed to update files:\n", name, n, t)
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+	return nil
+}
+
+func trapdoorLoadAction(ctx context.Context, params map[string]string) error {
+	path, exists := params["-f"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	var coordinators []string
+	if allow, exists := params["-allow"]; exists && allow != "" {
+		coordinators = strings.Split(allow, ",")
+	}
+	holder, err := manager.GetShares().Load(path, coordinators)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded share %d of %x\n", holder.Share.Index, holder.Share.PubKey)
+	return nil
+}
+
+func trapdoorSharesAction(ctx context.Context, params map[string]string) error {
+	holders := manager.GetShares().List()
+	if len(holders) == 0 {
+		fmt.Println("No key shares, load one with trapdoor-load")
+		return nil
+	}
+	for _, holder := range holders {
+		share := holder.Share
+		fmt.Printf("%s share %d, %d of %d needed, coordinators %v\n",
+			hex.EncodeToString(share.PubKey), share.Index, share.Threshold, len(share.PublicShares), holder.Coordinators)
+	}
+	return nil
+}
+
+func trapdoorRequestsAction(ctx context.Context, params map[string]string) error {
+	requests := manager.GetShares().Approvals().List()
+	if len(requests) == 0 {
+		fmt.Println("No trapdoor request waiting for approval")
+		return nil
+	}
+	for _, req := range requests {
+		fmt.Printf("%d %s of %x for key %x from %s, received at %s\n",
+			req.ID, req.Kind, req.RootHash, req.PubKey, req.From, req.Received.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// trapdoorDecideAction 返回批准或拒绝 -id 指定的协作请求的命令
+func trapdoorDecideAction(approve bool) func(context.Context, map[string]string) error {
+	return func(ctx context.Context, params map[string]string) error {
+		idString, exists := params["-id"]
+		if !exists {
+			return run.NoRequiredParamError
+		}
+		id, err := strconv.Atoi(idString)
+		if err != nil {
+			return fmt.Errorf("invalid -id: %v", err)
+		}
+		if err := manager.GetShares().Approvals().Decide(id, approve); err != nil {
+			return err
+		}
+		if approve {
+			fmt.Printf("Trapdoor request %d approved\n", id)
+		} else {
+			fmt.Printf("Trapdoor request %d denied\n", id)
+		}
+		return nil
+	}
+}
+
+// parseHolders 解析逗号分隔的分片持有者节点 ID
+func parseHolders(value string) ([]peer.ID, error) {
+	var holders []peer.ID
+	for _, s := range strings.Split(value, ",") {
+		id, err := peer.Decode(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid holder %s: %v", s, err)
+		}
+		holders = append(holders, id)
+	}
+	return holders, nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"main/DHT"
+	"main/challenge"
+	"main/chamMerkleTree"
+	"main/manager"
+	"main/resolver"
+	"main/run"
+	"main/transfer"
+	"os"
+	"strconv"
+)
+
+func init() {
+	run.RegisterCommand(run.Command{
+		Name:        "update",
+		Description: "Replaces the content of -root with file -f, using key -key or the share holders -holders",
+		Action:      updateAction,
+	})
+}
+
+// updateAction 用新文件替换已发布文件的内容，根哈希保持不变。
+// 指定 -holders 时由分片持有者协作生成碰撞和签名，否则使用 -key 或默认密钥。
+func updateAction(ctx context.Context, params map[string]string) error {
+	rootHex, exists := params["-root"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	filePath, exists := params["-f"]
+	if !exists {
+		return run.NoRequiredParamError
+	}
+	return updateFile(ctx, params, rootHex, filePath)
+}
+
+// updateFile 用 filePath 的内容替换根哈希为 rootHex 的文件，发送数据块后发布新的 metadata
+func updateFile(ctx context.Context, params map[string]string, rootHex, filePath string) error {
+	num, challenges, err := replicaParams(params)
+	if err != nil {
+		return err
+	}
+
+	// 1, Rebuild the current tree to get the chameleon hash message
+	metaData, err := resolver.Resolve(ctx, rootHex)
+	if err != nil {
+		return err
+	}
+	oldRoot, _, pubKey, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	config := chamMerkleTree.NewMerkleConfigFromParams(metaData.Chunker)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	transfer.FromContext(ctx).AddTotal(info.Size(), 0)
+
+	// 2, Find collisions for the changed subtrees
+	collide, sign, err := trapdoor(ctx, params, pubKey)
+	if err != nil {
+		return err
+	}
+	root, err := chamMerkleTree.UpdateMerkleTreeFromRoot(file, config, oldRoot, pubKey, collide)
+	if err != nil {
+		return err
+	}
+
+	// 3, Sign the new metadata
+	// 旧编码的公钥在更新时迁移到新编码
+	newMetaData := chamMerkleTree.NewMetaData(root, pubKey, metaData.Chunker)
+	if err := sign(newMetaData); err != nil {
+		return err
+	}
+
+	// 4, Send the new file splits to the network
+	if err := challenge.Discard(metaData.RootHash); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	chunker, err := chamMerkleTree.NewChunker(bufio.NewReader(file), config)
+	if err != nil {
+		return err
+	}
+	if err := sendSplits(ctx, root, chunker, 0, num, challenges); err != nil {
+		return err
+	}
+
+	// 5, Publish the new metadata after its splits are stored
+	if err := publishMetadata(ctx, newMetaData); err != nil {
+		return err
+	}
+	logrus.Infof("Update metadata %s", rootHex)
+	logrus.Infof("Update file %s finished", rootHex)
+	return nil
+}
+
+// replicaParams 读取 -n 指定的副本数和 -challenges 指定的每个分片的挑战个数
+func replicaParams(params map[string]string) (num, challenges int, err error) {
+	num, challenges = 5, 2
+	if numString, exists := params["-n"]; exists {
+		num, err = strconv.Atoi(numString)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if challengeString, exists := params["-challenges"]; exists {
+		challenges, err = strconv.Atoi(challengeString)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return num, challenges, nil
+}
+
+// trapdoor 返回修改已发布文件时生成碰撞和签名 metadata 的函数。
+// 指定 -holders 时由分片持有者协作完成，否则使用 -key 或默认密钥，密钥必须是发布这个文件的密钥。
+func trapdoor(ctx context.Context, params map[string]string, pubKey *chamMerkleTree.ChameleomPubKey) (chamMerkleTree.CollisionFunc, func(*DHT.MetaData) error, error) {
+	if holdersString, useHolders := params["-holders"]; useHolders {
+		if pubKey.Scheme() != chamMerkleTree.SchemeP256 {
+			return nil, nil, fmt.Errorf("threshold updates only support %s keys, file uses %s", chamMerkleTree.SchemeP256, pubKey.Scheme())
+		}
+		holders, err := parseHolders(holdersString)
+		if err != nil {
+			return nil, nil, err
+		}
+		collide := manager.GetCoordinator().Collider(ctx, holders, pubKey)
+		sign := func(m *DHT.MetaData) error { return manager.GetCoordinator().SignMetaData(ctx, holders, m) }
+		return collide, sign, nil
+	}
+	parameter, err := signingKey(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !parameter.PubKey.Equal(pubKey) {
+		return nil, nil, errors.New("file was published with another chameleon key")
+	}
+	collide := chamMerkleTree.LocalCollider(pubKey, parameter.SecKey)
+	sign := func(m *DHT.MetaData) error { return chamMerkleTree.SignMetaData(m, parameter.SecKey) }
+	return collide, sign, nil
+}
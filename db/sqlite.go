@@ -204,3 +204,34 @@ func (m *DBManager) LoadFromMemory(key string, result interface{}) error {
 	err = json.Unmarshal([]byte(valueJSON), result)
 	return err
 }
+
+// DeleteFromMemory 从内存数据库删除数据
+func (m *DBManager) DeleteFromMemory(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := m.memoryDB.Exec("DELETE FROM kv_store WHERE key = ?", key)
+	return err
+}
+
+// ListKeys 列出内存数据库中以 prefix 开头的所有键
+func (m *DBManager) ListKeys(prefix string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	rows, err := m.memoryDB.Query("SELECT key FROM kv_store WHERE substr(key, 1, ?) = ?", len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,212 @@
+// Package dhtsim 在 libp2p 的内存网络 mocknet 上运行多个 DHTService，不需要真实端口即可测试
+// Announce、Lookup、SendFile 和 GetFile，并提供节点加入退出和链路延迟的模拟。
+package dhtsim
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	dht "main/DHT"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Node 是模拟网络中的一个节点
+type Node struct {
+	*dht.DHTService
+
+	// Path 是节点保存收到的数据块的目录
+	Path string
+}
+
+// Addr 返回节点包含 /p2p 部分的完整地址，可以直接传给 SendFile 和 GetFile
+func (node *Node) Addr() multiaddr.Multiaddr {
+	info := peer.AddrInfo{ID: node.Host.ID(), Addrs: node.Host.Addrs()}
+	addrs, err := peer.AddrInfoToP2pAddrs(&info)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Network 是由 mocknet 连接起来的一组节点，所有节点两两相连，共享同一个路由表
+type Network struct {
+	ctx context.Context
+	mn  mocknet.Mocknet
+	dir string
+
+	lock  sync.Mutex
+	nodes []*Node
+}
+
+// New 创建一个空的模拟网络
+// 参数:
+// - ctx: 上下文，用于控制节点的生命周期。
+// - dir: 节点保存数据块的目录，每个节点使用其中以节点 ID 命名的子目录。
+func New(ctx context.Context, dir string) *Network {
+	return &Network{
+		ctx: ctx,
+		mn:  mocknet.New(),
+		dir: dir,
+	}
+}
+
+// Start 向网络中加入 count 个节点
+func (n *Network) Start(count int) ([]*Node, error) {
+	var nodes []*Node
+	for i := 0; i < count; i++ {
+		node, err := n.AddNode()
+		if err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// AddNode 加入一个新节点：与所有存活的节点建立链路并互相加入路由表，注册文件相关的协议处理函数
+func (n *Network) AddNode() (*Node, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	host, err := n.mn.GenPeer()
+	if err != nil {
+		return nil, err
+	}
+	config := dht.NewDHTConfig()
+	for _, node := range n.nodes {
+		if _, err := n.mn.LinkPeers(host.ID(), node.Host.ID()); err != nil {
+			host.Close()
+			return nil, err
+		}
+		if addr := node.Addr(); addr != nil {
+			config.BootstrapPeers = append(config.BootstrapPeers, addr)
+		}
+	}
+
+	service, err := dht.NewDHTServiceWithHost(n.ctx, host, config)
+	if err != nil {
+		host.Close()
+		return nil, err
+	}
+	for _, node := range n.nodes {
+		node.DHT.RoutingTable().TryAddPeer(host.ID(), true, true)
+	}
+
+	path := filepath.Join(n.dir, host.ID().String())
+	if err := os.MkdirAll(path, 0755); err != nil {
+		service.Close()
+		return nil, err
+	}
+	service.AnnounceHandler(n.ctx)
+	service.LookupHandler(n.ctx)
+	service.SendFileHandler(n.ctx, path)
+	service.GetFileHandler(n.ctx, path)
+
+	node := &Node{DHTService: service, Path: path}
+	n.nodes = append(n.nodes, node)
+	return node, nil
+}
+
+// Kill 让节点退出网络：关闭节点并断开它的所有链路，其他节点的路由表中也会移除它
+func (n *Network) Kill(node *Node) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	index := -1
+	for i, other := range n.nodes {
+		if other == node {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("node %s not in network", node.Host.ID())
+	}
+	n.nodes = append(n.nodes[:index], n.nodes[index+1:]...)
+
+	for _, other := range n.nodes {
+		n.mn.UnlinkPeers(node.Host.ID(), other.Host.ID())
+		other.DHT.RoutingTable().RemovePeer(node.Host.ID())
+	}
+	return node.Close()
+}
+
+// Churn 随机让 kill 个节点退出网络，再加入 add 个新节点
+// 返回值:
+// - []*Node: 新加入的节点。
+// - error: 错误信息。
+func (n *Network) Churn(kill, add int) ([]*Node, error) {
+	for _, node := range n.pick(kill) {
+		if err := n.Kill(node); err != nil {
+			return nil, err
+		}
+	}
+	return n.Start(add)
+}
+
+// pick 随机选择 count 个存活的节点
+func (n *Network) pick(count int) []*Node {
+	nodes := n.Nodes()
+	mrand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	if count > len(nodes) {
+		count = len(nodes)
+	}
+	return nodes[:count]
+}
+
+// Nodes 返回所有存活的节点
+func (n *Network) Nodes() []*Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]*Node(nil), n.nodes...)
+}
+
+// SetLatency 设置所有链路的延迟，之后建立的链路也使用这个延迟
+func (n *Network) SetLatency(latency time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	defaults := n.mn.LinkDefaults()
+	defaults.Latency = latency
+	n.mn.SetLinkDefaults(defaults)
+	for _, byPeer := range n.mn.Links() {
+		for _, links := range byPeer {
+			for link := range links {
+				opts := link.Options()
+				opts.Latency = latency
+				link.SetOptions(opts)
+			}
+		}
+	}
+}
+
+// SetLinkLatency 设置两个节点之间链路的延迟
+func (n *Network) SetLinkLatency(a, b *Node, latency time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, link := range n.mn.LinksBetweenPeers(a.Host.ID(), b.Host.ID()) {
+		opts := link.Options()
+		opts.Latency = latency
+		link.SetOptions(opts)
+	}
+}
+
+// Close 关闭所有节点
+func (n *Network) Close() error {
+	n.lock.Lock()
+	nodes := n.nodes
+	n.nodes = nil
+	n.lock.Unlock()
+
+	for _, node := range nodes {
+		node.Close()
+	}
+	return n.mn.Close()
+}
@@ -0,0 +1,172 @@
+package dhtsim
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dht "main/DHT"
+	"testing"
+	"time"
+)
+
+// lookupTimeout 是等待宣布传播到其他节点的最长时间
+const lookupTimeout = 10 * time.Second
+
+// chunk 返回随机内容的数据块和它的名称
+func chunk(t *testing.T) (string, []byte) {
+	t.Helper()
+	data := make([]byte, 4096)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data
+}
+
+// waitProviders 在 lookupTimeout 内反复查询，直到查到至少 want 个持有者
+func waitProviders(t *testing.T, ctx context.Context, node *Node, name string, want int) []peer.AddrInfo {
+	t.Helper()
+	deadline := time.Now().Add(lookupTimeout)
+	for {
+		providers, err := node.Lookup(ctx, name)
+		if err == nil && len(providers) >= want {
+			return providers
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("found %d providers of %s, want %d: %v", len(providers), name, want, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// push 把数据块发送给 holders，收到的节点自己宣布为持有者
+func push(t *testing.T, ctx context.Context, sender *Node, holders []*Node, name string, data []byte) {
+	t.Helper()
+	for _, holder := range holders {
+		info := peer.AddrInfo{ID: holder.Host.ID(), Addrs: holder.Host.Addrs()}
+		if err := sender.SendFileTo(ctx, info, name, dht.CodecNone, bytes.NewBuffer(data)); err != nil {
+			t.Fatalf("send to %s: %v", holder.Host.ID(), err)
+		}
+	}
+}
+
+// fetch 依次向查到的持有者请求数据块，返回第一个成功的结果
+func fetch(ctx context.Context, node *Node, providers []peer.AddrInfo, name string) ([]byte, error) {
+	err := dht.ErrFileNotFound
+	for _, provider := range providers {
+		var buf bytes.Buffer
+		if err = node.GetFileFrom(ctx, provider, name, &buf); err == nil {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, err
+}
+
+func TestSendLookupGet(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    int
+		holders  int
+		latency  time.Duration
+		lost     int // 宣布之后退出的持有者数
+		churn    int // 宣布之后退出的其他节点数，同时加入同样多的新节点
+		wantLost bool
+	}{
+		{name: "no latency", nodes: 4, holders: 2},
+		{name: "latency", nodes: 6, holders: 2, latency: 20 * time.Millisecond},
+		{name: "churn", nodes: 8, holders: 2, churn: 2},
+		{name: "churn with latency", nodes: 8, holders: 3, latency: 10 * time.Millisecond, churn: 3},
+		{name: "one provider lost", nodes: 6, holders: 2, lost: 1},
+		{name: "all providers lost", nodes: 6, holders: 2, lost: 2, wantLost: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			network := New(ctx, t.TempDir())
+			defer network.Close()
+			nodes, err := network.Start(tt.nodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			network.SetLatency(tt.latency)
+
+			// nodes[0] 发送，接下来的节点持有，最后一个节点读取
+			sender, holders, reader := nodes[0], nodes[1:1+tt.holders], nodes[len(nodes)-1]
+			name, data := chunk(t)
+			push(t, ctx, sender, holders, name, data)
+			waitProviders(t, ctx, reader, name, tt.holders)
+
+			for _, holder := range holders[:tt.lost] {
+				if err := network.Kill(holder); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, node := range nodes[1+tt.holders : 1+tt.holders+tt.churn] {
+				if err := network.Kill(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := network.Start(tt.churn); err != nil {
+				t.Fatal(err)
+			}
+
+			// 退出的持有者的记录仍然会被查到，读取时跳过它们
+			providers := waitProviders(t, ctx, reader, name, tt.holders)
+			got, err := fetch(ctx, reader, providers, name)
+			if tt.wantLost {
+				if err == nil {
+					t.Fatal("fetched a chunk whose providers are all gone")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("fetched chunk differs from the sent one")
+			}
+		})
+	}
+}
+
+func TestAnnounceRejectsOtherProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	network := New(ctx, t.TempDir())
+	defer network.Close()
+	nodes, err := network.Start(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, victim, reader := nodes[0], nodes[1], nodes[3]
+	name, _ := chunk(t)
+
+	// 替 victim 宣布它持有数据块
+	forged, err := peer.AddrInfo{ID: victim.Host.ID(), Addrs: victim.Host.Addrs()}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[1:] {
+		s, err := attacker.Host.NewStream(ctx, node.Host.ID(), dht.AnnounceProtocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Write([]byte(name + "\n"))
+		s.Write(append(forged, '\n'))
+		s.Close()
+	}
+
+	// 自己宣布的记录仍然有效
+	if err := attacker.Announce(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	for _, provider := range waitProviders(t, ctx, reader, name, 1) {
+		if provider.ID == victim.Host.ID() {
+			t.Fatal("provider announced by another peer was accepted")
+		}
+	}
+}
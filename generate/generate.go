@@ -1,54 +1,51 @@
 package main
 
 import (
+	"bufio"
 	"encoding/hex"
 	"fmt"
-	"gopkg.in/yaml.v3"
-	"main/chamMerkleTree"
+	"main/keystore"
 	"os"
+	"strings"
 )
 
-// 配置结构体
-type Config struct {
-	SecKey string `yaml:"SecKey"`
-	PubKey string `yaml:"PubKey"`
-}
-
-func generateConfig(filename string) error {
-	secKey, pubKey := chamMerkleTree.GenerateChameleonKeyPair()
-	// 配置数据，包含密钥
-	config := Config{
-		SecKey: hex.EncodeToString(secKey),             // 示例 SecKey
-		PubKey: hex.EncodeToString(pubKey.Serialize()), // 示例 PubKey
+// generateKey 在密钥库中生成一个新的变色龙密钥，私钥用口令加密保存
+func generateKey(path, name, scheme string) error {
+	passphrase := os.Getenv(keystore.PassphraseEnv)
+	if passphrase == "" {
+		fmt.Print("Passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("error reading passphrase: %v", err)
+		}
+		passphrase = strings.TrimSpace(line)
 	}
-	fmt.Printf("%s\n%s\n", config.SecKey, config.PubKey)
 
-	// 将配置结构体转换为 YAML 格式
-	data, err := yaml.Marshal(&config)
+	ks, err := keystore.Open(path)
 	if err != nil {
-		return fmt.Errorf("error marshaling config: %v", err)
+		return err
 	}
-
-	// 创建并写入 config.yml 文件
-	file, err := os.Create(filename)
+	key, err := ks.Create(name, scheme, passphrase)
 	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+		return err
 	}
-	defer file.Close()
-
-	_, err = file.Write(data)
-	if err != nil {
-		return fmt.Errorf("error writing to file: %v", err)
-	}
-
-	fmt.Printf("Config file %s has been generated.\n", filename)
+	fmt.Printf("%s\n", hex.EncodeToString(key.PubKey.Serialize()))
+	fmt.Printf("Key %s has been added to %s.\n", name, path)
 	return nil
 }
 
 func main() {
-	// 生成配置文件 config.yml
-	err := generateConfig("config.yml")
+	// 生成密钥，名字默认为 default，方案默认为 p256
+	name := "default"
+	if len(os.Args) > 1 {
+		name = os.Args[1]
+	}
+	scheme := ""
+	if len(os.Args) > 2 {
+		scheme = os.Args[2]
+	}
+	err := generateKey("keystore.json", name, scheme)
 	if err != nil {
-		fmt.Println("Error generating config:", err)
+		fmt.Println("Error generating key:", err)
 	}
 }
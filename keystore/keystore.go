@@ -0,0 +1,366 @@
+// Package keystore 保存多个命名的变色龙密钥，私钥用口令加密（scrypt 派生密钥 + AES-GCM）后写入一个 JSON 文件。
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"main/chamMerkleTree"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PassphraseEnv 是读取口令的环境变量，命令没有指定 -pass 时使用
+const PassphraseEnv = "FLEXISN_KEYSTORE_PASSPHRASE"
+
+// scrypt 参数
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltSize     = 32
+)
+
+var (
+	// ErrKeyNotFound 表示密钥库中没有这个名字的密钥
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyExists 表示密钥库中已经有这个名字的密钥
+	ErrKeyExists = errors.New("key already exists")
+	// ErrWrongPassphrase 表示口令错误或密钥文件被篡改
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrInvalidParams 表示密钥文件中的 scrypt 参数超出了本程序使用的参数
+	ErrInvalidParams = errors.New("invalid scrypt parameters")
+)
+
+// cryptoParams 是加密后的私钥及解密所需的参数
+type cryptoParams struct {
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+}
+
+// entry 是密钥库文件中的一个密钥
+type entry struct {
+	Scheme  string       `json:"scheme,omitempty"` // 变色龙哈希方案，为空表示 p256
+	PubKey  string       `json:"pubKey"`
+	Crypto  cryptoParams `json:"crypto"`
+	Created time.Time    `json:"created"`
+}
+
+// file 是密钥库文件的格式
+type file struct {
+	Default string            `json:"default"`
+	Keys    map[string]*entry `json:"keys"`
+}
+
+// KeyInfo 是列出密钥时返回的信息，不包含私钥
+type KeyInfo struct {
+	Name     string
+	Scheme   string
+	PubKey   []byte
+	Created  time.Time
+	Default  bool
+	Unlocked bool
+}
+
+// Key 是解密后的变色龙密钥对
+type Key struct {
+	Name   string
+	SecKey []byte
+	PubKey *chamMerkleTree.ChameleomPubKey
+}
+
+// Keystore 是保存在文件中的密钥库，解密过的私钥缓存在内存中
+type Keystore struct {
+	path string
+
+	lock     sync.Mutex
+	data     file
+	unlocked map[string]*Key
+}
+
+// Open 打开密钥库文件，文件不存在时创建一个空的密钥库，第一次保存时写入文件
+func Open(path string) (*Keystore, error) {
+	ks := &Keystore{
+		path:     path,
+		data:     file{Keys: make(map[string]*entry)},
+		unlocked: make(map[string]*Key),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ks.data); err != nil {
+		return nil, fmt.Errorf("invalid keystore %s: %v", path, err)
+	}
+	if ks.data.Keys == nil {
+		ks.data.Keys = make(map[string]*entry)
+	}
+	return ks, nil
+}
+
+// save 先写临时文件再重命名，避免写了一半的文件覆盖密钥库，调用者需要持有锁
+func (ks *Keystore) save() error {
+	data, err := json.MarshalIndent(&ks.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(ks.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// deriveKey 用 scrypt 从口令派生 AES 密钥
+func deriveKey(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt 加密私钥，公钥作为附加数据，防止把一个密钥的密文换到另一个公钥下
+func encrypt(secKey, pubKey []byte, passphrase string) (*cryptoParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := deriveKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &cryptoParams{
+		Salt:       hex.EncodeToString(salt),
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, secKey, pubKey)),
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+	}, nil
+}
+
+// decrypt 解密私钥
+func decrypt(params *cryptoParams, pubKey []byte, passphrase string) ([]byte, error) {
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(params.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := hex.DecodeString(params.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	// 参数来自文件，不加限制时被篡改的文件可以让 scrypt 占用任意多的内存和时间
+	if params.N < 2 || params.N > scryptN || params.R < 1 || params.R > scryptR || params.P < 1 || params.P > scryptP {
+		return nil, fmt.Errorf("%w: n %d, r %d, p %d", ErrInvalidParams, params.N, params.R, params.P)
+	}
+	aead, err := deriveKey(passphrase, salt, params.N, params.R, params.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	secKey, err := aead.Open(nil, nonce, ciphertext, pubKey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return secKey, nil
+}
+
+// Create 生成一个新的变色龙密钥对并加密保存，密钥库中还没有默认密钥时设为默认密钥
+// 参数:
+// - scheme: 变色龙哈希方案，为空时使用 chamMerkleTree.DefaultScheme。
+func (ks *Keystore) Create(name, scheme, passphrase string) (*Key, error) {
+	if scheme == "" {
+		scheme = chamMerkleTree.DefaultScheme
+	}
+	secKey, pubKey, err := chamMerkleTree.GenerateKeyPair(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return ks.add(name, secKey, pubKey, passphrase)
+}
+
+// Import 导入一个已有的变色龙私钥，公钥由私钥按 scheme 方案计算
+func (ks *Keystore) Import(name, scheme string, secKey []byte, passphrase string) (*Key, error) {
+	if scheme == "" {
+		scheme = chamMerkleTree.DefaultScheme
+	}
+	pubKey, err := chamMerkleTree.PubKeyFromSecKey(scheme, secKey)
+	if err != nil {
+		return nil, err
+	}
+	return ks.add(name, secKey, pubKey, passphrase)
+}
+
+func (ks *Keystore) add(name string, secKey []byte, pubKey *chamMerkleTree.ChameleomPubKey, passphrase string) (*Key, error) {
+	if name == "" {
+		return nil, errors.New("key name is empty")
+	}
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if _, exists := ks.data.Keys[name]; exists {
+		return nil, fmt.Errorf("%s: %w", name, ErrKeyExists)
+	}
+	pubBytes := pubKey.Serialize()
+	params, err := encrypt(secKey, pubBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks.data.Keys[name] = &entry{
+		Scheme:  pubKey.Scheme(),
+		PubKey:  hex.EncodeToString(pubBytes),
+		Crypto:  *params,
+		Created: time.Now(),
+	}
+	if ks.data.Default == "" {
+		ks.data.Default = name
+	}
+	if err := ks.save(); err != nil {
+		delete(ks.data.Keys, name)
+		return nil, err
+	}
+	key := &Key{Name: name, SecKey: secKey, PubKey: pubKey}
+	ks.unlocked[name] = key
+	return key, nil
+}
+
+// Unlock 用口令解密私钥，解密后的密钥缓存在内存中。
+// 已经解锁的密钥也重新解密，口令错误时返回 ErrWrongPassphrase，否则任何口令都能取得缓存的私钥
+func (ks *Keystore) Unlock(name, passphrase string) (*Key, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	e, ok := ks.data.Keys[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	pubBytes, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	secKey, err := decrypt(&e.Crypto, pubBytes, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if key, ok := ks.unlocked[name]; ok {
+		return key, nil
+	}
+	pubKey, err := chamMerkleTree.ParseChameleomPubKey(e.Scheme, pubBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	key := &Key{Name: name, SecKey: secKey, PubKey: pubKey}
+	ks.unlocked[name] = key
+	return key, nil
+}
+
+// Lock 清除内存中缓存的私钥
+func (ks *Keystore) Lock(name string) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	delete(ks.unlocked, name)
+}
+
+// Export 用口令解密并返回私钥，导出时总是重新验证口令
+func (ks *Keystore) Export(name, passphrase string) ([]byte, error) {
+	ks.lock.Lock()
+	e, ok := ks.data.Keys[name]
+	ks.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	pubBytes, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(&e.Crypto, pubBytes, passphrase)
+}
+
+// SetDefault 设置默认密钥
+func (ks *Keystore) SetDefault(name string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if _, ok := ks.data.Keys[name]; !ok {
+		return fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	previous := ks.data.Default
+	ks.data.Default = name
+	if err := ks.save(); err != nil {
+		ks.data.Default = previous
+		return err
+	}
+	return nil
+}
+
+// Default 返回默认密钥的名字，没有密钥时为空
+func (ks *Keystore) Default() string {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.data.Default
+}
+
+// List 按名字排序列出所有密钥
+func (ks *Keystore) List() []KeyInfo {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	var infos []KeyInfo
+	for name, e := range ks.data.Keys {
+		pubKey, _ := hex.DecodeString(e.PubKey)
+		_, unlocked := ks.unlocked[name]
+		scheme := e.Scheme
+		if scheme == "" {
+			scheme = chamMerkleTree.SchemeP256
+		}
+		infos = append(infos, KeyInfo{
+			Name:     name,
+			Scheme:   scheme,
+			PubKey:   pubKey,
+			Created:  e.Created,
+			Default:  name == ks.data.Default,
+			Unlocked: unlocked,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
@@ -0,0 +1,189 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"main/chamMerkleTree"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const passphrase = "correct horse battery staple"
+
+// open 打开 path 中的密钥库
+func open(t *testing.T, path string) *Keystore {
+	t.Helper()
+	ks, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// rewrite 修改密钥库文件中的一个密钥，模拟文件被篡改
+func rewrite(t *testing.T, path, name string, modify func(e *entry)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	modify(f.Keys[name])
+	if data, err = json.Marshal(&f); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateLockUnlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	ks := open(t, path)
+	created, err := ks.Create("main", "", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Create("main", "", passphrase); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("got %v, want ErrKeyExists", err)
+	}
+	if ks.Default() != "main" {
+		t.Fatalf("default key is %q", ks.Default())
+	}
+
+	ks.Lock("main")
+	if infos := ks.List(); len(infos) != 1 || infos[0].Unlocked || !infos[0].Default {
+		t.Fatalf("listed %+v", infos)
+	}
+	// 重新打开的密钥库从文件解密
+	for _, ks := range []*Keystore{ks, open(t, path)} {
+		key, err := ks.Unlock("main", passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key.SecKey, created.SecKey) || !key.PubKey.Equal(created.PubKey) {
+			t.Fatal("unlocked key differs from the created one")
+		}
+		if infos := ks.List(); !infos[0].Unlocked {
+			t.Fatal("key not cached after unlock")
+		}
+	}
+	if _, err := ks.Unlock("other", passphrase); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	ks := open(t, filepath.Join(t.TempDir(), "keystore.json"))
+	if _, err := ks.Create("main", "", passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create 之后密钥已经解锁，错误的口令仍然被拒绝
+	if _, err := ks.Unlock("main", "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("unlocked key: got %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := ks.Unlock("main", passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Unlock("main", ""); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("unlocked key, empty passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+	ks.Lock("main")
+	if _, err := ks.Unlock("main", "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("locked key: got %v, want ErrWrongPassphrase", err)
+	}
+	if infos := ks.List(); infos[0].Unlocked {
+		t.Fatal("wrong passphrase unlocked the key")
+	}
+	if _, err := ks.Export("main", "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("export: got %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestTamperedKeystore(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(e *entry)
+		want   error
+	}{
+		{"larger n", func(e *entry) { e.Crypto.N *= 2 }, ErrInvalidParams},
+		{"larger r", func(e *entry) { e.Crypto.R++ }, ErrInvalidParams},
+		{"larger p", func(e *entry) { e.Crypto.P++ }, ErrInvalidParams},
+		{"zero n", func(e *entry) { e.Crypto.N = 0 }, ErrInvalidParams},
+		{"smaller n", func(e *entry) { e.Crypto.N /= 2 }, ErrWrongPassphrase},
+		{"salt", func(e *entry) { e.Crypto.Salt = flip(t, e.Crypto.Salt) }, ErrWrongPassphrase},
+		{"nonce", func(e *entry) { e.Crypto.Nonce = flip(t, e.Crypto.Nonce) }, ErrWrongPassphrase},
+		{"short nonce", func(e *entry) { e.Crypto.Nonce = e.Crypto.Nonce[2:] }, ErrWrongPassphrase},
+		{"ciphertext", func(e *entry) { e.Crypto.Ciphertext = flip(t, e.Crypto.Ciphertext) }, ErrWrongPassphrase},
+		{"public key", func(e *entry) { e.PubKey = flip(t, e.PubKey) }, ErrWrongPassphrase},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keystore.json")
+			if _, err := open(t, path).Create("main", "", passphrase); err != nil {
+				t.Fatal(err)
+			}
+			rewrite(t, path, "main", test.modify)
+			ks := open(t, path)
+			if _, err := ks.Unlock("main", passphrase); !errors.Is(err, test.want) {
+				t.Fatalf("unlock: got %v, want %v", err, test.want)
+			}
+			if _, err := ks.Export("main", passphrase); !errors.Is(err, test.want) {
+				t.Fatalf("export: got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// flip 翻转16进制字符串的最后一个字节
+func flip(t *testing.T, s string) string {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	return hex.EncodeToString(data)
+}
+
+func TestExportImport(t *testing.T) {
+	for _, scheme := range []string{chamMerkleTree.SchemeP256, chamMerkleTree.SchemeEd25519} {
+		t.Run(scheme, func(t *testing.T) {
+			src := open(t, filepath.Join(t.TempDir(), "keystore.json"))
+			created, err := src.Create("main", scheme, passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secKey, err := src.Export("main", passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(secKey, created.SecKey) {
+				t.Fatal("exported key differs from the created one")
+			}
+
+			path := filepath.Join(t.TempDir(), "keystore.json")
+			dst := open(t, path)
+			if _, err := dst.Import("imported", scheme, secKey, "another passphrase"); err != nil {
+				t.Fatal(err)
+			}
+			dst.Lock("imported")
+			key, err := open(t, path).Unlock("imported", "another passphrase")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key.SecKey, secKey) || !key.PubKey.Equal(created.PubKey) || key.PubKey.Scheme() != scheme {
+				t.Fatal("imported key differs from the exported one")
+			}
+			if infos := dst.List(); len(infos) != 1 || infos[0].Scheme != scheme || !bytes.Equal(infos[0].PubKey, created.PubKey.Serialize()) {
+				t.Fatalf("listed %+v", infos)
+			}
+		})
+	}
+}
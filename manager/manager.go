@@ -2,12 +2,16 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
 	dht "main/DHT"
 	"main/chamMerkleTree"
 	"main/db"
+	"main/keystore"
+	"main/registry"
 	"main/rpc"
+	"main/threshold"
 	"time"
 )
 
@@ -23,14 +27,21 @@ var (
 
 	DBManager *db.DBManager
 
+	Registry registry.MetadataRegistry
+
+	Keystore *keystore.Keystore
+
+	Shares *threshold.Store
+
 	Params *Parameters
 )
 
-func InitDHTService(ctx context.Context, port int, target string) error {
+func InitDHTService(ctx context.Context, port int, target string, nat *dht.NATConfig) error {
 	var err error
 
 	dhtConfig := dht.NewDHTConfig()
 	dhtConfig.Port = port
+	dhtConfig.NAT = nat
 
 	if target != "" {
 		maddr, err := multiaddr.NewMultiaddr(target)
@@ -50,9 +61,23 @@ func InitDHTService(ctx context.Context, port int, target string) error {
 	DHTService.LookupHandler(ctx)
 	DHTService.SendFileHandler(ctx, "data")
 	DHTService.GetFileHandler(ctx, "data")
+	DHTService.MetaDataHandler(ctx, loadMetaData)
 	return nil
 }
 
+// loadMetaData 从本地数据库读取 metadata，应答其他节点的 metadata 请求
+func loadMetaData(rootHash string) (*dht.MetaData, error) {
+	dbManager := GetDBManager()
+	if dbManager == nil {
+		return nil, errors.New("database not initialized")
+	}
+	var metaData dht.MetaData
+	if err := dbManager.LoadFromMemory(rootHash, &metaData); err != nil {
+		return nil, err
+	}
+	return &metaData, nil
+}
+
 func GetDHTService() *dht.DHTService {
 	return DHTService
 }
@@ -84,11 +109,57 @@ func GetDBManager() *db.DBManager {
 	return DBManager
 }
 
-func InitParameters(secKey, pubKey []byte) {
+func InitRegistry(r registry.MetadataRegistry) {
+	Registry = r
+}
+
+func GetRegistry() registry.MetadataRegistry {
+	return Registry
+}
+
+func InitKeystore(path string) error {
+	var err error
+	Keystore, err = keystore.Open(path)
+	return err
+}
+
+func GetKeystore() *keystore.Keystore {
+	return Keystore
+}
+
+func InitShares(path string) error {
+	var err error
+	Shares, err = threshold.Open(path)
+	return err
+}
+
+func GetShares() *threshold.Store {
+	return Shares
+}
+
+// GetCoordinator 返回使用本节点和本地分片发起门限协作的协调者
+func GetCoordinator() *threshold.Coordinator {
+	return &threshold.Coordinator{DHT: DHTService, Store: Shares}
+}
+
+// UseKey 将密钥库中的密钥设为发送文件时默认使用的密钥
+func UseKey(key *keystore.Key) {
+	Params = &Parameters{
+		SecKey: key.SecKey,
+		PubKey: key.PubKey,
+	}
+}
+
+func InitParameters(secKey, pubKey []byte) error {
+	key, err := chamMerkleTree.DeserializeChameleomPubKey(pubKey)
+	if err != nil {
+		return err
+	}
 	Params = &Parameters{
 		SecKey: secKey,
-		PubKey: chamMerkleTree.DeserializeChameleomPubKey(pubKey),
+		PubKey: key,
 	}
+	return nil
 }
 
 func GetParameters() *Parameters {
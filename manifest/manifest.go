@@ -0,0 +1,150 @@
+package manifest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 目录清单: 目录中每个文件作为独立的文件发送，清单记录每个文件的相对路径、根哈希、大小和权限，
+// 清单本身的 JSON 编码再作为一个普通文件发送，清单的根哈希就是目录的标识。
+// 清单同样使用变色龙哈希，增加或删除文件后更新清单，目录的根哈希保持不变。
+
+// Version 是清单格式的版本号
+const Version = 1
+
+// ErrInvalidManifest 表示内容不是有效的目录清单
+var ErrInvalidManifest = errors.New("invalid directory manifest")
+
+// Entry 是清单中的一个文件
+type Entry struct {
+	Path string      `json:"path"`           // 相对于目录的路径，使用 / 分隔
+	Root string      `json:"root,omitempty"` // 文件根哈希的16进制字符串，空文件没有根哈希
+	Size int64       `json:"size"`
+	Mode fs.FileMode `json:"mode"` // 文件的权限位
+}
+
+// Manifest 是目录清单，Files 和 Dirs 按路径排序
+type Manifest struct {
+	Version int     `json:"version"`
+	Files   []Entry `json:"files"`
+	// Dirs 记录目录中的所有子目录，恢复时先创建，空目录也能保留
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+// Walk 遍历目录中的普通文件和子目录，按路径顺序对每个文件和子目录调用 fn，
+// 目录本身、符号链接和其他特殊文件被跳过
+// 参数:
+// - dir: 目录路径。
+// - fn: 处理文件的函数，参数为文件的完整路径和清单中的相对路径，子目录的 info.IsDir() 为 true。
+func Walk(dir string, fn func(path, rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || !(d.Type().IsRegular() || d.IsDir()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(rel), info)
+	})
+}
+
+// Marshal 将清单编码为 JSON，文件和子目录按路径排序，相同的目录总是得到相同的编码
+func (m *Manifest) Marshal() ([]byte, error) {
+	m.Version = Version
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	sort.Strings(m.Dirs)
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Parse 解码并检查清单
+// 返回值:
+// - *Manifest: 清单。
+// - error: 版本未知、路径不安全或根哈希无效时返回 ErrInvalidManifest。
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidManifest, m.Version)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Validate 检查每个文件和子目录的路径都在目录之内且不重复，避免恢复目录时写到目录之外
+func (m *Manifest) Validate() error {
+	seen := make(map[string]bool, len(m.Files)+len(m.Dirs))
+	check := func(path string) error {
+		// "." 是目录本身，不能作为文件或子目录
+		if path == "." || !filepath.IsLocal(filepath.FromSlash(path)) || filepath.ToSlash(filepath.Clean(path)) != path {
+			return fmt.Errorf("%w: unsafe path %q", ErrInvalidManifest, path)
+		}
+		if seen[path] {
+			return fmt.Errorf("%w: duplicate path %q", ErrInvalidManifest, path)
+		}
+		seen[path] = true
+		return nil
+	}
+	for _, dir := range m.Dirs {
+		if err := check(dir); err != nil {
+			return err
+		}
+	}
+	for _, entry := range m.Files {
+		if err := check(entry.Path); err != nil {
+			return err
+		}
+		if entry.Size < 0 || entry.Mode&^fs.ModePerm != 0 {
+			return fmt.Errorf("%w: invalid size or mode of %q", ErrInvalidManifest, entry.Path)
+		}
+		if (entry.Size == 0) != (entry.Root == "") {
+			return fmt.Errorf("%w: root of %q", ErrInvalidManifest, entry.Path)
+		}
+		if _, err := hex.DecodeString(entry.Root); err != nil {
+			return fmt.Errorf("%w: root of %q: %v", ErrInvalidManifest, entry.Path, err)
+		}
+	}
+	return nil
+}
+
+// MakeDirs 创建 dir 和清单中的所有子目录，没有文件的目录也会被恢复
+func (m *Manifest) MakeDirs(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, sub := range m.Dirs {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(sub)), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Target 返回文件在 dir 下的路径，并创建所在的目录
+func (entry *Entry) Target(dir string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(entry.Path))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,197 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const root = "0123456789abcdef"
+
+func TestMarshalParse(t *testing.T) {
+	m := &Manifest{
+		Files: []Entry{
+			{Path: "sub/b.txt", Root: root, Size: 10, Mode: 0600},
+			{Path: "a.txt", Root: "fedcba9876543210", Size: 20, Mode: 0644},
+			{Path: "empty", Size: 0, Mode: 0644},
+		},
+		Dirs: []string{"sub", "other/empty", "other"},
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Fatalf("parsed %+v, want %+v", parsed, m)
+	}
+	if parsed.Files[0].Path != "a.txt" || parsed.Dirs[0] != "other" {
+		t.Fatalf("files and dirs not sorted: %+v", parsed)
+	}
+
+	// 相同的内容以任意顺序给出时编码相同
+	again, err := (&Manifest{Files: []Entry{m.Files[2], m.Files[0], m.Files[1]}, Dirs: []string{"sub", "other", "other/empty"}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Fatalf("encoding depends on order:\n%s\n%s", data, again)
+	}
+
+	// 旧的清单没有 dirs
+	old, err := Parse([]byte(`{"version":1,"files":[{"path":"a","root":"` + root + `","size":1,"mode":420}]}`))
+	if err != nil || len(old.Files) != 1 || old.Dirs != nil {
+		t.Fatalf("parsed %+v, %v", old, err)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Manifest
+	}{
+		{"parent", Manifest{Files: []Entry{{Path: "../escape", Root: root, Size: 1}}}},
+		{"nested parent", Manifest{Files: []Entry{{Path: "a/../../escape", Root: root, Size: 1}}}},
+		{"absolute", Manifest{Files: []Entry{{Path: "/etc/passwd", Root: root, Size: 1}}}},
+		{"unclean", Manifest{Files: []Entry{{Path: "a//b", Root: root, Size: 1}}}},
+		{"dot", Manifest{Files: []Entry{{Path: ".", Root: root, Size: 1}}}},
+		{"empty path", Manifest{Files: []Entry{{Path: "", Root: root, Size: 1}}}},
+		{"duplicate", Manifest{Files: []Entry{{Path: "a", Root: root, Size: 1}, {Path: "a", Root: root, Size: 1}}}},
+		{"file and dir", Manifest{Files: []Entry{{Path: "a", Root: root, Size: 1}}, Dirs: []string{"a"}}},
+		{"parent dir", Manifest{Dirs: []string{".."}}},
+		{"absolute dir", Manifest{Dirs: []string{"/tmp"}}},
+		{"negative size", Manifest{Files: []Entry{{Path: "a", Root: root, Size: -1}}}},
+		{"special mode", Manifest{Files: []Entry{{Path: "a", Root: root, Size: 1, Mode: fs.ModeSetuid | 0755}}}},
+		{"missing root", Manifest{Files: []Entry{{Path: "a", Size: 1}}}},
+		{"empty file with root", Manifest{Files: []Entry{{Path: "a", Root: root}}}},
+		{"invalid root", Manifest{Files: []Entry{{Path: "a", Root: "not hex", Size: 1}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.m.Marshal(); !errors.Is(err, ErrInvalidManifest) {
+				t.Fatalf("marshal: got %v, want ErrInvalidManifest", err)
+			}
+			// 绕过 Marshal 直接构造的清单在下载时同样被拒绝
+			test.m.Version = Version
+			data, err := json.Marshal(&test.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Parse(data); !errors.Is(err, ErrInvalidManifest) {
+				t.Fatalf("parse: got %v, want ErrInvalidManifest", err)
+			}
+		})
+	}
+
+	for _, data := range []string{`not json`, `{"version":2,"files":[]}`, `{"files":[]}`} {
+		if _, err := Parse([]byte(data)); !errors.Is(err, ErrInvalidManifest) {
+			t.Fatalf("parsed %s: %v", data, err)
+		}
+	}
+}
+
+func TestWalkAndRestore(t *testing.T) {
+	src := t.TempDir()
+	for _, dir := range []string{"sub/deep", "empty", "only-link"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"a.txt": "a", "sub/deep/b.txt": "b", "sub/empty.txt": ""}
+	for path, content := range files {
+		if err := os.WriteFile(filepath.Join(src, path), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(src, "a.txt"), filepath.Join(src, "only-link", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manifest{}
+	err := Walk(src, func(path, rel string, info fs.FileInfo) error {
+		if info.IsDir() {
+			m.Dirs = append(m.Dirs, rel)
+			return nil
+		}
+		if _, exists := files[rel]; !exists || path != filepath.Join(src, filepath.FromSlash(rel)) {
+			t.Fatalf("walked %s as %s", path, rel)
+		}
+		entry := Entry{Path: rel, Size: info.Size(), Mode: info.Mode().Perm()}
+		if entry.Size > 0 {
+			entry.Root = root
+		}
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"empty", "only-link", "sub", "sub/deep"}; !reflect.DeepEqual(m.Dirs, want) {
+		t.Fatalf("walked dirs %v, want %v", m.Dirs, want)
+	}
+	if len(m.Files) != len(files) {
+		t.Fatalf("walked %d files, want %d", len(m.Files), len(files))
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 恢复目录时空目录和只有符号链接的目录都被创建，文件的目录由 Target 创建
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := parsed.MakeDirs(dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range m.Dirs {
+		if info, err := os.Stat(filepath.Join(dst, dir)); err != nil || !info.IsDir() {
+			t.Fatalf("dir %s not restored: %v", dir, err)
+		}
+	}
+	for _, entry := range parsed.Files {
+		target, err := entry.Target(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(target, dst+string(filepath.Separator)) {
+			t.Fatalf("target %s outside %s", target, dst)
+		}
+		if _, err := os.Stat(filepath.Dir(target)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 没有任何文件的目录也能恢复
+	empty := t.TempDir()
+	m = &Manifest{}
+	if err := Walk(empty, func(path, rel string, info fs.FileInfo) error {
+		t.Fatalf("walked %s in an empty directory", rel)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = m.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err = Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	dst = filepath.Join(t.TempDir(), "empty")
+	if err := parsed.MakeDirs(dst); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dst); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not restored: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package norntest
+
+import (
+	"context"
+	"fmt"
+	"github.com/multiformats/go-multiaddr"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/db"
+	"main/manager"
+	"main/websocket"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Setup 启动一个假 norn 节点，并初始化 manager 中除 DHT 以外的全局对象：
+// 连接假节点的 gRPC 客户端、内存数据库、norn 后端和随机生成的变色龙密钥。
+// 后端的订阅和回填在 ctx 结束前一直运行。
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// 返回值:
+// - *Node: 假节点。
+// - error: 错误信息。
+func Setup(ctx context.Context) (*Node, error) {
+	node, err := setup()
+	if err != nil {
+		return nil, err
+	}
+	go manager.GetRegistry().Run(ctx)
+	return node, nil
+}
+
+// setup 与 Setup 相同，但不运行后端的订阅和回填，由调用者决定何时运行
+func setup() (*Node, error) {
+	node, err := Start()
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.InitGRPCClient(node.GRPCAddress); err != nil {
+		node.Close()
+		return nil, err
+	}
+	manager.DBManager, err = db.NewDBManager("")
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+
+	secKey, pubKey := chamMerkleTree.GenerateChameleonKeyPair()
+	if err := manager.InitParameters(secKey, pubKey.Serialize()); err != nil {
+		node.Close()
+		return nil, err
+	}
+
+	manager.InitRegistry(websocket.NewNornRegistry(node.WebSocketConfig(), 100*time.Millisecond))
+	return node, nil
+}
+
+// StartPeers 在本机启动 count 个 DHT 节点，其余节点以第一个节点为引导节点。
+// 第 i 个节点收到的数据块保存在 dir/<i> 目录中，第一个节点同时被设置为 manager 的 DHT 服务。
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - count: 节点数。
+// - dir: 保存数据块的目录。
+// 返回值:
+// - []*dht.DHTService: 启动的节点。
+// - error: 错误信息。
+func StartPeers(ctx context.Context, count int, dir string) ([]*dht.DHTService, error) {
+	var peers []*dht.DHTService
+	for i := 0; i < count; i++ {
+		config := dht.NewDHTConfig()
+		config.Port = 0
+		if i > 0 {
+			bootstrap, err := multiaddr.NewMultiaddr(dht.GetHostAddress(peers[0].Host))
+			if err != nil {
+				return peers, err
+			}
+			config.BootstrapPeers = append(config.BootstrapPeers, bootstrap)
+		}
+		service, err := dht.NewDHTService(ctx, config)
+		if err != nil {
+			return peers, fmt.Errorf("start peer %d: %v", i, err)
+		}
+
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return peers, err
+		}
+		service.AnnounceHandler(ctx)
+		service.LookupHandler(ctx)
+		service.SendFileHandler(ctx, path)
+		service.GetFileHandler(ctx, path)
+		peers = append(peers, service)
+	}
+	if len(peers) > 0 {
+		manager.DHTService = peers[0]
+	}
+	return peers, nil
+}
@@ -0,0 +1,387 @@
+// Package norntest 提供进程内的假 norn 节点和本地 DHT 节点，用于在没有真实链的情况下运行 send → 链上事件 → get 的端到端流程。
+//
+// 假节点实现了 pb.BlockchainServer 和 /subscribe websocket：每个 SendTransactionWithData 交易单独出一个区块，
+// 写入合约状态并推送给所有订阅者。Reorg 和 MineEmpty 用于模拟链重组和确认数。
+package norntest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"log"
+	"main/rpc/pb"
+	mws "main/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node 是进程内的假 norn 节点
+type Node struct {
+	pb.UnimplementedBlockchainServer
+
+	// GRPCAddress 是 gRPC 服务的地址，可直接传给 rpc.NewClient
+	GRPCAddress string
+	// WebSocketURL 是订阅地址
+	WebSocketURL string
+
+	lock        sync.Mutex
+	blocks      []*pb.Block
+	state       map[string]map[string]string // 接收地址 -> key -> value
+	subscribers map[*websocket.Conn]bool
+	refuse      bool   // 拒绝新的订阅连接
+	salt        uint64 // 区分重组前后相同高度的区块
+
+	grpcServer *grpc.Server
+	httpServer *httptest.Server
+}
+
+// Start 启动假 norn 节点，链上只有创世区块
+// 返回值:
+// - *Node: 假节点，使用完后调用 Close。
+// - error: 监听端口失败时返回错误信息。
+func Start() (*Node, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		GRPCAddress: listener.Addr().String(),
+		state:       make(map[string]map[string]string),
+		subscribers: make(map[*websocket.Conn]bool),
+	}
+	n.mine(nil)
+
+	n.grpcServer = grpc.NewServer()
+	pb.RegisterBlockchainServer(n.grpcServer, n)
+	go n.grpcServer.Serve(listener)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", n.handleSubscribe)
+	n.httpServer = httptest.NewServer(mux)
+	n.WebSocketURL = "ws" + strings.TrimPrefix(n.httpServer.URL, "http") + "/subscribe"
+	return n, nil
+}
+
+// Close 关闭 gRPC 服务和所有订阅连接
+func (n *Node) Close() {
+	n.DisconnectSubscribers()
+	n.grpcServer.Stop()
+	n.httpServer.Close()
+}
+
+// WebSocketConfig 返回订阅假节点的配置，重连间隔较短
+func (n *Node) WebSocketConfig() *mws.Config {
+	return &mws.Config{
+		URL:               n.WebSocketURL,
+		MinBackoff:        50 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		HeartbeatInterval: time.Second,
+	}
+}
+
+// Height 返回最新的区块高度
+func (n *Node) Height() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return uint64(len(n.blocks) - 1)
+}
+
+// MineEmpty 出 count 个空区块，用于增加确认数
+func (n *Node) MineEmpty(count int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i := 0; i < count; i++ {
+		n.mine(nil)
+	}
+}
+
+// Reorg 丢弃最新的 depth 个区块及其中的交易，再出 depth+1 个空区块作为新的主链
+func (n *Node) Reorg(depth int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if depth > len(n.blocks)-1 {
+		depth = len(n.blocks) - 1
+	}
+	n.blocks = n.blocks[:len(n.blocks)-depth]
+
+	// 按剩下的区块重放合约状态
+	n.state = make(map[string]map[string]string)
+	for _, block := range n.blocks {
+		for _, tx := range block.GetTransactions() {
+			n.apply(tx)
+		}
+	}
+	n.salt++
+	for i := 0; i <= depth; i++ {
+		n.mine(nil)
+	}
+}
+
+// DisconnectSubscribers 断开所有订阅连接，用于模拟 websocket 中断
+func (n *Node) DisconnectSubscribers() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for conn := range n.subscribers {
+		conn.Close()
+		delete(n.subscribers, conn)
+	}
+}
+
+// RefuseSubscribers 设置是否拒绝新的订阅连接，用于模拟 websocket 服务不可用，已有的连接不受影响
+func (n *Node) RefuseSubscribers(refuse bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.refuse = refuse
+}
+
+// txData 是交易数据的格式，与 SendTransactionWithData 的参数对应
+type txData struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// mine 把交易打包成一个新区块，调用者需要持有锁
+func (n *Node) mine(txs []*pb.Transaction) *pb.Block {
+	height := uint64(len(n.blocks))
+	prevHash := ""
+	if height > 0 {
+		prevHash = n.blocks[height-1].GetHeader().GetBlockHash()
+	}
+
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	binary.Write(h, binary.BigEndian, height)
+	binary.Write(h, binary.BigEndian, n.salt)
+	for _, tx := range txs {
+		h.Write([]byte(tx.GetHash()))
+	}
+	blockHash := hex.EncodeToString(h.Sum(nil))
+	timestamp := uint64(time.Now().UnixMilli())
+
+	block := &pb.Block{
+		Header: &pb.BlockHeader{
+			Timestamp:     &timestamp,
+			PrevBlockHash: &prevHash,
+			BlockHash:     &blockHash,
+			Height:        &height,
+		},
+		Transactions: txs,
+	}
+	n.blocks = append(n.blocks, block)
+	for _, tx := range txs {
+		n.apply(tx)
+	}
+	return block
+}
+
+// apply 把交易写入合约状态，调用者需要持有锁
+func (n *Node) apply(tx *pb.Transaction) {
+	var data txData
+	if err := json.Unmarshal([]byte(tx.GetData()), &data); err != nil || data.Type != "set" {
+		return
+	}
+	receiver := tx.GetReceiver()
+	if n.state[receiver] == nil {
+		n.state[receiver] = make(map[string]string)
+	}
+	n.state[receiver][data.Key] = data.Value
+}
+
+// publish 把交易事件推送给所有订阅者，调用者需要持有锁
+func (n *Node) publish(tx *pb.Transaction, height uint64, data *txData) {
+	event := mws.Data{
+		Type:    data.Type,
+		Hash:    tx.GetHash(),
+		Height:  strconv.FormatUint(height, 10),
+		Address: tx.GetReceiver(),
+		Params:  mws.Params{Key: data.Key, Value: data.Value},
+	}
+	message, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for conn := range n.subscribers {
+		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			conn.Close()
+			delete(n.subscribers, conn)
+		}
+	}
+}
+
+func (n *Node) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	n.lock.Lock()
+	refuse := n.refuse
+	n.lock.Unlock()
+	if refuse {
+		http.Error(w, "subscription unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error upgrading subscription: ", err)
+		return
+	}
+
+	// 订阅消息和心跳都不需要应答，收到第一条消息后开始推送
+	if _, _, err := conn.ReadMessage(); err != nil {
+		conn.Close()
+		return
+	}
+	n.lock.Lock()
+	n.subscribers[conn] = true
+	n.lock.Unlock()
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	n.lock.Lock()
+	delete(n.subscribers, conn)
+	n.lock.Unlock()
+	conn.Close()
+}
+
+// block 返回指定高度的区块，调用者需要持有锁
+func (n *Node) block(height uint64) (*pb.Block, error) {
+	if height >= uint64(len(n.blocks)) {
+		return nil, status.Errorf(codes.NotFound, "block %d not found", height)
+	}
+	return n.blocks[height], nil
+}
+
+func blockResp(block *pb.Block, full bool) *pb.GetBlockResp {
+	body := block
+	if !full {
+		body = &pb.Block{Header: block.GetHeader()}
+	}
+	return &pb.GetBlockResp{Timestamp: block.GetHeader().Timestamp, Body: body}
+}
+
+func txResp(tx *pb.Transaction) *pb.GetTransactionResp {
+	timestamp := uint64(time.Now().UnixMilli())
+	return &pb.GetTransactionResp{Timestamp: &timestamp, Body: tx}
+}
+
+func (n *Node) GetBlockNumber(ctx context.Context, _ *emptypb.Empty) (*pb.BlockNumberResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	number := uint64(len(n.blocks) - 1)
+	timestamp := uint64(time.Now().UnixMilli())
+	return &pb.BlockNumberResp{Timestamp: &timestamp, Number: &number}, nil
+}
+
+func (n *Node) GetBlockByHash(ctx context.Context, req *pb.GetBlockReq) (*pb.GetBlockResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, block := range n.blocks {
+		if block.GetHeader().GetBlockHash() == req.GetHash() {
+			return blockResp(block, req.GetFull()), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "block %s not found", req.GetHash())
+}
+
+func (n *Node) GetBlockByNumber(ctx context.Context, req *pb.GetBlockReq) (*pb.GetBlockResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	block, err := n.block(req.GetNumber())
+	if err != nil {
+		return nil, err
+	}
+	return blockResp(block, req.GetFull()), nil
+}
+
+func (n *Node) GetTransactionByHash(ctx context.Context, req *pb.GetTransactionReq) (*pb.GetTransactionResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, block := range n.blocks {
+		for _, tx := range block.GetTransactions() {
+			if tx.GetHash() == req.GetHash() {
+				return txResp(tx), nil
+			}
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "transaction %s not found", req.GetHash())
+}
+
+func (n *Node) GetTransactionByBlockHashAndIndex(ctx context.Context, req *pb.GetTransactionReq) (*pb.GetTransactionResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, block := range n.blocks {
+		if block.GetHeader().GetBlockHash() != req.GetBlockHash() {
+			continue
+		}
+		if req.GetIndex() >= uint64(len(block.GetTransactions())) {
+			break
+		}
+		return txResp(block.GetTransactions()[req.GetIndex()]), nil
+	}
+	return nil, status.Errorf(codes.NotFound, "transaction %d of block %s not found", req.GetIndex(), req.GetBlockHash())
+}
+
+func (n *Node) GetTransactionByBlockNumberAndIndex(ctx context.Context, req *pb.GetTransactionReq) (*pb.GetTransactionResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	block, err := n.block(req.GetBlockNumber())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetIndex() >= uint64(len(block.GetTransactions())) {
+		return nil, status.Errorf(codes.NotFound, "transaction %d of block %d not found", req.GetIndex(), req.GetBlockNumber())
+	}
+	return txResp(block.GetTransactions()[req.GetIndex()]), nil
+}
+
+func (n *Node) ReadContractAddress(ctx context.Context, req *pb.ReadContractAddressReq) (*pb.ReadContractAddressResp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	value, ok := n.state[req.GetAddress()][req.GetKey()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s/%s not found", req.GetAddress(), req.GetKey())
+	}
+	encoded := hex.EncodeToString([]byte(value))
+	return &pb.ReadContractAddressResp{Hex: &encoded}, nil
+}
+
+// SendTransactionWithData 把交易单独打包成一个区块，并推送给订阅者
+func (n *Node) SendTransactionWithData(ctx context.Context, req *pb.SendTransactionWithDataReq) (*pb.SendTransactionWithDataResp, error) {
+	data := &txData{Type: req.GetType(), Key: req.GetKey(), Value: req.GetValue()}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	sum := sha256.Sum256(append(encoded, fmt.Sprintf("%d/%d", len(n.blocks), n.salt)...))
+	hash := hex.EncodeToString(sum[:])
+	receiver := req.GetReceiver()
+	dataString := string(encoded)
+	tx := &pb.Transaction{
+		Hash:     &hash,
+		Receiver: &receiver,
+		Opt:      req.Type,
+		Data:     &dataString,
+	}
+	block := n.mine([]*pb.Transaction{tx})
+	n.publish(tx, block.GetHeader().GetHeight(), data)
+	return &pb.SendTransactionWithDataResp{TxHash: &hash}, nil
+}
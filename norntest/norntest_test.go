@@ -0,0 +1,304 @@
+package norntest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	_ "main/cmd"
+	"main/manager"
+	"main/resolver"
+	"main/run"
+	"main/websocket"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mirrorTimeout 是等待链上事件镜像到本地数据库的最长时间
+const mirrorTimeout = 10 * time.Second
+
+// cluster 启动假 norn 节点和 count 个 DHT 节点，测试结束时全部关闭
+func cluster(t *testing.T, count int) (context.Context, *Node) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	node, err := Setup(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	peers, err := StartPeers(ctx, count, t.TempDir())
+	t.Cleanup(func() {
+		for _, p := range peers {
+			p.Close()
+		}
+		cancel()
+		node.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, node
+}
+
+// mirrored 在每次有新的 metadata 镜像到本地时收到它的根哈希
+func mirrored() <-chan string {
+	ch := make(chan string, 16)
+	manager.GetRegistry().Subscribe(func(metaData *dht.MetaData) {
+		ch <- hex.EncodeToString(metaData.RootHash)
+	})
+	return ch
+}
+
+// waitMirror 等待下一个镜像到本地的 metadata
+func waitMirror(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case rootHash := <-ch:
+		return rootHash
+	case <-time.After(mirrorTimeout):
+		t.Fatal("metadata was not mirrored")
+		return ""
+	}
+}
+
+// waitFor 在 mirrorTimeout 内反复检查 cond，直到它返回 true
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(mirrorTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sendFile 写入一个随机内容的文件并用 send 命令按 64KB 的数据块发送，返回文件内容
+func sendFile(t *testing.T, ctx context.Context, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Execute(ctx, fmt.Sprintf("send -f %s -n 2 -challenges 1 -bs 65536", path)); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// getFile 用 get 命令下载根哈希为 rootHash 的文件
+func getFile(ctx context.Context, dir, rootHash string) ([]byte, error) {
+	if err := run.Execute(ctx, fmt.Sprintf("get -f %s -path %s", rootHash, dir)); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, rootHash))
+}
+
+func TestSendMirrorGet(t *testing.T) {
+	ctx, node := cluster(t, 4)
+	ch := mirrored()
+
+	data := sendFile(t, ctx, 300*1024)
+	rootHash := waitMirror(t, ch)
+
+	confirmed, err := manager.GetRegistry().IsConfirmed(ctx, rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed {
+		t.Fatal("metadata confirmed without enough blocks")
+	}
+	node.MineEmpty(int(websocket.Confirmations))
+	waitFor(t, "confirmations", func() bool {
+		confirmed, err := manager.GetRegistry().IsConfirmed(ctx, rootHash)
+		return err == nil && confirmed
+	})
+
+	got, err := getFile(ctx, t.TempDir(), rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the sent one")
+	}
+}
+
+func TestReorgRollsBackMirror(t *testing.T) {
+	ctx, node := cluster(t, 3)
+	ch := mirrored()
+
+	data := sendFile(t, ctx, 100*1024)
+	rootHash := waitMirror(t, ch)
+	metaData, err := resolver.Resolve(ctx, rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 等回填记录下区块哈希，之后的重组才能被检测到
+	node.MineEmpty(int(websocket.Confirmations))
+	waitFor(t, "confirmations", func() bool {
+		confirmed, err := manager.GetRegistry().IsConfirmed(ctx, rootHash)
+		return err == nil && confirmed
+	})
+
+	// 发布 metadata 的区块被重组掉，镜像和链上状态中都不再有这个文件
+	node.Reorg(int(websocket.Confirmations) + 1)
+	waitFor(t, "rollback", func() bool {
+		var stored dht.MetaData
+		return manager.GetDBManager().LoadFromMemory(rootHash, &stored) != nil
+	})
+	if _, err := getFile(ctx, t.TempDir(), rootHash); err == nil {
+		t.Fatal("got a file whose metadata was orphaned")
+	}
+
+	// 所有者的绑定也被撤销，同一个 metadata 可以重新发布
+	if err := manager.GetRegistry().Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitMirror(t, ch); got != rootHash {
+		t.Fatalf("mirrored %s, want %s", got, rootHash)
+	}
+	got, err := getFile(ctx, t.TempDir(), rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the sent one")
+	}
+}
+
+// publishFile 为随机内容的文件构建默克尔树，签名后把 metadata 发布到链上，不发送数据块
+func publishFile(t *testing.T, ctx context.Context) *dht.MetaData {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data := make([]byte, 10*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	parameters := manager.GetParameters()
+	config := chamMerkleTree.NewMerkleConfig()
+	root, _, _, err := chamMerkleTree.BuildMerkleTree(file, config, parameters.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaData := chamMerkleTree.NewMetaData(root, parameters.PubKey, config.ChunkerParams())
+	if err := chamMerkleTree.SignMetaData(metaData, parameters.SecKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.GetRegistry().Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+	return metaData
+}
+
+// 实时订阅收到的交易所在的区块在回填处理到它之前就被重组掉时，没有区块哈希可以比较，
+// 回填处理同一高度的新区块时必须撤销这个交易
+func TestReorgBeforeBackfill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	node, err := setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	ch := mirrored()
+	go websocket.RunWebSocket(ctx, node.WebSocketConfig())
+	if _, err := websocket.CatchUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscription", func() bool {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		return len(node.subscribers) > 0
+	})
+
+	metaData := publishFile(t, ctx)
+	rootHash := waitMirror(t, ch)
+	if rootHash != hex.EncodeToString(metaData.RootHash) {
+		t.Fatalf("mirrored %s, want %x", rootHash, metaData.RootHash)
+	}
+
+	node.Reorg(1)
+	if _, err := websocket.CatchUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var stored dht.MetaData
+	if err := manager.GetDBManager().LoadFromMemory(rootHash, &stored); err == nil {
+		t.Fatal("metadata from an orphaned block is still mirrored")
+	}
+}
+
+// websocket 连接失败时退避间隔逐次加倍直到上限，成功建立连接之后再中断时从最小间隔重新开始
+func TestWebSocketBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	node, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	config := node.WebSocketConfig()
+	config.MinBackoff = 100 * time.Millisecond
+	config.MaxBackoff = 400 * time.Millisecond
+	node.RefuseSubscribers(true)
+	start := websocket.GetStats()
+	done := make(chan struct{})
+	go func() {
+		websocket.RunWebSocket(ctx, config)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// 记录每次变化后的退避间隔，间隔至少是最小间隔的一半，轮询不会错过
+	var seen []time.Duration
+	waitFor(t, "backoff to reach its cap", func() bool {
+		stats := websocket.GetStats()
+		if stats.Failures > start.Failures && (len(seen) == 0 || seen[len(seen)-1] != stats.Backoff) {
+			seen = append(seen, stats.Backoff)
+		}
+		return stats.Failures >= start.Failures+5
+	})
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Fatalf("backoff went %v, want %v", seen, want)
+	}
+	if stats := websocket.GetStats(); stats.Connects != start.Connects || stats.Connected {
+		t.Fatal("connected while subscriptions were refused")
+	}
+
+	node.RefuseSubscribers(false)
+	waitFor(t, "subscription", func() bool {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		return len(node.subscribers) > 0
+	})
+	failures := websocket.GetStats().Failures
+	node.DisconnectSubscribers()
+	waitFor(t, "disconnect", func() bool { return websocket.GetStats().Failures > failures })
+	if stats := websocket.GetStats(); stats.Backoff != config.MinBackoff {
+		t.Fatalf("backoff after a successful connect is %s, want %s", stats.Backoff, config.MinBackoff)
+	}
+	waitFor(t, "reconnect", func() bool { return websocket.GetStats().Connected })
+}
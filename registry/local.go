@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	dht "main/DHT"
+	"main/db"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalRegistry 把每个 metadata 保存为目录中的一个 JSON 文件: <path>/<rootHash>.json，
+// 附加记录保存在 <path>/records/<rootHash>/ 中，文件名为转义后的键。
+// 同一台机器上的多个节点可以共用一个目录，每个节点定期扫描目录把其他节点发布的 metadata 镜像到本地数据库。
+// 写入文件即视为最终确认。
+type LocalRegistry struct {
+	path      string
+	interval  time.Duration
+	dbManager *db.DBManager
+	handlers  Handlers
+
+	// modTimes 记录已经镜像过或拒绝过的文件的修改时间
+	lock     sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// NewLocalRegistry 创建一个本地目录保存的 metadata 后端
+// 参数:
+// - path: 保存 metadata 的目录，不存在时创建。
+// - dbManager: 镜像 metadata 的本地数据库。
+// - interval: 扫描目录的间隔。
+// 返回值:
+// - *LocalRegistry: 本地后端。
+// - error: 创建目录失败时返回错误信息。
+func NewLocalRegistry(path string, dbManager *db.DBManager, interval time.Duration) (*LocalRegistry, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalRegistry{
+		path:      path,
+		interval:  interval,
+		dbManager: dbManager,
+		modTimes:  make(map[string]time.Time),
+	}, nil
+}
+
+func (r *LocalRegistry) file(rootHash string) string {
+	return filepath.Join(r.path, rootHash+".json")
+}
+
+// Publish 将 metadata 写入目录
+func (r *LocalRegistry) Publish(ctx context.Context, metaData *dht.MetaData) error {
+	data, err := json.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+	rootHash := hex.EncodeToString(metaData.RootHash)
+	if err := writeFile(r.file(rootHash), data); err != nil {
+		return err
+	}
+	// 本节点发布的文件不需要再被扫描一次
+	if info, err := os.Stat(r.file(rootHash)); err == nil {
+		r.seen(rootHash, info.ModTime())
+	}
+	r.handlers.Notify(metaData)
+	return nil
+}
+
+// writeFile 先写临时文件再重命名，扫描的节点不会读到写了一半的文件
+func writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Resolve 从目录中读取 metadata
+func (r *LocalRegistry) Resolve(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	data, err := os.ReadFile(r.file(rootHash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", rootHash, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metaData dht.MetaData
+	if err := json.Unmarshal(data, &metaData); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %v", rootHash, err)
+	}
+	return &metaData, nil
+}
+
+// IsConfirmed 目录中存在的 metadata 都是最终确认的
+func (r *LocalRegistry) IsConfirmed(ctx context.Context, rootHash string) (bool, error) {
+	_, err := os.Stat(r.file(rootHash))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Subscribe 注册回调，本节点发布和扫描到的 metadata 都会触发回调
+func (r *LocalRegistry) Subscribe(handler Handler) {
+	r.handlers.Add(handler)
+}
+
+// record 返回记录的文件名，根哈希必须是16进制字符串，键转义后不能是 "." 或 ".."
+func (r *LocalRegistry) record(rootHash, key string) (string, error) {
+	name := url.PathEscape(key)
+	if _, err := hex.DecodeString(rootHash); err != nil || rootHash == "" || name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid record %s of %s", key, rootHash)
+	}
+	return filepath.Join(r.path, "records", rootHash, name), nil
+}
+
+// PutRecord 将记录写入 records 目录中根哈希对应的子目录
+func (r *LocalRegistry) PutRecord(ctx context.Context, rootHash, key string, value []byte) error {
+	name, err := r.record(rootHash, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFile(name, value)
+}
+
+// GetRecord 读取 PutRecord 写入的记录
+func (r *LocalRegistry) GetRecord(ctx context.Context, rootHash, key string) ([]byte, error) {
+	name, err := r.record(rootHash, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("record %s of %s: %w", key, rootHash, ErrNotFound)
+	}
+	return data, err
+}
+
+// Height 本地后端没有区块，高度总是0
+func (r *LocalRegistry) Height(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+// Run 每隔 interval 扫描一次目录，直到 ctx 结束
+func (r *LocalRegistry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.scan(ctx); err != nil {
+			log.Println("Error scanning registry: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan 把新增或修改过的 metadata 文件镜像到本地数据库
+func (r *LocalRegistry) scan(ctx context.Context) error {
+	entries, err := os.ReadDir(r.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		rootHash, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		r.lock.Lock()
+		modTime, ok := r.modTimes[rootHash]
+		r.lock.Unlock()
+		if ok && modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		metaData, err := r.Resolve(ctx, rootHash)
+		if err == nil {
+			err = CheckOwner(r.dbManager, metaData)
+		}
+		if err != nil {
+			// 同一个版本的文件每次检查都会被拒绝，文件修改之后再重新检查
+			log.Printf("Skip metadata %s: %v", rootHash, err)
+			r.seen(rootHash, info.ModTime())
+			continue
+		}
+		if err := r.dbManager.SaveToMemory(rootHash, metaData); err != nil {
+			return err
+		}
+		r.seen(rootHash, info.ModTime())
+		r.handlers.Notify(metaData)
+	}
+	return nil
+}
+
+// seen 记录已经处理过的文件的修改时间
+func (r *LocalRegistry) seen(rootHash string, modTime time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.modTimes[rootHash] = modTime
+}
+
+// Close 本地后端没有需要释放的连接
+func (r *LocalRegistry) Close() error {
+	return nil
+}
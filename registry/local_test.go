@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLocal 在临时目录中创建本地后端，使用内存数据库
+func newLocal(t *testing.T, path string) *LocalRegistry {
+	t.Helper()
+	dbManager, err := db.NewDBManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewLocalRegistry(path, dbManager, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLocalRegistryRecords(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := newLocal(t, dir)
+	const rootHash = "00ff"
+	if _, err := r.GetRecord(ctx, rootHash, "challenge/peer"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	// 键中的 "/" 不会变成子目录，历史记录和最新记录互不覆盖
+	records := map[string]string{
+		"challenge/peer":   "latest",
+		"challenge/peer/1": "first",
+		"../escape":        "escaped",
+	}
+	for key, value := range records {
+		if err := r.PutRecord(ctx, rootHash, key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 共用目录的其他节点读到相同的记录
+	other := newLocal(t, dir)
+	for key, value := range records {
+		got, err := other.GetRecord(ctx, rootHash, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			t.Fatalf("record %s is %q, want %q", key, got, value)
+		}
+	}
+	if err := r.PutRecord(ctx, rootHash, "challenge/peer", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := other.GetRecord(ctx, rootHash, "challenge/peer"); string(got) != "newer" {
+		t.Fatalf("record was not replaced: %q", got)
+	}
+	if _, err := r.GetRecord(ctx, "0011", "challenge/peer"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	for _, key := range []string{"", ".", ".."} {
+		if err := r.PutRecord(ctx, rootHash, key, []byte("value")); err == nil {
+			t.Fatalf("record %q written", key)
+		}
+	}
+	if err := r.PutRecord(ctx, "../root", "key", []byte("value")); err == nil {
+		t.Fatal("record written outside the records directory")
+	}
+	if height, err := r.Height(ctx); err != nil || height != 0 {
+		t.Fatalf("got height %d, %v", height, err)
+	}
+}
+
+// signedMetaData 为随机内容的文件构建默克尔树，返回用新生成的密钥签名的 metadata 和公钥
+func signedMetaData(t *testing.T) (*dht.MetaData, *chamMerkleTree.ChameleomPubKey) {
+	t.Helper()
+	secKey, pubKey, err := chamMerkleTree.GenerateKeyPair(chamMerkleTree.SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config := chamMerkleTree.NewMerkleConfig()
+	config.BlockSize = 1024
+	root, _, _, err := chamMerkleTree.BuildMerkleTree(file, config, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaData := chamMerkleTree.NewMetaData(root, pubKey, config.ChunkerParams())
+	if err := chamMerkleTree.SignMetaData(metaData, secKey); err != nil {
+		t.Fatal(err)
+	}
+	return metaData, pubKey
+}
+
+// notified 返回订阅回调收到的根哈希
+func notified(r *LocalRegistry) *[]string {
+	var got []string
+	r.Subscribe(func(metaData *dht.MetaData) {
+		got = append(got, hex.EncodeToString(metaData.RootHash))
+	})
+	return &got
+}
+
+// touch 修改文件的修改时间，模拟文件被重新写入
+func touch(t *testing.T, name string, offset time.Duration) {
+	t.Helper()
+	modTime := time.Now().Add(offset)
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalRegistryPublishResolve(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	publisher, reader := newLocal(t, dir), newLocal(t, dir)
+	published, read := notified(publisher), notified(reader)
+
+	metaData, _ := signedMetaData(t)
+	rootHash := hex.EncodeToString(metaData.RootHash)
+	if _, err := publisher.Resolve(ctx, rootHash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if confirmed, err := publisher.IsConfirmed(ctx, rootHash); err != nil || confirmed {
+		t.Fatalf("unpublished metadata confirmed: %v, %v", confirmed, err)
+	}
+	if err := publisher.Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 1 || (*published)[0] != rootHash {
+		t.Fatalf("publisher notified %v", *published)
+	}
+
+	got, err := reader.Resolve(ctx, rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RootHash, metaData.RootHash) || !bytes.Equal(got.Signature, metaData.Signature) || len(got.Leaves) != len(metaData.Leaves) {
+		t.Fatal("resolved metadata differs from the published one")
+	}
+	if confirmed, err := reader.IsConfirmed(ctx, rootHash); err != nil || !confirmed {
+		t.Fatalf("published metadata not confirmed: %v, %v", confirmed, err)
+	}
+
+	// 共用目录的节点扫描后镜像到自己的数据库，发布者自己不会再镜像一次
+	for _, r := range []*LocalRegistry{publisher, reader} {
+		if err := r.scan(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stored dht.MetaData
+	if err := reader.dbManager.LoadFromMemory(rootHash, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 1 || len(*read) != 1 || (*read)[0] != rootHash {
+		t.Fatalf("notified publisher %v, reader %v", *published, *read)
+	}
+}
+
+func TestLocalRegistryRescan(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	publisher, reader := newLocal(t, dir), newLocal(t, dir)
+	read := notified(reader)
+
+	metaData, _ := signedMetaData(t)
+	if err := publisher.Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := reader.scan(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*read) != 1 {
+		t.Fatalf("unchanged file mirrored %d times", len(*read))
+	}
+
+	// 文件被重新写入后再镜像一次
+	touch(t, publisher.file(hex.EncodeToString(metaData.RootHash)), time.Minute)
+	if err := reader.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(*read) != 2 {
+		t.Fatalf("changed file mirrored %d times, want 2", len(*read))
+	}
+}
+
+func TestLocalRegistryRejectsOtherOwner(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	publisher, reader := newLocal(t, dir), newLocal(t, dir)
+	read := notified(reader)
+
+	metaData, _ := signedMetaData(t)
+	rootHash := hex.EncodeToString(metaData.RootHash)
+	// reader 已经把这个根哈希绑定给了另一个公钥
+	other, _ := signedMetaData(t)
+	other.RootHash = metaData.RootHash
+	if err := reader.dbManager.SaveToMemory(ownerPrefix+rootHash, hex.EncodeToString(other.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckOwner(reader.dbManager, metaData); !errors.Is(err, ErrOwnerMismatch) {
+		t.Fatalf("got %v, want ErrOwnerMismatch", err)
+	}
+	if err := publisher.Publish(ctx, metaData); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	for i := 0; i < 3; i++ {
+		if err := reader.scan(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stored dht.MetaData
+	if err := reader.dbManager.LoadFromMemory(rootHash, &stored); err == nil || len(*read) != 0 {
+		t.Fatal("metadata of another owner was mirrored")
+	}
+	// 被拒绝的文件没有修改时不再检查
+	if n := strings.Count(logs.String(), "Skip metadata"); n != 1 {
+		t.Fatalf("rejected file checked %d times, want 1", n)
+	}
+
+	// 绑定撤销并且文件被重新写入后，重新检查并镜像
+	if err := UnbindOwner(reader.dbManager, rootHash); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, publisher.file(rootHash), time.Minute)
+	if err := reader.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(*read) != 1 {
+		t.Fatalf("rewritten file mirrored %d times, want 1", len(*read))
+	}
+}
@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/db"
+	"strings"
+	"sync"
+)
+
+// ownerPrefix 是根哈希绑定的所有者公钥在数据库中的键前缀: owner/<rootHash>
+const ownerPrefix = "owner/"
+
+// ErrOwnerMismatch 表示 metadata 的公钥与根哈希第一次发布时绑定的所有者不同
+var ErrOwnerMismatch = errors.New("metadata owner mismatch")
+
+// AllowUnsigned 为 true 时接受没有签名的 metadata，用于兼容旧版本发布的文件，所有者绑定仍然生效
+var AllowUnsigned = false
+
+var ownerLock sync.Mutex
+
+// CheckOwner 验证 metadata 的签名和默克尔树，并检查签名公钥与根哈希绑定的所有者一致。
+// 第一次见到一个根哈希时，把 metadata 中的公钥绑定为它的所有者，之后其他公钥发布的更新都会被拒绝。
+// 绑定之前必须先验证 metadata，否则一个无法打开根哈希的 metadata 就可以抢先占用这个根哈希。
+// 参数:
+// - dbManager: 保存所有者绑定的数据库。
+// - metaData: 要检查的 metadata。
+// 返回值:
+// - error: 签名无效时返回 chamMerkleTree.ErrInvalidSignature 或 chamMerkleTree.ErrUnsigned，
+// 默克尔树无法重建或随机数不能打开根哈希时返回对应的错误，所有者不同时返回 ErrOwnerMismatch。
+func CheckOwner(dbManager *db.DBManager, metaData *dht.MetaData) error {
+	err := chamMerkleTree.VerifyMetaDataSignature(metaData)
+	if err != nil && !(AllowUnsigned && errors.Is(err, chamMerkleTree.ErrUnsigned)) {
+		return fmt.Errorf("metadata %x: %w", metaData.RootHash, err)
+	}
+	if _, _, _, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData); err != nil {
+		return fmt.Errorf("metadata %x: %w", metaData.RootHash, err)
+	}
+
+	// 同一个公钥可能使用旧编码或新编码，按解码后的公钥比较
+	pubKey, err := chamMerkleTree.ParseChameleomPubKey(metaData.Scheme, metaData.PublicKey)
+	if err != nil {
+		return fmt.Errorf("metadata %x: %w", metaData.RootHash, err)
+	}
+
+	ownerLock.Lock()
+	defer ownerLock.Unlock()
+
+	key := ownerPrefix + hex.EncodeToString(metaData.RootHash)
+	var owner string
+	if err := dbManager.LoadFromMemory(key, &owner); err != nil {
+		return dbManager.SaveToMemory(key, formatOwner(pubKey))
+	}
+	expected, err := parseOwner(owner)
+	if err != nil {
+		return err
+	}
+	if !expected.Equal(pubKey) {
+		return fmt.Errorf("metadata %x: %w", metaData.RootHash, ErrOwnerMismatch)
+	}
+	return nil
+}
+
+// UnbindOwner 删除根哈希绑定的所有者，链重组使第一次发布这个根哈希的交易失效时调用
+func UnbindOwner(dbManager *db.DBManager, rootHash string) error {
+	ownerLock.Lock()
+	defer ownerLock.Unlock()
+	return dbManager.DeleteFromMemory(ownerPrefix + rootHash)
+}
+
+// formatOwner 将所有者公钥编码为字符串，p256 公钥只保存16进制编码以兼容旧的记录，其他方案为 <方案>:<16进制编码>
+func formatOwner(pubKey *chamMerkleTree.ChameleomPubKey) string {
+	if pubKey.Scheme() == chamMerkleTree.SchemeP256 {
+		return hex.EncodeToString(pubKey.Serialize())
+	}
+	return pubKey.Scheme() + ":" + hex.EncodeToString(pubKey.Serialize())
+}
+
+// parseOwner 解码 formatOwner 保存的所有者公钥
+func parseOwner(owner string) (*chamMerkleTree.ChameleomPubKey, error) {
+	scheme := chamMerkleTree.SchemeP256
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		scheme, owner = owner[:i], owner[i+1:]
+	}
+	ownerBytes, err := hex.DecodeString(owner)
+	if err != nil {
+		return nil, err
+	}
+	return chamMerkleTree.ParseChameleomPubKey(scheme, ownerBytes)
+}
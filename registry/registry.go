@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	dht "main/DHT"
+	"sync"
+	"time"
+)
+
+const (
+	// NornType 使用 norn 链保存 metadata，通过 gRPC 发布和读取，通过 websocket 订阅
+	NornType = "norn"
+	// LocalType 使用本地目录保存 metadata，适用于单节点和测试环境
+	LocalType = "local"
+
+	// MetadataKey 是链上保存文件 metadata 的键，交易的接收地址为文件根哈希的16进制字符串
+	MetadataKey = "metadata"
+)
+
+var (
+	// ErrNotFound 表示后端中没有根哈希对应的 metadata 或记录
+	ErrNotFound = errors.New("metadata not found")
+	// ErrUnconfirmed 表示 metadata 还没有达到确认数
+	ErrUnconfirmed = errors.New("metadata not confirmed")
+)
+
+// Handler 在收到新的 metadata 时被调用
+type Handler func(metaData *dht.MetaData)
+
+// MetadataRegistry 是保存文件 metadata 的后端，负责发布、读取和订阅 metadata。
+// 收到的 metadata 由实现镜像到本地数据库中，本地数据库的键为根哈希的16进制字符串。
+type MetadataRegistry interface {
+	// Publish 发布一个文件的 metadata
+	Publish(ctx context.Context, metaData *dht.MetaData) error
+	// Resolve 从后端读取根哈希对应的 metadata，不存在时返回 ErrNotFound
+	Resolve(ctx context.Context, rootHash string) (*dht.MetaData, error)
+	// IsConfirmed 判断本地镜像的 metadata 是否已经最终确认
+	IsConfirmed(ctx context.Context, rootHash string) (bool, error)
+	// Subscribe 注册收到新的 metadata 时的回调
+	Subscribe(handler Handler)
+	// PutRecord 在根哈希下保存一条附加记录，例如存储证明挑战的结果，key 可以包含 "/"
+	PutRecord(ctx context.Context, rootHash, key string, value []byte) error
+	// GetRecord 读取 PutRecord 保存的记录，不存在时返回 ErrNotFound
+	GetRecord(ctx context.Context, rootHash, key string) ([]byte, error)
+	// Height 返回后端当前的区块高度，没有区块的后端返回0
+	Height(ctx context.Context) (uint64, error)
+	// Run 将后端的 metadata 镜像到本地数据库，直到 ctx 结束
+	Run(ctx context.Context)
+	// Close 释放后端的连接
+	Close() error
+}
+
+// Config 是配置文件中的 Registry 部分
+type Config struct {
+	Type         string        `yaml:"Type"`
+	GRPC         string        `yaml:"GRPC"`         // norn 的 gRPC 地址
+	SyncInterval time.Duration `yaml:"SyncInterval"` // norn 回填区块的间隔，或本地目录的扫描间隔
+	Path         string        `yaml:"Path"`         // 本地目录
+
+	AllowUnsigned bool `yaml:"AllowUnsigned"` // 是否接受没有签名的 metadata
+}
+
+// DefaultConfig 返回默认的配置
+func DefaultConfig() *Config {
+	return &Config{
+		Type:         NornType,
+		GRPC:         "localhost:45555",
+		SyncInterval: 30 * time.Second,
+		Path:         "./db/registry",
+	}
+}
+
+// WithDefaults 用默认值补全缺省的字段
+func (config *Config) WithDefaults() *Config {
+	res := DefaultConfig()
+	if config == nil {
+		return res
+	}
+	if config.Type != "" {
+		res.Type = config.Type
+	}
+	if config.GRPC != "" {
+		res.GRPC = config.GRPC
+	}
+	if config.SyncInterval > 0 {
+		res.SyncInterval = config.SyncInterval
+	}
+	if config.Path != "" {
+		res.Path = config.Path
+	}
+	res.AllowUnsigned = config.AllowUnsigned
+	return res
+}
+
+// Handlers 保存订阅回调，供各个实现共用
+type Handlers struct {
+	lock sync.RWMutex
+	list []Handler
+}
+
+// Add 注册一个回调
+func (h *Handlers) Add(handler Handler) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.list = append(h.list, handler)
+}
+
+// Notify 依次调用所有回调
+func (h *Handlers) Notify(metaData *dht.MetaData) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, handler := range h.list {
+		handler(metaData)
+	}
+}
@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"main/manager"
+	"main/registry"
+)
+
+// resolvePeers 是从其他节点读取 metadata 时最多询问的节点数
+const resolvePeers = 8
+
+// Resolve 根据根哈希获取文件的 metadata。
+// 依次读取本地数据库、metadata 后端和已连接的节点：本地没有时（例如 websocket 错过了事件）从后端读取，
+// 后端也没有时（例如后端不可用或交易还未上链）向评分最高的节点请求，验证通过后缓存到本地。
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - rootHash: 文件根哈希的16进制字符串。
+// 返回值:
+// - *dht.MetaData: 文件的 metadata。
+// - error: 都找不到或验证失败时返回错误信息。
+func Resolve(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	var metaData dht.MetaData
+	err := manager.GetDBManager().LoadFromMemory(rootHash, &metaData)
+	if err == nil {
+		return &metaData, nil
+	}
+	logrus.Infof("Metadata %s not found locally, resolve from registry: %v", rootHash, err)
+
+	resolved, err := fetchFromRegistry(ctx, rootHash)
+	if err == nil {
+		// 后端中的 metadata 验证失败时不再询问其他节点，后端的记录优先
+		err = verify(resolved, rootHash)
+	} else {
+		logrus.Infof("Metadata %s not found in registry, resolve from peers: %v", rootHash, err)
+		resolved, err = ResolveFromPeers(ctx, rootHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = manager.GetDBManager().SaveToMemory(rootHash, resolved)
+	if err != nil {
+		logrus.Errorf("Cache metadata %s failed: %v", rootHash, err)
+	}
+	return resolved, nil
+}
+
+// ResolveFromRegistry 从 metadata 后端读取根哈希对应的 metadata，用 RebuildMerkleTreeFromMetaData 验证之后再检查所有者
+func ResolveFromRegistry(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	metaData, err := fetchFromRegistry(ctx, rootHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(metaData, rootHash); err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+// ResolveFromPeers 向已连接的节点按评分从高到低请求 metadata，返回第一个验证通过的结果，
+// 对方返回的 metadata 根哈希、签名或所有者不对时跳过这个节点
+func ResolveFromPeers(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	dhtService := manager.GetDHTService()
+	if dhtService == nil {
+		return nil, errors.New("DHT service not initialized")
+	}
+	peers := dhtService.RankPeers(dhtService.Host.Network().Peers())
+	if len(peers) > resolvePeers {
+		peers = peers[:resolvePeers]
+	}
+
+	err := errors.New("no connected peers")
+	for _, p := range peers {
+		var metaData *dht.MetaData
+		metaData, err = dhtService.GetMetaData(ctx, p, rootHash)
+		if err == nil {
+			err = verify(metaData, rootHash)
+		}
+		if err == nil {
+			return metaData, nil
+		}
+		logrus.Infof("Resolve metadata %s from %s failed: %v", rootHash, p, err)
+	}
+	return nil, fmt.Errorf("metadata %s not found on %d peers: %w", rootHash, len(peers), err)
+}
+
+// fetchFromRegistry 从 metadata 后端读取根哈希对应的 metadata，不做验证
+func fetchFromRegistry(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	reg := manager.GetRegistry()
+	if reg == nil {
+		return nil, errors.New("metadata registry not initialized")
+	}
+	return reg.Resolve(ctx, rootHash)
+}
+
+// verify 检查 metadata 的根哈希是 rootHash，CheckOwner 先验证签名和默克尔树，通过之后才绑定所有者
+func verify(metaData *dht.MetaData, rootHash string) error {
+	expected, err := hex.DecodeString(rootHash)
+	if err != nil {
+		return fmt.Errorf("invalid root hash %s: %v", rootHash, err)
+	}
+	if !bytes.Equal(metaData.RootHash, expected) {
+		return fmt.Errorf("metadata has root hash %x, want %s", metaData.RootHash, rootHash)
+	}
+	return registry.CheckOwner(manager.GetDBManager(), metaData)
+}
@@ -0,0 +1,285 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"main/db"
+	"main/dhtsim"
+	"main/manager"
+	"main/registry"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry 是只能读取的 metadata 后端，记录 Resolve 的调用次数
+type fakeRegistry struct {
+	lock     sync.Mutex
+	entries  map[string]*dht.MetaData
+	resolved int
+}
+
+func (r *fakeRegistry) Publish(ctx context.Context, metaData *dht.MetaData) error {
+	return errors.New("read only")
+}
+
+func (r *fakeRegistry) Resolve(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resolved++
+	metaData, exists := r.entries[rootHash]
+	if !exists {
+		return nil, registry.ErrNotFound
+	}
+	return metaData, nil
+}
+
+func (r *fakeRegistry) IsConfirmed(ctx context.Context, rootHash string) (bool, error) {
+	_, exists := r.entries[rootHash]
+	return exists, nil
+}
+
+func (r *fakeRegistry) Subscribe(handler registry.Handler) {}
+
+func (r *fakeRegistry) PutRecord(ctx context.Context, rootHash, key string, value []byte) error {
+	return errors.New("read only")
+}
+
+func (r *fakeRegistry) GetRecord(ctx context.Context, rootHash, key string) ([]byte, error) {
+	return nil, registry.ErrNotFound
+}
+
+func (r *fakeRegistry) Height(ctx context.Context) (uint64, error) { return 0, nil }
+
+func (r *fakeRegistry) Run(ctx context.Context) {}
+
+func (r *fakeRegistry) Close() error { return nil }
+
+// peerStore 是一个节点本地保存的 metadata，记录被请求的次数
+type peerStore struct {
+	lock      sync.Mutex
+	entries   map[string]*dht.MetaData
+	requested int
+}
+
+func (s *peerStore) load(rootHash string) (*dht.MetaData, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requested++
+	metaData, exists := s.entries[rootHash]
+	if !exists {
+		return nil, registry.ErrNotFound
+	}
+	return metaData, nil
+}
+
+// env 是解析测试的环境: 本节点使用 manager 中的数据库和 reg 后端，两个已连接的节点各自保存一些 metadata
+type env struct {
+	ctx   context.Context
+	db    *db.DBManager
+	reg   *fakeRegistry
+	peers []*peerStore
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	network := dhtsim.New(ctx, t.TempDir())
+	t.Cleanup(func() { network.Close() })
+	nodes, err := network.Start(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbManager, err := db.NewDBManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &env{ctx: ctx, db: dbManager, reg: &fakeRegistry{entries: make(map[string]*dht.MetaData)}}
+	for _, node := range nodes[1:] {
+		store := &peerStore{entries: make(map[string]*dht.MetaData)}
+		node.MetaDataHandler(ctx, store.load)
+		e.peers = append(e.peers, store)
+	}
+
+	prevDB, prevDHT, prevRegistry := manager.DBManager, manager.DHTService, manager.Registry
+	manager.DBManager, manager.DHTService, manager.Registry = dbManager, nodes[0].DHTService, e.reg
+	t.Cleanup(func() {
+		manager.DBManager, manager.DHTService, manager.Registry = prevDB, prevDHT, prevRegistry
+	})
+	return e
+}
+
+// requests 返回 metadata 后端和其他节点被请求的次数
+func (e *env) requests() (int, int) {
+	e.reg.lock.Lock()
+	defer e.reg.lock.Unlock()
+	count := 0
+	for _, store := range e.peers {
+		store.lock.Lock()
+		count += store.requested
+		store.lock.Unlock()
+	}
+	return e.reg.resolved, count
+}
+
+// signedMetaData 为随机内容的文件构建默克尔树，返回用新生成的密钥签名的 metadata 和它的根哈希
+func signedMetaData(t *testing.T) (*dht.MetaData, string) {
+	t.Helper()
+	secKey, pubKey, err := chamMerkleTree.GenerateKeyPair(chamMerkleTree.SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config := chamMerkleTree.NewMerkleConfig()
+	config.BlockSize = 1024
+	root, _, _, err := chamMerkleTree.BuildMerkleTree(file, config, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaData := chamMerkleTree.NewMetaData(root, pubKey, config.ChunkerParams())
+	if err := chamMerkleTree.SignMetaData(metaData, secKey); err != nil {
+		t.Fatal(err)
+	}
+	return metaData, hex.EncodeToString(root.Hash)
+}
+
+// tampered 返回签名被破坏的副本
+func tampered(metaData *dht.MetaData) *dht.MetaData {
+	res := *metaData
+	res.Signature = append([]byte{}, metaData.Signature...)
+	res.Signature[len(res.Signature)-1] ^= 1
+	return &res
+}
+
+// cached 判断 metadata 是否缓存到了本地数据库
+func (e *env) cached(rootHash string) bool {
+	var metaData dht.MetaData
+	return e.db.LoadFromMemory(rootHash, &metaData) == nil
+}
+
+func TestResolveOrder(t *testing.T) {
+	e := newEnv(t)
+
+	// 本地数据库中有时不询问后端和其他节点
+	local, localHash := signedMetaData(t)
+	if err := e.db.SaveToMemory(localHash, local); err != nil {
+		t.Fatal(err)
+	}
+	e.reg.entries[localHash] = tampered(local)
+	if _, err := Resolve(e.ctx, localHash); err != nil {
+		t.Fatal(err)
+	}
+	if registryCalls, peerCalls := e.requests(); registryCalls != 0 || peerCalls != 0 {
+		t.Fatalf("local hit asked registry %d times and peers %d times", registryCalls, peerCalls)
+	}
+
+	// 本地没有时读取后端，后端有时不询问其他节点
+	onChain, onChainHash := signedMetaData(t)
+	e.reg.entries[onChainHash] = onChain
+	if _, err := Resolve(e.ctx, onChainHash); err != nil {
+		t.Fatal(err)
+	}
+	if registryCalls, peerCalls := e.requests(); registryCalls != 1 || peerCalls != 0 {
+		t.Fatalf("registry hit asked registry %d times and peers %d times", registryCalls, peerCalls)
+	}
+	if !e.cached(onChainHash) {
+		t.Fatal("metadata from registry not cached")
+	}
+
+	// 后端也没有时询问其他节点
+	shared, sharedHash := signedMetaData(t)
+	e.peers[1].entries[sharedHash] = shared
+	got, err := Resolve(e.ctx, sharedHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(got.RootHash) != sharedHash || !e.cached(sharedHash) {
+		t.Fatal("metadata from peers not resolved and cached")
+	}
+	if registryCalls, peerCalls := e.requests(); registryCalls != 2 || peerCalls == 0 {
+		t.Fatalf("peer hit asked registry %d times and peers %d times", registryCalls, peerCalls)
+	}
+
+	// 缓存之后直接从本地读取
+	_, before := e.requests()
+	if _, err := Resolve(e.ctx, sharedHash); err != nil {
+		t.Fatal(err)
+	}
+	if registryCalls, peerCalls := e.requests(); registryCalls != 2 || peerCalls != before {
+		t.Fatal("cached metadata resolved again")
+	}
+
+	_, missingHash := signedMetaData(t)
+	if _, err := Resolve(e.ctx, missingHash); err == nil {
+		t.Fatal("resolved metadata that nobody has")
+	}
+}
+
+func TestResolveRejects(t *testing.T) {
+	e := newEnv(t)
+
+	// 后端中签名被破坏的 metadata 不接受，也不绑定所有者
+	forged, forgedHash := signedMetaData(t)
+	e.reg.entries[forgedHash] = tampered(forged)
+	if _, err := Resolve(e.ctx, forgedHash); !errors.Is(err, chamMerkleTree.ErrInvalidSignature) {
+		t.Fatalf("got %v, want ErrInvalidSignature", err)
+	}
+	if e.cached(forgedHash) {
+		t.Fatal("forged metadata cached")
+	}
+	if err := registry.CheckOwner(e.db, forged); err != nil {
+		t.Fatalf("forged metadata bound the owner: %v", err)
+	}
+
+	// 根哈希已经绑定给其他公钥
+	owned, ownedHash := signedMetaData(t)
+	other, _ := signedMetaData(t)
+	e.reg.entries[ownedHash] = owned
+	if err := e.db.SaveToMemory("owner/"+ownedHash, hex.EncodeToString(other.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resolve(e.ctx, ownedHash); !errors.Is(err, registry.ErrOwnerMismatch) {
+		t.Fatalf("got %v, want ErrOwnerMismatch", err)
+	}
+
+	// 后端为请求的根哈希返回了另一个文件的 metadata
+	e.reg.entries[hex.EncodeToString(other.RootHash)] = owned
+	if _, err := Resolve(e.ctx, hex.EncodeToString(other.RootHash)); err == nil {
+		t.Fatal("metadata of another root hash accepted")
+	}
+
+	// 其他节点返回的 metadata 同样验证，跳过签名被破坏的节点
+	shared, sharedHash := signedMetaData(t)
+	e.peers[0].entries[sharedHash] = tampered(shared)
+	e.peers[1].entries[sharedHash] = tampered(shared)
+	if _, err := Resolve(e.ctx, sharedHash); !errors.Is(err, chamMerkleTree.ErrInvalidSignature) {
+		t.Fatalf("got %v, want ErrInvalidSignature", err)
+	}
+	e.peers[1].entries[sharedHash] = shared
+	got, err := Resolve(e.ctx, sharedHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(got.RootHash) != sharedHash {
+		t.Fatalf("resolved %x, want %s", got.RootHash, sharedHash)
+	}
+}
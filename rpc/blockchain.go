@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -12,6 +13,9 @@ import (
 	"main/rpc/pb" // 引入生成的 pb 包
 )
 
+// ErrNotFound 表示链上不存在请求的数据
+var ErrNotFound = errors.New("not found")
+
 // BlockchainClient 封装 gRPC 客户端
 type BlockchainClient struct {
 	client pb.BlockchainClient
@@ -57,10 +61,12 @@ func (bc *BlockchainClient) GetBlockNumber(ctx context.Context) (*pb.BlockNumber
 	return resp, nil
 }
 
-func (bc *BlockchainClient) GetBlockByNumber(ctx context.Context, number uint64) (*pb.GetBlockResp, error) {
+// GetBlockByNumber 根据区块高度获取区块，full 为 true 时返回完整的交易内容
+func (bc *BlockchainClient) GetBlockByNumber(ctx context.Context, number uint64, full bool) (*pb.GetBlockResp, error) {
 	// 创建请求
 	req := &pb.GetBlockReq{
 		Number: &number,
+		Full:   &full,
 	}
 
 	// 调用 GetBlockByNumber 方法
@@ -101,6 +107,38 @@ func (bc *BlockchainClient) GetTransactionByHash(ctx context.Context, hash strin
 	return resp, nil
 }
 
+// GetTransactionByBlockHashAndIndex 根据区块哈希和交易在区块中的下标获取交易
+func (bc *BlockchainClient) GetTransactionByBlockHashAndIndex(ctx context.Context, blockHash string, index uint64) (*pb.GetTransactionResp, error) {
+	// 创建请求
+	req := &pb.GetTransactionReq{
+		BlockHash: &blockHash,
+		Index:     &index,
+	}
+
+	// 调用 GetTransactionByBlockHashAndIndex 方法
+	resp, err := bc.client.GetTransactionByBlockHashAndIndex(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction by block hash and index: %v", err)
+	}
+	return resp, nil
+}
+
+// GetTransactionByBlockNumberAndIndex 根据区块高度和交易在区块中的下标获取交易
+func (bc *BlockchainClient) GetTransactionByBlockNumberAndIndex(ctx context.Context, blockNumber, index uint64) (*pb.GetTransactionResp, error) {
+	// 创建请求
+	req := &pb.GetTransactionReq{
+		BlockNumber: &blockNumber,
+		Index:       &index,
+	}
+
+	// 调用 GetTransactionByBlockNumberAndIndex 方法
+	resp, err := bc.client.GetTransactionByBlockNumberAndIndex(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction by block number and index: %v", err)
+	}
+	return resp, nil
+}
+
 // SendTransactionWithData 发送带数据的交易
 func (bc *BlockchainClient) SendTransactionWithData(ctx context.Context, txType, receiver, key, value string) (*pb.SendTransactionWithDataResp, error) {
 	// 创建请求
@@ -118,3 +156,22 @@ func (bc *BlockchainClient) SendTransactionWithData(ctx context.Context, txType,
 	}
 	return resp, nil
 }
+
+// ReadContractAddress 读取合约地址下指定 key 的数据，返回16进制编码的值
+func (bc *BlockchainClient) ReadContractAddress(ctx context.Context, address, key string) (*pb.ReadContractAddressResp, error) {
+	// 创建请求
+	req := &pb.ReadContractAddressReq{
+		Address: &address,
+		Key:     &key,
+	}
+
+	// 调用 ReadContractAddress 方法
+	resp, err := bc.client.ReadContractAddress(ctx, req)
+	if err != nil {
+		if grpcErr, ok := status.FromError(err); ok && grpcErr.Code() == codes.NotFound {
+			return nil, fmt.Errorf("contract data %s/%s: %w", address, key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to read contract address: %v", err)
+	}
+	return resp, nil
+}
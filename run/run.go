@@ -9,7 +9,11 @@ import (
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"log"
+	"main/DHT"
+	"main/challenge"
+	"main/keystore"
 	"main/manager"
+	"main/registry"
 	"main/websocket"
 	"os"
 	"os/signal"
@@ -20,8 +24,15 @@ import (
 
 // 配置结构体
 type Config struct {
-	SecKey string `yaml:"SecKey"`
-	PubKey string `yaml:"PubKey"`
+	SecKey    string            `yaml:"SecKey"` // 明文私钥，仅用于兼容旧的配置文件，应使用 Keystore
+	PubKey    string            `yaml:"PubKey"`
+	Keystore  string            `yaml:"Keystore"`
+	Shares    string            `yaml:"Shares"` // 本节点持有的变色龙私钥分片目录
+	Limits    *DHT.Limits       `yaml:"Limits"` // 文件传输的限速，运行时可以用 limits 命令修改
+	NAT       *DHT.NATConfig    `yaml:"NAT"`    // NAT 穿透，缺省时只监听 TCP 端口
+	Registry  *registry.Config  `yaml:"Registry"`
+	Challenge *challenge.Config `yaml:"Challenge"` // 存储证明挑战的数据块目录和间隔
+	WebSocket *websocket.Config `yaml:"WebSocket"`
 }
 
 // Command 结构体定义
@@ -46,34 +57,42 @@ func decodeFromHex(data string) ([]byte, error) {
 }
 
 // 导入配置文件并返回配置结构体
-func importConfig(filename string) error {
+func importConfig(filename string) (*Config, error) {
 	// 读取文件内容
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+		return nil, fmt.Errorf("error reading file: %v", err)
 	}
 
 	// 解析 YAML 内容到 Config 结构体
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
-		return fmt.Errorf("error unmarshaling config: %v", err)
+		return nil, fmt.Errorf("error unmarshaling config: %v", err)
 	}
 
+	// 没有明文私钥时使用密钥库中的默认密钥
+	if config.SecKey == "" {
+		return &config, nil
+	}
+	logrus.Warnln("SecKey in config file is not encrypted, import it with key-import and remove it from the config file")
+
 	// 解码 SecKey 和 PubKey
 	configSecKey, err := decodeFromHex(config.SecKey)
 	if err != nil {
-		return fmt.Errorf("error decoding SecKey: %v", err)
+		return nil, fmt.Errorf("error decoding SecKey: %v", err)
 	}
 	configPubKey, err := decodeFromHex(config.PubKey)
 	if err != nil {
-		return fmt.Errorf("error decoding PubKey: %v", err)
+		return nil, fmt.Errorf("error decoding PubKey: %v", err)
 	}
 
 	// 更新配置结构体中的 SecKey 和 PubKey 为 []byte
-	manager.InitParameters(configSecKey, configPubKey)
+	if err := manager.InitParameters(configSecKey, configPubKey); err != nil {
+		return nil, fmt.Errorf("error decoding PubKey: %v", err)
+	}
 
-	return nil
+	return &config, nil
 }
 
 // 注册命令
@@ -100,7 +119,7 @@ func Start() {
 	defer cancel()
 
 	// 导入配置文件
-	err := importConfig("config.yml")
+	config, err := importConfig("config.yml")
 	if err != nil {
 		fmt.Println("Error importing config:", err)
 		return
@@ -109,25 +128,46 @@ func Start() {
 	//解析命令行参数
 	port := flag.Int("p", 0, "wait for incoming connections")
 	target := flag.String("d", "", "target peer to dial")
+	confirmations := flag.Uint64("c", websocket.Confirmations, "confirmations before mirrored metadata is final")
 	flag.Parse()
 	if *port == 0 {
 		logrus.Fatal("Please provide a port to bind on with -l")
 	}
 
-	// 创建 DHT 服务
-	err = manager.InitDHTService(ctx, *port, *target)
+	websocket.Confirmations = *confirmations
+
+	// 打开密钥库，配置文件中没有明文私钥时用环境变量中的口令解锁默认密钥
+	keystorePath := config.Keystore
+	if keystorePath == "" {
+		keystorePath = "./keystore.json"
+	}
+	err = manager.InitKeystore(keystorePath)
 	if err != nil {
-		logrus.Fatalf("Failed to create DHT service: %v", err)
+		logrus.Fatalf("Failed to open keystore: %v", err)
+	}
+	if manager.GetParameters() == nil {
+		if name := manager.GetKeystore().Default(); name != "" {
+			key, err := manager.GetKeystore().Unlock(name, os.Getenv(keystore.PassphraseEnv))
+			if err != nil {
+				logrus.Warnf("Failed to unlock default key, select one with key-select: %v", err)
+			} else {
+				manager.UseKey(key)
+			}
+		} else {
+			logrus.Warnln("No chameleon key, create one with key-create")
+		}
 	}
 
-	// 创建GRPC client
-	err = manager.InitGRPCClient("localhost:45555")
+	// 创建 DHT 服务
+	err = manager.InitDHTService(ctx, *port, *target, config.NAT)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		logrus.Fatalf("Failed to create DHT service: %v", err)
+	}
+	if config.Limits != nil {
+		if err := manager.GetDHTService().SetLimits(*config.Limits); err != nil {
+			logrus.Fatalf("Invalid transfer limits: %v", err)
+		}
 	}
-
-	// 运行websocket订阅norn中的消息
-	go websocket.RunWebSocket(ctx)
 
 	// 创建 DBManager
 	err = manager.InitDBManager("./db/kvstore.db")
@@ -135,6 +175,45 @@ func Start() {
 		log.Fatal("Error initializing DBManager:", err)
 	}
 
+	// 创建 metadata 后端，并把后端中的 metadata 镜像到本地数据库
+	registryConfig := config.Registry.WithDefaults()
+	registry.AllowUnsigned = registryConfig.AllowUnsigned
+	switch registryConfig.Type {
+	case registry.NornType:
+		err = manager.InitGRPCClient(registryConfig.GRPC)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		manager.InitRegistry(websocket.NewNornRegistry(config.WebSocket, registryConfig.SyncInterval))
+	case registry.LocalType:
+		localRegistry, err := registry.NewLocalRegistry(registryConfig.Path, manager.GetDBManager(), registryConfig.SyncInterval)
+		if err != nil {
+			log.Fatalf("Failed to create local registry: %v", err)
+		}
+		manager.InitRegistry(localRegistry)
+	default:
+		log.Fatalf("Unknown registry type %s", registryConfig.Type)
+	}
+	go manager.GetRegistry().Run(ctx)
+
+	// 加载变色龙私钥分片，应答其他节点发起的门限协作
+	sharesPath := config.Shares
+	if sharesPath == "" {
+		sharesPath = "./shares"
+	}
+	err = manager.InitShares(sharesPath)
+	if err != nil {
+		logrus.Fatalf("Failed to load key shares: %v", err)
+	}
+	dhtService := manager.GetDHTService()
+	dhtService.TrapdoorHandler(ctx, manager.GetShares().Signer(dhtService.Host.ID()))
+
+	// 应答其他节点的存储证明挑战，定期挑战持有本节点文件的节点，并在后台把挑战结果提交到 metadata 后端
+	challengeConfig := config.Challenge.WithDefaults()
+	challenge.RegisterHandler(ctx, challengeConfig.Dir)
+	go challenge.RunScheduler(ctx, challengeConfig.Interval)
+	go challenge.RunAnchorer(ctx)
+
 	// 欢迎信息
 	logrus.Println("Welcome to the Interactive CLI!")
 	logrus.Println("Type 'help' for a list of commands.")
@@ -168,26 +247,34 @@ func Start() {
 				continue
 			}
 
-			// 解析输入的命令和参数
-			cmdName, params := parseInput(input)
-
-			// 查找并执行命令
-			mu.Lock()
-			cmd, exists := commands[cmdName]
-			mu.Unlock()
-			if exists {
-				err := cmd.Action(ctx, params)
-				if err != nil {
-					logrus.Println("Error:", err)
-				}
-			} else {
-				logrus.Println("Unknown command:", input)
+			// 解析并执行命令
+			err := Execute(ctx, input)
+			if err != nil {
+				logrus.Println("Error:", err)
 			}
 		}
 
 	}
 }
 
+// Execute 解析并执行一行命令，与交互式命令行的输入格式相同
+func Execute(ctx context.Context, input string) error {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil
+	}
+	cmdName, params := parseInput(input)
+
+	// 查找并执行命令
+	mu.Lock()
+	cmd, exists := commands[cmdName]
+	mu.Unlock()
+	if !exists {
+		return fmt.Errorf("unknown command: %s", input)
+	}
+	return cmd.Action(ctx, params)
+}
+
 // 解析命令行输入，分离命令和参数
 func parseInput(input string) (string, map[string]string) {
 	parts := strings.Fields(input)
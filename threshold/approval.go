@@ -0,0 +1,134 @@
+package threshold
+
+import (
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"sort"
+	"sync"
+	"time"
+)
+
+// approvalTimeout 是等待操作者批准一个请求的时间，超时后拒绝
+const approvalTimeout = 2 * time.Minute
+
+var (
+	// ErrNotApproved 表示协作请求被拒绝或没有在超时之前得到批准
+	ErrNotApproved = errors.New("trapdoor request not approved")
+	// ErrUnknownRequest 表示没有这个编号的待批准请求
+	ErrUnknownRequest = errors.New("unknown trapdoor request")
+)
+
+// Approver 在分片持有者返回部分结果之前决定是否批准这次协作，返回 nil 表示批准。
+// 部分结果一旦返回，协调者就得到了碰撞或签名，因此每个请求都要经过批准。
+type Approver func(from peer.ID, req *dht.TrapdoorRequest) error
+
+// PendingRequest 是一个等待操作者批准的协作请求
+type PendingRequest struct {
+	ID       int
+	From     peer.ID
+	Kind     string
+	PubKey   []byte
+	RootHash []byte // 碰撞的根哈希，或要签名的 metadata 的根哈希
+	Received time.Time
+
+	decision chan bool
+}
+
+// Approvals 保存等待操作者批准的请求，是 Store 缺省使用的 Approver
+type Approvals struct {
+	lock    sync.Mutex
+	next    int
+	pending map[int]*PendingRequest
+}
+
+func newApprovals() *Approvals {
+	return &Approvals{pending: make(map[int]*PendingRequest)}
+}
+
+// wait 登记请求并等待操作者的决定
+func (a *Approvals) wait(from peer.ID, req *dht.TrapdoorRequest) error {
+	rootHash := req.RootHash
+	if req.Kind == dht.TrapdoorSchnorr && req.MetaData != nil {
+		rootHash = req.MetaData.RootHash
+	}
+	a.lock.Lock()
+	a.next++
+	pending := &PendingRequest{
+		ID:       a.next,
+		From:     from,
+		Kind:     req.Kind,
+		PubKey:   req.PubKey,
+		RootHash: rootHash,
+		Received: time.Now(),
+		decision: make(chan bool, 1),
+	}
+	a.pending[pending.ID] = pending
+	a.lock.Unlock()
+	logrus.Warnf("Trapdoor %s request %d for %x from %s is waiting for approval, answer with trapdoor-approve or trapdoor-deny", req.Kind, pending.ID, rootHash, from)
+
+	defer func() {
+		a.lock.Lock()
+		delete(a.pending, pending.ID)
+		a.lock.Unlock()
+	}()
+	select {
+	case approved := <-pending.decision:
+		if approved {
+			return nil
+		}
+		return ErrNotApproved
+	case <-time.After(approvalTimeout):
+		return fmt.Errorf("%w: timed out", ErrNotApproved)
+	}
+}
+
+// List 返回等待批准的请求，按编号排序
+func (a *Approvals) List() []PendingRequest {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := make([]PendingRequest, 0, len(a.pending))
+	for _, pending := range a.pending {
+		res = append(res, *pending)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Decide 批准或拒绝编号为 id 的请求
+func (a *Approvals) Decide(id int, approve bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	pending, exists := a.pending[id]
+	if !exists {
+		return fmt.Errorf("%w: %d", ErrUnknownRequest, id)
+	}
+	delete(a.pending, id)
+	pending.decision <- approve
+	return nil
+}
+
+// Approvals 返回等待操作者批准的请求
+func (store *Store) Approvals() *Approvals {
+	return store.approvals
+}
+
+// SetApprover 替换批准协作请求的策略，例如按根哈希或协调者自动批准，为 nil 时恢复为等待操作者批准
+func (store *Store) SetApprover(approver Approver) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if approver == nil {
+		approver = store.approvals.wait
+	}
+	store.approver = approver
+}
+
+// approve 使用当前的策略批准请求
+func (store *Store) approve(from peer.ID, req *dht.TrapdoorRequest) error {
+	store.lock.Lock()
+	approver := store.approver
+	store.lock.Unlock()
+	return approver(from, req)
+}
@@ -0,0 +1,185 @@
+package threshold
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"sync"
+)
+
+// Coordinator 向分片持有者发起门限协作
+type Coordinator struct {
+	DHT   *dht.DHTService
+	Store *Store // 本节点的分片，本节点也是持有者时使用，可以为 nil
+}
+
+// call 向一个分片持有者发送请求，持有者是本节点时直接使用本地分片
+func (c *Coordinator) call(ctx context.Context, p peer.ID, req *dht.TrapdoorRequest) (*dht.TrapdoorResponse, error) {
+	dhtService := c.DHT
+	self := dhtService.Host.ID()
+	if p == self {
+		if c.Store == nil {
+			return nil, ErrNoShare
+		}
+		return c.Store.Signer(self)(self, req)
+	}
+	if len(dhtService.Host.Peerstore().Addrs(p)) == 0 {
+		addrInfo, err := dhtService.DHT.FindPeer(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		dhtService.Host.Peerstore().AddAddrs(p, addrInfo.Addrs, peerstore.TempAddrTTL)
+	}
+	return dhtService.Trapdoor(ctx, p, req)
+}
+
+// cooperate 与分片持有者进行两轮协作：先收集至少门限个承诺，再由这些持有者计算部分结果
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - holders: 分片持有者，按顺序选择前门限个应答的持有者。
+// - req: 请求内容，Round、Session、Indices 和 Commitments 由这个函数填写。
+// 返回值:
+// - []int: 参与者的分片编号。
+// - [][]byte: 参与者的承诺，与分片编号一一对应。
+// - [][]byte: 参与者的部分结果，与承诺一一对应。
+// - error: 应答的持有者少于门限或第二轮失败时返回错误信息。
+func (c *Coordinator) cooperate(ctx context.Context, holders []peer.ID, req *dht.TrapdoorRequest) ([]int, [][]byte, [][]byte, error) {
+	session := make([]byte, 16)
+	if _, err := rand.Read(session); err != nil {
+		return nil, nil, nil, err
+	}
+	req.Session = hex.EncodeToString(session)
+
+	// 1, 收集承诺
+	req.Round = dht.TrapdoorCommit
+	var participants []peer.ID
+	var indices []int
+	var commitments [][]byte
+	threshold := 0
+	seen := make(map[int]bool)
+	for _, p := range holders {
+		resp, err := c.call(ctx, p, req)
+		if err != nil {
+			logrus.Warnf("Holder %s did not commit: %v", p, err)
+			continue
+		}
+		if seen[resp.Index] {
+			continue
+		}
+		seen[resp.Index] = true
+		participants = append(participants, p)
+		indices = append(indices, resp.Index)
+		commitments = append(commitments, resp.Commitment)
+		threshold = resp.Threshold
+		if len(indices) >= threshold {
+			break
+		}
+	}
+	if threshold == 0 || len(indices) < threshold {
+		return nil, nil, nil, fmt.Errorf("%w: %d of %d holders answered", chamMerkleTree.ErrNotEnoughShares, len(indices), threshold)
+	}
+
+	// 2, 收集部分结果，持有者可能要等待操作者批准，同时向所有参与者请求
+	signReq := *req
+	signReq.Round = dht.TrapdoorSign
+	signReq.Indices = indices
+	signReq.Commitments = commitments
+	partials := make([][]byte, len(participants))
+	errs := make([]error, len(participants))
+	var wg sync.WaitGroup
+	for i, p := range participants {
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			resp, err := c.call(ctx, p, &signReq)
+			if err != nil {
+				errs[i] = fmt.Errorf("holder %s: %v", p, err)
+				return
+			}
+			partials[i] = resp.Partial
+		}(i, p)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, nil, err
+	}
+	return indices, commitments, partials, nil
+}
+
+// Collider 返回由分片持有者协作生成碰撞的 CollisionFunc，完整的私钥不会出现在任何节点上
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - holders: 分片持有者。
+// - pubKey: 变色龙公钥。
+func (c *Coordinator) Collider(ctx context.Context, holders []peer.ID, pubKey *chamMerkleTree.ChameleomPubKey) chamMerkleTree.CollisionFunc {
+	return func(message []byte, randomNum *chamMerkleTree.ChameleonRandomNum, rootHash, newMessage []byte) (*chamMerkleTree.ChameleonRandomNum, error) {
+		indices, commitments, partials, err := c.cooperate(ctx, holders, &dht.TrapdoorRequest{
+			Kind:       dht.TrapdoorCollision,
+			PubKey:     pubKey.Serialize(),
+			Message:    message,
+			RandomNum:  randomNum.Serialize(),
+			RootHash:   rootHash,
+			NewMessage: newMessage,
+		})
+		if err != nil {
+			return nil, err
+		}
+		session, err := chamMerkleTree.CollisionSession(message, randomNum, pubKey, rootHash, newMessage, indices, commitments)
+		if err != nil {
+			return nil, err
+		}
+		newRandomNum, err := chamMerkleTree.CombineCollision(session, partials)
+		if err != nil {
+			return nil, err
+		}
+		if !chamMerkleTree.VerifyMerkleRoot(newMessage, rootHash, pubKey, newRandomNum) {
+			return nil, errors.New("threshold collision verification failed")
+		}
+		return newRandomNum, nil
+	}
+}
+
+// SignMetaData 由分片持有者协作对 metadata 生成 Schnorr 签名，签名写入 Signature 字段
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - holders: 分片持有者。
+// - metaData: 要签名的 metadata，其中的随机数必须能打开根哈希。
+// 返回值:
+// - error: 错误信息。
+func (c *Coordinator) SignMetaData(ctx context.Context, holders []peer.ID, metaData *dht.MetaData) error {
+	unsigned := *metaData
+	unsigned.Signature = nil
+	indices, commitments, partials, err := c.cooperate(ctx, holders, &dht.TrapdoorRequest{
+		Kind:     dht.TrapdoorSchnorr,
+		PubKey:   metaData.PublicKey,
+		MetaData: &unsigned,
+	})
+	if err != nil {
+		return err
+	}
+	pubKey, err := chamMerkleTree.DeserializeChameleomPubKey(metaData.PublicKey)
+	if err != nil {
+		return err
+	}
+	session, err := chamMerkleTree.SchnorrSession(pubKey, metaData.Digest(), indices, commitments)
+	if err != nil {
+		return err
+	}
+	signature, err := chamMerkleTree.CombineSchnorr(session, partials)
+	if err != nil {
+		return err
+	}
+	metaData.Signature = signature
+	if err := chamMerkleTree.VerifyMetaDataSignature(metaData); err != nil {
+		metaData.Signature = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+// Package threshold 保存本节点持有的变色龙私钥分片，应答其他节点发起的门限协作请求，
+// 并作为协调者与分片持有者协作生成碰撞和签名。
+// 分片以 JSON 文件保存在分片目录中，每个变色龙公钥至多持有一个分片。
+package threshold
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AnyCoordinator 表示允许任意节点发起协作
+const AnyCoordinator = "*"
+
+// sessionTimeout 是第一轮承诺之后等待第二轮请求的时间，超时后随机数被丢弃
+const sessionTimeout = 5 * time.Minute
+
+var (
+	// ErrNoShare 表示本节点没有这个变色龙公钥的分片
+	ErrNoShare = errors.New("no key share for public key")
+	// ErrNotAllowed 表示发起协作的节点不在允许的协调者中
+	ErrNotAllowed = errors.New("coordinator not allowed")
+	// ErrUnknownSession 表示第二轮请求没有对应的第一轮承诺
+	ErrUnknownSession = errors.New("unknown trapdoor session")
+)
+
+// Holder 是本节点持有的一个分片
+type Holder struct {
+	Share        *chamMerkleTree.KeyShare `json:"share"`
+	Coordinators []string                 `json:"coordinators"` // 允许发起协作的节点，本节点总是允许
+}
+
+// allows 判断 from 是否可以使用这个分片
+func (holder *Holder) allows(self, from peer.ID) bool {
+	if from == self {
+		return true
+	}
+	for _, coordinator := range holder.Coordinators {
+		if coordinator == AnyCoordinator || coordinator == from.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// nonce 是第一轮承诺时生成的随机数，只能在同一个会话的第二轮中使用一次
+type nonce struct {
+	nonce   *chamMerkleTree.Nonce
+	kind    string
+	from    peer.ID
+	created time.Time
+}
+
+// Store 是本节点持有的分片和进行中的协作会话
+type Store struct {
+	lock      sync.Mutex
+	dir       string
+	holders   map[string]*Holder // 键为16进制的变色龙公钥
+	sessions  map[string]*nonce
+	approvals *Approvals
+	approver  Approver
+}
+
+// Open 从分片目录加载所有分片，目录不存在时创建
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		dir:       path,
+		holders:   make(map[string]*Holder),
+		sessions:  make(map[string]*nonce),
+		approvals: newApprovals(),
+	}
+	store.approver = store.approvals.wait
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var holder Holder
+		if err := json.Unmarshal(data, &holder); err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		if holder.Share == nil || holder.Share.Verify() != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), chamMerkleTree.ErrInvalidShare)
+		}
+		id, _ := keyID(holder.Share.PubKey)
+		store.holders[id] = &holder
+	}
+	return store, nil
+}
+
+// WriteShares 将拆分得到的分片分别写入 out 目录，文件名为 share-<编号>.json
+// 返回值:
+// - []string: 写入的文件路径。
+// - error: 错误信息。
+func WriteShares(shares []*chamMerkleTree.KeyShare, out string) ([]string, error) {
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, share := range shares {
+		data, err := json.MarshalIndent(share, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(out, fmt.Sprintf("share-%d.json", share.Index))
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// Load 读取 WriteShares 写出的一个分片文件，保存到分片目录中并开始应答协作请求
+// 参数:
+// - path: 分片文件路径。
+// - coordinators: 允许发起协作的节点，AnyCoordinator 表示任意节点。
+// 返回值:
+// - *Holder: 加载的分片。
+// - error: 分片无效或保存失败时返回错误信息。
+func (store *Store) Load(path string, coordinators []string) (*Holder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var share chamMerkleTree.KeyShare
+	if err := json.Unmarshal(data, &share); err != nil {
+		return nil, err
+	}
+	if err := share.Verify(); err != nil {
+		return nil, err
+	}
+	holder := &Holder{Share: &share, Coordinators: coordinators}
+	data, err = json.MarshalIndent(holder, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	id, err := keyID(share.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(store.dir, id+".json"), data, 0600); err != nil {
+		return nil, err
+	}
+	store.holders[id] = holder
+	return holder, nil
+}
+
+// List 返回本节点持有的所有分片，按公钥排序
+func (store *Store) List() []*Holder {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	res := make([]*Holder, 0, len(store.holders))
+	for _, holder := range store.holders {
+		res = append(res, holder)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Share.PubKey, res[j].Share.PubKey) < 0
+	})
+	return res
+}
+
+// Signer 返回应答门限协作请求的函数。
+// 其他节点发起的协作在返回部分结果之前需要经过 Approver 批准，缺省时等待本节点的操作者
+// 用 Approve 逐个批准；本节点自己发起的协作由操作者直接发起，不需要再次批准。
+// 参数:
+// - self: 本节点的 ID，本节点作为协调者时总是允许使用分片。
+func (store *Store) Signer(self peer.ID) dht.TrapdoorSigner {
+	return func(from peer.ID, req *dht.TrapdoorRequest) (*dht.TrapdoorResponse, error) {
+		id, err := keyID(req.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		store.lock.Lock()
+		holder, exists := store.holders[id]
+		store.lock.Unlock()
+		if !exists {
+			return nil, ErrNoShare
+		}
+		if !holder.allows(self, from) {
+			return nil, ErrNotAllowed
+		}
+		if req.Kind != dht.TrapdoorCollision && req.Kind != dht.TrapdoorSchnorr {
+			return nil, fmt.Errorf("unknown trapdoor kind %s", req.Kind)
+		}
+
+		share := holder.Share
+		switch req.Round {
+		case dht.TrapdoorCommit:
+			n, err := chamMerkleTree.NewNonce()
+			if err != nil {
+				return nil, err
+			}
+			store.saveNonce(req.Session, &nonce{nonce: n, kind: req.Kind, from: from, created: time.Now()})
+			return &dht.TrapdoorResponse{Index: share.Index, Threshold: share.Threshold, Commitment: n.Commitment()}, nil
+		case dht.TrapdoorSign:
+			// 无论成功与否随机数都只使用一次，否则两个部分结果可以解出分片私钥
+			n := store.takeNonce(req.Session)
+			if n == nil || n.kind != req.Kind || n.from != from {
+				return nil, ErrUnknownSession
+			}
+			if from != self {
+				if err := store.approve(from, req); err != nil {
+					return nil, err
+				}
+			}
+			partial, err := sign(share, n, req)
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("Trapdoor %s for %x answered with share %d", req.Kind, req.PubKey, share.Index)
+			return &dht.TrapdoorResponse{Index: share.Index, Threshold: share.Threshold, Partial: partial}, nil
+		default:
+			return nil, fmt.Errorf("unknown trapdoor round %s", req.Round)
+		}
+	}
+}
+
+// sign 检查第二轮请求并计算部分结果
+func sign(share *chamMerkleTree.KeyShare, n *nonce, req *dht.TrapdoorRequest) ([]byte, error) {
+	pubKey, err := chamMerkleTree.DeserializeChameleomPubKey(share.PubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Kind == dht.TrapdoorCollision {
+		randomNum, err := chamMerkleTree.DeserializeChameleonRandomNum(req.RandomNum)
+		if err != nil {
+			return nil, err
+		}
+		session, err := chamMerkleTree.CollisionSession(req.Message, randomNum, pubKey, req.RootHash, req.NewMessage, req.Indices, req.Commitments)
+		if err != nil {
+			return nil, err
+		}
+		return share.PartialCollision(n.nonce, session)
+	}
+
+	// 只对能用这个公钥打开根哈希的 metadata 签名
+	metaData := req.MetaData
+	if metaData == nil {
+		return nil, errors.New("invalid metadata")
+	}
+	_, _, metaPubKey, err := chamMerkleTree.RebuildMerkleTreeFromMetaData(metaData)
+	if err != nil {
+		return nil, err
+	}
+	if !metaPubKey.Equal(pubKey) {
+		return nil, errors.New("metadata published with another key")
+	}
+	session, err := chamMerkleTree.SchnorrSession(pubKey, metaData.Digest(), req.Indices, req.Commitments)
+	if err != nil {
+		return nil, err
+	}
+	return share.PartialSchnorr(n.nonce, session)
+}
+
+// keyID 返回公钥的统一编码的16进制字符串，旧编码和新编码的同一个公钥得到相同的结果
+func keyID(pubKey []byte) (string, error) {
+	key, err := chamMerkleTree.DeserializeChameleomPubKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key.Serialize()), nil
+}
+
+// saveNonce 保存会话的随机数，并丢弃超时的会话
+func (store *Store) saveNonce(session string, n *nonce) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for key, old := range store.sessions {
+		if time.Since(old.created) > sessionTimeout {
+			delete(store.sessions, key)
+		}
+	}
+	store.sessions[session] = n
+}
+
+// takeNonce 取出并删除会话的随机数
+func (store *Store) takeNonce(session string) *nonce {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	n, exists := store.sessions[session]
+	if !exists || time.Since(n.created) > sessionTimeout {
+		return nil
+	}
+	delete(store.sessions, session)
+	return n
+}
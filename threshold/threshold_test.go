@@ -0,0 +1,212 @@
+package threshold
+
+import (
+	"errors"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dht "main/DHT"
+	"main/chamMerkleTree"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	self        = peer.ID("holder")
+	coordinator = peer.ID("coordinator")
+)
+
+// holders 把一个 2-of-2 拆分的分片分别加载到两个 Store 中
+func holders(t *testing.T) ([]*Store, *chamMerkleTree.ChameleomPubKey, []byte) {
+	t.Helper()
+	secKey, pubKey, err := chamMerkleTree.GenerateKeyPair(chamMerkleTree.SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := chamMerkleTree.SplitKey(secKey, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := WriteShares(shares, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stores []*Store
+	for _, path := range paths {
+		store, err := Open(filepath.Join(t.TempDir(), "shares"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(path, []string{AnyCoordinator}); err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, store)
+	}
+	return stores, pubKey, secKey
+}
+
+// collisionRequest 返回一个为 newMessage 生成碰撞的请求
+func collisionRequest(t *testing.T, pubKey *chamMerkleTree.ChameleomPubKey, secKey []byte) *dht.TrapdoorRequest {
+	t.Helper()
+	message := []byte("old message")
+	scheme, err := chamMerkleTree.GetScheme(chamMerkleTree.SchemeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawPubKey, err := scheme.PublicKey(secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootHash, randomness, err := scheme.Hash(rawPubKey, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomNum, err := chamMerkleTree.ParseChameleonRandomNum(chamMerkleTree.SchemeP256, randomness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dht.TrapdoorRequest{
+		Kind:       dht.TrapdoorCollision,
+		Session:    "session",
+		PubKey:     pubKey.Serialize(),
+		Message:    message,
+		RandomNum:  randomNum.Serialize(),
+		RootHash:   rootHash,
+		NewMessage: []byte("new message"),
+	}
+}
+
+// run 让所有持有者完成两轮协作，返回部分结果或第一个错误
+func run(t *testing.T, stores []*Store, req *dht.TrapdoorRequest) ([]int, [][]byte, [][]byte, error) {
+	t.Helper()
+	commit := *req
+	commit.Round = dht.TrapdoorCommit
+	var indices []int
+	var commitments [][]byte
+	for _, store := range stores {
+		resp, err := store.Signer(self)(coordinator, &commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, resp.Index)
+		commitments = append(commitments, resp.Commitment)
+	}
+	sign := *req
+	sign.Round = dht.TrapdoorSign
+	sign.Indices = indices
+	sign.Commitments = commitments
+	var partials [][]byte
+	for _, store := range stores {
+		resp, err := store.Signer(self)(coordinator, &sign)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		partials = append(partials, resp.Partial)
+	}
+	return indices, commitments, partials, nil
+}
+
+func TestSignerRequiresApproval(t *testing.T) {
+	stores, pubKey, secKey := holders(t)
+	req := collisionRequest(t, pubKey, secKey)
+
+	for _, store := range stores {
+		store.SetApprover(func(from peer.ID, req *dht.TrapdoorRequest) error { return ErrNotApproved })
+	}
+	if _, _, _, err := run(t, stores, req); !errors.Is(err, ErrNotApproved) {
+		t.Fatalf("got %v, want ErrNotApproved", err)
+	}
+
+	// 缺省的策略等待操作者批准
+	for _, store := range stores {
+		store.SetApprover(nil)
+		go func(store *Store) {
+			for {
+				pending := store.Approvals().List()
+				if len(pending) > 0 {
+					if pending[0].From != coordinator || pending[0].Kind != dht.TrapdoorCollision {
+						t.Errorf("unexpected pending request %+v", pending[0])
+					}
+					store.Approvals().Decide(pending[0].ID, true)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(store)
+	}
+	indices, commitments, partials, err := run(t, stores, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomNum, err := chamMerkleTree.DeserializeChameleonRandomNum(req.RandomNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := chamMerkleTree.CollisionSession(req.Message, randomNum, pubKey, req.RootHash, req.NewMessage, indices, commitments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRandomNum, err := chamMerkleTree.CombineCollision(session, partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chamMerkleTree.VerifyMerkleRoot(req.NewMessage, req.RootHash, pubKey, newRandomNum) {
+		t.Fatal("approved collision does not open the hash")
+	}
+}
+
+func TestSignerDenied(t *testing.T) {
+	stores, pubKey, secKey := holders(t)
+	req := collisionRequest(t, pubKey, secKey)
+	go func() {
+		for {
+			if pending := stores[0].Approvals().List(); len(pending) > 0 {
+				stores[0].Approvals().Decide(pending[0].ID, false)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	commit := *req
+	commit.Round = dht.TrapdoorCommit
+	resp, err := stores[0].Signer(self)(coordinator, &commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := *req
+	sign.Round = dht.TrapdoorSign
+	sign.Indices = []int{resp.Index}
+	sign.Commitments = [][]byte{resp.Commitment}
+	if _, err := stores[0].Signer(self)(coordinator, &sign); !errors.Is(err, ErrNotApproved) {
+		t.Fatalf("got %v, want ErrNotApproved", err)
+	}
+	// 被拒绝之后会话的随机数已经作废，协调者不能再次请求
+	stores[0].SetApprover(func(peer.ID, *dht.TrapdoorRequest) error { return nil })
+	if _, err := stores[0].Signer(self)(coordinator, &sign); !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("got %v, want ErrUnknownSession", err)
+	}
+}
+
+func TestSignerSelfNeedsNoApproval(t *testing.T) {
+	stores, pubKey, secKey := holders(t)
+	req := collisionRequest(t, pubKey, secKey)
+	for _, store := range stores {
+		store.SetApprover(func(peer.ID, *dht.TrapdoorRequest) error {
+			t.Error("approver called for a local request")
+			return ErrNotApproved
+		})
+	}
+	commit := *req
+	commit.Round = dht.TrapdoorCommit
+	resp, err := stores[0].Signer(self)(self, &commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := *req
+	sign.Round = dht.TrapdoorSign
+	sign.Indices = []int{resp.Index}
+	sign.Commitments = [][]byte{resp.Commitment}
+	// 只有一个参与者，少于门限，但不会经过批准
+	if _, err := stores[0].Signer(self)(self, &sign); !errors.Is(err, chamMerkleTree.ErrNotEnoughShares) {
+		t.Fatalf("got %v, want ErrNotEnoughShares", err)
+	}
+}
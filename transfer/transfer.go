@@ -0,0 +1,251 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 传输管理: 每次 send 或 get 登记为一个传输，记录已经完成的字节数和数据块数，
+// 由此计算吞吐量和预计剩余时间。每个传输有自己的上下文，取消传输时正在进行的网络读写随之中断。
+// 传输通过上下文传递给发送和下载数据块的代码，没有登记的上下文上的进度更新会被忽略。
+
+// State 是传输的状态
+type State string
+
+const (
+	Running   State = "running"
+	Done      State = "done"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+)
+
+// keepFinished 是已经结束的传输保留的个数，更早结束的传输被删除
+const keepFinished = 64
+
+// ErrNotFound 表示传输编号不存在
+var ErrNotFound = errors.New("transfer not found")
+
+// Transfer 是一次传输
+type Transfer struct {
+	ID   int
+	Kind string // send 或 get
+	Name string // 文件路径或根哈希
+
+	mu          sync.Mutex
+	cancel      context.CancelFunc
+	cancelled   bool
+	started     time.Time
+	finished    time.Time
+	state       State
+	err         error
+	bytes       int64
+	totalBytes  int64
+	chunks      int
+	totalChunks int
+}
+
+// Status 是传输在某一时刻的快照
+type Status struct {
+	ID          int
+	Kind        string
+	Name        string
+	State       State
+	Err         error
+	Started     time.Time
+	Elapsed     time.Duration
+	Bytes       int64
+	TotalBytes  int64 // 为0时总字节数未知
+	Chunks      int
+	TotalChunks int
+	Throughput  float64       // 字节每秒
+	ETA         time.Duration // 为0时无法估计
+}
+
+type contextKey struct{}
+
+var (
+	mu        sync.Mutex
+	transfers = make(map[int]*Transfer)
+	nextID    = 1
+)
+
+// Start 登记一个新的传输
+// 参数:
+//   - ctx: 父上下文
+//   - kind: 传输的类型，send 或 get
+//   - name: 传输的文件路径或根哈希
+//
+// 返回值:
+//   - *Transfer: 新的传输
+//   - context.Context: 传输的上下文，取消传输时被取消，可以用 FromContext 取回传输
+func Start(ctx context.Context, kind, name string) (*Transfer, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	t := &Transfer{
+		ID:      nextID,
+		Kind:    kind,
+		Name:    name,
+		cancel:  cancel,
+		started: time.Now(),
+		state:   Running,
+	}
+	nextID++
+	transfers[t.ID] = t
+	prune()
+	return t, context.WithValue(ctx, contextKey{}, t)
+}
+
+// prune 只保留最近结束的 keepFinished 个传输，调用时需要持有锁
+func prune() {
+	var finished []*Transfer
+	for _, t := range transfers {
+		if t.Status().State != Running {
+			finished = append(finished, t)
+		}
+	}
+	if len(finished) <= keepFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].ID < finished[j].ID })
+	for _, t := range finished[:len(finished)-keepFinished] {
+		delete(transfers, t.ID)
+	}
+}
+
+// FromContext 返回上下文所属的传输，没有时返回 nil
+func FromContext(ctx context.Context) *Transfer {
+	t, _ := ctx.Value(contextKey{}).(*Transfer)
+	return t
+}
+
+// Get 返回编号为 id 的传输
+func Get(id int) (*Transfer, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	t, exists := transfers[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return t, nil
+}
+
+// List 返回所有传输的状态，按编号排序
+func List() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+	res := make([]Status, 0, len(transfers))
+	for _, t := range transfers {
+		res = append(res, t.Status())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Cancel 取消编号为 id 的传输
+func Cancel(id int) error {
+	t, err := Get(id)
+	if err != nil {
+		return err
+	}
+	t.Cancel()
+	return nil
+}
+
+// Cancel 取消传输，传输的上下文被取消
+func (t *Transfer) Cancel() {
+	t.mu.Lock()
+	if t.state == Running {
+		t.cancelled = true
+	}
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// AddTotal 增加传输的总字节数和总数据块数，一次传输包含多个文件时逐个增加。
+// 字节数未知时传入0，预计剩余时间改为按数据块数估计。
+func (t *Transfer) AddTotal(bytes int64, chunks int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.totalBytes += bytes
+	t.totalChunks += chunks
+}
+
+// AddChunk 记录完成了一个 bytes 字节的数据块
+func (t *Transfer) AddChunk(bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytes += bytes
+	t.chunks++
+}
+
+// Finish 记录传输结束，err 为 nil 时传输成功，被取消的传输失败时记为已取消，
+// 这时的错误可能是被中断的流的错误而不是 context.Canceled
+func (t *Transfer) Finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = time.Now()
+	t.err = err
+	switch {
+	case err == nil:
+		t.state = Done
+	case t.cancelled || errors.Is(err, context.Canceled):
+		t.state = Cancelled
+	default:
+		t.state = Failed
+	}
+	t.cancel()
+}
+
+// Status 返回传输的快照
+func (t *Transfer) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	end := time.Now()
+	if t.state != Running {
+		end = t.finished
+	}
+	s := Status{
+		ID:          t.ID,
+		Kind:        t.Kind,
+		Name:        t.Name,
+		State:       t.state,
+		Err:         t.err,
+		Started:     t.started,
+		Elapsed:     end.Sub(t.started),
+		Bytes:       t.bytes,
+		TotalBytes:  t.totalBytes,
+		Chunks:      t.chunks,
+		TotalChunks: t.totalChunks,
+	}
+	if s.Elapsed > 0 {
+		s.Throughput = float64(t.bytes) / s.Elapsed.Seconds()
+	}
+
+	// 按已经完成的比例估计剩余时间，总字节数未知时按数据块数
+	if t.state == Running {
+		var done float64
+		if t.totalBytes > 0 {
+			done = float64(t.bytes) / float64(t.totalBytes)
+		} else if t.totalChunks > 0 {
+			done = float64(t.chunks) / float64(t.totalChunks)
+		}
+		if done > 0 && done < 1 {
+			s.ETA = time.Duration(float64(s.Elapsed) * (1 - done) / done)
+		}
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	tr, ctx := Start(context.Background(), "send", "file")
+	if FromContext(ctx) != tr {
+		t.Fatal("transfer not in its context")
+	}
+	if FromContext(context.Background()) != nil {
+		t.Fatal("transfer in an unrelated context")
+	}
+
+	// 一次传输包含多个文件时逐个增加总数
+	tr.AddTotal(1000, 0)
+	tr.AddTotal(0, 4)
+	tr.AddTotal(1000, 4)
+	tr.AddChunk(500)
+	tr.AddChunk(500)
+	time.Sleep(10 * time.Millisecond)
+	s := tr.Status()
+	if s.State != Running || s.Bytes != 1000 || s.TotalBytes != 2000 || s.Chunks != 2 || s.TotalChunks != 8 {
+		t.Fatalf("status %+v", s)
+	}
+	if s.Throughput <= 0 {
+		t.Fatalf("throughput %f", s.Throughput)
+	}
+	// 完成了一半的字节，剩余时间等于已经用去的时间
+	if diff := s.ETA - s.Elapsed; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Fatalf("ETA %v, elapsed %v", s.ETA, s.Elapsed)
+	}
+
+	tr.Finish(nil)
+	s = tr.Status()
+	if s.State != Done || s.Err != nil || s.ETA != 0 {
+		t.Fatalf("finished status %+v", s)
+	}
+	// 结束之后经过的时间不再增加
+	time.Sleep(10 * time.Millisecond)
+	if again := tr.Status(); again.Elapsed != s.Elapsed {
+		t.Fatalf("elapsed changed after finish: %v, %v", s.Elapsed, again.Elapsed)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("context not released after finish")
+	}
+}
+
+func TestProgressByChunks(t *testing.T) {
+	tr, _ := Start(context.Background(), "get", "root")
+	defer tr.Finish(nil)
+	// 总字节数未知时按数据块数估计
+	tr.AddTotal(0, 4)
+	tr.AddChunk(100)
+	time.Sleep(10 * time.Millisecond)
+	s := tr.Status()
+	if s.ETA <= 0 {
+		t.Fatalf("no ETA by chunks: %+v", s)
+	}
+	if diff := s.ETA - 3*s.Elapsed; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Fatalf("ETA %v, want 3 times elapsed %v", s.ETA, s.Elapsed)
+	}
+	// 没有总数时无法估计
+	unknown, _ := Start(context.Background(), "get", "root")
+	defer unknown.Finish(nil)
+	unknown.AddChunk(100)
+	if s := unknown.Status(); s.ETA != 0 {
+		t.Fatalf("ETA %v without totals", s.ETA)
+	}
+
+	// 不属于任何传输的进度更新被忽略
+	var none *Transfer
+	none.AddTotal(1, 1)
+	none.AddChunk(1)
+	none.Finish(nil)
+}
+
+func TestCancel(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	defer cancelParent()
+	tr, ctx := Start(parent, "get", "root")
+	if err := Cancel(tr.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled")
+	}
+	if parent.Err() != nil {
+		t.Fatal("cancelling the transfer cancelled its parent")
+	}
+	// 被中断的流返回的错误不是 context.Canceled，仍然记为已取消
+	tr.Finish(errors.New("stream reset"))
+	if s := tr.Status(); s.State != Cancelled || s.Err == nil {
+		t.Fatalf("status %+v", s)
+	}
+
+	// 取消父上下文同样取消传输
+	child, ctx := Start(parent, "send", "file")
+	cancelParent()
+	<-ctx.Done()
+	child.Finish(ctx.Err())
+	if s := child.Status(); s.State != Cancelled {
+		t.Fatalf("state %s, want cancelled", s.State)
+	}
+
+	failed, _ := Start(context.Background(), "send", "file")
+	failed.Finish(errors.New("no peers"))
+	if s := failed.Status(); s.State != Failed {
+		t.Fatalf("state %s, want failed", s.State)
+	}
+	// 已经结束的传输再取消不改变状态
+	failed.Cancel()
+	if s := failed.Status(); s.State != Failed {
+		t.Fatalf("state %s after cancelling a finished transfer", s.State)
+	}
+
+	if err := Cancel(-1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestListAndPrune(t *testing.T) {
+	running, _ := Start(context.Background(), "get", "running")
+	defer running.Finish(nil)
+	var finished []*Transfer
+	for i := 0; i < keepFinished+10; i++ {
+		tr, _ := Start(context.Background(), "send", "finished")
+		tr.Finish(nil)
+		finished = append(finished, tr)
+	}
+	// 下一次登记时删除较早结束的传输
+	last, _ := Start(context.Background(), "get", "last")
+	defer last.Finish(nil)
+
+	list := List()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].ID >= list[i].ID {
+			t.Fatalf("list not sorted by id: %d, %d", list[i-1].ID, list[i].ID)
+		}
+	}
+	count := 0
+	for _, s := range list {
+		if s.State != Running {
+			count++
+		}
+	}
+	if count > keepFinished {
+		t.Fatalf("%d finished transfers kept, want at most %d", count, keepFinished)
+	}
+	// 正在进行的传输总是保留，最近结束的传输保留
+	if _, err := Get(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(finished[len(finished)-1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(finished[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want the oldest finished transfer pruned", err)
+	}
+}
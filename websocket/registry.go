@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	dht "main/DHT"
+	"main/manager"
+	"main/registry"
+	"main/rpc"
+	"time"
+)
+
+// metaDataHandlers 在实时订阅或回填得到新的 metadata 时被调用
+var metaDataHandlers registry.Handlers
+
+// NornRegistry 使用 norn 链保存 metadata：通过 gRPC 发布和读取，通过 websocket 订阅，并回填离线期间的区块
+type NornRegistry struct {
+	config       *Config
+	syncInterval time.Duration
+}
+
+// NewNornRegistry 创建 norn 后端，使用前需要先初始化 gRPC 客户端
+// 参数:
+// - config: websocket 订阅配置，为 nil 时使用默认配置。
+// - syncInterval: 回填区块的间隔。
+func NewNornRegistry(config *Config, syncInterval time.Duration) *NornRegistry {
+	return &NornRegistry{
+		config:       config,
+		syncInterval: syncInterval,
+	}
+}
+
+// Publish 以文件根哈希为接收地址，将 metadata 写入链上的 registry.MetadataKey
+func (r *NornRegistry) Publish(ctx context.Context, metaData *dht.MetaData) error {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return errors.New("grpc client not initialized")
+	}
+	jsonData, err := json.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+	_, err = client.SendTransactionWithData(ctx, "set", hex.EncodeToString(metaData.RootHash), registry.MetadataKey, string(jsonData))
+	return err
+}
+
+// Resolve 从链上读取根哈希对应的 metadata
+func (r *NornRegistry) Resolve(ctx context.Context, rootHash string) (*dht.MetaData, error) {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return nil, errors.New("grpc client not initialized")
+	}
+	resp, err := client.ReadContractAddress(ctx, rootHash, registry.MetadataKey)
+	if errors.Is(err, rpc.ErrNotFound) {
+		return nil, fmt.Errorf("%s: %w", rootHash, registry.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := hex.DecodeString(resp.GetHex())
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s on chain: %v", rootHash, err)
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("%s: %w", rootHash, registry.ErrNotFound)
+	}
+	return ParseMetaDataValue(string(value))
+}
+
+// IsConfirmed 判断镜像的 metadata 是否已经达到 Confirmations 个确认
+func (r *NornRegistry) IsConfirmed(ctx context.Context, rootHash string) (bool, error) {
+	return IsConfirmed(ctx, rootHash)
+}
+
+// Subscribe 注册回调，实时订阅和回填得到的新 metadata 都会触发回调
+func (r *NornRegistry) Subscribe(handler registry.Handler) {
+	metaDataHandlers.Add(handler)
+}
+
+// PutRecord 以文件根哈希为接收地址，将记录写入链上的 key
+func (r *NornRegistry) PutRecord(ctx context.Context, rootHash, key string, value []byte) error {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return errors.New("grpc client not initialized")
+	}
+	_, err := client.SendTransactionWithData(ctx, "set", rootHash, key, string(value))
+	return err
+}
+
+// GetRecord 从链上读取根哈希下 key 对应的记录
+func (r *NornRegistry) GetRecord(ctx context.Context, rootHash, key string) ([]byte, error) {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return nil, errors.New("grpc client not initialized")
+	}
+	resp, err := client.ReadContractAddress(ctx, rootHash, key)
+	if errors.Is(err, rpc.ErrNotFound) {
+		return nil, fmt.Errorf("record %s of %s: %w", key, rootHash, registry.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := hex.DecodeString(resp.GetHex())
+	if err != nil {
+		return nil, fmt.Errorf("invalid record %s of %s on chain: %v", key, rootHash, err)
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("record %s of %s: %w", key, rootHash, registry.ErrNotFound)
+	}
+	return value, nil
+}
+
+// Height 返回链的当前区块高度
+func (r *NornRegistry) Height(ctx context.Context) (uint64, error) {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return 0, errors.New("grpc client not initialized")
+	}
+	resp, err := client.GetBlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetNumber(), nil
+}
+
+// Run 运行 websocket 订阅，订阅建立后再回填离线期间的区块，直到 ctx 结束
+func (r *NornRegistry) Run(ctx context.Context) {
+	go RunWebSocket(ctx, r.config)
+	RunSync(ctx, r.syncInterval)
+}
+
+// Close 关闭 gRPC 连接
+func (r *NornRegistry) Close() error {
+	if client := manager.GetGRPCClient(); client != nil {
+		client.Close()
+	}
+	return nil
+}
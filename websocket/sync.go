@@ -0,0 +1,482 @@
+package websocket
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"log"
+	dht "main/DHT"
+	"main/manager"
+	"main/registry"
+	"main/rpc/pb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// syncHeightKey 保存已经处理完的最高区块高度
+	syncHeightKey = "sync/height"
+	// versionsPrefix 保存每个根哈希尚未最终确认的 metadata 版本: sync/versions/<rootHash>
+	versionsPrefix = "sync/versions/"
+	// blockPrefix 保存最近处理过的区块哈希，用于检测链重组: sync/block/<height>
+	blockPrefix = "sync/block/"
+	// livePrefix 保存实时订阅收到、回填还没有处理到的交易: sync/live/<height>
+	livePrefix = "sync/live/"
+
+	// blockHashWindow 是保存区块哈希的数量，超过这个深度的重组无法检测
+	blockHashWindow = 256
+)
+
+// Confirmations 是 metadata 被视为最终确认所需的确认数
+var Confirmations uint64 = 6
+
+// errUnknownTxData 表示交易数据不是 txKeyValue 支持的编码
+var errUnknownTxData = errors.New("unknown transaction data encoding")
+
+// errForkBeyondWindow 表示向前比较到保存窗口之外仍没有找到与链上一致的区块
+var errForkBeyondWindow = errors.New("fork point is beyond the block hash window")
+
+// mirrorEntry 是从链上镜像的一个 metadata 版本
+type mirrorEntry struct {
+	MetaData  *dht.MetaData `json:"metaData"`
+	Height    uint64        `json:"height"`
+	BlockHash string        `json:"blockHash"` // 实时订阅不包含区块哈希，由回填补上
+	TxHash    string        `json:"txHash"`
+}
+
+// liveTx 是实时订阅收到的一个交易，回填处理到它的高度时检查它是否仍在区块中
+type liveTx struct {
+	RootHash string `json:"rootHash"`
+	TxHash   string `json:"txHash"`
+}
+
+// applyLock 保证回填、实时订阅和回滚不会同时修改镜像数据
+var applyLock sync.Mutex
+
+func loadVersions(rootHash string) []mirrorEntry {
+	var versions []mirrorEntry
+	if err := manager.GetDBManager().LoadFromMemory(versionsPrefix+rootHash, &versions); err != nil {
+		return nil
+	}
+	return versions
+}
+
+// saveVersions 保存版本列表，并把最高区块中的版本作为根哈希当前的 metadata
+func saveVersions(rootHash string, versions []mirrorEntry) error {
+	dbManager := manager.GetDBManager()
+	if len(versions) == 0 {
+		if err := dbManager.DeleteFromMemory(rootHash); err != nil {
+			return err
+		}
+		return dbManager.DeleteFromMemory(versionsPrefix + rootHash)
+	}
+	if err := dbManager.SaveToMemory(rootHash, versions[len(versions)-1].MetaData); err != nil {
+		return err
+	}
+	return dbManager.SaveToMemory(versionsPrefix+rootHash, versions)
+}
+
+// ApplyMetaData 将链上的 metadata 写入本地数据库。
+// 回填和实时订阅可能以任意顺序收到同一个交易，或者先收到新交易再收到旧交易，
+// 因此同一个交易只记录一次，且最高区块中的版本才是当前的 metadata。
+// 尚未最终确认的旧版本会被保留，以便链重组时回滚。
+// 参数:
+// - metaData: 解析出的 metadata。
+// - height: 交易所在的区块高度。
+// - blockHash: 交易所在的区块哈希，未知时为空。
+// - txHash: 交易哈希。
+// 返回值:
+// - bool: 当前的 metadata 是否发生了变化。
+// - error: 错误信息。
+func ApplyMetaData(metaData *dht.MetaData, height uint64, blockHash, txHash string) (bool, error) {
+	applyLock.Lock()
+	defer applyLock.Unlock()
+
+	rootHash := hex.EncodeToString(metaData.RootHash)
+	versions := loadVersions(rootHash)
+	for i := range versions {
+		if versions[i].TxHash != txHash {
+			continue
+		}
+		// 已经记录过这个交易，只补上回填得到的区块信息
+		if blockHash != "" && (versions[i].BlockHash != blockHash || versions[i].Height != height) {
+			versions[i].BlockHash, versions[i].Height = blockHash, height
+			return false, saveVersions(rootHash, versions)
+		}
+		return false, nil
+	}
+
+	// 实时订阅不知道交易所在的区块，回填处理到这个高度时才能确认交易没有被重组掉
+	if blockHash == "" {
+		dbManager := manager.GetDBManager()
+		var live []liveTx
+		dbManager.LoadFromMemory(liveKey(height), &live)
+		live = append(live, liveTx{RootHash: rootHash, TxHash: txHash})
+		if err := dbManager.SaveToMemory(liveKey(height), live); err != nil {
+			return false, err
+		}
+	}
+
+	current := len(versions) == 0 || versions[len(versions)-1].Height <= height
+	versions = append(versions, mirrorEntry{
+		MetaData:  metaData,
+		Height:    height,
+		BlockHash: blockHash,
+		TxHash:    txHash,
+	})
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Height < versions[j].Height })
+
+	// 已经最终确认的版本之前的版本不会再被回滚，可以丢弃
+	for len(versions) > 1 && versions[1].Height+Confirmations <= height {
+		versions = versions[1:]
+	}
+	return current, saveVersions(rootHash, versions)
+}
+
+// rollback 删除高于 forkHeight 的区块中镜像的 metadata，恢复到分叉点时的版本，
+// 并解除这些区块中第一次出现的根哈希的所有者绑定
+func rollback(forkHeight uint64) error {
+	applyLock.Lock()
+	defer applyLock.Unlock()
+
+	dbManager := manager.GetDBManager()
+	keys, err := dbManager.ListKeys(versionsPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		rootHash := strings.TrimPrefix(key, versionsPrefix)
+		versions := loadVersions(rootHash)
+		kept := versions[:0]
+		for _, entry := range versions {
+			if entry.Height <= forkHeight {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == len(versions) {
+			continue
+		}
+		log.Printf("Rolled back %d metadata versions of %s from orphaned blocks", len(versions)-len(kept), rootHash)
+		if err := saveVersions(rootHash, kept); err != nil {
+			return err
+		}
+		// 最早的版本也在孤块中时，所有者是由孤块中的交易绑定的，主链上可能由其他公钥第一个发布
+		if len(kept) == 0 {
+			if err := registry.UnbindOwner(dbManager, rootHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 分叉点之后的区块哈希和实时交易都已经无效
+	for _, prefix := range []string{blockPrefix, livePrefix} {
+		heightKeys, err := dbManager.ListKeys(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range heightKeys {
+			var height uint64
+			if _, err := fmt.Sscanf(strings.TrimPrefix(key, prefix), "%d", &height); err == nil && height > forkHeight {
+				if err := dbManager.DeleteFromMemory(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dropOrphanedLive 撤销实时订阅收到、但不在回填得到的同一高度区块中的交易。
+// 这些交易所在的区块在回填处理到它之前就被重组掉了，本地没有记录它的区块哈希，CatchUp 无法通过哈希比较发现
+func dropOrphanedLive(block *pb.Block, height uint64) error {
+	applyLock.Lock()
+	defer applyLock.Unlock()
+
+	dbManager := manager.GetDBManager()
+	var live []liveTx
+	if err := dbManager.LoadFromMemory(liveKey(height), &live); err != nil {
+		return nil
+	}
+	inBlock := make(map[string]bool, len(block.GetTransactions()))
+	for _, tx := range block.GetTransactions() {
+		inBlock[tx.GetHash()] = true
+	}
+	for _, l := range live {
+		if inBlock[l.TxHash] {
+			continue
+		}
+		versions := loadVersions(l.RootHash)
+		kept := versions[:0]
+		for _, entry := range versions {
+			if entry.TxHash != l.TxHash {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == len(versions) {
+			continue
+		}
+		log.Printf("Dropped metadata of %s in tx %s, block %d was orphaned before backfill", l.RootHash, l.TxHash, height)
+		if err := saveVersions(l.RootHash, kept); err != nil {
+			return err
+		}
+		if len(kept) == 0 {
+			if err := registry.UnbindOwner(dbManager, l.RootHash); err != nil {
+				return err
+			}
+		}
+	}
+	return dbManager.DeleteFromMemory(liveKey(height))
+}
+
+// IsConfirmed 判断根哈希当前的 metadata 是否已经最终确认。
+// 只有回填已经处理过所在区块（区块哈希已知且在主链上），并且达到 Confirmations 个确认的版本才是最终确认的。
+func IsConfirmed(ctx context.Context, rootHash string) (bool, error) {
+	versions := loadVersions(rootHash)
+	if len(versions) == 0 {
+		return false, nil
+	}
+	latest := versions[len(versions)-1]
+	if latest.BlockHash == "" {
+		return false, nil
+	}
+	var synced uint64
+	if err := manager.GetDBManager().LoadFromMemory(syncHeightKey, &synced); err != nil || synced < latest.Height {
+		return false, nil
+	}
+
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return false, errors.New("grpc client not initialized")
+	}
+	head, err := client.GetBlockNumber(ctx)
+	if err != nil {
+		return false, err
+	}
+	return head.GetNumber()+1 >= latest.Height+Confirmations, nil
+}
+
+// txKeyValue 从交易数据中取出操作类型、key 和 value。
+// pb.Transaction 的 Data 字段（blockchain.proto 中 Transaction 的第9个字段）是 norn 按 SendTransactionWithData
+// 请求写入的交易数据，本仓库的 proto 中没有定义它的编码，只有请求本身 SendTransactionWithDataReq
+// （type=1, receiver=2, key=3, value=4）。因此这里接受两种编码，都可能经过16进制编码:
+//   - 与请求字段同名的 JSON {"type", "key", "value"}，norntest 的假节点写入这种格式，旧版本的 norn 也用 "opt" 表示操作类型
+//   - 按 SendTransactionWithDataReq 编码的 protobuf
+//
+// 两种都无法解析时返回 errUnknownTxData，由调用者记录，norn 改变交易数据的格式时不会悄悄地漏掉 metadata。
+// 操作类型只记录在交易的 Opt 字段中时使用 Opt。
+func txKeyValue(tx *pb.Transaction) (opt, key, value string, err error) {
+	data := []byte(tx.GetData())
+	if decoded, err := hex.DecodeString(tx.GetData()); err == nil {
+		data = decoded
+	}
+
+	var command struct {
+		Type  string `json:"type"`
+		Opt   string `json:"opt"`
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &command); err == nil {
+		opt, key, value = command.Opt, command.Key, command.Value
+		if opt == "" {
+			opt = command.Type
+		}
+	} else {
+		var req pb.SendTransactionWithDataReq
+		if err := proto.Unmarshal(data, &req); err != nil || req.Key == nil {
+			return "", "", "", errUnknownTxData
+		}
+		opt, key, value = req.GetType(), req.GetKey(), req.GetValue()
+	}
+	if opt == "" {
+		opt = tx.GetOpt()
+	}
+	return opt, key, value, nil
+}
+
+// getBlock 获取区块内容
+func getBlock(ctx context.Context, height uint64) (*pb.Block, error) {
+	resp, err := manager.GetGRPCClient().GetBlockByNumber(ctx, height, true)
+	if err != nil {
+		return nil, err
+	}
+	block := resp.GetBody()
+	if block == nil || block.GetHeader() == nil {
+		return nil, fmt.Errorf("block %d has no body", height)
+	}
+	return block, nil
+}
+
+// blockKey 返回保存区块哈希的键
+func blockKey(height uint64) string {
+	return fmt.Sprintf("%s%d", blockPrefix, height)
+}
+
+// liveKey 返回保存实时交易的键
+func liveKey(height uint64) string {
+	return fmt.Sprintf("%s%d", livePrefix, height)
+}
+
+// syncBlock 处理一个区块中所有写入 metadata 的交易
+func syncBlock(block *pb.Block, height uint64) error {
+	blockHash := block.GetHeader().GetBlockHash()
+	unknown := 0
+	for _, tx := range block.GetTransactions() {
+		opt, key, value, err := txKeyValue(tx)
+		if err != nil {
+			unknown++
+			continue
+		}
+		if opt != "set" || key != registry.MetadataKey {
+			continue
+		}
+		metaData, err := ParseMetaDataValue(value)
+		if err != nil {
+			log.Printf("Skip metadata in tx %s: %v", tx.GetHash(), err)
+			continue
+		}
+		if err := registry.CheckOwner(manager.GetDBManager(), metaData); err != nil {
+			log.Printf("Reject metadata in tx %s: %v", tx.GetHash(), err)
+			continue
+		}
+		applied, err := ApplyMetaData(metaData, height, blockHash, tx.GetHash())
+		if err != nil {
+			return err
+		}
+		if applied {
+			log.Printf("Backfilled metadata %x from block %d", metaData.RootHash, height)
+			metaDataHandlers.Notify(metaData)
+		}
+	}
+	if unknown > 0 {
+		log.Printf("Skip %d transactions with %v in block %d", unknown, errUnknownTxData, height)
+	}
+	if err := dropOrphanedLive(block, height); err != nil {
+		return err
+	}
+
+	dbManager := manager.GetDBManager()
+	if err := dbManager.SaveToMemory(blockKey(height), blockHash); err != nil {
+		return err
+	}
+	if height > blockHashWindow {
+		return dbManager.DeleteFromMemory(blockKey(height - blockHashWindow))
+	}
+	return nil
+}
+
+// findForkPoint 从 height 开始向前查找本地记录的区块哈希与链上一致的最高区块。
+// 超出保存窗口的区块没有哈希可以比较，无法确认它们仍在主链上，此时返回 errForkBeyondWindow
+func findForkPoint(ctx context.Context, height uint64) (uint64, error) {
+	dbManager := manager.GetDBManager()
+	for ; height > 0; height-- {
+		var stored string
+		if err := dbManager.LoadFromMemory(blockKey(height), &stored); err != nil {
+			return 0, errForkBeyondWindow
+		}
+		block, err := getBlock(ctx, height)
+		if err != nil {
+			return 0, err
+		}
+		if block.GetHeader().GetBlockHash() == stored {
+			return height, nil
+		}
+	}
+	return 0, nil
+}
+
+// CatchUp 从上次处理的高度开始逐个区块处理，直到链上最新高度。
+// 新区块的 PrevBlockHash 与本地记录的上一个区块哈希不一致时，说明发生了链重组，
+// 回滚分叉点之后镜像的 metadata，并从分叉点重新同步；重组深度超出保存窗口时回滚全部镜像，从创世区块重新同步。
+// 返回值:
+// - uint64: 处理完的最高区块高度。
+// - error: 错误信息，已处理的区块会保存检查点。
+func CatchUp(ctx context.Context) (uint64, error) {
+	client := manager.GetGRPCClient()
+	if client == nil {
+		return 0, errors.New("grpc client not initialized")
+	}
+	dbManager := manager.GetDBManager()
+
+	var height uint64
+	if err := dbManager.LoadFromMemory(syncHeightKey, &height); err != nil {
+		// 第一次同步，从创世区块开始
+		height = 0
+	}
+
+	for {
+		head, err := client.GetBlockNumber(ctx)
+		if err != nil {
+			return height, err
+		}
+		if height >= head.GetNumber() {
+			return height, nil
+		}
+		for next := height + 1; next <= head.GetNumber(); next++ {
+			if ctx.Err() != nil {
+				return height, ctx.Err()
+			}
+			block, err := getBlock(ctx, next)
+			if err != nil {
+				return height, fmt.Errorf("sync block %d: %v", next, err)
+			}
+
+			var prevHash string
+			if err := dbManager.LoadFromMemory(blockKey(height), &prevHash); err == nil && prevHash != block.GetHeader().GetPrevBlockHash() {
+				fork, err := findForkPoint(ctx, height)
+				if errors.Is(err, errForkBeyondWindow) {
+					log.Printf("Chain reorganized at block %d deeper than %d blocks, resync from genesis", next, blockHashWindow)
+					fork = 0
+				} else if err != nil {
+					return height, err
+				}
+				log.Printf("Chain reorganized at block %d, roll back to block %d", next, fork)
+				if err := rollback(fork); err != nil {
+					return height, err
+				}
+				height = fork
+				if err := dbManager.SaveToMemory(syncHeightKey, height); err != nil {
+					return height, err
+				}
+				break
+			}
+
+			if err := syncBlock(block, next); err != nil {
+				return height, fmt.Errorf("sync block %d: %v", next, err)
+			}
+			height = next
+			if err := dbManager.SaveToMemory(syncHeightKey, height); err != nil {
+				return height, err
+			}
+		}
+	}
+}
+
+// RunSync 回填节点离线期间链上发布的 metadata。
+// 调用前应先启动实时订阅：订阅开始之后的区块一定会被订阅或回填之一覆盖，重复的交易由 ApplyMetaData 去重。
+// 追上最新高度后每隔 interval 再推进一次检查点，websocket 断开期间遗漏的事件也会被补上，
+// 同时检测链重组并补上实时事件缺少的区块哈希。
+func RunSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		height, err := CatchUp(ctx)
+		if err != nil {
+			log.Println("Error syncing chain: ", err)
+		} else {
+			log.Printf("Chain synced to block %d", height)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
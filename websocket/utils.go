@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	dht "main/DHT"
 )
 
@@ -24,10 +23,20 @@ type Data struct {
 
 // parseData 定义结构体以匹配JSON格式，字段为字符串类型
 type parseData struct {
-	RootHash  string   `json:"rootHash"`
-	RandomNum string   `json:"randomNum"`
-	PublicKey string   `json:"publicKey"`
-	Leaves    []string `json:"leaves"`
+	RootHash  string            `json:"rootHash"`
+	RandomNum string            `json:"randomNum"`
+	PublicKey string            `json:"publicKey"`
+	Leaves    []string          `json:"leaves"`
+	Chunker   dht.ChunkerParams `json:"chunker"`
+	Scheme    string            `json:"scheme"`
+	Codecs    []string          `json:"codecs"`
+	Signature string            `json:"signature"`
+
+	SubtreeHeight int `json:"subtreeHeight"`
+	Subtrees      []struct {
+		Hash      string `json:"hash"`
+		RandomNum string `json:"randomNum"`
+	} `json:"subtrees"`
 }
 
 func ParseTxValue(jsonStr string) (*dht.MetaData, error) {
@@ -42,17 +51,27 @@ func ParseTxValue(jsonStr string) (*dht.MetaData, error) {
 	// 解析 JSON 字符串
 	err := json.Unmarshal([]byte(jsonStr), &data)
 	if err != nil {
-		log.Fatalf("Error unmarshalling JSON: %v", err)
+		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
 	}
-	fmt.Println("Extracted value:", data.Params.Value)
 
+	return ParseMetaDataValue(data.Params.Value)
+}
+
+// ParseMetaDataValue 解析交易中 metadata 的值。
+// 值中的字节字段使用16进制字符串；由 json.Marshal(dht.MetaData) 直接生成的 base64 格式同样支持。
+func ParseMetaDataValue(value string) (*dht.MetaData, error) {
 	// 创建parseData结构体的实例
 	var parseData parseData
 
 	// 解析JSON字符串到parseData结构体
-	err = json.Unmarshal([]byte(data.Params.Value), &parseData)
+	err := json.Unmarshal([]byte(value), &parseData)
 	if err != nil {
-		log.Fatalf("Error unmarshalling JSON: %v", err)
+		// 字节字段不是字符串时无法解析为 parseData，尝试按 dht.MetaData 解析
+		var metaData dht.MetaData
+		if err := json.Unmarshal([]byte(value), &metaData); err != nil {
+			return nil, fmt.Errorf("error unmarshalling metadata: %v", err)
+		}
+		return &metaData, nil
 	}
 
 	// 创建metaData结构体的实例
@@ -61,15 +80,19 @@ func ParseTxValue(jsonStr string) (*dht.MetaData, error) {
 	// 将字符串字段转换为字节数组
 	metaData.RootHash, err = hex.DecodeString(parseData.RootHash)
 	if err != nil {
-		log.Fatalf("Error decoding rootHash: %v", err)
+		// 不是16进制字符串，说明是 base64 格式
+		if err := json.Unmarshal([]byte(value), &metaData); err != nil {
+			return nil, fmt.Errorf("error unmarshalling metadata: %v", err)
+		}
+		return &metaData, nil
 	}
 	metaData.RandomNum, err = hex.DecodeString(parseData.RandomNum)
 	if err != nil {
-		log.Fatalf("Error decoding randomNum: %v", err)
+		return nil, fmt.Errorf("error decoding randomNum: %v", err)
 	}
 	metaData.PublicKey, err = hex.DecodeString(parseData.PublicKey)
 	if err != nil {
-		log.Fatalf("Error decoding publicKey: %v", err)
+		return nil, fmt.Errorf("error decoding publicKey: %v", err)
 	}
 
 	// 处理leaves字段
@@ -77,9 +100,30 @@ func ParseTxValue(jsonStr string) (*dht.MetaData, error) {
 	for i, leafStr := range parseData.Leaves {
 		metaData.Leaves[i], err = hex.DecodeString(leafStr)
 		if err != nil {
-			log.Fatalf("Error decoding leaf: %v", err)
+			return nil, fmt.Errorf("error decoding leaf: %v", err)
 		}
 	}
+	metaData.Chunker = parseData.Chunker
+	metaData.Scheme = parseData.Scheme
+	metaData.Codecs = parseData.Codecs
+
+	// 处理变色龙子树
+	metaData.SubtreeHeight = parseData.SubtreeHeight
+	for _, subtree := range parseData.Subtrees {
+		hash, err := hex.DecodeString(subtree.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding subtree hash: %v", err)
+		}
+		randomNum, err := hex.DecodeString(subtree.RandomNum)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding subtree randomNum: %v", err)
+		}
+		metaData.Subtrees = append(metaData.Subtrees, dht.Subtree{Hash: hash, RandomNum: randomNum})
+	}
+	metaData.Signature, err = hex.DecodeString(parseData.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %v", err)
+	}
 
 	return &metaData, nil
 }
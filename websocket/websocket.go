@@ -2,10 +2,17 @@ package websocket
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"main/manager"
+	"main/registry"
+	mrand "math/rand"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,103 +20,299 @@ const (
 	webSocketURL = "ws://localhost:8888/subscribe"
 )
 
-type WebSocketClient struct {
-	conn *websocket.Conn
+// Subscription 是发送给 norn 的订阅消息，订阅某个地址上的某类事件
+type Subscription struct {
+	Address string `yaml:"Address" json:"address"`
+	Type    string `yaml:"Type" json:"type"`
 }
 
-func RunWebSocket(ctx context.Context) {
+// Config 是 websocket 订阅的配置，对应配置文件中的 WebSocket 部分，缺省的字段使用 DefaultConfig 中的值
+type Config struct {
+	URL               string         `yaml:"URL"`
+	Subscriptions     []Subscription `yaml:"Subscriptions"`
+	MinBackoff        time.Duration  `yaml:"MinBackoff"`
+	MaxBackoff        time.Duration  `yaml:"MaxBackoff"`
+	HeartbeatInterval time.Duration  `yaml:"HeartbeatInterval"`
+}
 
-	u, err := url.Parse(webSocketURL)
-	if err != nil {
-		log.Fatal("Error parsing URL: ", err)
+// DefaultConfig 返回默认的订阅配置
+func DefaultConfig() *Config {
+	return &Config{
+		URL: webSocketURL,
+		Subscriptions: []Subscription{
+			{Address: "0a0f870f81376f77db1981f94f39b719f5eb3f7c", Type: "data"},
+		},
+		MinBackoff:        time.Second,
+		MaxBackoff:        time.Minute,
+		HeartbeatInterval: 30 * time.Second,
+	}
+}
+
+// withDefaults 用默认值补全缺省的字段
+func (config *Config) withDefaults() *Config {
+	res := DefaultConfig()
+	if config == nil {
+		return res
+	}
+	if config.URL != "" {
+		res.URL = config.URL
+	}
+	if len(config.Subscriptions) > 0 {
+		res.Subscriptions = config.Subscriptions
+	}
+	for i := range res.Subscriptions {
+		if res.Subscriptions[i].Type == "" {
+			res.Subscriptions[i].Type = "data"
+		}
+	}
+	if config.MinBackoff > 0 {
+		res.MinBackoff = config.MinBackoff
 	}
+	if config.MaxBackoff > 0 {
+		res.MaxBackoff = config.MaxBackoff
+	}
+	if res.MaxBackoff < res.MinBackoff {
+		res.MaxBackoff = res.MinBackoff
+	}
+	if config.HeartbeatInterval > 0 {
+		res.HeartbeatInterval = config.HeartbeatInterval
+	}
+	return res
+}
+
+// Stats 是订阅的运行计数
+type Stats struct {
+	Connected  bool
+	Connects   uint64        // 成功建立连接的次数
+	Failures   uint64        // 连接失败或连接中断的次数
+	Backoff    time.Duration // 最近一次重连的退避间隔，实际等待的时间在它的一半和全部之间随机选取
+	Received   uint64        // 收到的消息数
+	Skipped    uint64        // 不是 metadata 的消息数
+	Malformed  uint64        // 无法解析的消息数
+	Rejected   uint64        // 签名无效或所有者不同的 metadata 数
+	Applied    uint64        // 写入数据库的 metadata 数
+	ApplyError uint64        // 写入数据库失败的次数
+}
+
+var (
+	connected  atomic.Bool
+	connects   atomic.Uint64
+	failures   atomic.Uint64
+	backoff    atomic.Int64
+	received   atomic.Uint64
+	skipped    atomic.Uint64
+	malformed  atomic.Uint64
+	rejected   atomic.Uint64
+	applied    atomic.Uint64
+	applyError atomic.Uint64
+)
+
+// GetStats 返回订阅的运行计数
+func GetStats() Stats {
+	return Stats{
+		Connected:  connected.Load(),
+		Connects:   connects.Load(),
+		Failures:   failures.Load(),
+		Backoff:    time.Duration(backoff.Load()),
+		Received:   received.Load(),
+		Skipped:    skipped.Load(),
+		Malformed:  malformed.Load(),
+		Rejected:   rejected.Load(),
+		Applied:    applied.Load(),
+		ApplyError: applyError.Load(),
+	}
+}
 
-	client := &WebSocketClient{}
-	err = client.connect(u)
+type WebSocketClient struct {
+	conn   *websocket.Conn
+	config *Config
+}
+
+// RunWebSocket 订阅 norn 中写入 metadata 的交易，直到 ctx 结束。
+// 连接失败或中断后按指数退避重连，并重新发送订阅消息，成功建立过连接之后从最小间隔重新开始退避。
+// 参数:
+// - ctx: 上下文，用于控制生命周期。
+// - config: 订阅配置，为 nil 时使用默认配置。
+func RunWebSocket(ctx context.Context, config *Config) {
+	config = config.withDefaults()
+	u, err := url.Parse(config.URL)
 	if err != nil {
-		log.Fatal("Error connecting to WebSocket server: ", err)
+		log.Println("Error parsing URL: ", err)
+		return
 	}
-	defer client.conn.Close()
 
-	// Start the heartbeat ticker
-	heartbeatTicker := time.NewTicker(30 * time.Second)
-	defer heartbeatTicker.Stop()
+	client := &WebSocketClient{config: config}
+	next := config.MinBackoff
+	for {
+		established, err := client.run(ctx, u)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// 连接成功建立过说明服务端是正常的，从最小间隔重新开始退避
+		if established {
+			next = config.MinBackoff
+		}
+		backoff.Store(int64(next))
+		failures.Add(1)
+		// 加入随机抖动，避免多个节点同时重连
+		wait := next/2 + time.Duration(mrand.Int63n(int64(next/2)+1))
+		log.Printf("WebSocket disconnected: %v, reconnecting in %s", err, wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		next *= 2
+		if next > config.MaxBackoff {
+			next = config.MaxBackoff
+		}
+	}
+}
+
+// run 建立一次连接并处理消息，直到连接中断或 ctx 结束
+// 返回值:
+// - bool: 连接是否成功建立过。
+// - error: 连接失败或中断的原因。
+func (c *WebSocketClient) run(ctx context.Context, u *url.URL) (bool, error) {
+	if err := c.connect(ctx, u); err != nil {
+		return false, err
+	}
+	defer c.conn.Close()
+	connected.Store(true)
+	defer connected.Store(false)
+	connects.Add(1)
+	log.Printf("Connected to %s", u)
 
 	// Start the read pump
-	go client.readPump(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.readPump()
+	}()
+
+	// Start the heartbeat ticker
+	heartbeatTicker := time.NewTicker(c.config.HeartbeatInterval)
+	defer heartbeatTicker.Stop()
 
 	// Main loop
 	for {
 		select {
 		case <-heartbeatTicker.C:
-			client.sendHeartbeat()
+			if err := c.sendHeartbeat(); err != nil {
+				return true, err
+			}
+		case err := <-done:
+			return true, err
 		case <-ctx.Done():
 			log.Println("Context cancelled, closing connection...")
-			client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return true, ctx.Err()
 		}
 	}
 }
 
-func (c *WebSocketClient) connect(u *url.URL) error {
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+func (c *WebSocketClient) connect(ctx context.Context, u *url.URL) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
 		return err
 	}
 	c.conn = conn
-	c.sendSubscriptionMessage()
+	if err := c.sendSubscriptionMessage(); err != nil {
+		conn.Close()
+		return err
+	}
 	return nil
 }
 
-func (c *WebSocketClient) sendSubscriptionMessage() {
-	message := `{"address":"0a0f870f81376f77db1981f94f39b719f5eb3f7c","type":"data"}`
-	err := c.conn.WriteMessage(websocket.TextMessage, []byte(message))
-	if err != nil {
-		log.Println("Error sending subscription message: ", err)
+func (c *WebSocketClient) sendSubscriptionMessage() error {
+	for _, sub := range c.config.Subscriptions {
+		message, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+		if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			return fmt.Errorf("error sending subscription message: %v", err)
+		}
 	}
-	//log.Println("Sent subscription message")
+	return nil
 }
 
-func (c *WebSocketClient) sendHeartbeat() {
+func (c *WebSocketClient) sendHeartbeat() error {
 	message := `{"type":"heartbeat"}`
 	err := c.conn.WriteMessage(websocket.TextMessage, []byte(message))
 	if err != nil {
-		log.Println("Error sending heartbeat: ", err)
+		return fmt.Errorf("error sending heartbeat: %v", err)
 	}
-	//log.Println("Sent heartbeat")
+	return nil
 }
 
-func (c *WebSocketClient) readPump(ctx context.Context) {
-	defer func() {
-		c.conn.Close()
-	}()
-
+// readPump 读取并处理消息，直到连接中断。单条消息处理失败只计数，不会中断连接
+func (c *WebSocketClient) readPump() error {
 	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Context cancelled, closing connection...")
-			return
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("error reading message: %v", err)
+		}
+		received.Add(1)
+		log.Printf("Received message: %s\n", message)
+
+		err = handleMessage(message)
+		switch {
+		case err == nil:
+			applied.Add(1)
+		case errors.Is(err, errSkipped):
+			skipped.Add(1)
+		case errors.Is(err, errRejected):
+			rejected.Add(1)
+			log.Println(err)
+		case errors.Is(err, errApply):
+			applyError.Add(1)
+			log.Println(err)
 		default:
-			_, message, err := c.conn.ReadMessage()
-			if err != nil {
-				log.Println("Error reading message: ", err)
-				return
-			}
-			log.Printf("Received message: %s\n", message)
+			malformed.Add(1)
+			log.Println("Error parsing message: ", err)
+		}
+	}
+}
 
-			// parse data and build a fileTree
-			metaData, err := ParseTxValue(string(message))
-			if err != nil {
-				log.Println("Error parsing message: ", err)
-				break
-			}
+var (
+	errSkipped  = errors.New("not a metadata message")
+	errApply    = errors.New("error saving to memory")
+	errRejected = errors.New("metadata rejected")
+)
 
-			// Persist the fileTree using sqlite
-			err = manager.GetDBManager().SaveToMemory(string(metaData.RootHash), metaData)
-			if err != nil {
-				log.Println("Error saving to memory: ", err)
-				break
-			}
-		}
+// handleMessage 解析一条订阅消息并写入数据库
+func handleMessage(message []byte) error {
+	var data Data
+	if err := json.Unmarshal(message, &data); err != nil {
+		return err
+	}
+	if data.Params.Key != registry.MetadataKey {
+		return errSkipped
 	}
+	height, err := strconv.ParseUint(data.Height, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing height: %v", err)
+	}
+
+	// parse data and build a fileTree
+	metaData, err := ParseTxValue(string(message))
+	if err != nil {
+		return err
+	}
+
+	if err := registry.CheckOwner(manager.GetDBManager(), metaData); err != nil {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+
+	// Persist the fileTree using sqlite
+	current, err := ApplyMetaData(metaData, height, "", data.Hash)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errApply, err)
+	}
+	if current {
+		metaDataHandlers.Notify(metaData)
+	}
+	return nil
 }